@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/chaos"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/generate"
+	"os"
+	"time"
+)
+
+// runChaos 通过双写运行负载并注入故障，最后校验源库和目标库，不一致时退出码为 1
+func runChaos(ctx context.Context, args []string) error {
+	fs := newFlagSet("chaos")
+	profile := fs.String("profile", "write-heavy", "负载：read-heavy、write-heavy、hotspot、bulk-insert")
+	duration := fs.Duration("duration", time.Minute, "负载的运行时长")
+	qps := fs.Int("qps", 200, "负载的目标 QPS，0 为不限速")
+	faults := fs.String("faults", "", "注入的故障，格式 kind@at+duration，多个以逗号分隔，为空时在负载期间依次注入所有故障")
+	latency := fs.Duration("latency", time.Millisecond*200, "slow-target 每个请求增加的延迟")
+	settle := fs.Duration("settle", time.Second*5, "双写和修复静止多久后认为已经追平")
+	timeout := fs.Duration("timeout", time.Minute*2, "等待追平的最长时间")
+	reset := fs.Bool("reset", false, "开始前清空源库和目标库的表，只能用于测试环境")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出结果")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	p, err := generate.LookupProfile(*profile)
+	if err != nil {
+		return err
+	}
+	p.Duration, p.QPS = *duration, *qps
+
+	opts := []chaos.Option{chaos.WithLatency(*latency), chaos.WithSettle(*settle, *timeout), chaos.WithReset(*reset)}
+	if *faults != "" {
+		list, er := chaos.ParseFaults(*faults)
+		if er != nil {
+			return er
+		}
+		opts = append(opts, chaos.WithFaults(list...))
+	}
+	result, err := chaos.NewHarness(cfg, p, opts...).Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(result.Workload)
+		fmt.Println("注入的故障:", result.Faults)
+		fmt.Printf("写目标库: 成功 %d 失败 %d，目标库宕机期间失败的请求 %d\n",
+			result.DoubleWrite.Succeeded, result.DoubleWrite.Failed, result.TargetFailed)
+		fmt.Printf("binlog 增量修复: 重启 %d 次，追平的位点 %s\n", result.FixerRestarts, result.Position)
+		v := result.Verify
+		fmt.Printf("校验: 源库 %d 行，目标库 %d 行，缺少 %d %v，多出 %d %v，不一致 %d %v\n", v.Source, v.Target,
+			v.Missing, v.Samples.Missing, v.Extra, v.Samples.Extra, v.Different, v.Samples.Different)
+	}
+	if !result.Consistent() {
+		return errors.New("混沌测试后源库和目标库不一致")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/backfill"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/wiring"
+	"os"
+)
+
+// runCopy 从源库的一致性快照全量复制到目标库，保存快照的 binlog 位点，
+// 指定 -handoff 时接着从该位点开始 binlog 增量修复，等同于随后执行 fix cdc
+func runCopy(ctx context.Context, args []string) error {
+	fs := newFlagSet("copy")
+	handoff := fs.Bool("handoff", false, "复制完成后从快照的位点开始 binlog 增量修复，需要 -fix.source binlog")
+	force := fs.Bool("force", false, "目标库不为空或者位点文件已经存在时仍然复制，会覆盖位点文件")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出复制结果")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	// canal 和 Kafka 的消费位点由服务端管理，只有直接读取 binlog 时才能从快照的位点开始
+	if *handoff && cfg.Fix.Source != "binlog" {
+		return fmt.Errorf("-handoff 需要 -fix.source binlog，当前为 %s", cfg.Fix.Source)
+	}
+	sdb, tdb, err := openDBs(cfg)
+	if err != nil {
+		return err
+	}
+	models.Migrate(tdb)
+
+	store := fix.NewFilePositionStore(cfg.Fix.PositionFile)
+	if !*force {
+		count, _, er := userStats(ctx, tdb)
+		if er != nil {
+			return fmt.Errorf("查询目标库失败 error:%w", er)
+		}
+		if count > 0 {
+			return fmt.Errorf("目标库已经有 %d 行数据，确认覆盖时使用 -force", count)
+		}
+		pos, er := store.Load()
+		if er != nil {
+			return er
+		}
+		if !pos.IsZero() {
+			return fmt.Errorf("位点文件 %s 已经有位点 %s，确认覆盖时使用 -force", cfg.Fix.PositionFile, pos)
+		}
+	}
+
+	th, closer, err := wiring.NewThrottle(cfg, sdb)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	c := backfill.NewCopier(sdb, tdb,
+		backfill.WithWorkers(cfg.Copy.Workers), backfill.WithChunk(cfg.Copy.ChunkSize, cfg.Copy.BatchSize),
+		backfill.WithSleep(cfg.Copy.Sleep), backfill.WithPositionStore(store), backfill.WithThrottle(th))
+	report, err := c.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("复制行数: %d\n分片数: %d\nID 范围: [%d, %d]\n", report.Rows, report.Chunks, report.MinID, report.MaxID)
+		fmt.Printf("快照位点: %s（%s）\n", report.Position, cfg.Fix.PositionFile)
+		fmt.Printf("限速暂停: %s\n耗时: %s\n", report.Throttled, report.Duration)
+	}
+	if !*handoff {
+		if cfg.Fix.Source != "binlog" {
+			fmt.Printf("canal 和 Kafka 需要从位点 %s 开始订阅后再执行 fix cdc\n", report.Position)
+		}
+		return nil
+	}
+
+	source, err := wiring.NewFixSource(cfg, sdb, store)
+	if err != nil {
+		return err
+	}
+	f := fix.NewFixUser(sdb, tdb, append(wiring.FixOptions(cfg),
+		fix.WithSource(source), fix.WithPositionStore(store))...)
+	return f.FixIncByCDC(ctx, cfg.Fix.CDCBatchSize)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/wiring"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runVerify 只读比对源库和目标库
+func runVerify(ctx context.Context, args []string) error {
+	fs := newFlagSet("verify")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出校验报告")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	sdb, tdb, err := openDBs(cfg)
+	if err != nil {
+		return err
+	}
+	th, closer, err := wiring.NewThrottle(cfg, sdb)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	replicas, err := replicaOption(cfg)
+	if err != nil {
+		return err
+	}
+	f := fix.NewFixUser(sdb, tdb, fix.WithSleep(cfg.Fix.Sleep), fix.WithThrottle(th), replicas,
+		fix.WithSkipDeleted(cfg.Fix.SkipDeleted))
+	report, err := f.Verify(ctx, cfg.Fix.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("源库行数: %d\n目标库行数: %d\n", report.Source, report.Target)
+		fmt.Printf("目标库缺少: %d %v\n", report.Missing, report.Samples.Missing)
+		fmt.Printf("目标库多出: %d %v\n", report.Extra, report.Samples.Extra)
+		fmt.Printf("数据不一致: %d %v\n", report.Different, report.Samples.Different)
+		if report.Stale > 0 {
+			fmt.Printf("从库落后、主库一致: %d\n", report.Stale)
+		}
+		fmt.Printf("耗时: %s\n", report.Duration)
+	}
+	if !report.Consistent() {
+		return errors.New("源库和目标库不一致")
+	}
+	return nil
+}
+
+// runFix 修复目标库，切换到目标库前以源库为准
+func runFix(ctx context.Context, args []string) error {
+	mode, args, err := action("fix", args, "full", "incr", "cdc", "ddl")
+	if err != nil {
+		return err
+	}
+	if mode == "ddl" {
+		return runFixDDL(ctx, args)
+	}
+	fs := newFlagSet("fix " + mode)
+	since := fs.String("since", "", "incr: 校验该时间之后更新的数据，格式 2006-01-02 15:04:05，默认为当前时间")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	sdb, tdb, err := openDBs(cfg)
+	if err != nil {
+		return err
+	}
+	models.Migrate(tdb)
+
+	switch mode {
+	case "full":
+		opts, closer, er := scanOptions(cfg, sdb)
+		if er != nil {
+			return er
+		}
+		defer closer()
+		f := fix.NewFixUser(sdb, tdb, opts...)
+		return f.FixFull(ctx, cfg.Fix.BatchSize)
+	case "incr":
+		opts, closer, er := scanOptions(cfg, sdb)
+		if er != nil {
+			return er
+		}
+		defer closer()
+		if *since != "" {
+			t, er := time.ParseInLocation("2006-01-02 15:04:05", *since, time.Local)
+			if er != nil {
+				return fmt.Errorf("错误的 -since %s error:%w", *since, er)
+			}
+			opts = append(opts, fix.WithUpdatedAt(t))
+		}
+		f := fix.NewFixUser(sdb, tdb, opts...)
+		return f.FixIncByUpdatedAt(ctx)
+	default: // binlog 增量修复需要跟上源库的写入，不限速
+		store := fix.NewFilePositionStore(cfg.Fix.PositionFile)
+		source, er := wiring.NewFixSource(cfg, sdb, store)
+		if er != nil {
+			return er
+		}
+		f := fix.NewFixUser(sdb, tdb, append(wiring.FixOptions(cfg),
+			fix.WithSource(source), fix.WithPositionStore(store))...)
+		return f.FixIncByCDC(ctx, cfg.Fix.CDCBatchSize)
+	}
+}
+
+// runFixDDL 查看或者确认业务服务中 binlog 增量修复等待确认的 DDL，通过 cmd/server 的管理接口完成，
+// 确认前需要先在目标库处理该 DDL，例如人工执行或者确认忽略，token 使用配置项 server.admin_token
+func runFixDDL(ctx context.Context, args []string) error {
+	act := "get"
+	if len(args) > 0 && args[0] == "confirm" {
+		act, args = "confirm", args[1:]
+	}
+	fs := newFlagSet("fix ddl")
+	server := fs.String("server", defaultServer, "业务服务的地址")
+	cfg, err := conf.LoadAdmin(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var ddl fix.DDLEvent
+	token := cfg.Server.AdminToken
+	if act == "confirm" {
+		if err = requestAdmin(ctx, *server, token, http.MethodPost, "/admin/fix/ddl/confirm", nil, &ddl); err != nil {
+			return err
+		}
+		fmt.Println("已确认 DDL，binlog 增量修复继续运行:", ddl.SQL)
+		return nil
+	}
+	if err = requestAdmin(ctx, *server, token, http.MethodGet, "/admin/fix/ddl", nil, &ddl); err != nil {
+		return err
+	}
+	fmt.Printf("binlog[%s] name[%s,%s] types:%v\n%s\n", ddl.Position, ddl.Schema, ddl.Table, ddl.Types, ddl.SQL)
+	return nil
+}
+
+// runReplay 从指定位点回放源库的 binlog，位点只保存在内存中，不影响 fix cdc 的位点文件。
+// canal 和 Kafka 的消费位点由服务端管理，回放总是伪装成从库直接读取 binlog，
+// 与 fix cdc 同时运行时需要通过 -binlog.server_id 指定不同的 server_id
+func runReplay(ctx context.Context, args []string) error {
+	fs := newFlagSet("replay")
+	fromStr := fs.String("from", "", "回放的起点，格式 file:offset，例如 mysql-bin.000003:154")
+	toStr := fs.String("to", "", "回放的终点，格式 file:offset，为空时一直回放")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	from, err := fix.ParsePosition(*fromStr)
+	if err != nil {
+		return err
+	}
+	var to fix.Position
+	if *toStr != "" {
+		if to, err = fix.ParsePosition(*toStr); err != nil {
+			return err
+		}
+		if !from.Before(to) {
+			return fmt.Errorf("回放的终点 %s 需要在起点 %s 之后", to, from)
+		}
+	}
+	sdb, tdb, err := openDBs(cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.Fix.Source = "binlog"
+	store := fix.NewMemoryPositionStore(from)
+	source, err := wiring.NewFixSource(cfg, sdb, store)
+	if err != nil {
+		return err
+	}
+	until := &untilSource{Source: source, to: to}
+	f := fix.NewFixUser(sdb, tdb, append(wiring.FixOptions(cfg),
+		fix.WithSource(until), fix.WithPositionStore(store))...)
+	until.stop = f.Close
+
+	log.Println(fmt.Sprintf("开始回放 binlog from:%s to:%s", from, to))
+	if err = f.FixIncByCDC(ctx, cfg.Fix.CDCBatchSize); err != nil {
+		return err
+	}
+	log.Println("回放完成:", f.CDCStats().Position)
+	return nil
+}
+
+// untilSource 读到终点后丢弃之后的 binlog 并停止修复，终点为空时一直读取
+type untilSource struct {
+	fix.Source
+	to   fix.Position
+	stop func()
+	done bool
+}
+
+func (s *untilSource) Fetch(ctx context.Context, batchSize int) (*fix.Batch, error) {
+	if s.done {
+		return nil, nil
+	}
+	b, err := s.Source.Fetch(ctx, batchSize)
+	if b == nil || err != nil || s.to.IsZero() {
+		return b, err
+	}
+	for i := range b.Events {
+		pos := b.Events[i].Position
+		if pos.File != "" && s.to.Before(pos) {
+			b.Events = b.Events[:i]
+			s.done = true
+			break
+		}
+	}
+	if !b.Position.Before(s.to) {
+		s.done = true
+	}
+	if s.done {
+		s.stop()
+	}
+	return b, nil
+}
+
+// scanOptions 全量和按 updated_at 增量修复的选项：按源库的负载限速，配置了从库时从从库批量读取。
+// binlog 增量修复需要跟上源库的写入，不限速也不读从库，不使用这些选项。返回的 closer 用于关闭限速使用的从库连接
+func scanOptions(cfg *conf.Config, sdb *gorm.DB) ([]fix.Optional, func(), error) {
+	th, closer, err := wiring.NewThrottle(cfg, sdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	replicas, err := replicaOption(cfg)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	return append(wiring.FixOptions(cfg), fix.WithThrottle(th), replicas), closer, nil
+}
+
+// replicaOption 配置了从库时，全量修复、按 updated_at 增量修复和校验从从库批量读取
+func replicaOption(cfg *conf.Config) (fix.Optional, error) {
+	srdb, trdb, err := conf.InitReplicaDBs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return fix.WithReplicas(srdb, trdb), nil
+}
+
+// openDBs 连接源库和目标库
+func openDBs(cfg *conf.Config) (*gorm.DB, *gorm.DB, error) {
+	sdb, err := conf.InitSourceDB(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	tdb, err := conf.InitTargetDB(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sdb, tdb, nil
+}
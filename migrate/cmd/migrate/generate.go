@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/generate"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"log"
+	"os"
+	"time"
+)
+
+// runGenerate 向源库写入测试数据，指定 -profile 时按负载压测
+func runGenerate(ctx context.Context, args []string) error {
+	fs := newFlagSet("generate")
+	batches := fs.Int("batches", 100, "批量插入的批次")
+	size := fs.Int("size", 1000, "每批插入的行数")
+	interval := fs.Duration("interval", time.Millisecond*50, "批次之间的间隔")
+	crud := fs.Bool("crud", false, "插入后持续模拟业务的增删改，直到退出")
+
+	profile := fs.String("profile", "", "按负载压测：read-heavy、write-heavy、hotspot、bulk-insert，以下参数覆盖负载的配置")
+	mix := fs.String("mix", "", "profile: 各操作的权重，例如 read=90,insert=5,update=4,delete=1")
+	batch := fs.Int("batch", 0, "profile: 每次插入的行数")
+	zipf := fs.Float64("zipf", 0, "profile: 热点 ID 的 Zipf 分布参数，需要大于 1，0 为均匀分布")
+	concurrency := fs.Int("concurrency", 0, "profile: 并发数")
+	qps := fs.Int("qps", 0, "profile: 目标 QPS，0 为不限速")
+	duration := fs.Duration("duration", 0, "profile: 运行时长，0 为一直运行直到退出")
+	mode := fs.String("mode", "", "profile: 通过双写连接池写入，指定双写模式，为空时直接写源库")
+	asJSON := fs.Bool("json", false, "profile: 以 JSON 格式输出报告")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *profile != "" {
+		p, er := generate.LookupProfile(*profile)
+		if er != nil {
+			return er
+		}
+		// 只覆盖命令行指定的参数，例如 -qps 0 表示不限速
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "mix":
+				p.Mix, er = generate.ParseMix(*mix)
+			case "batch":
+				p.BatchSize = *batch
+			case "zipf":
+				p.Zipf = *zipf
+			case "concurrency":
+				p.Concurrency = *concurrency
+			case "qps":
+				p.QPS = *qps
+			case "duration":
+				p.Duration = *duration
+			}
+		})
+		if er != nil {
+			return er
+		}
+		return runWorkload(ctx, cfg, p, *mode, *asJSON)
+	}
+
+	db, err := conf.InitSourceDB(cfg)
+	if err != nil {
+		return err
+	}
+	models.Migrate(db)
+
+	g := generate.NewGenerate(db, 10)
+	for i := 0; i < *batches; i++ {
+		if err = g.InsertBatch(*size); err != nil {
+			log.Println("批量插入失败:", err)
+		}
+		if err = sleep(ctx, *interval); err != nil {
+			return err
+		}
+	}
+	for *crud {
+		if err = g.Insert(); err != nil {
+			log.Println("插入失败:", err)
+		}
+		if err = g.Update(); err != nil {
+			log.Println("批量更新失败:", err)
+		}
+		if err = g.Delete(); err != nil {
+			log.Println("删除失败:", err)
+		}
+		if err = sleep(ctx, *interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWorkload 运行负载并输出吞吐量和延迟，通过双写连接池写入时同时输出写第二个库的统计
+func runWorkload(ctx context.Context, cfg *conf.Config, p generate.Profile, mode string, asJSON bool) error {
+	var (
+		db   *gorm.DB
+		pool *dwrite.DoubleWritePool
+		err  error
+	)
+	if mode == "" {
+		db, err = conf.InitSourceDB(cfg)
+	} else {
+		m, er := dwrite.ParseMode(mode)
+		if er != nil {
+			return er
+		}
+		if db, pool, err = conf.InitDoubleWriteDB(cfg); err == nil {
+			pool.SetMode(m)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// 压测时不输出每条 SQL
+	db = db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Silent)})
+	models.Migrate(db)
+
+	log.Println(fmt.Sprintf("开始运行负载 %s mix:%s batch:%d zipf:%v concurrency:%d qps:%d duration:%s",
+		p.Name, p.Mix, p.BatchSize, p.Zipf, p.Concurrency, p.QPS, p.Duration))
+	report, err := generate.NewWorkload(db, p).Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		out := struct {
+			*generate.Report
+			DoubleWrite *dwrite.SecondaryStats `json:"double_write,omitempty"`
+		}{Report: report}
+		if pool != nil {
+			stats := pool.Stats()
+			out.DoubleWrite = &stats
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	fmt.Print(report)
+	if pool != nil {
+		stats := pool.Stats()
+		fmt.Printf("双写模式 %s，写第二个库: 成功 %d 失败 %d 未完成 %d\n", mode, stats.Succeeded, stats.Failed, stats.Pending)
+		if stats.LastError != "" {
+			fmt.Println("写第二个库最近一次错误:", stats.LastError)
+		}
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
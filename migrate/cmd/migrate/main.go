@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// command 子命令
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{name: "verify", usage: "verify [flags]\n\t只读比对源库和目标库，不一致时退出码为 1", run: runVerify},
+	{name: "copy", usage: "copy [-handoff] [-force] [flags]\n\t从源库的一致性快照全量复制到目标库，保存快照的 binlog 位点，-handoff 时接着增量修复", run: runCopy},
+	{name: "fix", usage: "fix full|incr|cdc [flags]\n\t修复目标库：全量比对、按 updated_at 增量比对、按 binlog 增量修复\n" +
+		"  migrate fix ddl [confirm] [-server url]\n\t查看或者确认业务服务中 binlog 增量修复等待确认的 DDL", run: runFix},
+	{name: "replay", usage: "replay -from file:offset [-to file:offset] [flags]\n\t伪装成从库，从指定位点回放源库的 binlog", run: runReplay},
+	{name: "mode", usage: "mode get|set <mode> [-server url]\n\t查看或者切换业务服务的双写模式：source-write、double-write、transition、target-write", run: runMode},
+	{name: "generate", usage: "generate [-profile name] [flags]\n\t向源库写入测试数据，指定 -profile 时按负载压测并输出吞吐量和延迟", run: runGenerate},
+	{name: "chaos", usage: "chaos [-profile name] [-faults kind@at+duration,...] [flags]\n\t通过双写运行负载并注入故障，追平后校验源库和目标库，不一致时退出码为 1", run: runChaos},
+	{name: "status", usage: "status [flags]\n\t查看迁移状态：两边的行数、binlog 位点和双写模式", run: runStatus},
+}
+
+// 不停机数据迁移的命令行工具，每个子命令都支持 -h 查看参数，
+// 数据库、canal 等配置见 conf/migrate.yaml，例如：
+// go run ./cmd/migrate fix cdc -config conf/migrate.yaml -fix.workers 8
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := cmd.run(ctx, os.Args[2:])
+		cancel()
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp), errors.Is(err, context.Canceled):
+		default:
+			log.Fatalln(err)
+		}
+		return
+	}
+	if name != "-h" && name != "-help" && name != "help" {
+		fmt.Fprintf(os.Stderr, "未知的子命令 %s\n\n", name)
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "用法: migrate <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  migrate %s\n", cmd.usage)
+	}
+}
+
+// newFlagSet 创建子命令的参数，出错时只返回错误，由 main 统一退出
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("migrate "+name, flag.ContinueOnError)
+}
+
+// action 取出 get|set、full|incr|cdc 这类动作，动作需要写在参数前面
+func action(name string, args []string, actions ...string) (string, []string, error) {
+	if len(args) > 0 {
+		for _, a := range actions {
+			if args[0] == a {
+				return a, args[1:], nil
+			}
+		}
+	}
+	var got string
+	if len(args) > 0 {
+		got = args[0]
+	}
+	return "", nil, fmt.Errorf("migrate %s 需要指定动作 %v，当前为 %q", name, actions, got)
+}
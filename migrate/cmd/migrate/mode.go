@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultServer cmd/server 的默认地址
+const defaultServer = "http://127.0.0.1:8080"
+
+// runMode 查看或者切换业务服务的双写模式，通过 cmd/server 的管理接口完成，token 使用配置项 server.admin_token
+func runMode(ctx context.Context, args []string) error {
+	act, args, err := action("mode", args, "get", "set")
+	if err != nil {
+		return err
+	}
+	var value string
+	if act == "set" {
+		if len(args) == 0 {
+			return fmt.Errorf("migrate mode set 需要指定双写模式")
+		}
+		value, args = args[0], args[1:]
+		if _, err = dwrite.ParseMode(value); err != nil {
+			return err
+		}
+	}
+	fs := newFlagSet("mode " + act)
+	server := fs.String("server", defaultServer, "业务服务的地址")
+	force := fs.Bool("force", false, "set: 跳过中间的模式直接切换")
+	cfg, err := conf.LoadAdmin(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var res modeResponse
+	if act == "set" {
+		res, err = requestMode(ctx, *server, cfg.Server.AdminToken, &modeRequest{Mode: value, Force: *force})
+	} else {
+		res, err = requestMode(ctx, *server, cfg.Server.AdminToken, nil)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(res.Mode)
+	for _, c := range res.History {
+		fmt.Printf("  %s %s -> %s\n", c.At.Format("2006-01-02 15:04:05"), c.From, c.To)
+	}
+	return nil
+}
+
+type modeRequest struct {
+	Mode  string `json:"mode"`
+	Force bool   `json:"force"`
+}
+
+type modeResponse struct {
+	Mode    dwrite.Mode         `json:"mode"`
+	History []dwrite.ModeChange `json:"history"`
+}
+
+// requestMode 请求管理接口的 /admin/mode，req 为 nil 时获取当前的双写模式
+func requestMode(ctx context.Context, server, token string, req *modeRequest) (modeResponse, error) {
+	var res modeResponse
+	method := http.MethodGet
+	if req != nil {
+		method = http.MethodPost
+	}
+	err := requestAdmin(ctx, server, token, method, "/admin/mode", req, &res)
+	return res, err
+}
+
+// requestAdmin 请求 cmd/server 的管理接口，req 不为 nil 时作为 JSON 请求体，响应的 data 解析到 data 中
+func requestAdmin(ctx context.Context, server, token, method, path string, req any, data any) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, method, server+path, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("请求业务服务失败 error:%w", err)
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Msg  string `json:"msg"`
+		Code int    `json:"code"`
+		Data any    `json:"data"`
+	}{Data: data}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("解析业务服务的响应失败 status:%d error:%w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Code != 0 {
+		return fmt.Errorf("业务服务返回错误 status:%d msg:%s", resp.StatusCode, result.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"gorm.io/gorm"
+)
+
+// runStatus 查看迁移状态
+func runStatus(ctx context.Context, args []string) error {
+	fs := newFlagSet("status")
+	server := fs.String("server", defaultServer, "业务服务的地址，为空时不查询双写模式")
+	cfg, err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	sdb, tdb, err := openDBs(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, db := range []struct {
+		name string
+		db   *gorm.DB
+	}{{"源库", sdb}, {"目标库", tdb}} {
+		count, maxID, er := userStats(ctx, db.db)
+		if er != nil {
+			return fmt.Errorf("查询%s失败 error:%w", db.name, er)
+		}
+		fmt.Printf("%s: rows=%d max_id=%d\n", db.name, count, maxID)
+	}
+
+	pos, err := fix.NewFilePositionStore(cfg.Fix.PositionFile).Load()
+	if err != nil {
+		return fmt.Errorf("读取位点文件 %s 失败 error:%w", cfg.Fix.PositionFile, err)
+	}
+	if pos.IsZero() {
+		fmt.Printf("binlog 位点: 无（%s）\n", cfg.Fix.PositionFile)
+	} else {
+		fmt.Printf("binlog 位点: %s（%s）\n", pos, cfg.Fix.PositionFile)
+	}
+
+	if *server != "" {
+		res, er := requestMode(ctx, *server, cfg.Server.AdminToken, nil)
+		if er != nil {
+			fmt.Println("双写模式: 未知，", er)
+		} else {
+			fmt.Println("双写模式:", res.Mode)
+		}
+	}
+	return nil
+}
+
+// userStats 查询用户表的行数和最大 ID，包括已经软删除的行
+func userStats(ctx context.Context, db *gorm.DB) (count int64, maxID uint64, err error) {
+	var row struct {
+		Count int64
+		MaxID *uint64
+	}
+	err = db.WithContext(ctx).Unscoped().Model(&models.User{}).Select("COUNT(*) AS count, MAX(id) AS max_id").Scan(&row).Error
+	if row.MaxID != nil {
+		maxID = *row.MaxID
+	}
+	return row.Count, maxID, err
+}
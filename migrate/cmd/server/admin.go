@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/wiring"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 修复任务的状态
+const (
+	jobRunning  = "running"
+	jobFinished = "finished"
+	jobStopped  = "stopped"
+	jobFailed   = "failed"
+)
+
+// jobNames 支持的修复任务：全量修复、按 updated_at 增量修复、按 binlog 增量修复、只读校验
+var jobNames = []string{"full", "incr", "cdc", "verify"}
+
+// Admin 迁移的管理接口，所有接口都需要 token，修改操作使用 POST
+type Admin struct {
+	cfg  *conf.Config
+	pool *dwrite.DoubleWritePool
+	sdb  *gorm.DB // 修复任务使用的源库
+	tdb  *gorm.DB // 修复任务使用的目标库
+	srdb *gorm.DB // 全量修复和校验批量读取的源库从库，为 nil 时使用源库
+	trdb *gorm.DB // 全量修复和校验批量读取的目标库从库，为 nil 时使用目标库
+
+	jobs   map[string]*job
+	report *fix.VerifyReport // 最近一次校验的报告
+	lock   sync.Mutex
+}
+
+// job 一个修复任务，同名的任务同时只能运行一个
+type job struct {
+	name      string
+	state     string
+	err       error
+	startedAt time.Time
+	endedAt   time.Time
+	cancel    context.CancelFunc
+	fixer     *fix.User
+}
+
+// JobStatus 修复任务的状态和进度
+type JobStatus struct {
+	Name      string           `json:"name"`
+	State     string           `json:"state"`
+	Error     string           `json:"error,omitempty"`
+	StartedAt time.Time        `json:"started_at"`
+	EndedAt   time.Time        `json:"ended_at"`
+	Progress  *fix.FixStats    `json:"progress,omitempty"`    // 全量和按 updated_at 增量修复的进度
+	Verify    *fix.VerifyStats `json:"verify,omitempty"`      // 只读校验的进度
+	CDC       *fix.CDCStats    `json:"cdc,omitempty"`         // binlog 增量修复的进度
+	DDL       *fix.DDLEvent    `json:"pending_ddl,omitempty"` // binlog 增量修复等待确认的 DDL
+}
+
+// NewAdmin 创建管理接口，srdb 和 trdb 为源库和目标库的从库，可以为 nil
+func NewAdmin(cfg *conf.Config, pool *dwrite.DoubleWritePool, sdb, tdb, srdb, trdb *gorm.DB) *Admin {
+	return &Admin{
+		cfg:  cfg,
+		pool: pool,
+		sdb:  sdb,
+		tdb:  tdb,
+		srdb: srdb,
+		trdb: trdb,
+		jobs: make(map[string]*job),
+	}
+}
+
+// Register 注册管理接口
+func (a *Admin) Register(server *gin.Engine) {
+	g := server.Group("/admin", a.Auth())
+	g.GET("/mode", a.GetMode())
+	g.POST("/mode", a.SetMode())
+	g.GET("/double-write/stats", a.DoubleWriteStats())
+	g.GET("/jobs", a.ListJobs())
+	g.GET("/jobs/:name", a.GetJob())
+	g.POST("/jobs/:name/start", a.StartJob())
+	g.POST("/jobs/:name/stop", a.StopJob())
+	g.GET("/fix/ddl", a.PendingDDL())
+	g.POST("/fix/ddl/confirm", a.ConfirmDDL())
+	g.GET("/verify", a.LastReport())
+	g.GET("/overview", a.Overview())
+}
+
+// Auth 校验请求头 Authorization: Bearer <token>
+func (a *Admin) Auth() gin.HandlerFunc {
+	token := []byte(a.cfg.Server.AdminToken)
+	return func(ctx *gin.Context) {
+		got := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), token) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "未授权", "code": 1})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// GetMode 获取当前的双写模式和切换历史
+func (a *Admin) GetMode() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": a.modeData()})
+	}
+}
+
+// SetMode 切换双写模式，请求体为 {"mode": "double-write", "force": false}，
+// 默认只能切换到相邻的模式，force 为 true 时可以跳过中间的模式
+func (a *Admin) SetMode() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req struct {
+			Mode  *dwrite.Mode `json:"mode"`
+			Force bool         `json:"force"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil || req.Mode == nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"msg": "错误的 mode", "code": 1})
+			return
+		}
+		to := *req.Mode
+		if to < dwrite.SourceWrite || to > dwrite.TargetWrite {
+			ctx.JSON(http.StatusBadRequest, gin.H{"msg": "错误的 mode", "code": 1})
+			return
+		}
+		from := a.pool.Mode()
+		if step := to - from; !req.Force && (step > 1 || step < -1) {
+			ctx.JSON(http.StatusConflict, gin.H{"code": 1,
+				"msg": fmt.Sprintf("不能从 %s 直接切换到 %s，需要逐步切换或者指定 force", from, to)})
+			return
+		}
+		a.pool.SetMode(to)
+		log.Println("model change to:", to)
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": a.modeData()})
+	}
+}
+
+func (a *Admin) modeData() gin.H {
+	return gin.H{"mode": a.pool.Mode(), "history": a.pool.History()}
+}
+
+// DoubleWriteStats 获取异步写第二个库的统计
+func (a *Admin) DoubleWriteStats() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": a.pool.Stats()})
+	}
+}
+
+// ListJobs 获取所有修复任务的状态
+func (a *Admin) ListJobs() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		jobs := make([]JobStatus, 0, len(a.jobs))
+		for _, name := range jobNames {
+			if j, ok := a.jobs[name]; ok {
+				jobs = append(jobs, j.status())
+			}
+		}
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": jobs})
+	}
+}
+
+// GetJob 获取修复任务的状态和进度
+func (a *Admin) GetJob() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		j, ok := a.jobs[ctx.Param("name")]
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"msg": "not found", "code": 1})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": j.status()})
+	}
+}
+
+// StartJob 启动修复任务，任务在后台运行，通过 GetJob 查看进度
+func (a *Admin) StartJob() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		if !isJob(name) {
+			ctx.JSON(http.StatusNotFound, gin.H{"code": 1,
+				"msg": fmt.Sprintf("未知的任务 %s，可选 %s", name, strings.Join(jobNames, "、"))})
+			return
+		}
+		status, err := a.start(name)
+		if err != nil {
+			ctx.JSON(http.StatusConflict, gin.H{"msg": err.Error(), "code": 1})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": status})
+	}
+}
+
+// StopJob 停止修复任务，binlog 增量修复会回滚未确认的批次
+func (a *Admin) StopJob() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		j, ok := a.jobs[ctx.Param("name")]
+		if !ok || j.state != jobRunning {
+			ctx.JSON(http.StatusConflict, gin.H{"msg": "任务没有运行", "code": 1})
+			return
+		}
+		j.cancel()
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": j.status()})
+	}
+}
+
+// PendingDDL 获取 binlog 增量修复等待确认的 DDL
+func (a *Admin) PendingDDL() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		j, ok := a.jobs["cdc"]
+		if !ok || j.state != jobRunning {
+			ctx.JSON(http.StatusNotFound, gin.H{"msg": "binlog 增量修复没有运行", "code": 1})
+			return
+		}
+		ddl, ok := j.fixer.PendingDDL()
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"msg": fix.ErrNoPendingDDL.Error(), "code": 1})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": ddl})
+	}
+}
+
+// ConfirmDDL 确认目标库已经处理了等待中的 DDL，binlog 增量修复继续运行
+func (a *Admin) ConfirmDDL() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		j, ok := a.jobs["cdc"]
+		if !ok || j.state != jobRunning {
+			ctx.JSON(http.StatusConflict, gin.H{"msg": "binlog 增量修复没有运行", "code": 1})
+			return
+		}
+		ddl, _ := j.fixer.PendingDDL()
+		if err := j.fixer.ConfirmDDL(); err != nil {
+			ctx.JSON(http.StatusConflict, gin.H{"msg": err.Error(), "code": 1})
+			return
+		}
+		log.Println("确认 DDL:", ddl.SQL)
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": ddl})
+	}
+}
+
+// LastReport 获取最近一次校验的报告
+func (a *Admin) LastReport() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.report == nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"msg": "还没有校验报告", "code": 1})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": a.report})
+	}
+}
+
+// Overview 页面使用的汇总数据
+type Overview struct {
+	Mode        dwrite.Mode           `json:"mode"`
+	History     []dwrite.ModeChange   `json:"history"`
+	Tables      []TableStatus         `json:"tables"`
+	DoubleWrite dwrite.SecondaryStats `json:"double_write"`
+	Jobs        []JobStatus           `json:"jobs"`
+	Report      *fix.VerifyReport     `json:"report"`
+}
+
+// TableStatus 一张表的双写模式和源库的最大 ID，用于计算全量修复的进度
+type TableStatus struct {
+	Name  string      `json:"name"`
+	Mode  dwrite.Mode `json:"mode"`
+	MaxID uint64      `json:"max_id"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Overview 获取双写模式、双写统计、修复任务和校验报告的汇总，用于页面展示
+func (a *Admin) Overview() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		o := Overview{
+			Mode:        a.pool.Mode(),
+			History:     a.pool.History(),
+			DoubleWrite: a.pool.Stats(),
+		}
+		// 所有表共用一个双写连接池，双写模式相同
+		for _, model := range []any{&models.User{}} {
+			o.Tables = append(o.Tables, a.tableStatus(ctx.Request.Context(), model, o.Mode))
+		}
+
+		a.lock.Lock()
+		o.Jobs = make([]JobStatus, 0, len(a.jobs))
+		for _, name := range jobNames {
+			if j, ok := a.jobs[name]; ok {
+				o.Jobs = append(o.Jobs, j.status())
+			}
+		}
+		o.Report = a.report
+		a.lock.Unlock()
+		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0, "data": o})
+	}
+}
+
+func (a *Admin) tableStatus(ctx context.Context, model any, mode dwrite.Mode) TableStatus {
+	stmt := &gorm.Statement{DB: a.sdb}
+	if err := stmt.Parse(model); err != nil {
+		return TableStatus{Mode: mode, Error: err.Error()}
+	}
+	t := TableStatus{Name: stmt.Schema.Table, Mode: mode}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
+	defer cancel()
+	var maxID *uint64
+	if err := a.sdb.WithContext(ctx).Unscoped().Model(model).Select("MAX(id)").Scan(&maxID).Error; err != nil {
+		t.Error = err.Error()
+	} else if maxID != nil {
+		t.MaxID = *maxID
+	}
+	return t
+}
+
+// start 在后台启动修复任务
+func (a *Admin) start(name string) (JobStatus, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if j, ok := a.jobs[name]; ok && j.state == jobRunning {
+		return JobStatus{}, fmt.Errorf("任务 %s 正在运行", name)
+	}
+
+	var (
+		opts = wiring.FixOptions(a.cfg)
+		run  func(ctx context.Context, f *fix.User) error
+	)
+	switch name {
+	case "full":
+		run = func(ctx context.Context, f *fix.User) error {
+			return f.FixFull(ctx, a.cfg.Fix.BatchSize)
+		}
+	case "incr":
+		run = func(ctx context.Context, f *fix.User) error {
+			return f.FixIncByUpdatedAt(ctx)
+		}
+	case "cdc":
+		store := fix.NewFilePositionStore(a.cfg.Fix.PositionFile)
+		source, err := wiring.NewFixSource(a.cfg, a.sdb, store)
+		if err != nil {
+			return JobStatus{}, err
+		}
+		opts = append(opts, fix.WithSource(source), fix.WithPositionStore(store))
+		run = func(ctx context.Context, f *fix.User) error {
+			return f.FixIncByCDC(ctx, a.cfg.Fix.CDCBatchSize)
+		}
+	case "verify":
+		run = func(ctx context.Context, f *fix.User) error {
+			report, err := f.Verify(ctx, a.cfg.Fix.BatchSize)
+			if err != nil {
+				return err
+			}
+			a.lock.Lock()
+			a.report = report
+			a.lock.Unlock()
+			return nil
+		}
+	default:
+		return JobStatus{}, fmt.Errorf("未知的任务 %s", name)
+	}
+	closer := func() {}
+	if name != "cdc" { // binlog 增量修复需要跟上源库的写入，不限速，也不从从库读取
+		th, c, err := wiring.NewThrottle(a.cfg, a.sdb)
+		if err != nil {
+			return JobStatus{}, err
+		}
+		opts, closer = append(opts, fix.WithThrottle(th), fix.WithReplicas(a.srdb, a.trdb)), c
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		name:      name,
+		state:     jobRunning,
+		startedAt: time.Now(),
+		cancel:    cancel,
+		fixer:     fix.NewFixUser(a.sdb, a.tdb, opts...),
+	}
+	a.jobs[name] = j
+	log.Println("启动修复任务:", name)
+
+	go func() {
+		defer closer()
+		err := run(ctx, j.fixer)
+		cancel()
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		j.endedAt = time.Now()
+		switch {
+		case err == nil:
+			j.state = jobFinished
+		case errors.Is(err, context.Canceled):
+			j.state = jobStopped
+		default:
+			j.state, j.err = jobFailed, err
+			log.Println(fmt.Errorf("修复任务 %s 失败 error:%w", name, err))
+		}
+		log.Println("修复任务结束:", name, j.state)
+	}()
+	return j.status(), nil
+}
+
+func isJob(name string) bool {
+	for _, n := range jobNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// status 任务的状态，需要持有 Admin 的锁
+func (j *job) status() JobStatus {
+	s := JobStatus{
+		Name:      j.name,
+		State:     j.state,
+		StartedAt: j.startedAt,
+		EndedAt:   j.endedAt,
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	switch j.name {
+	case "full", "incr":
+		progress := j.fixer.FixStats()
+		s.Progress = &progress
+	case "verify":
+		verify := j.fixer.VerifyStats()
+		s.Verify = &verify
+	case "cdc":
+		cdc := j.fixer.CDCStats()
+		s.CDC = &cdc
+		if ddl, ok := j.fixer.PendingDDL(); ok {
+			s.DDL = &ddl
+		}
+	}
+	return s
+}
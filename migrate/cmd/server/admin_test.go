@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+type testAdmin struct {
+	server   *gin.Engine
+	pool     *dwrite.DoubleWritePool
+	sdb, tdb *gorm.DB
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	gin.SetMode(gin.TestMode)
+	source, target := dbtest.NewFakeDB(), dbtest.NewFakeDB()
+	t.Cleanup(func() {
+		_ = source.Close()
+		_ = target.Close()
+	})
+	cfg := conf.Default()
+	cfg.Server.AdminToken = testToken
+	cfg.Fix.Sleep = time.Millisecond
+	cfg.Fix.PositionFile = t.TempDir() + "/position.json"
+	a := &testAdmin{
+		server: gin.New(),
+		pool:   dwrite.NewDoubleWritePool(source.DB, target.DB),
+		sdb:    dbtest.NewSQLite(t),
+		tdb:    dbtest.NewSQLite(t),
+	}
+	a.pool.SetMode(dwrite.SourceWrite)
+	NewAdmin(cfg, a.pool, a.sdb, a.tdb, nil, nil).Register(a.server)
+	RegisterDashboard(a.server)
+	return a
+}
+
+type response struct {
+	Msg  string          `json:"msg"`
+	Code int             `json:"code"`
+	Data json.RawMessage `json:"data"`
+}
+
+// do 请求接口，token 为空时不带 Authorization 请求头
+func (a *testAdmin) do(t *testing.T, method, path, token string, body any) (int, response) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.server.ServeHTTP(w, req)
+	var res response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: unexpected body %s", method, path, w.Body.String())
+	}
+	return w.Code, res
+}
+
+func TestAdminAuth(t *testing.T) {
+	a := newTestAdmin(t)
+	testCases := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{name: "no token", wantCode: http.StatusUnauthorized},
+		{name: "wrong token", token: "secre", wantCode: http.StatusUnauthorized},
+		{name: "token", token: testToken, wantCode: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, path := range []string{"/admin/mode", "/admin/overview", "/admin/jobs"} {
+				code, _ := a.do(t, http.MethodGet, path, tc.token, nil)
+				if code != tc.wantCode {
+					t.Fatalf("%s: expect %d, got %d", path, tc.wantCode, code)
+				}
+			}
+		})
+	}
+	// 没有 token 时不能修改双写模式
+	if code, _ := a.do(t, http.MethodPost, "/admin/mode", "", gin.H{"mode": "double-write"}); code != http.StatusUnauthorized {
+		t.Fatalf("expect %d, got %d", http.StatusUnauthorized, code)
+	}
+	if mode := a.pool.Mode(); mode != dwrite.SourceWrite {
+		t.Fatalf("expect mode unchanged, got %s", mode)
+	}
+}
+
+func TestAdminSetMode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		from     dwrite.Mode
+		body     gin.H
+		wantCode int
+		wantMode dwrite.Mode
+	}{
+		{name: "next", from: dwrite.SourceWrite, body: gin.H{"mode": "double-write"},
+			wantCode: http.StatusOK, wantMode: dwrite.DoubleWrite},
+		{name: "previous", from: dwrite.Transition, body: gin.H{"mode": "double-write"},
+			wantCode: http.StatusOK, wantMode: dwrite.DoubleWrite},
+		{name: "skip", from: dwrite.SourceWrite, body: gin.H{"mode": "transition"},
+			wantCode: http.StatusConflict, wantMode: dwrite.SourceWrite},
+		{name: "skip back", from: dwrite.TargetWrite, body: gin.H{"mode": "source-write"},
+			wantCode: http.StatusConflict, wantMode: dwrite.TargetWrite},
+		{name: "force", from: dwrite.SourceWrite, body: gin.H{"mode": "target-write", "force": true},
+			wantCode: http.StatusOK, wantMode: dwrite.TargetWrite},
+		{name: "unknown mode", from: dwrite.SourceWrite, body: gin.H{"mode": "both"},
+			wantCode: http.StatusBadRequest, wantMode: dwrite.SourceWrite},
+		{name: "no mode", from: dwrite.SourceWrite, body: gin.H{"force": true},
+			wantCode: http.StatusBadRequest, wantMode: dwrite.SourceWrite},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestAdmin(t)
+			a.pool.SetMode(tc.from)
+			code, res := a.do(t, http.MethodPost, "/admin/mode", testToken, tc.body)
+			if code != tc.wantCode {
+				t.Fatalf("expect %d, got %d %s", tc.wantCode, code, res.Msg)
+			}
+			if mode := a.pool.Mode(); mode != tc.wantMode {
+				t.Fatalf("expect mode %s, got %s", tc.wantMode, mode)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var data modeResponse
+			if err := json.Unmarshal(res.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+			if data.Mode != tc.wantMode || len(data.History) == 0 || data.History[len(data.History)-1].To != tc.wantMode {
+				t.Fatalf("unexpected response %+v", data)
+			}
+		})
+	}
+}
+
+type modeResponse struct {
+	Mode    dwrite.Mode         `json:"mode"`
+	History []dwrite.ModeChange `json:"history"`
+}
+
+// waitJob 等待任务结束，返回任务的状态
+func (a *testAdmin) waitJob(t *testing.T, name string) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		code, res := a.do(t, http.MethodGet, "/admin/jobs/"+name, testToken, nil)
+		if code != http.StatusOK {
+			t.Fatalf("expect %d, got %d %s", http.StatusOK, code, res.Msg)
+		}
+		var status JobStatus
+		if err := json.Unmarshal(res.Data, &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != jobRunning {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still running", name)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestAdminJobs(t *testing.T) {
+	a := newTestAdmin(t)
+	users := make([]models.User, 0, 5)
+	for i := 1; i <= 5; i++ {
+		users = append(users, models.User{ID: uint64(i), Name: "user", Email: "user@example.com",
+			CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	}
+	dbtest.SeedUsers(t, a.sdb, users...)
+
+	if code, _ := a.do(t, http.MethodPost, "/admin/jobs/unknown/start", testToken, nil); code != http.StatusNotFound {
+		t.Fatalf("expect %d, got %d", http.StatusNotFound, code)
+	}
+	if code, _ := a.do(t, http.MethodGet, "/admin/jobs/full", testToken, nil); code != http.StatusNotFound {
+		t.Fatalf("expect %d, got %d", http.StatusNotFound, code)
+	}
+
+	// 全量修复运行结束
+	if code, res := a.do(t, http.MethodPost, "/admin/jobs/full/start", testToken, nil); code != http.StatusOK {
+		t.Fatalf("expect %d, got %d %s", http.StatusOK, code, res.Msg)
+	}
+	if status := a.waitJob(t, "full"); status.State != jobFinished || status.Progress == nil || status.Progress.Created != 5 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	dbtest.AssertSameUsers(t, a.sdb, a.tdb)
+
+	// 增量修复一直运行，直到停止
+	if code, res := a.do(t, http.MethodPost, "/admin/jobs/incr/start", testToken, nil); code != http.StatusOK {
+		t.Fatalf("expect %d, got %d %s", http.StatusOK, code, res.Msg)
+	}
+	if code, _ := a.do(t, http.MethodPost, "/admin/jobs/incr/start", testToken, nil); code != http.StatusConflict {
+		t.Fatalf("expect %d for running job, got %d", http.StatusConflict, code)
+	}
+	if code, res := a.do(t, http.MethodPost, "/admin/jobs/incr/stop", testToken, nil); code != http.StatusOK {
+		t.Fatalf("expect %d, got %d %s", http.StatusOK, code, res.Msg)
+	}
+	if status := a.waitJob(t, "incr"); status.State != jobStopped {
+		t.Fatalf("expect %s, got %+v", jobStopped, status)
+	}
+	if code, _ := a.do(t, http.MethodPost, "/admin/jobs/incr/stop", testToken, nil); code != http.StatusConflict {
+		t.Fatalf("expect %d for stopped job, got %d", http.StatusConflict, code)
+	}
+
+	code, res := a.do(t, http.MethodGet, "/admin/jobs", testToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("expect %d, got %d", http.StatusOK, code)
+	}
+	var jobs []JobStatus
+	if err := json.Unmarshal(res.Data, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "full" || jobs[1].Name != "incr" {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFS 迁移进度页面，页面本身不需要 token，数据通过 /admin/overview 获取
+//
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// RegisterDashboard 在 /dashboard 下提供迁移进度页面，/ 重定向到页面
+func RegisterDashboard(server *gin.Engine) {
+	sub, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	server.StaticFS("/dashboard", http.FS(sub))
+	server.GET("/", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
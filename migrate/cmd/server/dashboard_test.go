@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	a := newTestAdmin(t)
+	testCases := []struct {
+		name         string
+		path         string
+		wantCode     int
+		wantLocation string
+		wantBody     string
+	}{
+		{name: "root", path: "/", wantCode: http.StatusFound, wantLocation: "/dashboard/"},
+		{name: "page", path: "/dashboard/", wantCode: http.StatusOK, wantBody: "<title>数据迁移进度</title>"},
+		{name: "ddl confirm", path: "/dashboard/", wantCode: http.StatusOK, wantBody: `request("POST", "/fix/ddl/confirm")`},
+		// 页面本身不需要 token，数据接口需要
+		{name: "overview without token", path: "/admin/overview", wantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.wantCode {
+				t.Fatalf("expect %d, got %d", tc.wantCode, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tc.wantLocation {
+				t.Fatalf("expect location %q, got %q", tc.wantLocation, got)
+			}
+			if !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Fatalf("expect body to contain %q", tc.wantBody)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"github.com/gin-gonic/gin"
 	"github.com/xuqil/experiments/migrate/internal/conf"
 	"github.com/xuqil/experiments/migrate/internal/generate"
@@ -10,53 +11,57 @@ import (
 	"gorm.io/gorm"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 )
 
 var db *gorm.DB
 var pool *dwrite.DoubleWritePool
+var cfg *conf.Config
 
 func main() {
 	Init()
 	go CrudTask(db)
 
 	s := gin.Default()
-	f := NewFakeServer(db, s, pool)
+	f := NewFakeServer(db, s)
 	f.Register()
 
-	if err := s.Run(":8080"); err != nil {
+	// 管理接口和迁移进度页面：双写模式、双写统计、修复任务和校验报告
+	if cfg.Server.AdminToken == "" {
+		log.Println("没有配置 server.admin_token，不开启管理接口")
+	} else {
+		sdb, err := conf.InitSourceDB(cfg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tdb, err := conf.InitTargetDB(cfg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		srdb, trdb, err := conf.InitReplicaDBs(cfg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		NewAdmin(cfg, pool, sdb, tdb, srdb, trdb).Register(s)
+		RegisterDashboard(s)
+	}
+
+	if err := s.Run(cfg.Server.Addr); err != nil {
 		log.Fatalln(err)
 	}
 }
 
 type FakeServer struct {
 	db     *gorm.DB
-	pool   *dwrite.DoubleWritePool
 	server *gin.Engine
 }
 
-func NewFakeServer(db *gorm.DB, server *gin.Engine, pool *dwrite.DoubleWritePool) *FakeServer {
+func NewFakeServer(db *gorm.DB, server *gin.Engine) *FakeServer {
 	return &FakeServer{
 		db:     db,
 		server: server,
-		pool:   pool,
-	}
-}
-
-// ChangeModel 修改双写模式
-func (f *FakeServer) ChangeModel() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		modeStr := ctx.Query("value")
-		m, err := strconv.Atoi(modeStr)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"msg": "错误的 model", "code": 1})
-			return
-		}
-		model := dwrite.Mode(m)
-		f.pool.SetMode(model)
-		log.Println("model change to:", model)
-		ctx.JSON(http.StatusOK, gin.H{"msg": "success", "code": 0})
 	}
 }
 
@@ -86,7 +91,6 @@ func (f *FakeServer) GetUser() gin.HandlerFunc {
 
 // Register 注册路由
 func (f *FakeServer) Register() {
-	f.server.GET("/mode", f.ChangeModel())
 	f.server.GET("/users/:id", f.GetUser())
 }
 
@@ -115,6 +119,14 @@ func CrudTask(db *gorm.DB) {
 }
 
 func Init() {
-	db, pool = conf.InitDoubleWriteDB()
+	var err error
+	cfg, err = conf.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	db, pool, err = conf.InitDoubleWriteDB(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	pool.SetMode(dwrite.SourceWrite)
 }
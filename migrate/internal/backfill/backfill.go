@@ -0,0 +1,229 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/throttle"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Option func(c *Copier)
+
+// WithWorkers 设置并发复制的数量，每个并发占用源库的一个连接和一个快照事务
+func WithWorkers(n int) Option {
+	return func(c *Copier) {
+		c.workers = n
+	}
+}
+
+// WithChunk 设置每个分片的 ID 范围和每次写入目标库的行数
+func WithChunk(chunkSize, batchSize int) Option {
+	return func(c *Copier) {
+		c.chunkSize = chunkSize
+		c.batchSize = batchSize
+	}
+}
+
+// WithSleep 设置每个分片之间的休眠时间，用于限速
+func WithSleep(d time.Duration) Option {
+	return func(c *Copier) {
+		c.sleep = d
+	}
+}
+
+// WithThrottle 设置自适应限速，每个分片之前执行，读取源库的延迟会上报给 t
+func WithThrottle(t *throttle.Throttle) Option {
+	return func(c *Copier) {
+		c.throttle = t
+	}
+}
+
+// WithPositionStore 设置保存快照 binlog 位点的存储，binlog 增量修复从这个位点开始
+func WithPositionStore(s fix.PositionStore) Option {
+	return func(c *Copier) {
+		c.store = s
+	}
+}
+
+// Copier 将源库的 users 表在线复制到目标库，用于迁移开始时初始化目标库。
+// 先在源库上获取一致性快照和对应的 binlog 位点，再按 ID 范围分片并发地从快照读取并写入目标库，
+// 复制完成后保存快照的位点，binlog 增量修复从这个位点开始，正好接上快照之后的变更。
+// 写入目标库使用 INSERT ... ON DUPLICATE KEY UPDATE，中断后可以重新执行
+type Copier struct {
+	sdb       *gorm.DB // 源库
+	tdb       *gorm.DB // 目标库
+	workers   int
+	chunkSize int
+	batchSize int
+	sleep     time.Duration
+	throttle  *throttle.Throttle
+	store     fix.PositionStore
+	snapshot  snapshotFunc
+
+	chunks atomic.Int64 // 已经复制的分片
+	rows   atomic.Int64 // 已经复制的行数
+	total  atomic.Int64 // 分片总数
+}
+
+func NewCopier(sdb *gorm.DB, tdb *gorm.DB, opts ...Option) *Copier {
+	c := &Copier{
+		sdb:       sdb,
+		tdb:       tdb,
+		workers:   4,
+		chunkSize: 10000,
+		batchSize: 1000,
+		store:     fix.NewMemoryPositionStore(fix.Position{}),
+		snapshot:  mysqlSnapshot,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Report 复制的结果
+type Report struct {
+	Position  fix.Position  `json:"position"`  // 快照的 binlog 位点
+	MinID     uint64        `json:"min_id"`    // 快照中的最小 ID
+	MaxID     uint64        `json:"max_id"`    // 快照中的最大 ID
+	Chunks    int64         `json:"chunks"`    // 复制的分片数
+	Rows      int64         `json:"rows"`      // 复制的行数
+	Throttled time.Duration `json:"throttled"` // 限速休眠和暂停的时长
+	Duration  time.Duration `json:"duration"`
+}
+
+// Progress 复制的进度，返回已经复制的分片、分片总数和行数
+func (c *Copier) Progress() (chunks, total, rows int64) {
+	return c.chunks.Load(), c.total.Load(), c.rows.Load()
+}
+
+// chunk ID 范围 [start, start+chunkSize)
+type chunk struct {
+	start uint64
+}
+
+// Run 获取快照并复制，成功后保存快照的 binlog 位点。
+// 任意分片失败时取消其它分片并返回错误，此时不保存位点，可以直接重新执行
+func (c *Copier) Run(ctx context.Context) (*Report, error) {
+	start := time.Now()
+	readers, pos, release, err := c.snapshot(ctx, c.sdb, c.workers)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	log.Println("获取一致性快照，binlog 位点:", pos)
+
+	report := &Report{Position: pos}
+	report.MinID, report.MaxID, err = models.Users.IDRange(ctx, readers[0])
+	if err != nil {
+		return nil, err
+	}
+	if report.MaxID > 0 {
+		if err = c.copy(ctx, readers, report.MinID, report.MaxID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = c.store.Save(pos); err != nil {
+		return nil, fmt.Errorf("保存 binlog 位点失败 error:%w", err)
+	}
+	report.Chunks, _, report.Rows = c.Progress()
+	report.Throttled = c.throttle.Throttled()
+	report.Duration = time.Since(start)
+	log.Println(fmt.Sprintf("复制完成 rows:%d chunks:%d，binlog 增量修复从位点 %s 开始", report.Rows, report.Chunks, pos))
+	return report, nil
+}
+
+// copy 按 ID 范围分片，每个并发在自己的快照事务上读取分片
+func (c *Copier) copy(ctx context.Context, readers []*gorm.DB, minID, maxID uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	starts := chunkStarts(minID, maxID, c.chunkSize)
+	c.total.Store(int64(len(starts)))
+	ch := make(chan chunk)
+	go func() {
+		defer close(ch)
+		for _, s := range starts {
+			select {
+			case ch <- chunk{start: s}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		err  error
+	)
+	for _, reader := range readers {
+		wg.Add(1)
+		go func(reader *gorm.DB) {
+			defer wg.Done()
+			for ck := range ch {
+				if er := c.copyChunk(ctx, reader, ck); er != nil {
+					once.Do(func() {
+						err = er
+						cancel()
+					})
+					return
+				}
+			}
+		}(reader)
+	}
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// copyChunk 从快照读取一个分片并写入目标库
+func (c *Copier) copyChunk(ctx context.Context, reader *gorm.DB, ck chunk) error {
+	if err := c.throttle.Wait(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	users, err := models.Users.Interval(ctx, reader, ck.start, c.chunkSize)
+	c.throttle.Observe(time.Since(start))
+	if err != nil {
+		return fmt.Errorf("从源库读取分片失败 ID:%d error:%w", ck.start, err)
+	}
+	if len(users) > 0 {
+		if err = models.Users.UpsertBatch(ctx, c.tdb, users, c.batchSize); err != nil {
+			return fmt.Errorf("写入目标库失败 ID:%d error:%w", ck.start, err)
+		}
+	}
+	c.rows.Add(int64(len(users)))
+	if n := c.chunks.Add(1); n%100 == 0 {
+		log.Println(fmt.Sprintf("已经复制 %d/%d 个分片，%d 行", n, c.total.Load(), c.rows.Load()))
+	}
+	if c.sleep > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.sleep):
+		}
+	}
+	return nil
+}
+
+// chunkStarts 将 [minID, maxID] 按 size 切分，返回每个分片的起始 ID
+func chunkStarts(minID, maxID uint64, size int) []uint64 {
+	starts := make([]uint64, 0, (maxID-minID)/uint64(size)+1)
+	for s := minID; s <= maxID; s += uint64(size) {
+		starts = append(starts, s)
+		if s+uint64(size) < s { // 溢出
+			break
+		}
+	}
+	return starts
+}
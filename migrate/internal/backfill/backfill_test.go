@@ -0,0 +1,134 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/throttle"
+	"gorm.io/gorm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func testUsers(ids ...uint64) []models.User {
+	users := make([]models.User, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, models.User{
+			ID:        id,
+			Name:      "user",
+			Email:     "user@example.com",
+			Birthday:  testTime,
+			CreatedAt: testTime,
+			UpdatedAt: testTime.Add(time.Duration(id) * time.Second),
+		})
+	}
+	return users
+}
+
+// fakeSnapshot SQLite 没有全局读锁和 binlog，所有并发直接读取源库
+func fakeSnapshot(pos fix.Position) snapshotFunc {
+	return func(ctx context.Context, db *gorm.DB, n int) ([]*gorm.DB, fix.Position, func(), error) {
+		readers := make([]*gorm.DB, 0, n)
+		for i := 0; i < n; i++ {
+			readers = append(readers, db)
+		}
+		return readers, pos, func() {}, nil
+	}
+}
+
+func TestChunkStarts(t *testing.T) {
+	testCases := []struct {
+		minID, maxID uint64
+		size         int
+		want         []uint64
+	}{
+		{minID: 1, maxID: 1, size: 10, want: []uint64{1}},
+		{minID: 1, maxID: 10, size: 10, want: []uint64{1}},
+		{minID: 1, maxID: 11, size: 10, want: []uint64{1, 11}},
+		{minID: 5, maxID: 30, size: 10, want: []uint64{5, 15, 25}},
+	}
+	for _, tc := range testCases {
+		if got := chunkStarts(tc.minID, tc.maxID, tc.size); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("chunkStarts(%d, %d, %d): expect %v, got %v", tc.minID, tc.maxID, tc.size, tc.want, got)
+		}
+	}
+}
+
+func TestCopier(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	ids := []uint64{3, 4, 5, 17, 18, 40, 41, 42, 43, 44, 45, 46, 99}
+	dbtest.SeedUsers(t, sdb, testUsers(ids...)...)
+	// 上次中断时已经复制的数据会被覆盖
+	stale := testUsers(4, 40)
+	stale[0].Name = "stale"
+	dbtest.SeedUsers(t, tdb, stale...)
+
+	pos := fix.Position{File: "mysql-bin.000003", Offset: 154}
+	store := fix.NewMemoryPositionStore(fix.Position{})
+	lag := func(context.Context) (time.Duration, error) {
+		return 0, nil
+	}
+	c := NewCopier(sdb, tdb, WithWorkers(3), WithChunk(10, 4), WithPositionStore(store),
+		WithThrottle(throttle.New(throttle.WithReplicaLag(lag, time.Second), throttle.WithInterval(time.Millisecond))))
+	c.snapshot = fakeSnapshot(pos)
+	report, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	if report.MinID != 3 || report.MaxID != 99 || report.Chunks != 10 || report.Rows != int64(len(ids)) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got, _ := store.Load(); got != pos {
+		t.Fatalf("expect position %s, got %s", pos, got)
+	}
+}
+
+func TestCopierEmpty(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	pos := fix.Position{File: "mysql-bin.000001", Offset: 4}
+	store := fix.NewMemoryPositionStore(fix.Position{})
+	c := NewCopier(sdb, tdb, WithPositionStore(store))
+	c.snapshot = fakeSnapshot(pos)
+	report, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 0 || report.Chunks != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got, _ := store.Load(); got != pos {
+		t.Fatalf("expect position %s, got %s", pos, got)
+	}
+}
+
+func TestCopierCanceled(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(1, 2, 3)...)
+	store := fix.NewMemoryPositionStore(fix.Position{})
+	// 复制延迟一直超过阈值
+	lag := func(context.Context) (time.Duration, error) {
+		return time.Minute, nil
+	}
+	th := throttle.New(throttle.WithReplicaLag(lag, time.Second), throttle.WithInterval(time.Millisecond))
+	c := NewCopier(sdb, tdb, WithPositionStore(store), WithThrottle(th))
+	c.snapshot = fakeSnapshot(fix.Position{File: "mysql-bin.000001", Offset: 4})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+	// 失败时不保存位点
+	if got, _ := store.Load(); !got.IsZero() {
+		t.Fatalf("expect no position, got %s", got)
+	}
+	if users := dbtest.Users(t, tdb); len(users) != 0 {
+		t.Fatalf("expect no users, got %d", len(users))
+	}
+}
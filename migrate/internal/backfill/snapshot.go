@@ -0,0 +1,82 @@
+package backfill
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"gorm.io/gorm"
+	"log"
+)
+
+// lockWaitTimeout 获取全局读锁的最长等待时间，单位秒，避免长查询导致业务写入长时间阻塞
+const lockWaitTimeout = 10
+
+// snapshotFunc 在源库上开启 n 个一致性快照的只读事务，返回在每个事务上执行查询的 *gorm.DB、
+// 快照对应的 binlog 位点，以及结束事务并归还连接的 release
+type snapshotFunc func(ctx context.Context, db *gorm.DB, n int) ([]*gorm.DB, fix.Position, func(), error)
+
+// mysqlSnapshot 与 mydumper 相同的方式获取一致性快照：
+// 持有全局读锁期间在每个连接上开启 WITH CONSISTENT SNAPSHOT 的事务并读取 binlog 位点，随后立即释放锁，
+// 所有事务看到的数据都对应这个位点。需要 RELOAD 和 REPLICATION CLIENT 权限，持锁期间业务写入会阻塞
+func mysqlSnapshot(ctx context.Context, db *gorm.DB, n int) (readers []*gorm.DB, pos fix.Position, release func(), err error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, pos, nil, err
+	}
+	conns := make([]*sql.Conn, 0, n)
+	release = func() {
+		for _, c := range conns {
+			_, _ = c.ExecContext(context.Background(), "ROLLBACK")
+			_ = c.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	lockConn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, pos, nil, err
+	}
+	defer lockConn.Close()
+	if _, err = lockConn.ExecContext(ctx, fmt.Sprintf("SET SESSION lock_wait_timeout = %d", lockWaitTimeout)); err != nil {
+		return nil, pos, nil, err
+	}
+	if _, err = lockConn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		return nil, pos, nil, fmt.Errorf("获取全局读锁失败 error:%w", err)
+	}
+	defer func() {
+		if _, er := lockConn.ExecContext(context.Background(), "UNLOCK TABLES"); er != nil {
+			log.Println(fmt.Errorf("释放全局读锁失败 error:%w", er))
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		c, er := sqlDB.Conn(ctx)
+		if er != nil {
+			return nil, pos, nil, er
+		}
+		conns = append(conns, c)
+		if _, err = c.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return nil, pos, nil, err
+		}
+		if _, err = c.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY"); err != nil {
+			return nil, pos, nil, fmt.Errorf("开启一致性快照失败 error:%w", err)
+		}
+		readers = append(readers, withConn(ctx, db, c))
+	}
+	if pos, err = fix.MasterStatus(withConn(ctx, db, lockConn)); err != nil {
+		return nil, pos, nil, fmt.Errorf("获取 binlog 位点失败 error:%w", err)
+	}
+	return readers, pos, release, nil
+}
+
+// withConn 返回在连接 conn 上执行语句的 *gorm.DB
+func withConn(ctx context.Context, db *gorm.DB, conn gorm.ConnPool) *gorm.DB {
+	tx := db.Session(&gorm.Session{NewDB: true, Context: ctx})
+	tx.Statement.ConnPool = conn
+	return tx
+}
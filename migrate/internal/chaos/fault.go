@@ -0,0 +1,96 @@
+package chaos
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FaultKind 注入的故障类型
+type FaultKind string
+
+const (
+	TargetDown       FaultKind = "target-down"       // 目标库宕机，双写和修复写目标库都失败
+	SlowTarget       FaultKind = "slow-target"       // 目标库变慢，每个请求增加延迟
+	KillFixer        FaultKind = "kill-fixer"        // 杀掉 binlog 增量修复，故障结束后从保存的位点重启
+	SourceDisconnect FaultKind = "source-disconnect" // 断开 canal、Kafka 或者 binlog 数据源的连接
+	ModeFlip         FaultKind = "mode-flip"         // 写入过程中在 source-write 和 double-write 之间来回切换
+)
+
+var faultKinds = []FaultKind{TargetDown, SlowTarget, KillFixer, SourceDisconnect, ModeFlip}
+
+// Fault 在负载开始 At 之后注入故障，持续 Duration
+type Fault struct {
+	Kind     FaultKind     `json:"kind"`
+	At       time.Duration `json:"at"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (f Fault) String() string {
+	return fmt.Sprintf("%s@%s+%s", f.Kind, f.At, f.Duration)
+}
+
+// ParseFaults 解析 kind@at+duration 格式的故障，多个故障以逗号分隔，
+// 例如 target-down@10s+5s,kill-fixer@30s+3s
+func ParseFaults(s string) ([]Fault, error) {
+	var faults []Fault
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, rest, ok := strings.Cut(item, "@")
+		if !ok {
+			return nil, fmt.Errorf("错误的故障 %s，格式为 kind@at+duration", item)
+		}
+		f := Fault{Kind: FaultKind(kind)}
+		if !f.Kind.valid() {
+			return nil, fmt.Errorf("未知的故障 %s，可选 %s", kind, joinKinds())
+		}
+		at, duration, ok := strings.Cut(rest, "+")
+		if !ok {
+			return nil, fmt.Errorf("错误的故障 %s，格式为 kind@at+duration", item)
+		}
+		var err error
+		if f.At, err = time.ParseDuration(at); err != nil || f.At < 0 {
+			return nil, fmt.Errorf("错误的故障开始时间 %s", item)
+		}
+		if f.Duration, err = time.ParseDuration(duration); err != nil || f.Duration <= 0 {
+			return nil, fmt.Errorf("错误的故障持续时间 %s", item)
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// DefaultFaults 把负载的时长平均分给所有类型的故障，每种故障持续半个时间片，
+// 所有故障都在负载结束前恢复
+func DefaultFaults(d time.Duration) []Fault {
+	slot := d / time.Duration(len(faultKinds)+1)
+	faults := make([]Fault, 0, len(faultKinds))
+	for i, kind := range faultKinds {
+		faults = append(faults, Fault{
+			Kind:     kind,
+			At:       slot*time.Duration(i) + slot/2,
+			Duration: slot / 2,
+		})
+	}
+	return faults
+}
+
+func (k FaultKind) valid() bool {
+	for _, kind := range faultKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func joinKinds() string {
+	names := make([]string, 0, len(faultKinds))
+	for _, kind := range faultKinds {
+		names = append(names, string(kind))
+	}
+	return strings.Join(names, "、")
+}
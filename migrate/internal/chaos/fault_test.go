@@ -0,0 +1,87 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	testCases := []struct {
+		s       string
+		want    []Fault
+		wantErr bool
+	}{
+		{
+			s: "target-down@10s+5s, kill-fixer@1m+3s",
+			want: []Fault{
+				{Kind: TargetDown, At: 10 * time.Second, Duration: 5 * time.Second},
+				{Kind: KillFixer, At: time.Minute, Duration: 3 * time.Second},
+			},
+		},
+		{s: "", want: nil},
+		{s: "target-down", wantErr: true},
+		{s: "network-down@1s+1s", wantErr: true},
+		{s: "slow-target@1s", wantErr: true},
+		{s: "slow-target@-1s+1s", wantErr: true},
+		{s: "slow-target@1s+0s", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseFaults(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected error %v", tc.s, err)
+		}
+		if tc.wantErr {
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expect %v, got %v", tc.s, tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%s: expect %v, got %v", tc.s, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestDefaultFaults(t *testing.T) {
+	d := time.Minute
+	faults := DefaultFaults(d)
+	if len(faults) != len(faultKinds) {
+		t.Fatalf("expect %d faults, got %d", len(faultKinds), len(faults))
+	}
+	var end time.Duration
+	for _, f := range faults {
+		if f.At < end {
+			t.Fatalf("fault %s overlaps the previous one", f)
+		}
+		end = f.At + f.Duration
+	}
+	if end > d {
+		t.Fatalf("faults should recover before %s, got %s", d, end)
+	}
+}
+
+func TestFaultyPool(t *testing.T) {
+	p := NewFaultyPool(nil)
+	p.SetDown(true)
+	ctx := context.Background()
+	if _, err := p.ExecContext(ctx, "DELETE FROM users"); !errors.Is(err, ErrTargetDown) {
+		t.Fatalf("expect ErrTargetDown, got %v", err)
+	}
+	if _, err := p.BeginTx(ctx, nil); !errors.Is(err, ErrTargetDown) {
+		t.Fatalf("expect ErrTargetDown, got %v", err)
+	}
+	if p.Failed() != 2 {
+		t.Fatalf("expect 2 failed requests, got %d", p.Failed())
+	}
+
+	p.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.QueryContext(ctx, "SELECT 1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, got %v", err)
+	}
+}
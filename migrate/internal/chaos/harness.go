@@ -0,0 +1,455 @@
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/generate"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/wiring"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+)
+
+// Harness 迁移链路的混沌测试：通过 DoubleWritePool 运行负载，同时运行 binlog 增量修复，
+// 期间按计划注入故障，负载结束后等待双写和修复追平，最后全量校验源库和目标库
+type Harness struct {
+	cfg     *conf.Config
+	profile generate.Profile
+	faults  []Fault
+	latency time.Duration // slow-target 每个请求增加的延迟
+	flip    time.Duration // mode-flip 切换双写模式的间隔
+	settle  time.Duration // 双写没有未完成的写入，并且修复确认的变更数在 settle 内不再增加时认为已经追平
+	timeout time.Duration // 等待修复连接数据源和追平的最长时间
+	reset   bool          // 开始前清空两边的表
+}
+
+type Option func(h *Harness)
+
+// WithFaults 设置注入的故障，默认为 DefaultFaults
+func WithFaults(faults ...Fault) Option {
+	return func(h *Harness) {
+		h.faults = faults
+	}
+}
+
+// WithLatency 设置 slow-target 的延迟
+func WithLatency(d time.Duration) Option {
+	return func(h *Harness) {
+		h.latency = d
+	}
+}
+
+// WithSettle 设置追平的判断时长和最长等待时间
+func WithSettle(settle, timeout time.Duration) Option {
+	return func(h *Harness) {
+		h.settle = settle
+		h.timeout = timeout
+	}
+}
+
+// WithReset 开始前清空源库和目标库的表，只能用于测试环境。
+// 不清空时要求开始前两边已经一致
+func WithReset(reset bool) Option {
+	return func(h *Harness) {
+		h.reset = reset
+	}
+}
+
+func NewHarness(cfg *conf.Config, profile generate.Profile, opts ...Option) *Harness {
+	h := &Harness{
+		cfg:     cfg,
+		profile: profile,
+		faults:  DefaultFaults(profile.Duration),
+		latency: time.Millisecond * 200,
+		flip:    time.Millisecond * 500,
+		settle:  time.Second * 5,
+		timeout: time.Minute * 2,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Result 混沌测试的结果
+type Result struct {
+	Workload      *generate.Report      `json:"workload"`
+	Faults        []Fault               `json:"faults"`
+	DoubleWrite   dwrite.SecondaryStats `json:"double_write"`   // 异步写目标库的统计
+	TargetFailed  int64                 `json:"target_failed"`  // 目标库宕机期间失败的请求数
+	FixerRestarts int                   `json:"fixer_restarts"` // binlog 增量修复的重启次数
+	Position      fix.Position          `json:"position"`       // 追平时修复的位点
+	Verify        *fix.VerifyReport     `json:"verify"`
+}
+
+// Consistent 最终校验时源库和目标库是否一致
+func (r *Result) Consistent() bool {
+	return r.Verify != nil && r.Verify.Consistent()
+}
+
+// env 混沌测试使用的连接
+type env struct {
+	sdb    *gorm.DB // 源库，修复和校验使用
+	tdb    *gorm.DB // 目标库，开始前的准备和最终校验使用，不注入故障
+	fixTDB *gorm.DB // 修复写入的目标库，注入故障
+	wdb    *gorm.DB // 负载使用的双写 *gorm.DB
+	pool   *dwrite.DoubleWritePool
+	target *FaultyPool
+	dbs    []*sql.DB
+}
+
+func (e *env) close() {
+	for _, db := range e.dbs {
+		_ = db.Close()
+	}
+}
+
+// Run 运行混沌测试，源库和目标库最终不一致时不返回错误，通过 Result.Consistent 判断
+func (h *Harness) Run(ctx context.Context) (*Result, error) {
+	if h.profile.Duration <= 0 {
+		return nil, errors.New("混沌测试需要指定负载的运行时长")
+	}
+	for _, f := range h.faults {
+		if f.At+f.Duration > h.profile.Duration {
+			return nil, fmt.Errorf("故障 %s 需要在负载结束前恢复，负载运行 %s", f, h.profile.Duration)
+		}
+	}
+	e, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	defer e.close()
+	if err = h.prepare(ctx, e); err != nil {
+		return nil, err
+	}
+
+	store := fix.NewMemoryPositionStore(fix.Position{})
+	source, err := wiring.NewFixSource(h.cfg, e.sdb, store)
+	if err != nil {
+		return nil, err
+	}
+	flaky := newFlakySource(source)
+	sup := &supervisor{
+		source:    flaky,
+		batchSize: h.cfg.Fix.CDCBatchSize,
+		newFixer: func() *fix.User {
+			return fix.NewFixUser(e.sdb, e.fixTDB, append(wiring.FixOptions(h.cfg),
+				fix.WithSource(flaky), fix.WithPositionStore(store))...)
+		},
+	}
+	fixCtx, stopFixer := context.WithCancel(ctx)
+	fixDone := make(chan struct{})
+	go func() {
+		defer close(fixDone)
+		sup.run(fixCtx)
+	}()
+	stop := func() {
+		stopFixer()
+		<-fixDone
+	}
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-flaky.connected:
+	case <-time.After(h.timeout):
+		return nil, errors.New("binlog 增量修复连接数据源超时")
+	}
+
+	log.Println(fmt.Sprintf("开始混沌测试 负载:%s 故障:%v", h.profile.Name, h.faults))
+	e.pool.SetMode(dwrite.DoubleWrite)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, f := range h.faults {
+		wg.Add(1)
+		go func(f Fault) {
+			defer wg.Done()
+			h.inject(ctx, start, f, e, flaky, sup)
+		}(f)
+	}
+	report, err := generate.NewWorkload(e.wdb, h.profile).Run(ctx)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	e.pool.SetMode(dwrite.DoubleWrite)
+
+	log.Println("负载结束，等待双写和 binlog 增量修复追平")
+	var hw fix.Position
+	if h.cfg.Fix.Source == "binlog" {
+		// 负载已经结束，源库的 binlog 不再增加，直接读取 binlog 时修复的位点需要追到这里
+		if hw, err = fix.MasterStatus(e.sdb); err != nil {
+			return nil, err
+		}
+	}
+	pos, err := h.waitSettle(ctx, e.pool, store, flaky, hw)
+	if err != nil {
+		return nil, err
+	}
+	stop()
+
+	verify, err := fix.NewFixUser(e.sdb, e.tdb).Verify(ctx, h.cfg.Fix.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Workload:      report,
+		Faults:        h.faults,
+		DoubleWrite:   e.pool.Stats(),
+		TargetFailed:  e.target.Failed(),
+		FixerRestarts: sup.restarts(),
+		Position:      pos,
+		Verify:        verify,
+	}, nil
+}
+
+// open 连接源库和目标库，双写和修复写目标库都经过 FaultyPool
+func (h *Harness) open() (*env, error) {
+	e := &env{}
+	var err error
+	defer func() {
+		if err != nil {
+			e.close()
+		}
+	}()
+	var db *sql.DB
+	if e.sdb, err = conf.InitSourceDB(h.cfg); err != nil {
+		return nil, err
+	}
+	if db, err = e.sdb.DB(); err != nil {
+		return nil, err
+	}
+	e.dbs = append(e.dbs, db)
+	if e.tdb, err = conf.InitTargetDB(h.cfg); err != nil {
+		return nil, err
+	}
+	if db, err = e.tdb.DB(); err != nil {
+		return nil, err
+	}
+	e.dbs = append(e.dbs, db)
+
+	var source, target *sql.DB
+	if source, err = conf.OpenDB(h.cfg.Source); err != nil {
+		return nil, fmt.Errorf("连接源库失败 error:%w", err)
+	}
+	e.dbs = append(e.dbs, source)
+	if target, err = conf.OpenDB(h.cfg.Target); err != nil {
+		return nil, fmt.Errorf("连接目标库失败 error:%w", err)
+	}
+	e.dbs = append(e.dbs, target)
+	e.target = NewFaultyPool(target)
+	e.pool = dwrite.NewDoubleWritePool(source, e.target)
+	if e.wdb, err = conf.NewGorm(e.pool, h.cfg.Logger); err != nil {
+		return nil, err
+	}
+	if e.fixTDB, err = conf.NewGorm(e.target, h.cfg.Logger); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// prepare 创建两边的表，WithReset 时清空两边的表，否则要求两边已经一致。
+// 使用 DELETE 而不是 TRUNCATE，避免 DDL 进入 binlog 后修复等待确认
+func (h *Harness) prepare(ctx context.Context, e *env) error {
+	models.Migrate(e.sdb)
+	models.Migrate(e.tdb)
+	if h.reset {
+		for _, db := range []*gorm.DB{e.sdb, e.tdb} {
+			err := db.WithContext(ctx).Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&models.User{}).Error
+			if err != nil {
+				return fmt.Errorf("清空表失败 error:%w", err)
+			}
+		}
+		return nil
+	}
+	report, err := fix.NewFixUser(e.sdb, e.tdb).Verify(ctx, h.cfg.Fix.BatchSize)
+	if err != nil {
+		return err
+	}
+	if !report.Consistent() {
+		return fmt.Errorf("开始前源库和目标库不一致 missing:%d extra:%d different:%d，可以先修复或者使用 WithReset 清空两边的表",
+			report.Missing, report.Extra, report.Different)
+	}
+	return nil
+}
+
+// inject 在负载开始 f.At 之后注入故障，持续 f.Duration 后恢复，ctx 取消时立即恢复
+func (h *Harness) inject(ctx context.Context, start time.Time, f Fault, e *env, source *flakySource, sup *supervisor) {
+	if sleepUntil(ctx, start.Add(f.At)) != nil {
+		return
+	}
+	log.Println("注入故障:", f)
+	var restore func()
+	switch f.Kind {
+	case TargetDown:
+		e.target.SetDown(true)
+		restore = func() { e.target.SetDown(false) }
+	case SlowTarget:
+		e.target.SetLatency(h.latency)
+		restore = func() { e.target.SetLatency(0) }
+	case KillFixer:
+		sup.kill()
+		restore = sup.resume
+	case SourceDisconnect:
+		source.disconnect()
+		restore = source.restore
+	case ModeFlip:
+		restore = h.flipMode(ctx, e.pool)
+	}
+	_ = sleepUntil(ctx, start.Add(f.At+f.Duration))
+	restore()
+	log.Println("恢复故障:", f)
+}
+
+// flipMode 按间隔在 source-write 和 double-write 之间切换，返回停止切换的函数。
+// 不切换到 transition 和 target-write，这两个模式以目标库为准，binlog 增量修复无法修复
+func (h *Harness) flipMode(ctx context.Context, pool *dwrite.DoubleWritePool) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(h.flip)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if pool.Mode() == dwrite.DoubleWrite {
+					pool.SetMode(dwrite.SourceWrite)
+				} else {
+					pool.SetMode(dwrite.DoubleWrite)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		pool.SetMode(dwrite.DoubleWrite)
+	}
+}
+
+// waitSettle 等待双写没有未完成的写入，修复确认的变更数在 settle 内不再增加，并且修复的位点不早于 hw。
+// Kafka 的 FlatMessage 没有 binlog 文件位点，位点存储几乎不变，不能按位点判断是否追平；
+// hw 为空时不比较位点，例如 canal 和 Kafka 数据源
+func (h *Harness) waitSettle(ctx context.Context, pool *dwrite.DoubleWritePool, store fix.PositionStore,
+	source *flakySource, hw fix.Position) (fix.Position, error) {
+	deadline := time.Now().Add(h.timeout)
+	last, since := source.acked.Load(), time.Now()
+	ticker := time.NewTicker(time.Millisecond * 200)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fix.Position{}, ctx.Err()
+		case <-ticker.C:
+		}
+		pos, err := store.Load()
+		if err != nil {
+			return pos, err
+		}
+		acked := source.acked.Load()
+		if acked != last || pool.Stats().Pending > 0 || (!hw.IsZero() && pos.Before(hw)) {
+			last, since = acked, time.Now()
+		} else if time.Since(since) >= h.settle {
+			return pos, nil
+		}
+		if time.Now().After(deadline) {
+			return pos, fmt.Errorf("等待 binlog 增量修复追平超时 position:%s high-water:%s acked:%d", pos, hw, acked)
+		}
+	}
+}
+
+// supervisor 运行 binlog 增量修复，修复出错退出后自动重启，kill 后暂停直到 resume，
+// 重启的修复共用位点存储，从上次保存的位点继续
+type supervisor struct {
+	source    *flakySource
+	batchSize int
+	newFixer  func() *fix.User
+
+	cancel  context.CancelFunc // 取消正在运行的修复
+	paused  chan struct{}      // 不为 nil 时暂停，关闭后继续
+	restart int
+	lock    sync.Mutex
+}
+
+func (s *supervisor) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.lock.Lock()
+		paused := s.paused
+		runCtx, cancel := context.WithCancel(ctx)
+		if paused == nil {
+			s.cancel = cancel
+		}
+		s.lock.Unlock()
+		if paused != nil {
+			cancel()
+			select {
+			case <-ctx.Done():
+			case <-paused:
+			}
+			continue
+		}
+
+		err := s.newFixer().FixIncByCDC(runCtx, s.batchSize)
+		cancel()
+		_ = s.source.Source.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		s.lock.Lock()
+		s.restart++
+		s.lock.Unlock()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Println(fmt.Errorf("binlog 增量修复退出，准备重启 error:%w", err))
+			_ = sleepUntil(ctx, time.Now().Add(time.Second))
+		}
+	}
+}
+
+// kill 停止正在运行的修复，直到 resume 后重启
+func (s *supervisor) kill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.paused == nil {
+		s.paused = make(chan struct{})
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *supervisor) resume() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+}
+
+func (s *supervisor) restarts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.restart
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+//go:build integration
+
+package chaos
+
+import (
+	"context"
+	"flag"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/generate"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHarness 需要本地的源库和目标库，配置通过 MIGRATE_CONFIG 和 MIGRATE_* 环境变量指定，
+// 配置文件中没有 DSN，需要设置 MIGRATE_SOURCE_DSN 和 MIGRATE_TARGET_DSN，会清空两边的 users 表：
+// MIGRATE_CONFIG=$PWD/conf/migrate.yaml MIGRATE_FIX_SOURCE=binlog go test -tags integration -run TestHarness -v ./internal/chaos
+func TestHarness(t *testing.T) {
+	if os.Getenv("MIGRATE_SOURCE_DSN") == "" {
+		t.Skip("没有配置 MIGRATE_SOURCE_DSN")
+	}
+	cfg, err := conf.Load(flag.NewFlagSet("chaos", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := generate.LookupProfile("write-heavy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Duration, p.QPS, p.Concurrency = 30*time.Second, 100, 4
+
+	testCases := []struct {
+		name   string
+		faults []Fault
+	}{
+		{name: "all", faults: DefaultFaults(p.Duration)},
+		{name: "target down and killed fixer", faults: []Fault{
+			{Kind: TargetDown, At: 5 * time.Second, Duration: 10 * time.Second},
+			{Kind: KillFixer, At: 10 * time.Second, Duration: 10 * time.Second},
+		}},
+		{name: "mode flip with slow target", faults: []Fault{
+			{Kind: SlowTarget, At: 5 * time.Second, Duration: 20 * time.Second},
+			{Kind: ModeFlip, At: 5 * time.Second, Duration: 20 * time.Second},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			result, err := NewHarness(cfg, p, WithFaults(tc.faults...), WithReset(true)).Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Log(result.Workload)
+			v := result.Verify
+			if !result.Consistent() {
+				t.Fatalf("expect consistent, missing:%d %v extra:%d %v different:%d %v",
+					v.Missing, v.Samples.Missing, v.Extra, v.Samples.Extra, v.Different, v.Samples.Different)
+			}
+			if v.Source == 0 {
+				t.Fatal("expect rows written by the workload")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTargetDown 模拟目标库宕机时返回的错误
+var ErrTargetDown = errors.New("chaos: 目标库不可用")
+
+// FaultyPool 包装目标库的连接池，可以模拟宕机和慢查询，
+// 同时给 DoubleWritePool 和修复使用，实现 gorm.ConnPool 和 gorm.TxBeginner
+type FaultyPool struct {
+	db      *sql.DB
+	down    atomic.Bool
+	latency atomic.Int64
+	failed  atomic.Int64 // 因为宕机失败的请求数
+}
+
+func NewFaultyPool(db *sql.DB) *FaultyPool {
+	return &FaultyPool{db: db}
+}
+
+// SetDown 设置目标库是否宕机，宕机时所有请求立即返回 ErrTargetDown
+func (p *FaultyPool) SetDown(down bool) {
+	p.down.Store(down)
+}
+
+// SetLatency 设置每个请求额外的延迟，0 为不延迟
+func (p *FaultyPool) SetLatency(d time.Duration) {
+	p.latency.Store(int64(d))
+}
+
+// Failed 因为宕机失败的请求数
+func (p *FaultyPool) Failed() int64 {
+	return p.failed.Load()
+}
+
+// inject 按当前的故障延迟或者返回错误
+func (p *FaultyPool) inject(ctx context.Context) error {
+	if d := time.Duration(p.latency.Load()); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if p.down.Load() {
+		p.failed.Add(1)
+		return ErrTargetDown
+	}
+	return nil
+}
+
+func (p *FaultyPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if err := p.inject(ctx); err != nil {
+		return nil, err
+	}
+	return p.db.PrepareContext(ctx, query)
+}
+
+func (p *FaultyPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := p.inject(ctx); err != nil {
+		return nil, err
+	}
+	return p.db.ExecContext(ctx, query, args...)
+}
+
+func (p *FaultyPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if err := p.inject(ctx); err != nil {
+		return nil, err
+	}
+	return p.db.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext 无法直接构造带错误的 *sql.Row，故障时使用已经取消的 ctx 查询，Scan 时返回 context.Canceled
+func (p *FaultyPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if err := p.inject(ctx); err != nil {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		return p.db.QueryRowContext(canceled, query, args...)
+	}
+	return p.db.QueryRowContext(ctx, query, args...)
+}
+
+// BeginTx 事务开始后的语句直接使用目标库的连接，不再注入故障
+func (p *FaultyPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if err := p.inject(ctx); err != nil {
+		return nil, err
+	}
+	return p.db.BeginTx(ctx, opts)
+}
@@ -0,0 +1,67 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSourceDisconnected 模拟 binlog 数据源断开时返回的错误
+var ErrSourceDisconnected = errors.New("chaos: binlog 数据源断开")
+
+// flakySource 包装 canal、Kafka 或者 binlog 数据源，可以模拟连接断开，
+// 断开期间 Fetch 和 Connect 都返回 ErrSourceDisconnected，修复会按重试配置重连
+type flakySource struct {
+	fix.Source
+	down      atomic.Bool
+	acked     atomic.Int64  // 已经确认的变更数，修复重启后继续累加，用于判断修复是否追平
+	connected chan struct{} // 第一次连接成功后关闭
+	once      sync.Once
+}
+
+func newFlakySource(s fix.Source) *flakySource {
+	return &flakySource{
+		Source:    s,
+		connected: make(chan struct{}),
+	}
+}
+
+func (s *flakySource) Connect(filter string) error {
+	if s.down.Load() {
+		return ErrSourceDisconnected
+	}
+	if err := s.Source.Connect(filter); err != nil {
+		return err
+	}
+	s.once.Do(func() { close(s.connected) })
+	return nil
+}
+
+func (s *flakySource) Fetch(ctx context.Context, batchSize int) (*fix.Batch, error) {
+	if s.down.Load() {
+		return nil, ErrSourceDisconnected
+	}
+	return s.Source.Fetch(ctx, batchSize)
+}
+
+// Ack 确认成功后累加批次中的变更数
+func (s *flakySource) Ack(b *fix.Batch) error {
+	if err := s.Source.Ack(b); err != nil {
+		return err
+	}
+	s.acked.Add(int64(len(b.Events)))
+	return nil
+}
+
+// disconnect 断开数据源，同时关闭底层的连接
+func (s *flakySource) disconnect() {
+	s.down.Store(true)
+	_ = s.Source.Close()
+}
+
+// restore 允许重新连接数据源
+func (s *flakySource) restore() {
+	s.down.Store(false)
+}
@@ -0,0 +1,66 @@
+package chaos
+
+import (
+	"context"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"github.com/xuqil/experiments/migrate/pkg/dwrite"
+	"testing"
+	"time"
+)
+
+// ackSource 只实现 Ack 的数据源
+type ackSource struct {
+	fix.Source
+}
+
+func (ackSource) Ack(*fix.Batch) error {
+	return nil
+}
+
+func TestWaitSettle(t *testing.T) {
+	source, target := dbtest.NewFakeDB(), dbtest.NewFakeDB()
+	t.Cleanup(func() {
+		_ = source.Close()
+		_ = target.Close()
+	})
+	pool := dwrite.NewDoubleWritePool(source.DB, target.DB)
+	h := &Harness{settle: time.Millisecond * 300, timeout: time.Second * 5}
+
+	t.Run("acked", func(t *testing.T) {
+		// Kafka 的 FlatMessage 没有 binlog 文件位点，位点存储一直为空
+		store := fix.NewMemoryPositionStore(fix.Position{})
+		flaky := newFlakySource(ackSource{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 8; i++ {
+				time.Sleep(time.Millisecond * 100)
+				_ = flaky.Ack(&fix.Batch{Events: make([]cdc.ChangeEvent, 1)})
+			}
+		}()
+		if _, err := h.waitSettle(context.Background(), pool, store, flaky, fix.Position{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		default:
+			t.Fatalf("settled before all batches acked, acked %d", flaky.acked.Load())
+		}
+	})
+
+	t.Run("high-water", func(t *testing.T) {
+		hw := fix.Position{File: "mysql-bin.000001", Offset: 200}
+		store := fix.NewMemoryPositionStore(fix.Position{File: "mysql-bin.000001", Offset: 100})
+		time.AfterFunc(time.Millisecond*600, func() { _ = store.Save(hw) })
+		start := time.Now()
+		pos, err := h.waitSettle(context.Background(), pool, store, newFlakySource(ackSource{}), hw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != hw || time.Since(start) < time.Millisecond*600 {
+			t.Fatalf("expect settled at %s after catching up, got %s after %s", hw, pos, time.Since(start))
+		}
+	})
+}
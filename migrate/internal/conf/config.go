@@ -0,0 +1,264 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config 迁移工具的配置，conf 标签为配置文件中的路径，usage 标签为命令行参数的说明
+type Config struct {
+	Source        DB       `conf:"source"`         // 源库
+	Target        DB       `conf:"target"`         // 目标库
+	SourceReplica DB       `conf:"source_replica"` // 源库的从库，DSN 为空时不使用
+	TargetReplica DB       `conf:"target_replica"` // 目标库的从库，DSN 为空时不使用
+	Logger        Logger   `conf:"logger"`
+	Canal         Canal    `conf:"canal"`
+	Kafka         Kafka    `conf:"kafka"`
+	Binlog        Binlog   `conf:"binlog"`
+	Fix           Fix      `conf:"fix"`
+	Copy          Copy     `conf:"copy"`
+	Throttle      Throttle `conf:"throttle"`
+	Server        Server   `conf:"server"`
+}
+
+// DB 数据库连接和连接池
+type DB struct {
+	DSN             string        `conf:"dsn" usage:"数据库 DSN，例如 user:password@tcp(127.0.0.1:3306)/test?parseTime=True&loc=Local"`
+	MaxIdleConns    int           `conf:"max_idle_conns" usage:"最大空闲连接数"`
+	MaxOpenConns    int           `conf:"max_open_conns" usage:"最大连接数，0 表示不限制"`
+	ConnMaxLifetime time.Duration `conf:"conn_max_lifetime" usage:"连接的最长存活时间，0 表示不限制"`
+}
+
+// Endpoint 解析 DSN 中的地址和账号，伪装成从库读取 binlog 时使用
+func (d DB) Endpoint() (host string, port uint16, user, password string, err error) {
+	c, err := mysql.ParseDSN(d.DSN)
+	if err != nil {
+		return "", 0, "", "", err
+	}
+	host, portStr, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return "", 0, "", "", fmt.Errorf("DSN 的地址 %s 错误 error:%w", c.Addr, err)
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, "", "", fmt.Errorf("DSN 的端口 %s 错误 error:%w", portStr, err)
+	}
+	return host, uint16(p), c.User, c.Passwd, nil
+}
+
+// Location DSN 的 loc，读取源库时按这个时区解析时间，没有设置时为 UTC
+func (d DB) Location() (*time.Location, error) {
+	c, err := mysql.ParseDSN(d.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return c.Loc, nil
+}
+
+// Logger gorm 的日志
+type Logger struct {
+	Level         string        `conf:"level" usage:"SQL 日志级别：silent、error、warn、info"`
+	SlowThreshold time.Duration `conf:"slow_threshold" usage:"慢 SQL 阈值"`
+}
+
+// Canal canal server 的地址和实例
+type Canal struct {
+	Host        string        `conf:"host" usage:"canal server 地址"`
+	Port        int           `conf:"port" usage:"canal server 端口"`
+	Username    string        `conf:"username" usage:"canal 用户名"`
+	Password    string        `conf:"password" usage:"canal 密码"`
+	Destination string        `conf:"destination" usage:"canal 实例"`
+	SoTimeout   time.Duration `conf:"so_timeout" usage:"读取超时"`
+	IdleTimeout time.Duration `conf:"idle_timeout" usage:"空闲超时"`
+}
+
+// Kafka canal 投递到 Kafka 时的消费配置
+type Kafka struct {
+	Brokers []string `conf:"brokers" usage:"Kafka 地址，逗号分隔"`
+	Group   string   `conf:"group" usage:"消费者组"`
+	Topics  []string `conf:"topics" usage:"canal 投递的 topic，逗号分隔"`
+	Format  string   `conf:"format" usage:"消息格式：flat（canal.mq.flatMessage = true）、protobuf"`
+}
+
+// Binlog 伪装成从库直接读取源库的 binlog，地址和账号取自源库的 DSN
+type Binlog struct {
+	ServerID uint32 `conf:"server_id" usage:"伪装的从库 server_id，不能与其它从库重复"`
+	GTID     bool   `conf:"gtid" usage:"是否按 GTID 同步"`
+}
+
+// Fix 数据修复的批次和限速
+type Fix struct {
+	Source        string        `conf:"source" usage:"增量修复的 binlog 数据源：canal、kafka、binlog"`
+	Filter        string        `conf:"filter" usage:"订阅的表，canal 的正则格式"`
+	PositionFile  string        `conf:"position_file" usage:"保存 binlog 位点的文件"`
+	BatchSize     int           `conf:"batch_size" usage:"全量修复每批比对的行数"`
+	CDCBatchSize  int           `conf:"cdc_batch_size" usage:"增量修复每次获取的 binlog 条数"`
+	Sleep         time.Duration `conf:"sleep" usage:"每批之间的休眠时间，用于限速"`
+	Workers       int           `conf:"workers" usage:"写入目标库的并发数"`
+	FlushSize     int           `conf:"flush_size" usage:"攒批写入目标库的行数"`
+	FlushInterval time.Duration `conf:"flush_interval" usage:"攒批的最长等待时间，0 表示每批 binlog 写入一次"`
+	Retries       int           `conf:"retries" usage:"数据源重连次数，0 表示一直重试"`
+	RetryBackoff  time.Duration `conf:"retry_backoff" usage:"数据源重连的初始退避时长"`
+	RowImage      bool          `conf:"row_image" usage:"是否直接使用 binlog 的行数据，需要 binlog_row_image = FULL"`
+	DDLAllow      []string      `conf:"ddl_allow" usage:"允许直接在目标库执行的 DDL 类型，逗号分隔"`
+	SkipDeleted   bool          `conf:"skip_deleted" usage:"是否忽略源库已经软删除的行，忽略时目标库只保留未删除的行"`
+}
+
+// Copy 全量复制的并发和限速
+type Copy struct {
+	Workers   int           `conf:"workers" usage:"并发复制的数量，每个并发占用源库的一个快照事务"`
+	ChunkSize int           `conf:"chunk_size" usage:"每个分片的 ID 范围"`
+	BatchSize int           `conf:"batch_size" usage:"每次写入目标库的行数"`
+	Sleep     time.Duration `conf:"sleep" usage:"每个分片之间的休眠时间，用于限速"`
+}
+
+// Throttle 全量复制、全量修复、按 updated_at 增量修复和校验的自适应限速，
+// 任意指标超过阈值时逐步增加每批之间的休眠时长，超过阈值的 2 倍时暂停
+type Throttle struct {
+	Replicas          []string      `conf:"replicas" usage:"需要监控复制延迟的从库 DSN，逗号分隔"`
+	MaxLag            time.Duration `conf:"max_lag" usage:"从库复制延迟的阈值，0 表示不检查"`
+	MaxThreadsRunning int64         `conf:"max_threads_running" usage:"源库 Threads_running 的阈值，0 表示不检查"`
+	MaxReadLatency    time.Duration `conf:"max_read_latency" usage:"读取源库一批数据的平均延迟的阈值，0 表示不检查"`
+	MinBackoff        time.Duration `conf:"min_backoff" usage:"超过阈值时每批之间的初始休眠时长"`
+	MaxBackoff        time.Duration `conf:"max_backoff" usage:"超过阈值时每批之间的最长休眠时长"`
+	Interval          time.Duration `conf:"interval" usage:"检查指标的间隔"`
+}
+
+// Server cmd/server 的监听地址和管理接口
+type Server struct {
+	Addr       string `conf:"addr" usage:"业务服务和管理接口的监听地址"`
+	AdminToken string `conf:"admin_token" usage:"管理接口的 token，为空时不开启管理接口"`
+}
+
+// Default 返回本地开发环境的默认配置，DSN 需要通过配置文件、环境变量或者命令行参数指定
+func Default() *Config {
+	return &Config{
+		Source:        DB{MaxIdleConns: 20, MaxOpenConns: 100},
+		Target:        DB{MaxIdleConns: 20, MaxOpenConns: 100},
+		SourceReplica: DB{MaxIdleConns: 5, MaxOpenConns: 10},
+		TargetReplica: DB{MaxIdleConns: 5, MaxOpenConns: 10},
+		Logger:        Logger{Level: "silent", SlowThreshold: time.Second},
+		Canal: Canal{
+			Host:        "127.0.0.1",
+			Port:        11111,
+			Destination: "example",
+			SoTimeout:   time.Minute,
+			IdleTimeout: time.Hour,
+		},
+		Kafka:  Kafka{Group: "migrate-fix", Format: "flat"},
+		Binlog: Binlog{ServerID: 1001},
+		Fix: Fix{
+			Source:       "canal",
+			Filter:       "test\\.users",
+			PositionFile: "binlog.pos",
+			BatchSize:    1000,
+			CDCBatchSize: 100,
+			Sleep:        time.Millisecond * 50,
+			Workers:      1,
+			FlushSize:    100,
+			Retries:      10,
+			RetryBackoff: time.Second,
+		},
+		Copy: Copy{
+			Workers:   4,
+			ChunkSize: 10000,
+			BatchSize: 1000,
+		},
+		Throttle: Throttle{
+			MaxLag:     time.Second * 10,
+			MinBackoff: time.Millisecond * 100,
+			MaxBackoff: time.Second * 10,
+			Interval:   time.Second,
+		},
+		Server: Server{Addr: ":8080"},
+	}
+}
+
+// Validate 校验配置，返回所有不合法的配置项
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	for _, db := range []struct {
+		key      string
+		optional bool
+		DB
+	}{{"source", false, c.Source}, {"target", false, c.Target},
+		{"source_replica", true, c.SourceReplica}, {"target_replica", true, c.TargetReplica}} {
+		if db.DSN == "" {
+			if !db.optional {
+				errs = append(errs, fmt.Errorf("%s.dsn 不能为空", db.key))
+			}
+		} else if _, err := mysql.ParseDSN(db.DSN); err != nil {
+			errs = append(errs, fmt.Errorf("%s.dsn 格式错误 error:%w", db.key, err))
+		}
+		check(db.MaxIdleConns >= 0, "%s.max_idle_conns 不能小于 0", db.key)
+		check(db.MaxOpenConns >= 0, "%s.max_open_conns 不能小于 0", db.key)
+		check(db.MaxOpenConns == 0 || db.MaxIdleConns <= db.MaxOpenConns,
+			"%s.max_idle_conns 不能大于 max_open_conns", db.key)
+		check(db.ConnMaxLifetime >= 0, "%s.conn_max_lifetime 不能小于 0", db.key)
+	}
+
+	_, ok := logLevels[strings.ToLower(c.Logger.Level)]
+	check(ok, "logger.level 只能是 silent、error、warn、info，当前为 %q", c.Logger.Level)
+	check(c.Logger.SlowThreshold >= 0, "logger.slow_threshold 不能小于 0")
+
+	switch c.Fix.Source {
+	case "canal":
+		check(c.Canal.Host != "", "canal.host 不能为空")
+		check(c.Canal.Port > 0 && c.Canal.Port < 65536, "canal.port 必须在 1-65535 之间，当前为 %d", c.Canal.Port)
+		check(c.Canal.Destination != "", "canal.destination 不能为空")
+		check(c.Canal.SoTimeout > 0, "canal.so_timeout 必须大于 0")
+		check(c.Canal.IdleTimeout > 0, "canal.idle_timeout 必须大于 0")
+	case "kafka":
+		check(len(c.Kafka.Brokers) > 0, "kafka.brokers 不能为空")
+		check(len(c.Kafka.Topics) > 0, "kafka.topics 不能为空")
+		check(c.Kafka.Group != "", "kafka.group 不能为空")
+		check(c.Kafka.Format == "flat" || c.Kafka.Format == "protobuf",
+			"kafka.format 只能是 flat、protobuf，当前为 %q", c.Kafka.Format)
+	case "binlog":
+		check(c.Binlog.ServerID > 0, "binlog.server_id 必须大于 0")
+		if c.Source.DSN != "" {
+			if _, _, _, _, err := c.Source.Endpoint(); err != nil {
+				errs = append(errs, fmt.Errorf("source.dsn 不能用于读取 binlog error:%w", err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("fix.source 只能是 canal、kafka、binlog，当前为 %q", c.Fix.Source))
+	}
+
+	check(c.Fix.BatchSize > 0, "fix.batch_size 必须大于 0")
+	check(c.Fix.CDCBatchSize > 0, "fix.cdc_batch_size 必须大于 0")
+	check(c.Fix.Sleep >= 0, "fix.sleep 不能小于 0")
+	check(c.Fix.Workers > 0, "fix.workers 必须大于 0")
+	check(c.Fix.FlushSize > 0, "fix.flush_size 必须大于 0")
+	check(c.Fix.FlushInterval >= 0, "fix.flush_interval 不能小于 0")
+	check(c.Fix.Retries >= 0, "fix.retries 不能小于 0")
+	check(c.Fix.RetryBackoff >= 0, "fix.retry_backoff 不能小于 0")
+	check(c.Fix.PositionFile != "", "fix.position_file 不能为空")
+	check(c.Copy.Workers > 0, "copy.workers 必须大于 0")
+	check(c.Copy.ChunkSize > 0, "copy.chunk_size 必须大于 0")
+	check(c.Copy.BatchSize > 0, "copy.batch_size 必须大于 0")
+	check(c.Copy.Sleep >= 0, "copy.sleep 不能小于 0")
+	for i, dsn := range c.Throttle.Replicas {
+		if _, err := mysql.ParseDSN(dsn); err != nil {
+			errs = append(errs, fmt.Errorf("throttle.replicas 第 %d 个 DSN 格式错误 error:%w", i+1, err))
+		}
+	}
+	check(c.Throttle.MaxLag >= 0, "throttle.max_lag 不能小于 0")
+	check(c.Throttle.MaxThreadsRunning >= 0, "throttle.max_threads_running 不能小于 0")
+	check(c.Throttle.MaxReadLatency >= 0, "throttle.max_read_latency 不能小于 0")
+	check(c.Throttle.MinBackoff > 0, "throttle.min_backoff 必须大于 0")
+	check(c.Throttle.MaxBackoff >= c.Throttle.MinBackoff, "throttle.max_backoff 不能小于 min_backoff")
+	check(c.Throttle.Interval > 0, "throttle.interval 必须大于 0")
+	check(c.Server.Addr != "", "server.addr 不能为空")
+	return errors.Join(errs...)
+}
@@ -2,83 +2,136 @@ package conf
 
 import (
 	"database/sql"
+	"fmt"
+	"github.com/withlin/canal-go/client"
 	"github.com/xuqil/experiments/migrate/pkg/dwrite"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"log"
 	"os"
-	"time"
+	"strings"
 )
 
-var (
-	sDsn = "root:Mysql_1234@tcp(127.0.0.1:3306)/test?charset=utf8mb4&parseTime=True&loc=Local"
-	tDsn = "root:Mysql_1234@tcp(127.0.0.1:3307)/test?charset=utf8mb4&parseTime=True&loc=Local"
-)
+var logLevels = map[string]logger.LogLevel{
+	"silent": logger.Silent,
+	"error":  logger.Error,
+	"warn":   logger.Warn,
+	"info":   logger.Info,
+}
 
-var l = logger.New(
-	log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-	logger.Config{
-		SlowThreshold:             time.Second,   // Slow SQL threshold
-		LogLevel:                  logger.Silent, // Log level
-		IgnoreRecordNotFoundError: true,          // Ignore ErrRecordNotFound error for logger
-		ParameterizedQueries:      true,          // Don't include params in the SQL log
-		Colorful:                  false,         // Disable color
-	},
-)
+// newLogger 按配置创建 gorm 的日志
+func newLogger(c Logger) logger.Interface {
+	return logger.New(
+		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
+		logger.Config{
+			SlowThreshold:             c.SlowThreshold,                     // Slow SQL threshold
+			LogLevel:                  logLevels[strings.ToLower(c.Level)], // Log level
+			IgnoreRecordNotFoundError: true,                                // Ignore ErrRecordNotFound error for logger
+			ParameterizedQueries:      true,                                // Don't include params in the SQL log
+			Colorful:                  false,                               // Disable color
+		},
+	)
+}
 
-// InitSourceDB 初始化源库 *gorm.DB
-func InitSourceDB() *gorm.DB {
-	dia := mysql.Open(sDsn)
-	db, err := gorm.Open(dia, &gorm.Config{
-		Logger: l,
+// OpenDB 按配置打开数据库连接池
+func OpenDB(c DB) (*sql.DB, error) {
+	db, err := sql.Open("mysql", c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	return db, nil
+}
+
+// openGorm 打开数据库的 *gorm.DB
+func openGorm(c DB, l Logger) (*gorm.DB, error) {
+	sqlDB, err := OpenDB(c)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: c.DSN, Conn: sqlDB}), &gorm.Config{
+		Logger: newLogger(l),
 	})
 	if err != nil {
-		log.Fatalln(err)
+		_ = sqlDB.Close()
+		return nil, err
 	}
-	return db
+	return db, nil
 }
 
-// InitTargetDB 初始化目标库 *gorm.DB
-func InitTargetDB() *gorm.DB {
-	dia := mysql.Open(tDsn)
-	db, err := gorm.Open(dia, &gorm.Config{
-		Logger: l,
+// NewGorm 使用已有的连接创建 *gorm.DB，例如 DoubleWritePool
+func NewGorm(conn gorm.ConnPool, l Logger) (*gorm.DB, error) {
+	return gorm.Open(mysql.New(mysql.Config{Conn: conn}), &gorm.Config{
+		Logger: newLogger(l),
 	})
+}
+
+// InitSourceDB 初始化源库 *gorm.DB
+func InitSourceDB(cfg *Config) (*gorm.DB, error) {
+	db, err := openGorm(cfg.Source, cfg.Logger)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("连接源库失败 error:%w", err)
 	}
-	return db
+	return db, nil
 }
 
-// InitDoubleWriteDB 初始化双写 *gorm.DB 和 *DoubleWritePool
-func InitDoubleWriteDB() (*gorm.DB, *dwrite.DoubleWritePool) {
-	sdb, err := sql.Open("mysql", sDsn)
+// InitTargetDB 初始化目标库 *gorm.DB
+func InitTargetDB(cfg *Config) (*gorm.DB, error) {
+	db, err := openGorm(cfg.Target, cfg.Logger)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("连接目标库失败 error:%w", err)
+	}
+	return db, nil
+}
+
+// InitReplicaDBs 初始化源库和目标库的从库，没有配置 DSN 的从库返回 nil，修复时使用主库
+func InitReplicaDBs(cfg *Config) (*gorm.DB, *gorm.DB, error) {
+	var (
+		sdb, tdb *gorm.DB
+		err      error
+	)
+	if cfg.SourceReplica.DSN != "" {
+		if sdb, err = openGorm(cfg.SourceReplica, cfg.Logger); err != nil {
+			return nil, nil, fmt.Errorf("连接源库的从库失败 error:%w", err)
+		}
+	}
+	if cfg.TargetReplica.DSN != "" {
+		if tdb, err = openGorm(cfg.TargetReplica, cfg.Logger); err != nil {
+			return nil, nil, fmt.Errorf("连接目标库的从库失败 error:%w", err)
+		}
 	}
-	sdb.SetMaxIdleConns(20)
-	sdb.SetMaxOpenConns(100)
+	return sdb, tdb, nil
+}
 
-	tdb, err := sql.Open("mysql", tDsn)
+// InitDoubleWriteDB 初始化双写 *gorm.DB 和 *DoubleWritePool
+func InitDoubleWriteDB(cfg *Config) (*gorm.DB, *dwrite.DoubleWritePool, error) {
+	sdb, err := OpenDB(cfg.Source)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, nil, fmt.Errorf("连接源库失败 error:%w", err)
+	}
+	tdb, err := OpenDB(cfg.Target)
+	if err != nil {
+		_ = sdb.Close()
+		return nil, nil, fmt.Errorf("连接目标库失败 error:%w", err)
 	}
-	tdb.SetMaxIdleConns(20)
-	tdb.SetMaxOpenConns(100)
 
 	pool := dwrite.NewDoubleWritePool(sdb, tdb)
 	pool.SetMode(dwrite.SourceWrite)
-	dial := mysql.New(mysql.Config{
-		Conn: pool,
-	})
-
-	db, err := gorm.Open(dial, &gorm.Config{
-		Logger: l,
-	})
+	db, err := NewGorm(pool, cfg.Logger)
 	if err != nil {
-		log.Fatalln(err)
+		_ = sdb.Close()
+		_ = tdb.Close()
+		return nil, nil, err
 	}
 
-	return db, pool
+	return db, pool, nil
+}
+
+// NewCanalConnector 按配置创建 canal 连接，需要调用 Connect 连接 canal server
+func NewCanalConnector(c Canal) *client.SimpleCanalConnector {
+	return client.NewSimpleCanalConnector(c.Host, c.Port, c.Username, c.Password, c.Destination,
+		int32(c.SoTimeout.Milliseconds()), int32(c.IdleTimeout.Milliseconds()))
 }
@@ -0,0 +1,270 @@
+package conf
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix 环境变量的前缀，配置项 source.dsn 对应环境变量 MIGRATE_SOURCE_DSN
+const envPrefix = "MIGRATE_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load 按 默认配置、配置文件、环境变量、命令行参数 的顺序加载配置，后面的覆盖前面的，最后校验配置。
+// 配置文件通过 -config 或者环境变量 MIGRATE_CONFIG 指定，支持 YAML 和 TOML；
+// 每个配置项都可以用同名的命令行参数覆盖，例如 -source.dsn、-fix.batch_size。
+// fs 可以事先注册子命令自己的参数，解析后通过 fs.Args() 获取剩余的参数
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg, err := load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("配置错误:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// LoadAdmin 与 Load 相同的方式加载配置，只用于请求 cmd/server 的管理接口，
+// 不校验数据库等其它配置项，server.admin_token 不能为空
+func LoadAdmin(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg, err := load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.AdminToken == "" {
+		return nil, fmt.Errorf("配置错误:\nserver.admin_token 不能为空")
+	}
+	return cfg, nil
+}
+
+// load 加载配置，不校验
+func load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	items := settings(cfg)
+
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "配置文件，支持 YAML 和 TOML (MIGRATE_CONFIG)")
+	flags := make(map[string]string, len(items))
+	for _, it := range items {
+		fv := &flagValue{key: it.key, isBool: it.value.Kind() == reflect.Bool, set: flags}
+		if !it.value.IsZero() {
+			fv.def = format(it.value)
+		}
+		fs.Var(fv, it.key, fmt.Sprintf("%s (%s)", it.usage, envName(it.key)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		values, err := readFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err = apply(items, values, "配置文件 "+*path); err != nil {
+			return nil, err
+		}
+	}
+	env := make(map[string]string)
+	for _, it := range items {
+		if v, ok := os.LookupEnv(envName(it.key)); ok {
+			env[it.key] = v
+		}
+	}
+	if err := apply(items, env, "环境变量"); err != nil {
+		return nil, err
+	}
+	if err := apply(items, flags, "命令行参数"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setting 一个配置项，key 为配置文件中的路径，例如 source.dsn
+type setting struct {
+	key   string
+	usage string
+	value reflect.Value
+}
+
+// settings 按 conf 标签展开配置的所有配置项
+func settings(cfg *Config) []setting {
+	var items []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := prefix + f.Tag.Get("conf")
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			items = append(items, setting{key: key, usage: f.Tag.Get("usage"), value: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return items
+}
+
+// apply 将字符串形式的配置写入配置项，from 为配置的来源，用于错误信息
+func apply(items []setting, values map[string]string, from string) error {
+	index := make(map[string]reflect.Value, len(items))
+	for _, it := range items {
+		index[it.key] = it.value
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		v, ok := index[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: 未知的配置项 %s", from, key))
+			continue
+		}
+		if err := parse(v, values[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: 配置项 %s 的值 %q 错误 error:%w", from, key, values[key], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parse 按配置项的类型解析字符串，列表以逗号分隔
+func parse(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("不支持的配置类型 %s", v.Type())
+	}
+	return nil
+}
+
+// format 将配置项转为字符串，与 parse 相反
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// readFile 读取配置文件，按扩展名选择格式，展开为 key 为配置项路径的字符串
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	case ".toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		return nil, fmt.Errorf("不支持的配置文件格式 %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析配置文件 %s 失败 error:%w", path, err)
+	}
+	values := make(map[string]string)
+	flatten(m, "", values)
+	return values, nil
+}
+
+// flatten 将嵌套的配置展开，列表转为逗号分隔的字符串
+func flatten(m map[string]any, prefix string, values map[string]string) {
+	for k, v := range m {
+		key := prefix + k
+		switch val := v.(type) {
+		case map[string]any:
+			flatten(val, key+".", values)
+		case []any:
+			items := make([]string, 0, len(val))
+			for _, item := range val {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			values[key] = fmt.Sprint(val)
+		}
+	}
+}
+
+// envName 配置项对应的环境变量
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// flagValue 记录命令行参数，读取配置文件后再覆盖，保证命令行参数的优先级最高
+type flagValue struct {
+	key    string
+	def    string
+	isBool bool
+	set    map[string]string
+}
+
+// IsBoolFlag 布尔类型的配置项可以省略值，例如 -fix.row_image
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func (f *flagValue) String() string {
+	return f.def
+}
+
+func (f *flagValue) Set(s string) error {
+	f.set[f.key] = s
+	return nil
+}
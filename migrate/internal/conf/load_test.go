@@ -0,0 +1,202 @@
+package conf
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDsn = "root:pass@tcp(127.0.0.1:3306)/test?parseTime=True&loc=Local"
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "migrate.yaml")
+	writeFile(t, yamlFile, `
+source:
+  dsn: `+testDsn+`
+  max_open_conns: 50
+target:
+  dsn: `+testDsn+`
+fix:
+  batch_size: 500
+  sleep: 10ms
+  ddl_allow: [ALTER TABLE ADD COLUMN, CREATE INDEX]
+kafka:
+  brokers: [a:9092, b:9092]
+`)
+	tomlFile := filepath.Join(dir, "migrate.toml")
+	writeFile(t, tomlFile, `
+[source]
+dsn = "`+testDsn+`"
+max_open_conns = 50
+[target]
+dsn = "`+testDsn+`"
+[fix]
+batch_size = 500
+sleep = "10ms"
+ddl_allow = ["ALTER TABLE ADD COLUMN", "CREATE INDEX"]
+[kafka]
+brokers = ["a:9092", "b:9092"]
+`)
+
+	for _, file := range []string{yamlFile, tomlFile} {
+		cfg, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Source.MaxOpenConns != 50 || cfg.Source.MaxIdleConns != 20 {
+			t.Fatalf("%s: unexpected pool %+v", file, cfg.Source)
+		}
+		if cfg.Fix.BatchSize != 500 || cfg.Fix.Sleep != time.Millisecond*10 {
+			t.Fatalf("%s: unexpected fix %+v", file, cfg.Fix)
+		}
+		if strings.Join(cfg.Fix.DDLAllow, "|") != "ALTER TABLE ADD COLUMN|CREATE INDEX" {
+			t.Fatalf("%s: unexpected ddl_allow %v", file, cfg.Fix.DDLAllow)
+		}
+		if strings.Join(cfg.Kafka.Brokers, ",") != "a:9092,b:9092" {
+			t.Fatalf("%s: unexpected brokers %v", file, cfg.Kafka.Brokers)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "migrate.yml")
+	writeFile(t, file, "source:\n  dsn: "+testDsn+"\ntarget:\n  dsn: "+testDsn+"\nfix:\n  workers: 2\n  batch_size: 200\n")
+	t.Setenv("MIGRATE_CONFIG", file)
+	t.Setenv("MIGRATE_FIX_WORKERS", "4")
+	t.Setenv("MIGRATE_FIX_BATCH_SIZE", "300")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-fix.batch_size", "400", "-fix.row_image", "full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Fix.Workers != 4 {
+		t.Fatalf("env should override file, got workers %d", cfg.Fix.Workers)
+	}
+	if cfg.Fix.BatchSize != 400 {
+		t.Fatalf("flag should override env, got batch_size %d", cfg.Fix.BatchSize)
+	}
+	if !cfg.Fix.RowImage {
+		t.Fatal("bool flag without value should be true")
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "full" {
+		t.Fatalf("unexpected args %v", fs.Args())
+	}
+}
+
+func TestLoadAdmin(t *testing.T) {
+	t.Setenv("MIGRATE_CONFIG", "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := LoadAdmin(fs, nil); err == nil || !strings.Contains(err.Error(), "server.admin_token") {
+		t.Fatalf("expect admin token error, got %v", err)
+	}
+
+	// 不需要配置数据库
+	t.Setenv("MIGRATE_SERVER_ADMIN_TOKEN", "secret")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	force := fs.Bool("force", false, "")
+	cfg, err := LoadAdmin(fs, []string{"-force"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.AdminToken != "secret" || !*force {
+		t.Fatalf("unexpected token %q force %t", cfg.Server.AdminToken, *force)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name    string
+		content string
+		args    []string
+		wantErr []string
+	}{
+		{
+			name:    "unknown key",
+			content: "source:\n  dsn: " + testDsn + "\n  pool: 10\n",
+			wantErr: []string{"未知的配置项 source.pool"},
+		},
+		{
+			name:    "bad value",
+			content: "fix:\n  sleep: fast\n",
+			wantErr: []string{"配置项 fix.sleep"},
+		},
+		{
+			name:    "invalid config",
+			content: "source:\n  dsn: " + testDsn + "\nlogger:\n  level: debug\nfix:\n  batch_size: 0\n",
+			wantErr: []string{"target.dsn 不能为空", "logger.level", "fix.batch_size 必须大于 0"},
+		},
+		{
+			name:    "bad flag",
+			content: "source:\n  dsn: " + testDsn + "\ntarget:\n  dsn: " + testDsn + "\n",
+			args:    []string{"-fix.workers", "many"},
+			wantErr: []string{"命令行参数: 配置项 fix.workers"},
+		},
+		{
+			name:    "zero min backoff",
+			content: "source:\n  dsn: " + testDsn + "\ntarget:\n  dsn: " + testDsn + "\nthrottle:\n  min_backoff: 0s\n",
+			wantErr: []string{"throttle.min_backoff 必须大于 0"},
+		},
+		{
+			name:    "kafka source",
+			content: "source:\n  dsn: " + testDsn + "\ntarget:\n  dsn: " + testDsn + "\nfix:\n  source: kafka\n",
+			wantErr: []string{"kafka.brokers 不能为空", "kafka.topics 不能为空"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".yaml")
+			writeFile(t, file, tc.content)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			_, err := Load(fs, append([]string{"-config", file}, tc.args...))
+			if err == nil {
+				t.Fatal("expect error")
+			}
+			for _, want := range tc.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("expect error containing %q, got %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	host, port, user, password, err := DB{DSN: testDsn}.Endpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" || port != 3306 || user != "root" || password != "pass" {
+		t.Fatalf("unexpected endpoint %s %d %s %s", host, port, user, password)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	testCases := []struct {
+		dsn  string
+		want *time.Location
+	}{
+		{dsn: testDsn, want: time.Local},
+		{dsn: "root:pass@tcp(127.0.0.1:3306)/test?parseTime=True", want: time.UTC},
+	}
+	for _, tc := range testCases {
+		got, err := DB{DSN: tc.dsn}.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: expect %s, got %s", tc.dsn, tc.want, got)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
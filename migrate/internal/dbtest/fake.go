@@ -0,0 +1,268 @@
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statement 假数据库执行过的一条语句，事务记录为 BEGIN、COMMIT 和 ROLLBACK
+type Statement struct {
+	Query string
+	Args  []any
+}
+
+// FakeDB 内存中的假数据库，实现 database/sql 的驱动，记录执行过的语句，可以注入错误和延迟，
+// 用于测试 DoubleWritePool 这类只关心发出了哪些语句的逻辑。
+// INSERT 按自增 ID 返回 LastInsertId，影响的行数为 VALUES 的行数，其它语句影响 1 行，查询总是返回空结果
+type FakeDB struct {
+	DB *sql.DB
+
+	stmts   []Statement
+	nextID  int64
+	latency time.Duration
+	faults  []fault
+	changed chan struct{} // 每执行一条语句关闭一次，用于等待异步的写入
+	lock    sync.Mutex
+}
+
+// fault 语句包含 match 时返回 err
+type fault struct {
+	match string
+	err   error
+}
+
+func NewFakeDB() *FakeDB {
+	f := &FakeDB{
+		nextID:  1,
+		changed: make(chan struct{}),
+	}
+	f.DB = sql.OpenDB(&connector{db: f})
+	return f
+}
+
+// Statements 获取执行过的语句，按执行顺序排列
+func (f *FakeDB) Statements() []Statement {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Statement(nil), f.stmts...)
+}
+
+// WaitStatements 等待至少执行了 n 条语句，超时后返回已经执行的语句
+func (f *FakeDB) WaitStatements(n int, timeout time.Duration) []Statement {
+	deadline := time.After(timeout)
+	for {
+		f.lock.Lock()
+		stmts, changed := append([]Statement(nil), f.stmts...), f.changed
+		f.lock.Unlock()
+		if len(stmts) >= n {
+			return stmts
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return stmts
+		}
+	}
+}
+
+// Reset 清空执行过的语句和注入的故障
+func (f *FakeDB) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stmts = nil
+	f.faults = nil
+	f.latency = 0
+}
+
+// FailOn 包含 match 的语句返回 err，match 为空时所有语句都返回 err，失败的语句同样会被记录
+func (f *FakeDB) FailOn(match string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults = append(f.faults, fault{match: match, err: err})
+}
+
+// SetLatency 设置每条语句的延迟
+func (f *FakeDB) SetLatency(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.latency = d
+}
+
+// SetNextID 设置下一次 INSERT 的自增 ID
+func (f *FakeDB) SetNextID(id int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.nextID = id
+}
+
+func (f *FakeDB) Close() error {
+	return f.DB.Close()
+}
+
+// exec 记录语句并按注入的故障返回结果
+func (f *FakeDB) exec(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	f.lock.Lock()
+	values := make([]any, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	f.stmts = append(f.stmts, Statement{Query: query, Args: values})
+	close(f.changed)
+	f.changed = make(chan struct{})
+	latency := f.latency
+	var err error
+	for _, ft := range f.faults {
+		if strings.Contains(query, ft.match) {
+			err = ft.err
+			break
+		}
+	}
+	res := result{rows: 1}
+	if err == nil && strings.HasPrefix(strings.TrimSpace(strings.ToUpper(query)), "INSERT") {
+		res.rows = int64(strings.Count(query, "),(") + 1)
+		res.lastID = f.nextID
+		f.nextID += res.rows
+	}
+	f.lock.Unlock()
+
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type result struct {
+	lastID int64
+	rows   int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.lastID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rows, nil
+}
+
+type connector struct {
+	db *FakeDB
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, driver.ErrSkip
+}
+
+type conn struct {
+	db *FakeDB
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.db.exec(ctx, "BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.db.exec(ctx, query, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if _, err := c.db.exec(ctx, query, args); err != nil {
+		return nil, err
+	}
+	return emptyRows{}, nil
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.conn.db.exec(context.Background(), "COMMIT", nil)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.conn.db.exec(context.Background(), "ROLLBACK", nil)
+	return err
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	res := make([]driver.NamedValue, 0, len(args))
+	for i, v := range args {
+		res = append(res, driver.NamedValue{Ordinal: i + 1, Value: v})
+	}
+	return res
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string {
+	return nil
+}
+
+func (emptyRows) Close() error {
+	return nil
+}
+
+func (emptyRows) Next([]driver.Value) error {
+	return io.EOF
+}
@@ -0,0 +1,69 @@
+package dbtest
+
+import (
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"sync/atomic"
+	"testing"
+)
+
+var sqliteSeq atomic.Int64
+
+// NewSQLite 创建内存中的 SQLite 数据库并建好 models 的表，测试结束后关闭，
+// 用于修复的源库和目标库。只使用一个连接，避免内存数据库在不同连接之间不可见
+func NewSQLite(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:dbtest%d?mode=memory&cache=shared", sqliteSeq.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	models.Migrate(db)
+	return db
+}
+
+// SeedUsers 写入用户，保留 ID、CreatedAt 和 UpdatedAt
+func SeedUsers(t testing.TB, db *gorm.DB, users ...models.User) {
+	t.Helper()
+	if len(users) == 0 {
+		return
+	}
+	if err := db.Session(&gorm.Session{SkipHooks: true}).Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Users 按 ID 顺序获取所有用户，包括已经软删除的行
+func Users(t testing.TB, db *gorm.DB) []models.User {
+	t.Helper()
+	var users []models.User
+	if err := db.Unscoped().Order("id").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+// AssertSameUsers 断言两个库的用户相同，按 Checksum 比较
+func AssertSameUsers(t testing.TB, source, target *gorm.DB) {
+	t.Helper()
+	sUsers, tUsers := Users(t, source), Users(t, target)
+	if len(sUsers) != len(tUsers) {
+		t.Fatalf("expect %d users, got %d", len(sUsers), len(tUsers))
+	}
+	for i := range sUsers {
+		if sUsers[i].ID != tUsers[i].ID || sUsers[i].Checksum() != tUsers[i].Checksum() {
+			t.Fatalf("expect user %+v, got %+v", sUsers[i], tUsers[i])
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+)
+
+// rowEvent 解析后的行变更
+type rowEvent struct {
+	typ  pbe.EventType
+	id   uint64
+	user *models.User // binlog 中完整的行数据，为 nil 时需要从源库获取
+	ddl  *DDLEvent    // 不为 nil 时表示 DDL
+	pos  Position
+}
+
+// CDCStats binlog 增量修复的统计
+type CDCStats struct {
+	Batches   int64         `json:"batches"`    // 写入目标库的批次
+	Rows      int64         `json:"rows"`       // 写入目标库的行数
+	Position  Position      `json:"position"`   // 已经处理的 binlog 位点
+	Lag       time.Duration `json:"lag"`        // 最近一批 binlog 的执行时间到写入目标库的延迟
+	AppliedAt time.Time     `json:"applied_at"` // 最近一次写入目标库的时间
+}
+
+// cdcBatch 等待写入目标库的数据源批次
+type cdcBatch struct {
+	batches []*Batch   // 数据源的批次，按获取顺序排列
+	events  []rowEvent // 行变更，按 binlog 顺序排列
+	pos     Position   // 最后一条 binlog 的位点
+	start   time.Time  // 第一个批次的获取时间
+}
+
+func (b *cdcBatch) reset() {
+	b.batches = b.batches[:0]
+	b.events = b.events[:0]
+	b.pos = Position{}
+	b.start = time.Time{}
+}
+
+// WithWorkers 设置写入目标库的并发数，同一个主键的变更总是由同一个 worker 按顺序写入
+func WithWorkers(n int) Optional {
+	return func(f *User) {
+		if n > 0 {
+			f.workers = n
+		}
+	}
+}
+
+// WithFlush 设置攒批写入目标库的行数和最长等待时间，
+// 每个 worker 每 size 行使用一个目标库事务
+func WithFlush(size int, interval time.Duration) Optional {
+	return func(f *User) {
+		if size > 0 {
+			f.flushSize = size
+		}
+		f.flushInterval = interval
+	}
+}
+
+// CDCStats 获取 binlog 增量修复的统计
+func (f *User) CDCStats() CDCStats {
+	f.statsLock.RLock()
+	defer f.statsLock.RUnlock()
+	return f.stats
+}
+
+// shouldFlush 是否需要将攒的批次写入目标库
+func (f *User) shouldFlush(b *cdcBatch) bool {
+	if len(b.batches) == 0 {
+		return false
+	}
+	return len(b.events) >= f.flushSize || time.Since(b.start) >= f.flushInterval
+}
+
+// commit 将批次写入目标库，保存位点并 Ack，失败时回滚数据源的批次
+func (f *User) commit(ctx context.Context, b *cdcBatch) error {
+	if len(b.batches) == 0 {
+		return nil
+	}
+	if err := f.apply(ctx, b.events); err != nil {
+		f.rollback(b)
+		return err
+	}
+	if !b.pos.IsZero() {
+		if err := f.store.Save(b.pos); err != nil {
+			f.rollback(b)
+			return err
+		}
+		f.pos = b.pos
+	}
+	ids := make([]int64, 0, len(b.batches))
+	for _, batch := range b.batches {
+		ids = append(ids, batch.ID)
+		if err := f.source.Ack(batch); err != nil {
+			// 已经写入目标库并保存了位点，重连后重新投递的数据会被跳过
+			log.Println(fmt.Errorf("确认批次失败 batchId:%d error:%w", batch.ID, err))
+			b.reset()
+			return f.reconnect(ctx)
+		}
+	}
+
+	now := time.Now()
+	f.statsLock.Lock()
+	f.stats.Batches += int64(len(b.batches))
+	f.stats.Rows += int64(len(b.events))
+	f.stats.Position = f.pos
+	f.stats.AppliedAt = now
+	if ts := b.lastTimestamp(); ts > 0 {
+		f.stats.Lag = now.Sub(time.UnixMilli(ts))
+	}
+	lag := f.stats.Lag
+	f.statsLock.Unlock()
+
+	log.Println(fmt.Sprintf("批次处理完成 batchId:%v rows:%d binlog[%s] lag:%s", ids, len(b.events), f.pos, lag))
+	b.reset()
+	return nil
+}
+
+// rollback 回滚数据源的批次，数据源会重新投递
+func (f *User) rollback(b *cdcBatch) {
+	for _, batch := range b.batches {
+		if err := f.source.Rollback(batch); err != nil {
+			log.Println(fmt.Errorf("回滚批次失败 batchId:%d error:%w", batch.ID, err))
+		}
+	}
+	b.reset()
+}
+
+// lastTimestamp 最后一条行变更的 binlog 执行时间
+func (b *cdcBatch) lastTimestamp() int64 {
+	if len(b.events) == 0 {
+		return b.pos.Timestamp
+	}
+	return b.events[len(b.events)-1].pos.Timestamp
+}
+
+// parseEvents 将变更事件解析为行变更
+// 不晚于已处理位点的 binlog 会被跳过，保证重复投递时按 binlog 位点幂等。
+// 无法获取主键时返回错误，由调用方回滚批次，不能跳过后 Ack 导致丢失变更
+func (f *User) parseEvents(changes []cdc.ChangeEvent) ([]rowEvent, error) {
+	events := make([]rowEvent, 0, len(changes))
+	for i := range changes {
+		c := &changes[i]
+		pos := eventPosition(c)
+		if pos.File != "" && !f.pos.IsZero() && !f.pos.Before(pos) {
+			log.Println("跳过已经处理的 binlog:", pos)
+			continue
+		}
+		if c.IsDDL {
+			events = append(events, rowEvent{typ: c.Type, pos: pos, ddl: &DDLEvent{
+				Schema:   c.Schema,
+				Table:    c.Table,
+				SQL:      c.SQL,
+				Types:    ddlTypes(c.SQL),
+				Position: pos,
+			}})
+			continue
+		}
+		if c.Type == pbe.EventType_DELETE { // 源表删除的数据
+			id, er := parseID(c.Before)
+			if er != nil {
+				return nil, fmt.Errorf("获取 ID 失败 binlog[%s] error:%w", pos, er)
+			}
+			events = append(events, rowEvent{typ: c.Type, id: id, pos: pos})
+			continue
+		}
+		// 源表新插入或者更新的数据
+		if f.rowImage {
+			user, complete, er := parseUser(c.After)
+			if er != nil {
+				log.Println(fmt.Errorf("解析行数据失败 error:%w", er))
+			}
+			if complete {
+				events = append(events, rowEvent{typ: c.Type, id: user.ID, user: user, pos: pos})
+				continue
+			}
+			log.Println("行数据不完整，从源库重新获取")
+		}
+		id, er := parseID(c.After)
+		if er != nil {
+			return nil, fmt.Errorf("获取 ID 失败 binlog[%s] error:%w", pos, er)
+		}
+		events = append(events, rowEvent{typ: c.Type, id: id, pos: pos})
+	}
+	return events, nil
+}
+
+// apply 将行变更写入目标库，DDL 作为屏障：先写入 DDL 之前的行变更，再处理 DDL
+// 处理完 DDL 后立即保存并推进位点，DDL 之后的行变更失败、批次回滚后重新投递时，
+// parseEvents 会跳过 DDL 及之前的 binlog，不会重复执行或者重复确认 DDL。
+// Kafka 的 FlatMessage 没有 binlog 文件位点，按位点跳过不生效，
+// 由 ddlDone 跳过回滚后重新投递的同一个 DDL，进程重启后由 handleDDL 忽略目标库已经执行过的 DDL
+func (f *User) apply(ctx context.Context, events []rowEvent) error {
+	start := 0
+	for i := range events {
+		ddl := events[i].ddl
+		if ddl == nil {
+			continue
+		}
+		if err := f.applyRows(ctx, events[start:i]); err != nil {
+			return err
+		}
+		start = i + 1
+		if f.ddlDone != nil && sameDDL(f.ddlDone, ddl) {
+			log.Println("跳过已经处理的 DDL:", ddl.SQL)
+			continue
+		}
+		if err := f.handleDDL(ctx, ddl); err != nil {
+			return err
+		}
+		f.ddlDone = ddl
+		if !ddl.Position.IsZero() {
+			if err := f.store.Save(ddl.Position); err != nil {
+				return err
+			}
+			f.pos = ddl.Position
+		}
+	}
+	return f.applyRows(ctx, events[start:])
+}
+
+// applyRows 按主键哈希将行变更分配给 worker 并发写入目标库，
+// 每个 worker 按 binlog 顺序写入，每 flushSize 行一个事务。
+// 一个 worker 失败时取消其它 worker 还没有开始的事务，已经提交的事务不会回滚：
+// 整个批次回滚后重新投递，同一主键的变更仍然按 binlog 顺序重放，
+// 写入按 updated_at 保护不会覆盖更新的数据，删除本身幂等，所以重复写入已经提交的行不影响结果
+func (f *User) applyRows(ctx context.Context, events []rowEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parts := make([][]rowEvent, f.workers)
+	for _, e := range events {
+		i := e.id % uint64(f.workers)
+		parts[i] = append(parts[i], e)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+	for _, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(part []rowEvent) {
+			defer wg.Done()
+			for start := 0; start < len(part); start += f.flushSize {
+				if ctx.Err() != nil { // 其它 worker 已经失败
+					return
+				}
+				end := start + f.flushSize
+				if end > len(part) {
+					end = len(part)
+				}
+				err := f.tdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+					for i := start; i < end; i++ {
+						if err := f.applyEvent(ctx, tx, part[i]); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					lock.Lock()
+					errs = append(errs, err)
+					lock.Unlock()
+					cancel()
+					return
+				}
+			}
+		}(part)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// applyEvent 将一行变更写入目标库
+func (f *User) applyEvent(ctx context.Context, tx *gorm.DB, e rowEvent) error {
+	switch {
+	case e.typ == pbe.EventType_DELETE:
+		if err := models.Users.Delete(ctx, tx, e.id); err != nil {
+			return fmt.Errorf("从目标库删除失败 ID:%d error:%w", e.id, err)
+		}
+		log.Println(fmt.Sprintf("从目标库删除成功 ID:%d", e.id))
+	case e.user != nil && f.skipDeleted && e.user.DeletedAt.Valid: // 源库软删除，忽略软删除的行时从目标库删除
+		if err := models.Users.Delete(ctx, tx, e.id); err != nil {
+			return fmt.Errorf("从目标库删除失败 ID:%d error:%w", e.id, err)
+		}
+		log.Println(fmt.Sprintf("源库已经软删除，从目标库删除成功 ID:%d", e.id))
+	case e.user != nil: // 直接使用 binlog 的行数据写入目标库
+		if err := models.Users.Upsert(ctx, tx, e.user); err != nil {
+			return fmt.Errorf("写入目标库失败 ID:%d error:%w", e.id, err)
+		}
+		log.Println(fmt.Sprintf("从目标库写入成功 ID:%d", e.id))
+	default:
+		return f.fixByID(ctx, tx, e.id)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTarget 使用假数据库作为目标库，记录写入目标库的语句和事务
+func fakeTarget(t *testing.T) (*gorm.DB, *dbtest.FakeDB) {
+	fake := dbtest.NewFakeDB()
+	t.Cleanup(func() { _ = fake.Close() })
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: fake.DB, SkipInitializeWithVersion: true}), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, fake
+}
+
+// updateEvents 为每个 ID 依次生成 versions 个带行数据的更新，Name 为 "<id>-<version>"
+func updateEvents(versions int, ids ...uint64) []rowEvent {
+	events := make([]rowEvent, 0, versions*len(ids))
+	for v := 1; v <= versions; v++ {
+		for _, u := range testUsers(ids...) {
+			user := u
+			user.Name = fmt.Sprintf("%d-%d", u.ID, v)
+			user.UpdatedAt = user.UpdatedAt.Add(time.Duration(v) * time.Minute)
+			events = append(events, rowEvent{typ: pbe.EventType_UPDATE, id: user.ID, user: &user})
+		}
+	}
+	return events
+}
+
+// countStatements 统计以 prefix 开头的语句数
+func countStatements(stmts []dbtest.Statement, prefix string) int {
+	n := 0
+	for _, s := range stmts {
+		if strings.HasPrefix(s.Query, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestApplyRowsBatch(t *testing.T) {
+	testCases := []struct {
+		name      string
+		workers   int
+		flushSize int
+		ids       []uint64
+		versions  int
+		wantTx    int // 目标库事务数
+	}{
+		{name: "one tx", workers: 1, flushSize: 100, ids: idRange(1, 5), versions: 1, wantTx: 1},
+		{name: "split by flush size", workers: 1, flushSize: 2, ids: idRange(1, 5), versions: 1, wantTx: 3},
+		// worker 0: 3、6，worker 1: 1、4，worker 2: 2、5
+		{name: "per worker", workers: 3, flushSize: 100, ids: idRange(1, 6), versions: 1, wantTx: 3},
+		// 每个 worker 4 行，每 3 行一个事务
+		{name: "per worker split", workers: 3, flushSize: 3, ids: idRange(1, 6), versions: 2, wantTx: 6},
+		{name: "fewer keys than workers", workers: 4, flushSize: 100, ids: []uint64{8}, versions: 3, wantTx: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tdb, fake := fakeTarget(t)
+			f := NewFixUser(dbtest.NewSQLite(t), tdb, WithWorkers(tc.workers), WithFlush(tc.flushSize, time.Second))
+			events := updateEvents(tc.versions, tc.ids...)
+			if err := f.applyRows(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			stmts := fake.Statements()
+			if got := countStatements(stmts, "BEGIN"); got != tc.wantTx {
+				t.Fatalf("expect %d transactions, got %d", tc.wantTx, got)
+			}
+			if got := countStatements(stmts, "COMMIT"); got != tc.wantTx {
+				t.Fatalf("expect %d commits, got %d", tc.wantTx, got)
+			}
+			if got := countStatements(stmts, "INSERT"); got != len(events) {
+				t.Fatalf("expect %d writes, got %d", len(events), got)
+			}
+		})
+	}
+}
+
+func TestApplyRowsOrder(t *testing.T) {
+	tdb, fake := fakeTarget(t)
+	f := NewFixUser(dbtest.NewSQLite(t), tdb, WithWorkers(3), WithFlush(2, time.Second))
+	fake.SetLatency(time.Millisecond)
+	ids := idRange(1, 7)
+	if err := f.applyRows(context.Background(), updateEvents(4, ids...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不同的 worker 并发写入，同一个 ID 的变更按 binlog 顺序写入
+	got := make(map[uint64][]string, len(ids))
+	for _, s := range fake.Statements() {
+		if !strings.HasPrefix(s.Query, "INSERT") {
+			continue
+		}
+		// 第一个参数是 Name，主键在最后
+		id, ok := s.Args[len(s.Args)-1].(int64)
+		if !ok {
+			t.Fatalf("unexpected args %v", s.Args)
+		}
+		got[uint64(id)] = append(got[uint64(id)], s.Args[0].(string))
+	}
+	for _, id := range ids {
+		want := make([]string, 0, 4)
+		for v := 1; v <= 4; v++ {
+			want = append(want, fmt.Sprintf("%d-%d", id, v))
+		}
+		if !reflect.DeepEqual(got[id], want) {
+			t.Fatalf("ID %d: expect %v, got %v", id, want, got[id])
+		}
+	}
+}
+
+// failOn 写入 ID 为 id 的用户时返回 err
+func failOn(t *testing.T, db *gorm.DB, id uint64, err error) {
+	er := db.Callback().Create().Before("gorm:create").Register("test:fail", func(tx *gorm.DB) {
+		if u, ok := tx.Statement.Dest.(*models.User); ok && u.ID == id {
+			_ = tx.AddError(err)
+		}
+	})
+	if er != nil {
+		t.Fatal(er)
+	}
+}
+
+func TestApplyRowsFail(t *testing.T) {
+	errFail := errors.New("fail")
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	failOn(t, tdb, 4, errFail)
+	// 单个 worker，每 2 行一个事务：1、2 提交，3、4 回滚，5、6 不再写入
+	f := NewFixUser(sdb, tdb, WithFlush(2, time.Second))
+	err := f.applyRows(context.Background(), updateEvents(1, idRange(1, 6)...))
+	if !errors.Is(err, errFail) {
+		t.Fatalf("expect %v, got %v", errFail, err)
+	}
+	got := dbtest.Users(t, tdb)
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+		t.Fatalf("expect users 1 and 2, got %+v", got)
+	}
+
+	// 重新投递时已经提交的行重复写入，结果与只写一次相同
+	if err = f.applyRows(context.Background(), updateEvents(1, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	want := updateEvents(1, 1, 2)
+	got = dbtest.Users(t, tdb)
+	for i := range want {
+		if got[i].Checksum() != want[i].user.Checksum() {
+			t.Fatalf("expect %+v, got %+v", want[i].user, got[i])
+		}
+	}
+}
+
+func TestFixIncByCDCRollback(t *testing.T) {
+	errFail := errors.New("fail")
+	badKey := changeEvent(pbe.EventType_UPDATE, 4, 400)
+	badKey.After = cdc.Row{{Name: "id", Value: "x", IsKey: true}}
+	testCases := []struct {
+		name    string
+		events  []cdc.ChangeEvent
+		fail    bool
+		wantErr error
+	}{
+		{
+			name: "apply",
+			events: []cdc.ChangeEvent{
+				changeEvent(pbe.EventType_INSERT, 1, 100),
+				changeEvent(pbe.EventType_INSERT, 2, 200),
+			},
+			fail:    true,
+			wantErr: errFail,
+		},
+		{
+			name: "parse id",
+			events: []cdc.ChangeEvent{
+				changeEvent(pbe.EventType_INSERT, 1, 100),
+				badKey,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+			dbtest.SeedUsers(t, sdb, testUsers(1, 2)...)
+			if tc.fail {
+				failOn(t, tdb, 2, errFail)
+			}
+			source := &fakeSource{
+				drained: make(chan struct{}),
+				batches: []*Batch{{ID: 1, Events: tc.events,
+					Position: Position{File: "mysql-bin.000001", Offset: 400}}},
+			}
+			store := NewMemoryPositionStore(Position{})
+			f := NewFixUser(sdb, tdb, WithSleep(time.Millisecond), WithSource(source), WithPositionStore(store),
+				WithWorkers(2), WithFlush(1, 0))
+
+			err := f.FixIncByCDC(context.Background(), 10)
+			if err == nil || (tc.wantErr != nil && !errors.Is(err, tc.wantErr)) {
+				t.Fatalf("expect error %v, got %v", tc.wantErr, err)
+			}
+			if len(source.acked) != 0 || len(source.rolledBack) != 1 {
+				t.Fatalf("expect batch rolled back, acked %v rolled back %v", source.acked, source.rolledBack)
+			}
+			if pos, _ := store.Load(); !pos.IsZero() {
+				t.Fatalf("expect no position saved, got %s", pos)
+			}
+		})
+	}
+}
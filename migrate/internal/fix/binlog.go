@@ -0,0 +1,583 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binlogPollTimeout Fetch 在事务边界等待下一个 binlog 事件的时长
+const binlogPollTimeout = time.Millisecond * 100
+
+// BinlogConfig 直接读取 MySQL binlog 的配置，账号需要 REPLICATION SLAVE 和 REPLICATION CLIENT 权限，
+// 源库需要开启 binlog_format=ROW 和 binlog_row_image=FULL
+type BinlogConfig struct {
+	Host     string
+	Port     uint16
+	User     string
+	Password string
+	ServerID uint32 // 伪装成从库使用的 server_id，不能和集群中的其它实例重复
+	GTID     bool   // 使用 GTID 定位，需要源库开启 gtid_mode
+}
+
+// BinlogSource 伪装成 MySQL 的从库，通过 binlog dump 协议直接读取 binlog，不需要部署 canal
+// 字段信息从 information_schema 获取，读取历史 binlog 时如果表结构已经变化，需要从变化后的位点开始读取
+type BinlogSource struct {
+	cfg   BinlogConfig
+	db    *gorm.DB      // 源库，用于获取表结构和当前的 binlog 位点
+	store PositionStore // 首次连接时从位点存储中获取起始位点
+
+	filter   string
+	filters  []*regexp.Regexp
+	syncer   *replication.BinlogSyncer
+	streamer *replication.BinlogStreamer
+
+	file    string            // 当前的 binlog 文件
+	tx      []cdc.ChangeEvent // 当前未提交事务中的变更
+	acked   Position          // 已经确认的位点，重连时从这里开始读取
+	batchID int64             // 批次 ID
+	tables  sync.Map          // 表结构缓存，key 为 schema.table
+}
+
+// binlogColumn 表的字段信息
+type binlogColumn struct {
+	name     string
+	dataType string
+	typ      string // COLUMN_TYPE，例如 bigint(20) unsigned
+	key      bool
+	unsigned bool
+	sqlType  int32
+}
+
+func NewBinlogSource(cfg BinlogConfig, db *gorm.DB, store PositionStore) *BinlogSource {
+	return &BinlogSource{
+		cfg:   cfg,
+		db:    db,
+		store: store,
+	}
+}
+
+// Connect 从已确认的位点开始读取 binlog，没有已确认的位点时使用位点存储中的位点，
+// 都没有时从源库当前的位点开始读取
+func (s *BinlogSource) Connect(filter string) error {
+	filters, err := compileFilter(filter)
+	if err != nil {
+		return err
+	}
+	s.filter = filter
+	s.filters = filters
+
+	pos := s.acked
+	if pos.IsZero() {
+		if pos, err = s.store.Load(); err != nil {
+			return err
+		}
+	}
+	if pos.IsZero() {
+		if pos, err = s.masterStatus(); err != nil {
+			return err
+		}
+	}
+	useGTID, err := binlogStart(pos, s.cfg.GTID)
+	if err != nil {
+		return err
+	}
+
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID: s.cfg.ServerID,
+		Flavor:   mysql.MySQLFlavor,
+		Host:     s.cfg.Host,
+		Port:     s.cfg.Port,
+		User:     s.cfg.User,
+		Password: s.cfg.Password,
+	})
+	var streamer *replication.BinlogStreamer
+	if useGTID {
+		gset, er := mysql.ParseMysqlGTIDSet(pos.GTID)
+		if er != nil {
+			syncer.Close()
+			return er
+		}
+		streamer, err = syncer.StartSyncGTID(gset)
+	} else {
+		streamer, err = syncer.StartSync(mysql.Position{Name: pos.File, Pos: uint32(pos.Offset)})
+	}
+	if err != nil {
+		syncer.Close()
+		return err
+	}
+	s.syncer = syncer
+	s.streamer = streamer
+	s.file = pos.File
+	s.tx = nil
+	s.acked = pos
+	return nil
+}
+
+// binlogStart 判断从位点开始读取时是否使用 GTID 定位。
+// 开启 GTID 但位点中没有 GTID 时（例如没有开启 GTID 时保存的位点）使用位点的 file:offset，
+// 不能改为从源库当前的位点开始，否则会丢失两个位点之间的变更
+func binlogStart(pos Position, gtid bool) (bool, error) {
+	switch {
+	case gtid && pos.GTID != "":
+		return true, nil
+	case gtid && pos.File != "":
+		log.Println(fmt.Sprintf("位点 %s 没有 GTID，使用 file:offset 定位", pos))
+		return false, nil
+	case gtid:
+		return false, fmt.Errorf("位点 %s 没有 GTID，请确认源库开启了 gtid_mode", pos)
+	case pos.File == "":
+		return false, fmt.Errorf("位点 %s 没有 binlog 文件，只有 GTID 时需要开启 binlog.gtid", pos)
+	}
+	return false, nil
+}
+
+// Fetch 读取 binlog，只在事务边界切分批次，保证批次的位点可以用于断点续传
+func (s *BinlogSource) Fetch(ctx context.Context, batchSize int) (*Batch, error) {
+	b := &Batch{}
+	for {
+		evCtx, cancel := context.WithTimeout(ctx, binlogPollTimeout)
+		ev, err := s.streamer.GetEvent(evCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return nil, err
+			}
+			// 事务没有结束时继续等待
+			if len(s.tx) > 0 {
+				continue
+			}
+			return s.batch(b), nil
+		}
+
+		header := ev.Header
+		pos := Position{File: s.file, Offset: int64(header.LogPos), Timestamp: int64(header.Timestamp) * 1000}
+		switch e := ev.Event.(type) {
+		case *replication.RotateEvent:
+			s.file = string(e.NextLogName)
+		case *replication.RowsEvent:
+			events, er := s.rowsEvents(header.EventType, e, pos)
+			if er != nil {
+				return nil, er
+			}
+			s.tx = append(s.tx, events...)
+		case *replication.XIDEvent: // 事务提交
+			s.commit(b, pos, e.GSet)
+		case *replication.QueryEvent:
+			query := strings.TrimSpace(string(e.Query))
+			switch strings.ToUpper(query) {
+			case "BEGIN":
+			case "COMMIT": // 非事务引擎的提交
+				s.commit(b, pos, e.GSet)
+			default:
+				// 事务中的 SAVEPOINT、XA 等事务控制语句不是事务边界，不能切分事务，也不能保存事务中间的位点
+				if !isDDL(query) {
+					break
+				}
+				// DDL 自动提交
+				schema, table := ddlTable(query, string(e.Schema))
+				s.tables.Delete(schema + "." + table)
+				if matchFilter(s.filters, schema, table) {
+					ddl := binlogEvent(schema, table, pos)
+					ddl.Type = ddlEventType(query)
+					ddl.IsDDL = true
+					ddl.SQL = query
+					s.tx = append(s.tx, ddl)
+				}
+				s.commit(b, pos, e.GSet)
+			}
+		}
+		if len(s.tx) == 0 && len(b.Events) >= batchSize {
+			return s.batch(b), nil
+		}
+	}
+}
+
+// commit 将事务中的变更加入批次，批次的位点移动到事务结束的位置
+func (s *BinlogSource) commit(b *Batch, pos Position, gset mysql.GTIDSet) {
+	if gset != nil {
+		pos.GTID = gset.String()
+	}
+	b.Events = append(b.Events, s.tx...)
+	b.Position = pos
+	s.tx = nil
+}
+
+// batch 没有变更也没有移动位点时返回 nil
+func (s *BinlogSource) batch(b *Batch) *Batch {
+	if len(b.Events) == 0 && b.Position.IsZero() {
+		return nil
+	}
+	s.batchID++
+	b.ID = s.batchID
+	return b
+}
+
+// Ack 记录已经确认的位点，位点由 FixIncByCDC 保存到位点存储
+func (s *BinlogSource) Ack(b *Batch) error {
+	if !b.Position.IsZero() {
+		s.acked = b.Position
+	}
+	return nil
+}
+
+// Rollback 断开后从已经确认的位点重新读取
+func (s *BinlogSource) Rollback(_ *Batch) error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return s.Connect(s.filter)
+}
+
+func (s *BinlogSource) Close() error {
+	if s.syncer != nil {
+		s.syncer.Close()
+		s.syncer = nil
+	}
+	s.tx = nil
+	return nil
+}
+
+// masterStatus 获取源库当前的 binlog 位点
+func (s *BinlogSource) masterStatus() (Position, error) {
+	return MasterStatus(s.db)
+}
+
+// MasterStatus 通过 SHOW MASTER STATUS 获取 db 当前的 binlog 位点，开启 GTID 时包含 Executed_Gtid_Set
+func MasterStatus(db *gorm.DB) (Position, error) {
+	var pos Position
+	rows, err := db.Raw("SHOW MASTER STATUS").Rows()
+	if err != nil {
+		return pos, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	if !rows.Next() {
+		return pos, errors.New("源库没有开启 binlog")
+	}
+	values := make([]any, len(columns))
+	raw := make([]*string, len(columns))
+	for i := range values {
+		values[i] = &raw[i]
+	}
+	if err = rows.Scan(values...); err != nil {
+		return pos, err
+	}
+	for i, name := range columns {
+		if raw[i] == nil {
+			continue
+		}
+		switch name {
+		case "File":
+			pos.File = *raw[i]
+		case "Position":
+			pos.Offset, err = strconv.ParseInt(*raw[i], 10, 64)
+		case "Executed_Gtid_Set":
+			pos.GTID = strings.ReplaceAll(*raw[i], "\n", "")
+		}
+	}
+	return pos, err
+}
+
+// rowsEvents 将行事件转为变更事件，不匹配过滤规则时返回 nil
+func (s *BinlogSource) rowsEvents(typ replication.EventType, e *replication.RowsEvent, pos Position) ([]cdc.ChangeEvent, error) {
+	schema, table := string(e.Table.Schema), string(e.Table.Table)
+	if !matchFilter(s.filters, schema, table) {
+		return nil, nil
+	}
+	columns, err := s.tableColumns(schema, table, e.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	base := binlogEvent(schema, table, pos)
+	var rows []*pbe.RowData
+	switch typ {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		base.Type = pbe.EventType_INSERT
+		for _, row := range e.Rows {
+			rows = append(rows, &pbe.RowData{AfterColumns: binlogColumns(columns, row, nil)})
+		}
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		base.Type = pbe.EventType_DELETE
+		for _, row := range e.Rows {
+			rows = append(rows, &pbe.RowData{BeforeColumns: binlogColumns(columns, row, nil)})
+		}
+	default: // 更新事件的行数据成对出现，前一行为更新前的数据
+		base.Type = pbe.EventType_UPDATE
+		for i := 0; i+1 < len(e.Rows); i += 2 {
+			rows = append(rows, &pbe.RowData{
+				BeforeColumns: binlogColumns(columns, e.Rows[i], nil),
+				AfterColumns:  binlogColumns(columns, e.Rows[i+1], e.Rows[i]),
+			})
+		}
+	}
+	return cdc.DecodeRows(base, rows)
+}
+
+// binlogEvent 构造位于 pos 的变更事件
+func binlogEvent(schema, table string, pos Position) cdc.ChangeEvent {
+	return cdc.ChangeEvent{
+		Schema:    schema,
+		Table:     table,
+		Position:  pos,
+		Timestamp: time.UnixMilli(pos.Timestamp),
+	}
+}
+
+// tableColumns 获取表的字段信息，优先使用 binlog_row_metadata=FULL 时 binlog 中的字段名
+func (s *BinlogSource) tableColumns(schema, table string, tm *replication.TableMapEvent) ([]binlogColumn, error) {
+	key := schema + "." + table
+	if v, ok := s.tables.Load(key); ok {
+		columns := v.([]binlogColumn)
+		if len(columns) == int(tm.ColumnCount) {
+			return columns, nil
+		}
+	}
+
+	var rows []struct {
+		ColumnName string
+		DataType   string
+		ColumnType string
+		ColumnKey  string
+	}
+	err := s.db.Raw("SELECT COLUMN_NAME AS column_name, DATA_TYPE AS data_type, COLUMN_TYPE AS column_type, COLUMN_KEY AS column_key "+
+		"FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=? AND TABLE_NAME=? ORDER BY ORDINAL_POSITION", schema, table).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != int(tm.ColumnCount) {
+		return nil, fmt.Errorf("表 %s 的字段数量 %d 与 binlog 中的 %d 不一致，表结构已经变化", key, len(rows), tm.ColumnCount)
+	}
+	names := tm.ColumnNameString()
+	columns := make([]binlogColumn, 0, len(rows))
+	for i, r := range rows {
+		col := binlogColumn{
+			name:     r.ColumnName,
+			dataType: strings.ToLower(r.DataType),
+			typ:      r.ColumnType,
+			key:      r.ColumnKey == "PRI",
+			unsigned: strings.Contains(strings.ToLower(r.ColumnType), "unsigned"),
+		}
+		if i < len(names) && names[i] != "" {
+			col.name = names[i]
+		}
+		col.sqlType = mysqlSQLType(col.dataType)
+		columns = append(columns, col)
+	}
+	s.tables.Store(key, columns)
+	return columns, nil
+}
+
+// binlogColumns 将一行 binlog 数据转为 canal 格式的字段，before 不为空时标记修改过的字段
+func binlogColumns(columns []binlogColumn, row []any, before []any) []*pbe.Column {
+	result := make([]*pbe.Column, 0, len(columns))
+	for i, meta := range columns {
+		col := &pbe.Column{
+			Index:     int32(i),
+			Name:      meta.name,
+			IsKey:     meta.key,
+			SqlType:   meta.sqlType,
+			MysqlType: meta.typ,
+		}
+		var v any
+		if i < len(row) {
+			v = row[i]
+		}
+		if v == nil {
+			col.IsNullPresent = &pbe.Column_IsNull{IsNull: true}
+		} else {
+			col.Value = binlogValue(meta, v)
+		}
+		if before != nil && i < len(before) {
+			col.Updated = fmt.Sprint(before[i]) != fmt.Sprint(v)
+		}
+		result = append(result, col)
+	}
+	return result
+}
+
+// binlogValue 按 canal 的格式将 binlog 中的值转为字符串
+func binlogValue(meta binlogColumn, v any) string {
+	switch val := v.(type) {
+	case int8:
+		if meta.unsigned {
+			return strconv.FormatUint(uint64(uint8(val)), 10)
+		}
+		return strconv.FormatInt(int64(val), 10)
+	case int16:
+		if meta.unsigned {
+			return strconv.FormatUint(uint64(uint16(val)), 10)
+		}
+		return strconv.FormatInt(int64(val), 10)
+	case int32:
+		if meta.unsigned {
+			if meta.dataType == "mediumint" {
+				return strconv.FormatUint(uint64(uint32(val)&0xFFFFFF), 10)
+			}
+			return strconv.FormatUint(uint64(uint32(val)), 10)
+		}
+		return strconv.FormatInt(int64(val), 10)
+	case int64:
+		if meta.unsigned {
+			return strconv.FormatUint(uint64(val), 10)
+		}
+		return strconv.FormatInt(val, 10)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case []byte:
+		if isBinarySQLType(meta.sqlType) {
+			// 与 canal 一致，二进制数据按 ISO-8859-1 编码
+			r := make([]rune, len(val))
+			for i, c := range val {
+				r[i] = rune(c)
+			}
+			return string(r)
+		}
+		return string(val)
+	case string:
+		return val
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05.999999")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// mysqlSQLType 将 MySQL 的 DATA_TYPE 转为 canal 使用的 java.sql.Types
+func mysqlSQLType(dataType string) int32 {
+	switch dataType {
+	case "bit":
+		return cdc.SQLTypeBit
+	case "tinyint":
+		return cdc.SQLTypeTinyInt
+	case "smallint":
+		return cdc.SQLTypeSmallInt
+	case "mediumint", "int", "integer":
+		return cdc.SQLTypeInteger
+	case "bigint":
+		return cdc.SQLTypeBigInt
+	case "float":
+		return cdc.SQLTypeReal
+	case "double", "real":
+		return cdc.SQLTypeDouble
+	case "decimal", "numeric":
+		return cdc.SQLTypeDecimal
+	case "date":
+		return cdc.SQLTypeDate
+	case "time":
+		return cdc.SQLTypeTime
+	case "datetime", "timestamp":
+		return cdc.SQLTypeTimestamp
+	case "binary":
+		return cdc.SQLTypeBinary
+	case "varbinary":
+		return cdc.SQLTypeVarBinary
+	case "tinyblob", "blob", "mediumblob", "longblob":
+		return cdc.SQLTypeBlob
+	case "char":
+		return cdc.SQLTypeChar
+	case "tinytext", "text", "mediumtext", "longtext":
+		return cdc.SQLTypeClob
+	default: // varchar、json、enum、set、year 等
+		return cdc.SQLTypeVarchar
+	}
+}
+
+func isBinarySQLType(sqlType int32) bool {
+	switch sqlType {
+	case cdc.SQLTypeBinary, cdc.SQLTypeVarBinary, cdc.SQLTypeLongVarBinary, cdc.SQLTypeBlob:
+		return true
+	default:
+		return false
+	}
+}
+
+// ddlEventType DDL 对应的 canal 事件类型
+func ddlEventType(sql string) pbe.EventType {
+	types := ddlTypes(sql)
+	if len(types) == 0 {
+		return pbe.EventType_QUERY
+	}
+	switch typ := types[0]; {
+	case typ == "CREATE TABLE":
+		return pbe.EventType_CREATE
+	case typ == "DROP TABLE":
+		return pbe.EventType_ERASE
+	case typ == "TRUNCATE TABLE":
+		return pbe.EventType_TRUNCATE
+	case typ == "RENAME TABLE":
+		return pbe.EventType_RENAME
+	case typ == "CREATE INDEX":
+		return pbe.EventType_CINDEX
+	case typ == "DROP INDEX":
+		return pbe.EventType_DINDEX
+	case strings.HasPrefix(typ, "ALTER TABLE"):
+		return pbe.EventType_ALTER
+	default:
+		return pbe.EventType_QUERY
+	}
+}
+
+// ddlTable 解析 DDL 操作的库表，语句中没有指定库名时使用 schema
+func ddlTable(sql string, schema string) (string, string) {
+	words := strings.Fields(normalizeSQL(sql))
+	origin := strings.Fields(sql)
+	name := ""
+	for i, w := range words {
+		switch w {
+		case "TABLE", "ON": // ALTER/CREATE/DROP/TRUNCATE/RENAME TABLE name、CREATE INDEX idx ON name
+			j := i + 1
+			for j < len(words) && (words[j] == "IF" || words[j] == "NOT" || words[j] == "EXISTS") {
+				j++
+			}
+			if j < len(words) {
+				name = findOriginal(origin, words[j])
+			}
+		case "TRUNCATE":
+			if i+1 < len(words) && words[i+1] != "TABLE" {
+				name = findOriginal(origin, words[i+1])
+			}
+		}
+		if name != "" {
+			break
+		}
+	}
+	if idx := strings.IndexAny(name, "(;"); idx >= 0 {
+		name = name[:idx]
+	}
+	if idx := strings.Index(name, "."); idx >= 0 {
+		schema, name = name[:idx], name[idx+1:]
+	}
+	return strings.Trim(schema, "`"), strings.Trim(name, "`")
+}
+
+// findOriginal 按不区分大小写的方式找到原始语句中的单词，保留表名的大小写
+func findOriginal(origin []string, word string) string {
+	for _, w := range origin {
+		if strings.EqualFold(w, word) {
+			return w
+		}
+	}
+	return word
+}
@@ -0,0 +1,238 @@
+package fix
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/replication"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDDLTable(t *testing.T) {
+	testCases := []struct {
+		sql    string
+		schema string
+		table  string
+	}{
+		{sql: "ALTER TABLE `users` ADD COLUMN age int", schema: "test", table: "users"},
+		{sql: "alter table other.Users add age int", schema: "other", table: "Users"},
+		{sql: "CREATE TABLE IF NOT EXISTS `test`.`users_bak`(id bigint)", schema: "test", table: "users_bak"},
+		{sql: "CREATE INDEX idx_name ON users (name)", schema: "test", table: "users"},
+		{sql: "TRUNCATE users", schema: "test", table: "users"},
+		{sql: "DROP TABLE /* generated */ users", schema: "test", table: "users"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.sql, func(t *testing.T) {
+			schema, table := ddlTable(tc.sql, "test")
+			if schema != tc.schema || table != tc.table {
+				t.Fatalf("expect %s.%s, got %s.%s", tc.schema, tc.table, schema, table)
+			}
+		})
+	}
+}
+
+func TestBinlogValue(t *testing.T) {
+	testCases := []struct {
+		name string
+		meta binlogColumn
+		v    any
+		want string
+	}{
+		{name: "unsigned bigint", meta: binlogColumn{unsigned: true}, v: int64(-1), want: "18446744073709551615"},
+		{name: "signed tinyint", meta: binlogColumn{}, v: int8(-1), want: "-1"},
+		{name: "unsigned tinyint", meta: binlogColumn{unsigned: true}, v: int8(-1), want: "255"},
+		{name: "unsigned mediumint", meta: binlogColumn{dataType: "mediumint", unsigned: true}, v: int32(-1), want: "16777215"},
+		{name: "double", meta: binlogColumn{}, v: 1.5, want: "1.5"},
+		{name: "text", meta: binlogColumn{sqlType: cdc.SQLTypeClob}, v: []byte("中文"), want: "中文"},
+		{name: "binary", meta: binlogColumn{sqlType: cdc.SQLTypeBinary}, v: []byte{0xff}, want: "ÿ"},
+		{name: "datetime", meta: binlogColumn{}, v: "2023-07-01 12:00:00", want: "2023-07-01 12:00:00"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := binlogValue(tc.meta, tc.v); got != tc.want {
+				t.Fatalf("expect %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDDLEventType(t *testing.T) {
+	testCases := []struct {
+		sql  string
+		want pbe.EventType
+	}{
+		{sql: "ALTER TABLE users ADD COLUMN age int", want: pbe.EventType_ALTER},
+		{sql: "CREATE TABLE users_bak(id bigint)", want: pbe.EventType_CREATE},
+		{sql: "DROP TABLE users_bak", want: pbe.EventType_ERASE},
+		{sql: "TRUNCATE TABLE users", want: pbe.EventType_TRUNCATE},
+		{sql: "CREATE UNIQUE INDEX uk_email ON users (email)", want: pbe.EventType_CINDEX},
+		{sql: "GRANT ALL ON *.* TO canal", want: pbe.EventType_QUERY},
+	}
+	for _, tc := range testCases {
+		if got := ddlEventType(tc.sql); got != tc.want {
+			t.Fatalf("%s: expect %s, got %s", tc.sql, tc.want, got)
+		}
+	}
+}
+
+func TestBinlogStart(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pos      Position
+		gtid     bool
+		wantGTID bool
+		wantErr  bool
+	}{
+		{name: "file", pos: Position{File: "mysql-bin.000001", Offset: 4}},
+		{name: "gtid", pos: Position{File: "mysql-bin.000001", Offset: 4, GTID: "uuid:1-5"}, gtid: true, wantGTID: true},
+		{name: "gtid without file", pos: Position{GTID: "uuid:1-5"}, gtid: true, wantGTID: true},
+		// 没有开启 GTID 时保存的位点，按 file:offset 继续读取
+		{name: "gtid fallback to file", pos: Position{File: "mysql-bin.000001", Offset: 4}, gtid: true},
+		{name: "gtid without gtid set", pos: Position{Timestamp: 1}, gtid: true, wantErr: true},
+		{name: "file without file", pos: Position{GTID: "uuid:1-5"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := binlogStart(tc.pos, tc.gtid)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expect error %t, got %v", tc.wantErr, err)
+			}
+			if got != tc.wantGTID {
+				t.Fatalf("expect gtid %t, got %t", tc.wantGTID, got)
+			}
+		})
+	}
+}
+
+// queryEvent 构造位于 offset 的 QueryEvent
+func queryEvent(offset uint32, query string) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT, LogPos: offset},
+		Event:  &replication.QueryEvent{Schema: []byte("test"), Query: []byte(query)},
+	}
+}
+
+// insertEvent 构造位于 offset、插入 test.users 中 ID 为 id 的行事件
+func insertEvent(offset uint32, id int64) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, LogPos: offset},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("users"), ColumnCount: 1},
+			Rows:  [][]any{{id}},
+		},
+	}
+}
+
+func TestBinlogFetch(t *testing.T) {
+	streamer := replication.NewBinlogStreamer()
+	s := &BinlogSource{streamer: streamer, file: "mysql-bin.000001"}
+	s.tables.Store("test.users", []binlogColumn{{name: "id", dataType: "bigint", key: true}})
+	events := []*replication.BinlogEvent{
+		queryEvent(100, "BEGIN"),
+		insertEvent(200, 1),
+		queryEvent(300, "SAVEPOINT sp1"),
+		insertEvent(400, 2),
+		queryEvent(500, "ROLLBACK TO SAVEPOINT sp1"),
+		insertEvent(600, 3),
+		{Header: &replication.EventHeader{EventType: replication.XID_EVENT, LogPos: 700}, Event: &replication.XIDEvent{}},
+		queryEvent(800, "ALTER TABLE users ADD COLUMN age int"),
+	}
+	for _, ev := range events {
+		if err := streamer.AddEventToStreamer(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// SAVEPOINT 不切分事务，批次在 XID 处结束
+	b, err := s.Fetch(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Position{File: "mysql-bin.000001", Offset: 700}
+	if b == nil || len(b.Events) != 3 || b.Position.File != want.File || b.Position.Offset != want.Offset {
+		t.Fatalf("expect 3 events at %s, got %+v", want, b)
+	}
+	for i, e := range b.Events {
+		if e.IsDDL || e.Type != pbe.EventType_INSERT {
+			t.Fatalf("unexpected event %d: %+v", i, e)
+		}
+	}
+
+	// DDL 自动提交
+	if b, err = s.Fetch(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if b == nil || len(b.Events) != 1 || !b.Events[0].IsDDL || b.Position.Offset != 800 {
+		t.Fatalf("expect DDL at 800, got %+v", b)
+	}
+}
+
+// TestBinlogSource 需要本地 127.0.0.1:3306 的 mysqld 开启 binlog_format=ROW，连接失败时跳过
+func TestBinlogSource(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:3306", time.Second)
+	if err != nil {
+		t.Skip("本地没有 mysqld:", err)
+	}
+	_ = conn.Close()
+	db, err := gorm.Open(mysql.Open("root:Mysql_1234@tcp(127.0.0.1:3306)/test?charset=utf8mb4&parseTime=True&loc=Local"),
+		&gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Skip("连接 mysqld 失败:", err)
+	}
+	table := fmt.Sprintf("binlog_test_%d", time.Now().UnixNano())
+	if err = db.Exec("CREATE TABLE " + table + " (id bigint unsigned PRIMARY KEY, name varchar(32))").Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE " + table)
+
+	s := NewBinlogSource(BinlogConfig{Host: "127.0.0.1", Port: 3306, User: "root", Password: "Mysql_1234", ServerID: 1001},
+		db, &memoryPositionStore{})
+	if err = s.Connect("test\\." + table); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	db.Exec("INSERT INTO "+table+" VALUES (?, ?)", 1, "tom")
+	db.Exec("UPDATE "+table+" SET name=? WHERE id=?", "jack", 1)
+	db.Exec("DELETE FROM "+table+" WHERE id=?", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	var events []cdc.ChangeEvent
+	for len(events) < 3 {
+		b, er := s.Fetch(ctx, 100)
+		if er != nil {
+			t.Fatal(er)
+		}
+		if b == nil {
+			continue
+		}
+		events = append(events, b.Events...)
+		if err = s.Ack(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []pbe.EventType{pbe.EventType_INSERT, pbe.EventType_UPDATE, pbe.EventType_DELETE}
+	for i, e := range events {
+		if e.Type != want[i] || e.Table != table {
+			t.Fatalf("unexpected event %d: %+v", i, e)
+		}
+	}
+	if id, er := parseID(events[1].After); er != nil || id != 1 {
+		t.Fatalf("expect id 1, got %d error:%v", id, er)
+	}
+	if name := events[1].After.Value("name"); name != "jack" {
+		t.Fatalf("expect name jack, got %v", name)
+	}
+	if updated := events[1].Updated(); len(updated) != 1 || updated[0].Name != "name" {
+		t.Fatalf("expect name updated, got %v", updated)
+	}
+}
@@ -0,0 +1,288 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"strings"
+)
+
+// ErrNoPendingDDL 没有等待确认的 DDL
+var ErrNoPendingDDL = errors.New("没有等待确认的 DDL")
+
+// DDLEvent 源库执行的 DDL
+type DDLEvent struct {
+	Schema   string   `json:"schema"`
+	Table    string   `json:"table"`
+	SQL      string   `json:"sql"`
+	Types    []string `json:"types"` // 语句类型，例如 ALTER TABLE ADD COLUMN
+	Position Position `json:"position"`
+}
+
+// WithDDLAllow 设置允许直接在目标库执行的 DDL 语句类型，例如 "ALTER TABLE ADD COLUMN"、"CREATE INDEX"，
+// 其它的 DDL 会暂停增量修复，告警后等待运维人员调用 ConfirmDDL 确认
+func WithDDLAllow(types ...string) Optional {
+	return func(f *User) {
+		for _, typ := range types {
+			f.ddlAllow[normalizeSQL(typ)] = struct{}{}
+		}
+	}
+}
+
+// WithDDLAlert 设置 DDL 需要人工确认时的告警
+func WithDDLAlert(alert func(ddl DDLEvent)) Optional {
+	return func(f *User) {
+		f.ddlAlert = alert
+	}
+}
+
+// PendingDDL 获取等待确认的 DDL
+func (f *User) PendingDDL() (DDLEvent, bool) {
+	f.ddlLock.Lock()
+	defer f.ddlLock.Unlock()
+	if f.ddlPending == nil {
+		return DDLEvent{}, false
+	}
+	return *f.ddlPending, true
+}
+
+// ConfirmDDL 确认目标库已经处理了等待中的 DDL（例如人工执行或者确认忽略），增量修复继续运行
+func (f *User) ConfirmDDL() error {
+	f.ddlLock.Lock()
+	defer f.ddlLock.Unlock()
+	if f.ddlPending == nil {
+		return ErrNoPendingDDL
+	}
+	f.ddlPending = nil
+	f.ddlConfirm <- struct{}{}
+	return nil
+}
+
+// handleDDL 处理 DDL，允许的语句直接在目标库执行，否则暂停直到运维人员确认
+func (f *User) handleDDL(ctx context.Context, ddl *DDLEvent) error {
+	log.Println(fmt.Sprintf("源库执行了 DDL binlog[%s] name[%s,%s] types:%v sql: %s", ddl.Position, ddl.Schema, ddl.Table, ddl.Types, ddl.SQL))
+	if f.ddlAllowed(ddl) {
+		if err := f.tdb.WithContext(ctx).Exec(ddl.SQL).Error; err != nil {
+			if ddlApplied(err) { // 重新投递的 DDL，目标库已经执行过
+				log.Println(fmt.Errorf("目标库已经执行过 DDL，跳过 sql:%s error:%w", ddl.SQL, err))
+				return nil
+			}
+			return fmt.Errorf("目标库执行 DDL 失败 sql:%s error:%w", ddl.SQL, err)
+		}
+		log.Println("目标库执行 DDL 成功:", ddl.SQL)
+		return nil
+	}
+
+	f.ddlLock.Lock()
+	f.ddlPending = ddl
+	f.ddlLock.Unlock()
+	f.ddlAlert(*ddl)
+	log.Println("增量修复已暂停，等待确认 DDL:", ddl.SQL)
+
+	select {
+	case <-f.ddlConfirm:
+		log.Println("DDL 已确认，增量修复继续运行:", ddl.SQL)
+		return nil
+	case <-ctx.Done():
+		f.ddlLock.Lock()
+		f.ddlPending = nil
+		// 丢弃和退出同时发生的确认，避免影响下一个 DDL
+		select {
+		case <-f.ddlConfirm:
+		default:
+		}
+		f.ddlLock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ddlAllowed DDL 的全部语句类型都在允许列表中
+func (f *User) ddlAllowed(ddl *DDLEvent) bool {
+	if len(ddl.Types) == 0 {
+		return false
+	}
+	for _, typ := range ddl.Types {
+		if _, ok := f.ddlAllow[typ]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ddlApplied DDL 的错误是否表示目标库已经执行过该 DDL：
+// 表已经存在、表不存在、字段或者索引已经存在、字段或者索引不存在
+func ddlApplied(err error) bool {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) {
+		return false
+	}
+	switch me.Number {
+	case 1050, 1051, 1060, 1061, 1091:
+		return true
+	}
+	return false
+}
+
+// sameDDL 是否是同一个 DDL，没有 binlog 文件位点时按语句和执行时间判断
+func sameDDL(a, b *DDLEvent) bool {
+	return a.Schema == b.Schema && a.Table == b.Table && a.SQL == b.SQL && a.Position == b.Position
+}
+
+// defaultDDLAlert 默认的告警只打印日志
+func defaultDDLAlert(ddl DDLEvent) {
+	log.Println(fmt.Sprintf("告警：DDL 需要人工确认 binlog[%s] name[%s,%s] sql: %s", ddl.Position, ddl.Schema, ddl.Table, ddl.SQL))
+}
+
+// nonDDL 不是 DDL 的语句：事务控制语句和语句格式的 DML
+var nonDDL = map[string]struct{}{
+	"BEGIN": {}, "START": {}, "COMMIT": {}, "ROLLBACK": {}, "SAVEPOINT": {}, "RELEASE": {}, "XA": {},
+	"INSERT": {}, "UPDATE": {}, "DELETE": {}, "REPLACE": {},
+}
+
+// isDDL 是否是 DDL 语句，DDL 会隐式提交事务
+func isDDL(sql string) bool {
+	return len(ddlTypes(sql)) > 0
+}
+
+// ddlTypes 解析 DDL 的语句类型，ALTER TABLE 的每个子句对应一个类型，不是 DDL 时返回 nil
+func ddlTypes(sql string) []string {
+	words := strings.Fields(normalizeSQL(sql))
+	if len(words) < 2 {
+		return nil
+	}
+	if _, ok := nonDDL[words[0]]; ok {
+		return nil
+	}
+	switch words[0] {
+	case "ALTER":
+		if words[1] != "TABLE" {
+			return []string{"ALTER " + words[1]}
+		}
+		if len(words) < 4 {
+			return nil
+		}
+		// ALTER TABLE name clause, clause ...
+		clauses := splitClauses(strings.Join(words[3:], " "))
+		types := make([]string, 0, len(clauses))
+		for _, clause := range clauses {
+			types = append(types, "ALTER TABLE "+alterClauseType(strings.Fields(clause)))
+		}
+		return types
+	case "CREATE", "DROP":
+		// CREATE [UNIQUE|FULLTEXT|SPATIAL] INDEX、CREATE [TEMPORARY] TABLE
+		for _, w := range words[1:] {
+			switch w {
+			case "TABLE", "INDEX", "VIEW", "DATABASE", "SCHEMA", "TRIGGER", "PROCEDURE", "FUNCTION", "EVENT":
+				return []string{words[0] + " " + w}
+			}
+		}
+		return []string{words[0] + " " + words[1]}
+	case "TRUNCATE", "RENAME":
+		return []string{words[0] + " TABLE"}
+	default:
+		return []string{words[0]}
+	}
+}
+
+// alterClauseType 解析 ALTER TABLE 子句的类型
+func alterClauseType(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	action := words[0]
+	switch action {
+	case "ADD", "DROP":
+		if len(words) == 1 {
+			return action
+		}
+		switch words[1] {
+		case "INDEX", "KEY", "UNIQUE", "FULLTEXT", "SPATIAL":
+			return action + " INDEX"
+		case "PRIMARY", "FOREIGN", "CONSTRAINT", "CHECK", "PARTITION":
+			return action + " " + words[1]
+		default: // ADD [COLUMN] col_name ...
+			return action + " COLUMN"
+		}
+	case "MODIFY", "CHANGE", "ALTER":
+		return action + " COLUMN"
+	default:
+		return action
+	}
+}
+
+// splitClauses 按不在括号和引号中的逗号切分 ALTER TABLE 的子句
+func splitClauses(s string) []string {
+	var (
+		clauses []string
+		depth   int
+		quote   rune
+		start   int
+	)
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			clauses = append(clauses, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(clauses, strings.TrimSpace(s[start:]))
+}
+
+// normalizeSQL 去掉引号之外的注释，合并空白字符并转为大写
+func normalizeSQL(sql string) string {
+	var (
+		b     strings.Builder
+		quote byte
+	)
+	for len(sql) > 0 {
+		switch {
+		case quote != 0: // 引号中的内容原样保留，字符串中的反斜杠转义下一个字符
+			if quote != '`' && sql[0] == '\\' && len(sql) > 1 {
+				b.WriteString(sql[:2])
+				sql = sql[2:]
+				continue
+			}
+			if sql[0] == quote {
+				quote = 0
+			}
+			b.WriteByte(sql[0])
+			sql = sql[1:]
+		case sql[0] == '\'' || sql[0] == '"' || sql[0] == '`':
+			quote = sql[0]
+			b.WriteByte(sql[0])
+			sql = sql[1:]
+		case strings.HasPrefix(sql, "/*"):
+			end := strings.Index(sql[2:], "*/")
+			if end < 0 {
+				sql = ""
+				continue
+			}
+			sql = sql[end+4:]
+			b.WriteByte(' ')
+		case strings.HasPrefix(sql, "-- "), strings.HasPrefix(sql, "#"):
+			end := strings.IndexByte(sql, '\n')
+			if end < 0 {
+				sql = ""
+				continue
+			}
+			sql = sql[end+1:]
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(sql[0])
+			sql = sql[1:]
+		}
+	}
+	return strings.ToUpper(strings.Join(strings.Fields(b.String()), " "))
+}
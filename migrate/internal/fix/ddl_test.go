@@ -0,0 +1,305 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDDLTypes(t *testing.T) {
+	testCases := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{
+			name: "add column",
+			sql:  "ALTER TABLE `users` ADD COLUMN `age` int DEFAULT '0'",
+			want: []string{"ALTER TABLE ADD COLUMN"},
+		},
+		{
+			name: "multiple clauses",
+			sql:  "alter table users add age int, drop index idx_name, modify `name` varchar(10)",
+			want: []string{"ALTER TABLE ADD COLUMN", "ALTER TABLE DROP INDEX", "ALTER TABLE MODIFY COLUMN"},
+		},
+		{
+			name: "comma in parentheses",
+			sql:  "ALTER TABLE users ADD UNIQUE KEY uk_name_email (name, email)",
+			want: []string{"ALTER TABLE ADD INDEX"},
+		},
+		{
+			name: "comment",
+			sql:  "/* gh-ost */ ALTER TABLE users\n\tADD  age int",
+			want: []string{"ALTER TABLE ADD COLUMN"},
+		},
+		{
+			name: "hash in string",
+			sql:  "ALTER TABLE users ADD tag varchar(10) DEFAULT '#', DROP INDEX idx_name # drop",
+			want: []string{"ALTER TABLE ADD COLUMN", "ALTER TABLE DROP INDEX"},
+		},
+		{
+			name: "hash in identifier",
+			sql:  "ALTER TABLE users ADD `a#b` int,\n\tADD `c` int -- comment\n",
+			want: []string{"ALTER TABLE ADD COLUMN", "ALTER TABLE ADD COLUMN"},
+		},
+		{
+			name: "create index",
+			sql:  "CREATE UNIQUE INDEX uk_email ON users (email)",
+			want: []string{"CREATE INDEX"},
+		},
+		{
+			name: "drop table",
+			sql:  "DROP TABLE IF EXISTS `users`",
+			want: []string{"DROP TABLE"},
+		},
+		{
+			name: "truncate",
+			sql:  "TRUNCATE users",
+			want: []string{"TRUNCATE TABLE"},
+		},
+		{
+			name: "savepoint",
+			sql:  "SAVEPOINT sp1",
+		},
+		{
+			name: "xa",
+			sql:  "XA START 'xid'",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ddlTypes(tc.sql)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expect %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDDLAllowed(t *testing.T) {
+	f := NewFixUser(nil, nil, WithDDLAllow("alter table add column", "CREATE INDEX"))
+	if !f.ddlAllowed(&DDLEvent{Types: ddlTypes("ALTER TABLE users ADD age int, ADD nick varchar(10)")}) {
+		t.Fatal("expect add column allowed")
+	}
+	if f.ddlAllowed(&DDLEvent{Types: ddlTypes("ALTER TABLE users ADD age int, DROP name")}) {
+		t.Fatal("expect drop column not allowed")
+	}
+}
+
+func TestNormalizeSQL(t *testing.T) {
+	testCases := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{name: "comments", sql: "/* a */ alter table t # b\n add c int -- d", want: "ALTER TABLE T ADD C INT"},
+		{name: "hash in string", sql: "add c varchar(1) default '#' # x", want: "ADD C VARCHAR(1) DEFAULT '#'"},
+		{name: "escaped quote", sql: `comment 'it\'s # -- /*' # x`, want: `COMMENT 'IT\'S # -- /*'`},
+		{name: "double quote", sql: `comment "a # b" /* x */`, want: `COMMENT "A # B"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeSQL(tc.sql); got != tc.want {
+				t.Fatalf("expect %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleDDL(t *testing.T) {
+	ddl := func(sql string) *DDLEvent {
+		return &DDLEvent{Schema: "test", Table: "users", SQL: sql, Types: ddlTypes(sql),
+			Position: Position{File: "mysql-bin.000001", Offset: 100}}
+	}
+	alerts := make(chan DDLEvent, 1)
+	tdb := dbtest.NewSQLite(t)
+	f := NewFixUser(nil, tdb, WithDDLAllow("ALTER TABLE ADD COLUMN"),
+		WithDDLAlert(func(ddl DDLEvent) { alerts <- ddl }))
+
+	// 允许的 DDL 直接在目标库执行
+	if err := f.handleDDL(context.Background(), ddl("ALTER TABLE users ADD COLUMN age int")); err != nil {
+		t.Fatal(err)
+	}
+	if !tdb.Migrator().HasColumn("users", "age") {
+		t.Fatal("expect column age added")
+	}
+	if err := f.ConfirmDDL(); !errors.Is(err, ErrNoPendingDDL) {
+		t.Fatalf("expect %v, got %v", ErrNoPendingDDL, err)
+	}
+
+	// 其它的 DDL 暂停直到确认
+	pending := ddl("ALTER TABLE users DROP COLUMN age")
+	done := make(chan error, 1)
+	go func() {
+		done <- f.handleDDL(context.Background(), pending)
+	}()
+	select {
+	case got := <-alerts:
+		if got.SQL != pending.SQL {
+			t.Fatalf("expect alert %s, got %s", pending.SQL, got.SQL)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect alert")
+	}
+	if got, ok := f.PendingDDL(); !ok || got.SQL != pending.SQL {
+		t.Fatalf("expect pending %s, got %+v", pending.SQL, got)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expect paused, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := f.ConfirmDDL(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect resumed after confirm")
+	}
+	if _, ok := f.PendingDDL(); ok {
+		t.Fatal("expect no pending DDL")
+	}
+	// 没有执行需要确认的 DDL
+	if !tdb.Migrator().HasColumn("users", "age") {
+		t.Fatal("expect column age kept")
+	}
+
+	// 等待确认时退出
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- f.handleDDL(ctx, pending)
+	}()
+	<-alerts
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect returned after cancel")
+	}
+	if _, ok := f.PendingDDL(); ok {
+		t.Fatal("expect no pending DDL after cancel")
+	}
+	if err := f.ConfirmDDL(); !errors.Is(err, ErrNoPendingDDL) {
+		t.Fatalf("expect %v, got %v", ErrNoPendingDDL, err)
+	}
+}
+
+func TestApplyDDLRedelivered(t *testing.T) {
+	tdb := dbtest.NewSQLite(t)
+	f := NewFixUser(nil, tdb, WithDDLAllow("ALTER TABLE ADD COLUMN"))
+	// Kafka 的 FlatMessage 只有执行时间，没有 binlog 文件位点
+	sql := "ALTER TABLE users ADD COLUMN age int"
+	events := []rowEvent{{typ: pbe.EventType_ALTER, ddl: &DDLEvent{Schema: "test", Table: "users", SQL: sql,
+		Types: ddlTypes(sql), Position: Position{Timestamp: 1690000000000}}}}
+	for i := 0; i < 2; i++ {
+		if err := f.apply(context.Background(), events); err != nil {
+			t.Fatalf("apply %d: %v", i, err)
+		}
+	}
+	if !tdb.Migrator().HasColumn("users", "age") {
+		t.Fatal("expect column age added")
+	}
+}
+
+func TestApplyDDLRollback(t *testing.T) {
+	errFail := errors.New("fail")
+	testCases := []struct {
+		name string
+		sql  string
+	}{
+		{name: "allowed", sql: "ALTER TABLE users ADD COLUMN age int"},
+		{name: "confirmed", sql: "ALTER TABLE users DROP COLUMN email"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+			dbtest.SeedUsers(t, sdb, testUsers(1, 2)...)
+			// 第一次投递时 DDL 之前的行变更写入成功，DDL 之后的行变更失败
+			fail, writes := true, 0
+			err := tdb.Callback().Create().Before("gorm:create").Register("test:fail", func(tx *gorm.DB) {
+				if writes++; fail && writes > 1 {
+					_ = tx.AddError(errFail)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				f      *User
+				alerts int
+			)
+			f = NewFixUser(sdb, tdb, WithDDLAllow("ALTER TABLE ADD COLUMN"), WithDDLAlert(func(DDLEvent) {
+				alerts++
+				_ = f.ConfirmDDL()
+			}))
+			ddlPos := Position{File: "mysql-bin.000001", Offset: 200}
+			changes := []cdc.ChangeEvent{
+				changeEvent(pbe.EventType_UPDATE, 1, 100),
+				{Schema: "test", Table: "users", Type: pbe.EventType_ALTER, IsDDL: true, SQL: tc.sql, Position: ddlPos},
+				changeEvent(pbe.EventType_UPDATE, 2, 300),
+			}
+			apply := func() error {
+				events, er := f.parseEvents(changes)
+				if er != nil {
+					return er
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				return f.apply(ctx, events)
+			}
+			if err = apply(); !errors.Is(err, errFail) {
+				t.Fatalf("expect %v, got %v", errFail, err)
+			}
+			if f.pos != ddlPos {
+				t.Fatalf("expect position %s, got %s", ddlPos, f.pos)
+			}
+
+			// 重新投递时跳过已经处理的 DDL：允许的 DDL 重复执行会失败，需要确认的 DDL 不会再次告警
+			fail = false
+			if err = apply(); err != nil {
+				t.Fatal(err)
+			}
+			if alerts > 1 {
+				t.Fatalf("expect DDL confirmed once, got %d alerts", alerts)
+			}
+			if got := dbtest.Users(t, tdb); len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+				t.Fatalf("expect users 1 and 2, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestDDLApplied(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "duplicate column", err: &mysql.MySQLError{Number: 1060}, want: true},
+		{name: "wrapped", err: fmt.Errorf("exec: %w", &mysql.MySQLError{Number: 1091}), want: true},
+		{name: "other mysql error", err: &mysql.MySQLError{Number: 1146}},
+		{name: "other error", err: errors.New("duplicate column")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ddlApplied(tc.err); got != tc.want {
+				t.Fatalf("expect %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
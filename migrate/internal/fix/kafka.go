@@ -0,0 +1,424 @@
+package fix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/gogo/protobuf/proto"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	pbp "github.com/withlin/canal-go/protocol/packet"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KafkaFormat canal 投递到 Kafka 的消息格式，对应 canal.mq.flatMessage
+type KafkaFormat int
+
+const (
+	FlatMessage  KafkaFormat = iota // canal.mq.flatMessage = true，JSON 格式
+	ProtoMessage                    // canal.mq.flatMessage = false，protobuf 格式
+)
+
+// kafkaPollTimeout Fetch 等待第一条消息的时长
+const kafkaPollTimeout = time.Millisecond * 100
+
+// KafkaSource 使用 Kafka 的 canal 消息作为数据源，消费者组提交的 offset 即为消费位点，
+// 多个消费者可以使用同一个消费者组分摊分区，也可以使用新的消费者组从头重放 binlog
+type KafkaSource struct {
+	brokers []string
+	group   string
+	topics  []string
+	format  KafkaFormat
+	config  *sarama.Config
+
+	filter  string
+	filters []*regexp.Regexp
+	cg      sarama.ConsumerGroup
+	msgs    chan kafkaMessage
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	batchID int64
+	pending map[int64][]kafkaMessage // 未确认的消息
+	replay  []kafkaMessage           // 回滚的消息，Fetch 优先重新投递
+	lock    sync.Mutex
+}
+
+// kafkaMessage Kafka 消息和它所属的消费者组会话
+type kafkaMessage struct {
+	msg     *sarama.ConsumerMessage
+	session sarama.ConsumerGroupSession
+}
+
+func NewKafkaSource(brokers []string, group string, topics []string, format KafkaFormat) *KafkaSource {
+	config := sarama.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false // 处理成功后才提交 offset
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategyRange}
+	return &KafkaSource{
+		brokers: brokers,
+		group:   group,
+		topics:  topics,
+		format:  format,
+		config:  config,
+		pending: make(map[int64][]kafkaMessage),
+	}
+}
+
+// Connect 加入消费者组，从已提交的 offset 开始消费，filter 在客户端过滤库表
+func (s *KafkaSource) Connect(filter string) error {
+	filters, err := compileFilter(filter)
+	if err != nil {
+		return err
+	}
+	cg, err := sarama.NewConsumerGroup(s.brokers, s.group, s.config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.lock.Lock()
+	s.filter = filter
+	s.filters = filters
+	s.cg = cg
+	s.msgs = make(chan kafkaMessage)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.lock.Unlock()
+
+	go func(msgs chan kafkaMessage, done chan struct{}) {
+		defer close(done)
+		for ctx.Err() == nil {
+			if er := cg.Consume(ctx, s.topics, &kafkaHandler{msgs: msgs}); er != nil {
+				if errors.Is(er, sarama.ErrClosedConsumerGroup) {
+					return
+				}
+				log.Println(fmt.Errorf("消费 Kafka 失败 error:%w", er))
+				time.Sleep(time.Second)
+			}
+		}
+	}(s.msgs, s.done)
+	return nil
+}
+
+func (s *KafkaSource) Fetch(ctx context.Context, batchSize int) (*Batch, error) {
+	msgs := make([]kafkaMessage, 0, batchSize)
+	s.lock.Lock()
+	n := len(s.replay)
+	if n > batchSize {
+		n = batchSize
+	}
+	msgs = append(msgs, s.replay[:n]...)
+	s.replay = s.replay[n:]
+	s.lock.Unlock()
+	if len(msgs) > 0 {
+		return s.batch(msgs)
+	}
+
+	timer := time.NewTimer(kafkaPollTimeout)
+	defer timer.Stop()
+	// 等待第一条消息，之后只获取已经到达的消息
+	select {
+	case m := <-s.msgs:
+		msgs = append(msgs, m)
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+loop:
+	for len(msgs) < batchSize {
+		select {
+		case m := <-s.msgs:
+			msgs = append(msgs, m)
+		default:
+			break loop
+		}
+	}
+	return s.batch(msgs)
+}
+
+// batch 将消息记录为未确认的批次并解析
+func (s *KafkaSource) batch(msgs []kafkaMessage) (*Batch, error) {
+	s.lock.Lock()
+	s.batchID++
+	b := &Batch{ID: s.batchID}
+	s.pending[b.ID] = msgs
+	s.lock.Unlock()
+
+	for _, m := range msgs {
+		events, err := s.decode(m.msg)
+		if err != nil {
+			return b, fmt.Errorf("解析 Kafka 消息失败 topic:%s partition:%d offset:%d error:%w",
+				m.msg.Topic, m.msg.Partition, m.msg.Offset, err)
+		}
+		for _, e := range events {
+			if matchFilter(s.filters, e.Schema, e.Table) {
+				b.Events = append(b.Events, e)
+			}
+		}
+	}
+	return b, nil
+}
+
+// Ack 标记并提交批次中消息的 offset
+func (s *KafkaSource) Ack(b *Batch) error {
+	s.lock.Lock()
+	msgs := s.pending[b.ID]
+	delete(s.pending, b.ID)
+	s.lock.Unlock()
+
+	sessions := make(map[sarama.ConsumerGroupSession]struct{})
+	for _, m := range msgs {
+		m.session.MarkMessage(m.msg, "")
+		sessions[m.session] = struct{}{}
+	}
+	for session := range sessions {
+		session.Commit()
+	}
+	return nil
+}
+
+// Rollback 将分区回退到批次的第一条消息，不需要重新加入消费者组：
+// 批次和之后获取的未确认批次的消息按获取顺序放回队列头部，Fetch 从这些消息重新投递，
+// 之后获取的批次随之回滚，保证每个分区仍然按 offset 顺序投递。
+// 期间分区被重新分配时，新的消费者从已提交的 offset 开始消费，消息可能重复投递
+func (s *KafkaSource) Rollback(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]int64, 0, len(s.pending))
+	for id := range s.pending {
+		if id >= b.ID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var msgs []kafkaMessage
+	for _, id := range ids {
+		msgs = append(msgs, s.pending[id]...)
+		delete(s.pending, id)
+	}
+	s.replay = append(msgs, s.replay...)
+	return nil
+}
+
+func (s *KafkaSource) Close() error {
+	s.lock.Lock()
+	cg, cancel, done := s.cg, s.cancel, s.done
+	s.cg = nil
+	// 重新加入消费者组后从已提交的 offset 开始消费
+	s.pending = make(map[int64][]kafkaMessage)
+	s.replay = nil
+	s.lock.Unlock()
+	if cg == nil {
+		return nil
+	}
+	cancel()
+	err := cg.Close()
+	<-done
+	return err
+}
+
+// decode 按消息格式解析 Kafka 消息
+func (s *KafkaSource) decode(msg *sarama.ConsumerMessage) ([]cdc.ChangeEvent, error) {
+	if s.format == ProtoMessage {
+		return decodeProtoMessage(msg.Value)
+	}
+	return decodeFlatMessage(msg.Value)
+}
+
+// kafkaHandler 将消费者组的消息转发给 Fetch
+type kafkaHandler struct {
+	msgs chan kafkaMessage
+}
+
+func (h *kafkaHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case h.msgs <- kafkaMessage{msg: msg, session: session}:
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// flatMessage canal.mq.flatMessage = true 时的消息格式
+type flatMessage struct {
+	ID        int64                `json:"id"`
+	Database  string               `json:"database"`
+	Table     string               `json:"table"`
+	PkNames   []string             `json:"pkNames"`
+	IsDdl     bool                 `json:"isDdl"`
+	Type      string               `json:"type"`
+	Es        int64                `json:"es"` // binlog 的执行时间
+	Ts        int64                `json:"ts"` // canal 的处理时间
+	SQL       string               `json:"sql"`
+	SqlType   map[string]int32     `json:"sqlType"`
+	MysqlType map[string]string    `json:"mysqlType"`
+	Data      []map[string]*string `json:"data"`
+	Old       []map[string]*string `json:"old"`
+	Gtid      string               `json:"gtid"`
+}
+
+// decodeFlatMessage 解析 JSON 格式的 canal 消息
+// FlatMessage 没有 binlog 的文件和偏移量，位点只有执行时间，消费位点由 Kafka 的 offset 记录
+func decodeFlatMessage(data []byte) ([]cdc.ChangeEvent, error) {
+	var m flatMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	typ, ok := pbe.EventType_value[strings.ToUpper(m.Type)]
+	if !ok {
+		typ = int32(pbe.EventType_QUERY)
+	}
+	base := cdc.ChangeEvent{
+		Schema: m.Database,
+		Table:  m.Table,
+		Type:   pbe.EventType(typ),
+		IsDDL:  m.IsDdl,
+		SQL:    m.SQL,
+	}
+	if m.Es > 0 {
+		base.Timestamp = time.UnixMilli(m.Es)
+	}
+	if m.IsDdl {
+		return []cdc.ChangeEvent{base}, nil
+	}
+
+	keys := make(map[string]bool, len(m.PkNames))
+	for _, pk := range m.PkNames {
+		keys[pk] = true
+	}
+	rows := make([]*pbe.RowData, 0, len(m.Data))
+	for i, row := range m.Data {
+		columns := flatColumns(&m, keys, row)
+		rowData := &pbe.RowData{}
+		switch base.Type {
+		case pbe.EventType_DELETE:
+			rowData.BeforeColumns = columns
+		case pbe.EventType_UPDATE:
+			// old 只包含修改过的字段
+			var old map[string]*string
+			if i < len(m.Old) {
+				old = m.Old[i]
+			}
+			before := make(map[string]*string, len(row))
+			for name, v := range row {
+				before[name] = v
+			}
+			for name, v := range old {
+				before[name] = v
+			}
+			rowData.BeforeColumns = flatColumns(&m, keys, before)
+			rowData.AfterColumns = columns
+			for _, col := range columns {
+				_, col.Updated = old[col.Name]
+			}
+		default:
+			rowData.AfterColumns = columns
+		}
+		rows = append(rows, rowData)
+	}
+	return cdc.DecodeRows(base, rows)
+}
+
+// flatColumns 将 FlatMessage 的一行数据转为 canal 的字段，按字段名排序
+func flatColumns(m *flatMessage, keys map[string]bool, row map[string]*string) []*pbe.Column {
+	names := make([]string, 0, len(row))
+	for name := range row {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columns := make([]*pbe.Column, 0, len(names))
+	for _, name := range names {
+		col := &pbe.Column{
+			Name:      name,
+			SqlType:   m.SqlType[name],
+			MysqlType: m.MysqlType[name],
+			IsKey:     keys[name],
+		}
+		if v := row[name]; v == nil {
+			col.IsNullPresent = &pbe.Column_IsNull{IsNull: true}
+		} else {
+			col.Value = *v
+		}
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// decodeProtoMessage 解析 protobuf 格式的 canal 消息，与 canal TCP 协议的 Messages 包相同
+func decodeProtoMessage(data []byte) ([]cdc.ChangeEvent, error) {
+	p := new(pbp.Packet)
+	if err := proto.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.GetType() != pbp.PacketType_MESSAGES {
+		return nil, fmt.Errorf("错误的 canal 消息类型 %s", p.GetType())
+	}
+	messages := new(pbp.Messages)
+	if err := proto.Unmarshal(p.GetBody(), messages); err != nil {
+		return nil, err
+	}
+	entries := make([]pbe.Entry, len(messages.GetMessages()))
+	for i, value := range messages.GetMessages() {
+		if err := proto.Unmarshal(value, &entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return cdc.DecodeEntries(entries)
+}
+
+// compileFilter 编译 canal 格式的过滤规则，多个正则之间以逗号分隔，匹配 schema.table
+func compileFilter(filter string) ([]*regexp.Regexp, error) {
+	var filters []*regexp.Regexp
+	for _, expr := range strings.Split(filter, ",") {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?i:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("错误的过滤规则 %s error:%w", expr, err)
+		}
+		filters = append(filters, re)
+	}
+	return filters, nil
+}
+
+// matchFilter 库表是否匹配过滤规则，没有规则时全部匹配
+func matchFilter(filters []*regexp.Regexp, schema, table string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	name := schema + "." + table
+	for _, re := range filters {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
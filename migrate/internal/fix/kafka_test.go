@@ -0,0 +1,112 @@
+package fix
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFlatMessage(t *testing.T) {
+	data := []byte(`{"data":[{"id":"1","name":"tom","email":null}],"database":"test","es":1690000000000,"id":3,
+"isDdl":false,"mysqlType":{"id":"bigint unsigned","name":"longtext","email":"longtext"},"old":[{"name":"jack"}],
+"pkNames":["id"],"sql":"","sqlType":{"id":-5,"name":2005,"email":2005},"table":"users","ts":1690000000001,"type":"UPDATE"}`)
+	events, err := decodeFlatMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Schema != "test" || e.Table != "users" || e.Type != pbe.EventType_UPDATE || e.Timestamp.UnixMilli() != 1690000000000 {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	id, err := parseID(e.After)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("expect id 1, got %d", id)
+	}
+	if name := e.Before.Value("name"); name != "jack" {
+		t.Fatalf("expect old name jack, got %v", name)
+	}
+	if email, _ := e.Before.Get("email"); !email.IsNull {
+		t.Fatal("expect null email")
+	}
+	for _, col := range e.After {
+		if col.Updated != (col.Name == "name") {
+			t.Fatalf("unexpected updated flag of %s", col.Name)
+		}
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	filters, err := compileFilter("test\\.users, canal\\..*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		schema string
+		table  string
+		want   bool
+	}{
+		{schema: "test", table: "users", want: true},
+		{schema: "test", table: "users_bak", want: false},
+		{schema: "canal", table: "anything", want: true},
+		{schema: "other", table: "users", want: false},
+	}
+	for _, tc := range testCases {
+		if got := matchFilter(filters, tc.schema, tc.table); got != tc.want {
+			t.Fatalf("%s.%s expect %t, got %t", tc.schema, tc.table, tc.want, got)
+		}
+	}
+}
+
+func TestKafkaRollback(t *testing.T) {
+	s := NewKafkaSource(nil, "test", []string{"canal"}, FlatMessage)
+	s.msgs = make(chan kafkaMessage, 5)
+	for offset := int64(0); offset < 5; offset++ {
+		value := fmt.Sprintf(`{"data":[{"id":"%d"}],"database":"test","table":"users","pkNames":["id"],"type":"INSERT"}`, offset)
+		s.msgs <- kafkaMessage{msg: &sarama.ConsumerMessage{Topic: "canal", Offset: offset, Value: []byte(value)}}
+	}
+	fetch := func(batchSize int) (*Batch, []int64) {
+		t.Helper()
+		b, err := s.Fetch(context.Background(), batchSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		var offsets []int64
+		for _, m := range s.pending[b.ID] {
+			offsets = append(offsets, m.msg.Offset)
+		}
+		return b, offsets
+	}
+
+	b1, _ := fetch(2)
+	b2, _ := fetch(2)
+	// 回滚第一个批次时之后的批次一起回滚，从第一个批次的 offset 重新投递
+	if err := s.Rollback(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rollback(b2); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]int64{{0, 1, 2}, {3}, {4}} {
+		b, got := fetch(3)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expect offsets %v, got %v", want, got)
+		}
+		if len(b.Events) != len(want) {
+			t.Fatalf("expect %d events, got %d", len(want), len(b.Events))
+		}
+	}
+	if b, err := s.Fetch(context.Background(), 3); b != nil || err != nil {
+		t.Fatalf("expect no batch, got %v %v", b, err)
+	}
+}
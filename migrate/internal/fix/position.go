@@ -0,0 +1,117 @@
+package fix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Position binlog 位点，与 canal 工具共用 cdc.Position
+type Position = cdc.Position
+
+// ParsePosition 解析 file:offset 格式的位点，例如 mysql-bin.000003:154
+func ParsePosition(s string) (Position, error) {
+	var pos Position
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return pos, fmt.Errorf("错误的 binlog 位点 %s，格式为 file:offset", s)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(s[i+1:]), 10, 64)
+	if err != nil {
+		return pos, fmt.Errorf("错误的 binlog 位点 %s error:%w", s, err)
+	}
+	pos.File = strings.TrimSpace(s[:i])
+	pos.Offset = offset
+	if pos.File == "" {
+		return pos, fmt.Errorf("错误的 binlog 位点 %s，缺少 binlog 文件", s)
+	}
+	return pos, nil
+}
+
+// PositionStore 用于持久化已经处理的 binlog 位点
+type PositionStore interface {
+	Load() (Position, error)
+	Save(pos Position) error
+}
+
+// FilePositionStore 将位点以 JSON 格式保存到本地文件
+type FilePositionStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFilePositionStore(path string) *FilePositionStore {
+	return &FilePositionStore{path: path}
+}
+
+// Load 读取位点，文件不存在时返回空位点
+func (s *FilePositionStore) Load() (Position, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var pos Position
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pos, nil
+		}
+		return pos, err
+	}
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+// Save 保存位点，先写临时文件再重命名，避免进程崩溃时写坏位点文件
+func (s *FilePositionStore) Save(pos Position) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// memoryPositionStore 默认的位点存储，只保存在内存中
+type memoryPositionStore struct {
+	pos  Position
+	lock sync.Mutex
+}
+
+// NewMemoryPositionStore 创建只保存在内存中的位点存储，pos 为初始位点，例如回放 binlog 的起点
+func NewMemoryPositionStore(pos Position) PositionStore {
+	return &memoryPositionStore{pos: pos}
+}
+
+func (s *memoryPositionStore) Load() (Position, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pos, nil
+}
+
+func (s *memoryPositionStore) Save(pos Position) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pos = pos
+	return nil
+}
@@ -0,0 +1,76 @@
+package fix
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePosition(t *testing.T) {
+	testCases := []struct {
+		s       string
+		want    Position
+		wantErr bool
+	}{
+		{s: "mysql-bin.000003:154", want: Position{File: "mysql-bin.000003", Offset: 154}},
+		{s: "mysql-bin.000003 : 154", want: Position{File: "mysql-bin.000003", Offset: 154}},
+		{s: "mysql-bin.000003", wantErr: true},
+		{s: ":154", wantErr: true},
+		{s: "mysql-bin.000003:abc", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParsePosition(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected error %v", tc.s, err)
+		}
+		if !tc.wantErr && got != tc.want {
+			t.Fatalf("%s: expect %+v, got %+v", tc.s, tc.want, got)
+		}
+	}
+}
+
+func TestFilePositionStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "position.json")
+	s := NewFilePositionStore(path)
+	pos, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pos.IsZero() {
+		t.Fatalf("expect zero position, got %s", pos)
+	}
+
+	for _, want := range []Position{
+		{File: "mysql-bin.000003", Offset: 154, Timestamp: 1690000000000},
+		{File: "mysql-bin.000004", Offset: 4, GTID: "uuid:1-5"},
+	} {
+		if err = s.Save(want); err != nil {
+			t.Fatal(err)
+		}
+		// 重新打开，模拟进程重启
+		if pos, err = NewFilePositionStore(path).Load(); err != nil {
+			t.Fatal(err)
+		}
+		if pos != want {
+			t.Fatalf("expect %+v, got %+v", want, pos)
+		}
+	}
+
+	// 重命名替换位点文件，不留下临时文件
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "position.json" {
+		t.Fatalf("expect only position.json, got %v", entries)
+	}
+
+	// 进程在写临时文件时崩溃，留下的临时文件不影响已经保存的位点
+	if err = os.WriteFile(path+".123", []byte(`{"file":"mysql`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err = s.Load(); err != nil || pos.File != "mysql-bin.000004" {
+		t.Fatalf("expect position kept, got %s error:%v", pos, err)
+	}
+}
@@ -0,0 +1,264 @@
+package fix
+
+import (
+	"context"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"log"
+	"time"
+)
+
+// userDiff 一批数据在目标库需要创建、更新和删除的行
+type userDiff struct {
+	create []models.User
+	update []models.User
+	delete []uint64
+}
+
+// diffUsers 比对一批 ID 范围相同的数据，以源库为准
+func diffUsers(sUsers, tUsers []models.User) userDiff {
+	var d userDiff
+	sum := models.Users.Index(sUsers)
+	tum := models.Users.Index(tUsers)
+	for i := range sUsers {
+		su := &sUsers[i]
+		if tu, ok := tum[su.ID]; !ok { // 源库新建的
+			d.create = append(d.create, *su)
+		} else if su.Checksum() != tu.Checksum() {
+			d.update = append(d.update, *su)
+		}
+	}
+	for i := range tUsers {
+		if _, ok := sum[tUsers[i].ID]; !ok { // 源库已经删除
+			d.delete = append(d.delete, tUsers[i].ID)
+		}
+	}
+	return d
+}
+
+func (d userDiff) len() int {
+	return len(d.create) + len(d.update) + len(d.delete)
+}
+
+// ids 所有不一致的 ID
+func (d userDiff) ids() []uint64 {
+	ids := make([]uint64, 0, d.len())
+	for i := range d.create {
+		ids = append(ids, d.create[i].ID)
+	}
+	for i := range d.update {
+		ids = append(ids, d.update[i].ID)
+	}
+	return append(ids, d.delete...)
+}
+
+// userWindow 两边 ID 范围相同的一批数据
+type userWindow struct {
+	source []models.User
+	target []models.User
+	upper  uint64 // 本批的最大 ID，last 为 true 时为 0
+	last   bool   // 两边都已经读完
+}
+
+// scan 两边按主键各读取一批 ID 大于 prevID 的数据，以两边批次中较小的最大 ID 为界对齐。
+// 批次满了说明后面还有数据，只能比对到两边都读全的 ID；两边的批次都不满时读完
+func (f *User) scan(ctx context.Context, prevID uint64, batchSize int) (userWindow, error) {
+	var w userWindow
+	if err := checkBatchSize(batchSize); err != nil {
+		return w, err
+	}
+	start := time.Now()
+	sUsers, err := models.Users.Batch(ctx, f.srdb, prevID, batchSize)
+	f.throttle.Observe(time.Since(start))
+	if err != nil {
+		return w, err
+	}
+	tUsers, err := models.Users.Batch(ctx, f.trdb, prevID, batchSize)
+	if err != nil {
+		return w, err
+	}
+
+	w.last = true
+	if len(sUsers) == batchSize {
+		w.upper, w.last = sUsers[len(sUsers)-1].ID, false
+	}
+	if len(tUsers) == batchSize && (w.last || tUsers[len(tUsers)-1].ID < w.upper) {
+		w.upper, w.last = tUsers[len(tUsers)-1].ID, false
+	}
+	if !w.last {
+		sUsers = usersUpTo(sUsers, w.upper)
+		tUsers = usersUpTo(tUsers, w.upper)
+	}
+	w.source, w.target = sUsers, tUsers
+	return w, nil
+}
+
+// checkBatchSize batchSize 小于等于 0 时每批都读不满也读不到数据，会把后面的数据当作不存在
+func checkBatchSize(batchSize int) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("batchSize 必须大于 0，当前为 %d", batchSize)
+	}
+	return nil
+}
+
+// usersUpTo 返回 ID 不大于 upper 的数据，users 按 ID 升序排列
+func usersUpTo(users []models.User, upper uint64) []models.User {
+	for i := range users {
+		if users[i].ID > upper {
+			return users[:i]
+		}
+	}
+	return users
+}
+
+// confirm 从从库读取时，从主库重新读取 sUsers 和 tUsers 中不一致的行并替换，
+// 避免从库的复制延迟导致错误的修复。返回替换后的数据，以及从库上不一致、主库上已经一致的行数
+func (f *User) confirm(ctx context.Context, sUsers, tUsers []models.User) ([]models.User, []models.User, int, error) {
+	if !f.replica {
+		return sUsers, tUsers, 0, nil
+	}
+	ids := diffUsers(sUsers, tUsers).ids()
+	if len(ids) == 0 {
+		return sUsers, tUsers, 0, nil
+	}
+	ps, err := models.Users.ByIDs(ctx, f.sdb, ids)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("从源库确认不一致的数据失败 error:%w", err)
+	}
+	ps = f.live(ps)
+	pt, err := models.Users.ByIDs(ctx, f.tdb, ids)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("从目标库确认不一致的数据失败 error:%w", err)
+	}
+	stale := len(ids) - diffUsers(ps, pt).len()
+	if stale > 0 {
+		log.Println("从库不一致、主库已经一致的数量:", stale)
+	}
+	suspect := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		suspect[id] = struct{}{}
+	}
+	return replaceUsers(sUsers, suspect, ps), replaceUsers(tUsers, suspect, pt), stale, nil
+}
+
+// live 设置了 WithSkipDeleted 时去掉已经软删除的行，不修改 users。
+// 用于源库的数据，去掉的行在目标库中按源库已经删除处理
+func (f *User) live(users []models.User) []models.User {
+	if !f.skipDeleted {
+		return users
+	}
+	res := make([]models.User, 0, len(users))
+	for i := range users {
+		if !users[i].DeletedAt.Valid {
+			res = append(res, users[i])
+		}
+	}
+	return res
+}
+
+// replaceUsers 将 users 中 ID 在 suspect 中的行替换为 fresh，不修改 users
+func replaceUsers(users []models.User, suspect map[uint64]struct{}, fresh []models.User) []models.User {
+	res := make([]models.User, 0, len(users)+len(fresh))
+	for i := range users {
+		if _, ok := suspect[users[i].ID]; !ok {
+			res = append(res, users[i])
+		}
+	}
+	return append(res, fresh...)
+}
+
+// reconcile 比对一批 ID 范围相同的数据并修复目标库，写入目标库失败时只记录在结果中。
+// 从从库读取时只修复在主库上仍然不一致的数据
+func (f *User) reconcile(ctx context.Context, sUsers, tUsers []models.User) (fixCount, error) {
+	var c fixCount
+	sUsers, tUsers, stale, err := f.confirm(ctx, f.live(sUsers), tUsers)
+	if err != nil {
+		return c, err
+	}
+	c.stale = stale
+	d := diffUsers(sUsers, tUsers)
+
+	for i := range d.update {
+		su := &d.update[i]
+		log.Println("从目的库中更新 ID:", su.ID)
+		updated, er := models.Users.Update(ctx, f.tdb, su)
+		switch {
+		case er != nil:
+			log.Println(fmt.Errorf("更新目的库失败，ID: %d err:%w", su.ID, er))
+			c.failed++
+		case !updated: // 比对之后双写更新了目标库
+			log.Println("目的库的数据更新，跳过 ID:", su.ID)
+			c.skipped++
+		default:
+			c.updated++
+		}
+	}
+	if len(d.create) > 0 {
+		log.Println("从目标库中批量创建的数量:", len(d.create))
+		// 比对之后双写可能已经插入，主键冲突时只覆盖不比源库新的行
+		if er := models.Users.UpsertBatch(ctx, f.tdb, d.create, len(d.create)); er != nil {
+			log.Println(fmt.Errorf("插入目的库失败， err:%w", er))
+			c.failed += len(d.create)
+		} else {
+			created := f.written(ctx, d.create)
+			c.created += created
+			c.skipped += len(d.create) - created
+		}
+	}
+	if len(d.delete) > 0 {
+		ids, er := f.orphans(ctx, d.delete)
+		if er != nil {
+			return c, er
+		}
+		c.skipped += len(d.delete) - len(ids)
+		log.Println("从目标库中批量删除的数量:", len(ids))
+		if er = models.Users.DeleteBatch(ctx, f.tdb, ids); er != nil {
+			log.Println(fmt.Errorf("删除目的库失败， err:%w", er))
+			c.failed += len(ids)
+		} else {
+			c.deleted += len(ids)
+		}
+	}
+	return c, nil
+}
+
+// written 从目标库重新读取 upsert 的行，返回与 users 一致的行数。
+// 不一致的行在目标库中更新（例如比对之后双写已经写入），没有被覆盖；读取失败时按全部写入计算
+func (f *User) written(ctx context.Context, users []models.User) int {
+	ids := make([]uint64, 0, len(users))
+	for i := range users {
+		ids = append(ids, users[i].ID)
+	}
+	tUsers, err := models.Users.ByIDs(ctx, f.tdb, ids)
+	if err != nil {
+		log.Println(fmt.Errorf("从目标库确认写入的数据失败 error:%w", err))
+		return len(users)
+	}
+	tum := models.Users.Index(tUsers)
+	n := 0
+	for i := range users {
+		if tu, ok := tum[users[i].ID]; ok && tu.Checksum() == users[i].Checksum() {
+			n++
+		}
+	}
+	return n
+}
+
+// orphans 删除前从源库主库重新读取，返回源库中仍然不存在的 ID。
+// 读取源库之后、读取目标库之前双写插入的行，目标库中存在而读到的源库数据中没有，不能删除
+func (f *User) orphans(ctx context.Context, ids []uint64) ([]uint64, error) {
+	sUsers, err := models.Users.ByIDs(ctx, f.sdb, ids)
+	if err != nil {
+		return nil, fmt.Errorf("删除前从源库确认数据失败 error:%w", err)
+	}
+	sum := models.Users.Index(f.live(sUsers))
+	res := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := sum[id]; ok {
+			log.Println("源库中已经存在，跳过删除 ID:", id)
+			continue
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
@@ -0,0 +1,35 @@
+package fix
+
+import (
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+	"time"
+)
+
+// userColumns 构造 models.User 需要的字段
+var userColumns = []string{"id", "name", "email", "birthday", "created_at", "updated_at", "deleted_at"}
+
+// parseUser 根据 binlog 的行数据构造 models.User
+// 行数据缺少字段时（例如 binlog_row_image=MINIMAL）complete 返回 false，需要从源库重新获取
+func parseUser(row cdc.Row) (user *models.User, complete bool, err error) {
+	for _, name := range userColumns {
+		if _, ok := row.Get(name); !ok {
+			return nil, false, nil
+		}
+	}
+
+	user = &models.User{}
+	if user.ID, err = userID(row.Value("id")); err != nil {
+		return nil, false, err
+	}
+	user.Name, _ = row.Value("name").(string)
+	user.Email, _ = row.Value("email").(string)
+	user.Birthday, _ = row.Value("birthday").(time.Time)
+	user.CreatedAt, _ = row.Value("created_at").(time.Time)
+	user.UpdatedAt, _ = row.Value("updated_at").(time.Time)
+	if t, ok := row.Value("deleted_at").(time.Time); ok { // 没有软删除时为 NULL
+		user.DeletedAt = gorm.DeletedAt{Time: t, Valid: true}
+	}
+	return user, true, nil
+}
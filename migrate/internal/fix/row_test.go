@@ -0,0 +1,101 @@
+package fix
+
+import (
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"testing"
+	"time"
+)
+
+func column(name string, sqlType int32, mysqlType string, value string) *pbe.Column {
+	return &pbe.Column{
+		Name:      name,
+		SqlType:   sqlType,
+		MysqlType: mysqlType,
+		Value:     value,
+	}
+}
+
+func nullColumn(name string, sqlType int32, mysqlType string) *pbe.Column {
+	c := column(name, sqlType, mysqlType, "")
+	c.IsNullPresent = &pbe.Column_IsNull{IsNull: true}
+	return c
+}
+
+func decodeColumns(t *testing.T, columns ...*pbe.Column) cdc.Row {
+	row, err := cdc.DecodeColumns(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
+func TestParseUser(t *testing.T) {
+	row := decodeColumns(t,
+		column("id", cdc.SQLTypeBigInt, "bigint unsigned", "18446744073709551615"),
+		column("name", cdc.SQLTypeClob, "longtext", "tom"),
+		column("email", cdc.SQLTypeClob, "longtext", "tom@example.com"),
+		column("birthday", cdc.SQLTypeTimestamp, "datetime(3)", "2000-01-02 03:04:05.678"),
+		column("created_at", cdc.SQLTypeTimestamp, "datetime(3)", "2023-08-01 10:00:00"),
+		column("updated_at", cdc.SQLTypeTimestamp, "datetime(3)", "2023-08-01 10:00:01.5"),
+		nullColumn("deleted_at", cdc.SQLTypeTimestamp, "datetime(3)"),
+	)
+	user, complete, err := parseUser(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Fatal("expect complete row image")
+	}
+	if user.ID != 18446744073709551615 || user.Name != "tom" || user.Email != "tom@example.com" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	birthday := time.Date(2000, 1, 2, 3, 4, 5, 678000000, time.Local)
+	if !user.Birthday.Equal(birthday) {
+		t.Fatalf("expect birthday %s, got %s", birthday, user.Birthday)
+	}
+	updatedAt := time.Date(2023, 8, 1, 10, 0, 1, 500000000, time.Local)
+	if !user.UpdatedAt.Equal(updatedAt) {
+		t.Fatalf("expect updated_at %s, got %s", updatedAt, user.UpdatedAt)
+	}
+	if user.DeletedAt.Valid {
+		t.Fatalf("expect not deleted, got %s", user.DeletedAt.Time)
+	}
+}
+
+func TestParseUserDeleted(t *testing.T) {
+	row := decodeColumns(t,
+		column("id", cdc.SQLTypeBigInt, "bigint unsigned", "1"),
+		column("name", cdc.SQLTypeClob, "longtext", "tom"),
+		column("email", cdc.SQLTypeClob, "longtext", "tom@example.com"),
+		column("birthday", cdc.SQLTypeTimestamp, "datetime(3)", "2000-01-02 03:04:05"),
+		column("created_at", cdc.SQLTypeTimestamp, "datetime(3)", "2023-08-01 10:00:00"),
+		column("updated_at", cdc.SQLTypeTimestamp, "datetime(3)", "2023-08-01 10:00:01"),
+		column("deleted_at", cdc.SQLTypeTimestamp, "datetime(3)", "2023-08-02 10:00:00"),
+	)
+	user, complete, err := parseUser(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Fatal("expect complete row image")
+	}
+	deletedAt := time.Date(2023, 8, 2, 10, 0, 0, 0, time.Local)
+	if !user.DeletedAt.Valid || !user.DeletedAt.Time.Equal(deletedAt) {
+		t.Fatalf("expect deleted_at %s, got %+v", deletedAt, user.DeletedAt)
+	}
+}
+
+func TestParseUserIncomplete(t *testing.T) {
+	row := decodeColumns(t,
+		column("id", cdc.SQLTypeBigInt, "bigint unsigned", "1"),
+		column("name", cdc.SQLTypeClob, "longtext", "tom"),
+	)
+	_, complete, err := parseUser(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Fatal("expect incomplete row image")
+	}
+}
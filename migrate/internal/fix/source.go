@@ -0,0 +1,92 @@
+package fix
+
+import (
+	"context"
+	"github.com/withlin/canal-go/client"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+)
+
+// Batch 数据源的一批 binlog 变更
+type Batch struct {
+	ID       int64
+	Events   []cdc.ChangeEvent // 每行数据一个变更事件，按 binlog 顺序排列
+	Position Position          // 最后一条 binlog 的位点，数据源不提供 binlog 位点时为空
+}
+
+// Source binlog 数据源，处理成功后 Ack，失败则 Rollback，数据源会重新投递未确认的批次
+type Source interface {
+	// Connect 连接数据源并订阅 filter 匹配的表，filter 为 Perl 正则表达式，多个正则之间以逗号分隔
+	Connect(filter string) error
+	// Fetch 获取一批 binlog 变更，没有数据时返回 nil
+	Fetch(ctx context.Context, batchSize int) (*Batch, error)
+	Ack(b *Batch) error
+	Rollback(b *Batch) error
+	Close() error
+}
+
+// canalSource 使用 canal 的 TCP 连接作为数据源
+type canalSource struct {
+	conn client.CanalConnector
+}
+
+// NewCanalSource 使用 canal 的 SimpleCanalConnector 或者 ClusterCanalConnector 作为数据源
+func NewCanalSource(conn client.CanalConnector) Source {
+	return &canalSource{conn: conn}
+}
+
+func (s *canalSource) Connect(filter string) error {
+	if err := s.conn.Connect(); err != nil {
+		return err
+	}
+	return s.conn.Subscribe(filter)
+}
+
+func (s *canalSource) Fetch(_ context.Context, batchSize int) (*Batch, error) {
+	message, err := s.conn.GetWithOutAck(int32(batchSize), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if message == nil || message.Id == -1 || len(message.Entries) <= 0 {
+		return nil, nil
+	}
+	b := &Batch{ID: message.Id, Position: entryPosition(&message.Entries[len(message.Entries)-1])}
+	b.Events, err = cdc.DecodeEntries(message.Entries)
+	if err != nil {
+		// 回滚由调用方负责
+		return b, err
+	}
+	return b, nil
+}
+
+func (s *canalSource) Ack(b *Batch) error {
+	return s.conn.Ack(b.ID)
+}
+
+func (s *canalSource) Rollback(b *Batch) error {
+	return s.conn.RollBack(b.ID)
+}
+
+func (s *canalSource) Close() error {
+	return s.conn.DisConnection()
+}
+
+// entryPosition 获取 binlog 的位点
+func entryPosition(entry *pbe.Entry) Position {
+	header := entry.GetHeader()
+	return Position{
+		File:      header.GetLogfileName(),
+		Offset:    header.GetLogfileOffset(),
+		GTID:      header.GetGtid(),
+		Timestamp: header.GetExecuteTime(),
+	}
+}
+
+// eventPosition 获取变更事件的位点
+func eventPosition(e *cdc.ChangeEvent) Position {
+	pos := e.Position
+	if !e.Timestamp.IsZero() {
+		pos.Timestamp = e.Timestamp.UnixMilli()
+	}
+	return pos
+}
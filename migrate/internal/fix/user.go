@@ -4,16 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/gogo/protobuf/proto"
 	"github.com/withlin/canal-go/client"
-	pbe "github.com/withlin/canal-go/protocol/entry"
 	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/throttle"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
 	"gorm.io/gorm"
 	"log"
-	"strconv"
+	"sync"
 	"time"
 )
 
+// maxBackoff 数据源重连的最大退避时长
+const maxBackoff = time.Second * 30
+
 type Optional func(f *User)
 
 func WithSleep(d time.Duration) Optional {
@@ -28,23 +31,118 @@ func WithUpdatedAt(u time.Time) Optional {
 	}
 }
 
-func WithCanal(c *client.SimpleCanalConnector) Optional {
+func WithCanal(c client.CanalConnector) Optional {
+	return func(f *User) {
+		f.source = NewCanalSource(c)
+	}
+}
+
+// WithSource 设置 binlog 数据源，例如 canal 或者 Kafka
+func WithSource(s Source) Optional {
+	return func(f *User) {
+		f.source = s
+	}
+}
+
+// WithFilter 设置订阅的表，Perl 正则表达式，多个正则之间以逗号分隔
+func WithFilter(filter string) Optional {
+	return func(f *User) {
+		f.filter = filter
+	}
+}
+
+// WithPositionStore 设置 binlog 位点的存储
+func WithPositionStore(s PositionStore) Optional {
+	return func(f *User) {
+		f.store = s
+	}
+}
+
+// WithRowImage 直接使用 binlog 中的行数据写入目标库，不再从源库重新获取
+// 行数据不完整时仍然从源库获取
+func WithRowImage(enable bool) Optional {
+	return func(f *User) {
+		f.rowImage = enable
+	}
+}
+
+// WithRetry 设置数据源断开后的重连次数和初始退避时长，retries 小于等于 0 表示一直重试
+func WithRetry(retries int, backoff time.Duration) Optional {
+	return func(f *User) {
+		f.retries = retries
+		f.backoff = backoff
+	}
+}
+
+// WithThrottle 设置全量修复、按 updated_at 增量修复和校验的自适应限速，在每批之间的休眠之后执行，
+// 读取源库的延迟会上报给 t
+func WithThrottle(t *throttle.Throttle) Optional {
+	return func(f *User) {
+		f.throttle = t
+	}
+}
+
+// WithReplicas 设置 FixFull、FixIncByUpdatedAt 和 Verify 批量读取使用的从库，为 nil 时使用主库。
+// 从库上不一致的数据会再从主库读取确认，只修复主库上仍然不一致的数据
+func WithReplicas(source, target *gorm.DB) Optional {
+	return func(f *User) {
+		if source != nil {
+			f.srdb = source
+			f.replica = true
+		}
+		if target != nil {
+			f.trdb = target
+			f.replica = true
+		}
+	}
+}
+
+// WithSkipDeleted 忽略源库已经软删除的行：源库软删除的行当作已经删除，不再写入目标库，
+// 目标库中对应的行会被物理删除。默认软删除作为普通的更新同步到目标库
+func WithSkipDeleted(skip bool) Optional {
 	return func(f *User) {
-		f.conn = c
+		f.skipDeleted = skip
 	}
 }
 
 // User 用于校验和修目标数据库的表 user
 // FixFull 和 FixIncByUpdatedAt 会对数据库造成压力，
-// 可以考虑从“从库“（目标库和源库的从库，或其中之一的从库）批量获取数据
-// 要是有数据不一致的情况，要从源库再次获取该数据，如何再更新目标库
+// 可以通过 WithReplicas 从“从库“（目标库和源库的从库，或其中之一的从库）批量获取数据，
+// 要是有数据不一致的情况，从主库再次获取该数据，确认后再更新目标库
 type User struct {
-	d         time.Duration                // 休眠时长
-	updatedAt time.Time                    // 上次更新时间
-	quit      chan struct{}                // 用于关闭增量更新
-	sdb       *gorm.DB                     // 源库
-	tdb       *gorm.DB                     // 目标库
-	conn      *client.SimpleCanalConnector // canal
+	d         time.Duration      // 休眠时长
+	updatedAt time.Time          // 上次更新时间
+	quit      chan struct{}      // 用于关闭增量更新
+	sdb       *gorm.DB           // 源库
+	tdb       *gorm.DB           // 目标库
+	srdb      *gorm.DB           // 批量读取源库使用的从库，默认为源库
+	trdb      *gorm.DB           // 批量读取目标库使用的从库，默认为目标库
+	replica   bool               // 是否从从库批量读取
+	source    Source             // binlog 数据源
+	filter    string             // 订阅的表
+	store     PositionStore      // binlog 位点存储
+	pos       Position           // 已经处理的 binlog 位点
+	retries   int                // 数据源重连次数
+	backoff   time.Duration      // 数据源重连的初始退避时长
+	rowImage  bool               // 是否直接使用 binlog 的行数据
+	throttle  *throttle.Throttle // 按源库负载限速
+
+	skipDeleted bool // 是否忽略源库已经软删除的行
+
+	workers       int           // 写入目标库的并发数
+	flushSize     int           // 攒批写入目标库的行数
+	flushInterval time.Duration // 攒批的最长等待时间
+	stats         CDCStats      // binlog 增量修复的统计
+	fixStats      FixStats      // 全量和按 updated_at 增量修复的统计
+	verifyStats   VerifyStats   // 只读校验的进度，与全量修复的进度分开
+	statsLock     sync.RWMutex
+
+	ddlAllow   map[string]struct{} // 允许直接在目标库执行的 DDL 语句类型
+	ddlAlert   func(ddl DDLEvent)  // DDL 需要人工确认时的告警
+	ddlPending *DDLEvent           // 等待确认的 DDL
+	ddlDone    *DDLEvent           // 最近处理完的 DDL，用于跳过回滚后重新投递的同一个 DDL
+	ddlConfirm chan struct{}       // 确认 DDL
+	ddlLock    sync.Mutex
 }
 
 func NewFixUser(sdb *gorm.DB, tdb *gorm.DB, opts ...Optional) *User {
@@ -54,6 +152,17 @@ func NewFixUser(sdb *gorm.DB, tdb *gorm.DB, opts ...Optional) *User {
 		quit:      make(chan struct{}, 1),
 		sdb:       sdb,
 		tdb:       tdb,
+		srdb:      sdb,
+		trdb:      tdb,
+		filter:    "test\\.users",
+		store:     &memoryPositionStore{},
+		backoff:   time.Second,
+		workers:   1,
+		flushSize: 100,
+
+		ddlAllow:   make(map[string]struct{}),
+		ddlAlert:   defaultDDLAlert,
+		ddlConfirm: make(chan struct{}, 1),
 	}
 	for _, opt := range opts {
 		opt(f)
@@ -65,135 +174,80 @@ func (f *User) Close() {
 	f.quit <- struct{}{}
 }
 
-// FixFull 全量比对 fix
-func (f *User) FixFull(ctx context.Context, batchSize int) error {
-	var (
-		prevID uint64
-		sUsers []models.User
-		tUsers []models.User
-		err    error
-	)
+// FixStats 全量和按 updated_at 增量修复的进度
+type FixStats struct {
+	Batches   int64     `json:"batches"`    // 已经比对的批次
+	NextID    uint64    `json:"next_id"`    // 全量修复下一批的起始 ID，之前的 ID 已经比对过
+	Created   int64     `json:"created"`    // 在目标库创建的行数
+	Updated   int64     `json:"updated"`    // 在目标库更新的行数
+	Deleted   int64     `json:"deleted"`    // 在目标库删除的行数
+	Failed    int64     `json:"failed"`     // 写入目标库失败的行数
+	Stale     int64     `json:"stale"`      // 从库上不一致、主库上已经一致的行数
+	Skipped   int64     `json:"skipped"`    // 目标库的行比源库新（例如双写已经写入），没有覆盖或者删除的行数
+	UpdatedAt time.Time `json:"updated_at"` // 按 updated_at 增量修复已经校验到的时间
+}
 
-	// 从源库获取 User
-	sUsers, err = models.FetchUserInterval(ctx, f.sdb, prevID, batchSize)
-	if err != nil {
-		return err
+// fixCount 一批比对的结果
+type fixCount struct {
+	created, updated, deleted, failed, stale, skipped int
+}
+
+// FixStats 获取全量和按 updated_at 增量修复的进度
+func (f *User) FixStats() FixStats {
+	f.statsLock.RLock()
+	defer f.statsLock.RUnlock()
+	return f.fixStats
+}
+
+// recordFix 累加一批比对的结果，nextID 为 0 时不更新全量修复的进度
+func (f *User) recordFix(c fixCount, nextID uint64) {
+	f.statsLock.Lock()
+	defer f.statsLock.Unlock()
+	f.fixStats.Batches++
+	if nextID > 0 {
+		f.fixStats.NextID = nextID
 	}
+	f.fixStats.Created += int64(c.created)
+	f.fixStats.Updated += int64(c.updated)
+	f.fixStats.Deleted += int64(c.deleted)
+	f.fixStats.Failed += int64(c.failed)
+	f.fixStats.Stale += int64(c.stale)
+	f.fixStats.Skipped += int64(c.skipped)
+	f.fixStats.UpdatedAt = f.updatedAt
+}
 
-	// 从目标库获取 User
-	tUsers, err = models.FetchUserInterval(ctx, f.tdb, prevID, batchSize)
-	if err != nil {
+// FixFull 全量比对 fix
+// 两边按主键分批读取，以两边批次中较小的最大 ID 为界比对和修复，直到两边都读完，ID 不连续时也不会漏掉数据
+func (f *User) FixFull(ctx context.Context, batchSize int) error {
+	if err := checkBatchSize(batchSize); err != nil {
 		return err
 	}
-
-	for len(sUsers) != 0 && len(tUsers) != 0 {
-		// 转为 map 类型
-		sum := ParseUsers(sUsers)
-		tum := ParseUsers(tUsers)
-		deleteIDList := make([]uint64, 0)
-		createIDList := make([]models.User, 0)
-		for id := range sum {
-			if tu, exist := tum[id]; !exist { // 源库新建的
-				//log.Println("从目的库中新建 ID:", id)
-				createIDList = append(createIDList, *sum[id])
-			} else { // 源库和目标库都存在
-				su := sum[id]
-				if su.Checksum() == tu.Checksum() { // 记录相同
-					continue
-				} else {
-					log.Println("从目的库中更新 ID:", tu.ID)
-					if er := su.Update(ctx, f.tdb); er != nil {
-						log.Println(fmt.Errorf("更新目的库失败，ID: %d err:%w", tu.ID, er))
-					}
-				}
-				delete(tum, tu.ID) // 移除已经记录的条目
-			}
-		}
-		for id := range tum {
-			if _, exist := sum[id]; !exist { // 源库已经删除
-				//log.Println("从目的库中删除 ID:", id)
-				deleteIDList = append(deleteIDList, id)
-			}
-		}
-
-		if len(createIDList) > 0 {
-			log.Println("1-从目标库中批量创建的数量:", len(createIDList))
-			if er := models.CreateUserBatch(ctx, f.tdb, createIDList); er != nil {
-				log.Println(fmt.Errorf("1-插入目的库失败， err:%w", er))
-			}
-		}
-		if len(deleteIDList) > 0 {
-			log.Println("1-从目标库中批量删除的数量:", len(deleteIDList))
-			if er := models.DeleteUserBatch(ctx, f.tdb, deleteIDList); er != nil {
-				log.Println(fmt.Errorf("删除目的库失败， err:%w", er))
-			}
-		}
-
-		time.Sleep(f.d)
-		prevID += uint64(batchSize)
-		// 从源库获取 User
-		sUsers, err = models.FetchUserInterval(ctx, f.sdb, prevID, batchSize)
+	var prevID uint64
+	for {
+		w, err := f.scan(ctx, prevID, batchSize)
 		if err != nil {
 			return err
 		}
-
-		// 从目标库获取 User
-		tUsers, err = models.FetchUserInterval(ctx, f.tdb, prevID, batchSize)
+		c, err := f.reconcile(ctx, w.source, w.target)
 		if err != nil {
 			return err
 		}
-	}
-
-	prevID += uint64(batchSize)
-
-	// 处理剩下的记录
-	for len(sUsers) != 0 {
-		log.Println("source 处理剩下的记录")
-		newUsers := make([]models.User, 0, len(sUsers))
-		for i := range sUsers {
-			//log.Println("从目的库中创建 ID:", sUsers[i].ID)
-			newUsers = append(newUsers, sUsers[i])
-		}
-		if len(newUsers) > 0 {
-			log.Println("2-批量插入目的库的数量:", len(newUsers))
-			if er := models.CreateUserBatch(ctx, f.tdb, newUsers); er != nil {
-				log.Println(fmt.Errorf("2-插入目的库失败 err:%w", er))
-			}
-		}
-		// 从源库获取 User
-		sUsers, err = models.FetchUserInterval(ctx, f.sdb, prevID, batchSize)
-		if err != nil {
-			return err
-		}
-		prevID += uint64(batchSize)
-		time.Sleep(f.d)
-		log.Println("s:", len(sUsers), "t:", len(tUsers))
-	}
-
-	for len(tUsers) != 0 {
-		log.Println("target 处理剩下的记录")
-		deleteIDList := make([]uint64, 0)
-		for i := range tUsers {
-			u := &tUsers[i]
-			//log.Println("从目的库中删除 ID:", u.ID)
-			deleteIDList = append(deleteIDList, u.ID)
-		}
-		if len(deleteIDList) > 0 {
-			log.Println("2-从目标库中批量删除的数量:", len(deleteIDList))
-			if er := models.DeleteUserBatch(ctx, f.tdb, deleteIDList); er != nil {
-				log.Println(fmt.Errorf("2-删除目的库失败 err:%w", er))
-			}
+		if w.last {
+			f.recordFix(c, 0)
+			return nil
 		}
-		// 从目的库获取 User
-		tUsers, err = models.FetchUserInterval(ctx, f.tdb, prevID, batchSize)
-		if err != nil {
+		prevID = w.upper
+		f.recordFix(c, prevID+1)
+		if err = f.pause(ctx); err != nil {
 			return err
 		}
-		prevID += uint64(batchSize)
-		time.Sleep(f.d)
 	}
+}
 
-	return nil
+// pause 每批之间休眠，再按源库的负载限速
+func (f *User) pause(ctx context.Context) error {
+	time.Sleep(f.d)
+	return f.throttle.Wait(ctx)
 }
 
 // FixIncByUpdatedAt 根据 UpdatedAt 字段增量校验
@@ -208,7 +262,9 @@ func (f *User) FixIncByUpdatedAt(ctx context.Context) error {
 			if err := f.fixByUpdatedAt(ctx); err != nil {
 				return err
 			}
-			time.Sleep(f.d)
+			if err := f.pause(ctx); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -218,231 +274,206 @@ func (f *User) FixIncByUpdatedAt(ctx context.Context) error {
 func (f *User) fixByUpdatedAt(ctx context.Context) error {
 	log.Println("增量校验，updatedAt:", f.updatedAt)
 	// 从源库获取 User
-	sUsers, err := models.FetchUserByUpdatedAt(ctx, f.sdb, f.updatedAt)
+	start := time.Now()
+	sUsers, err := models.Users.UpdatedAfter(ctx, f.srdb, f.updatedAt)
+	f.throttle.Observe(time.Since(start))
 	if err != nil {
 		return err
 	}
 	IDList := make([]uint64, 0, len(sUsers))
-	for i, _ := range sUsers {
+	prevTime := f.updatedAt
+	for i := range sUsers {
 		IDList = append(IDList, sUsers[i].ID)
+		if sUsers[i].UpdatedAt.After(prevTime) {
+			prevTime = sUsers[i].UpdatedAt
+		}
 	}
 	// 从目标库获取 User
 	tUsers := make([]models.User, 0)
 	if len(IDList) > 0 {
-		tUsers, err = models.FetchUserByIDList(ctx, f.tdb, IDList)
+		tUsers, err = models.Users.ByIDs(ctx, f.trdb, IDList)
 		if err != nil {
 			return err
 		}
 	}
 
-	// 转为 map 类型
-	sum := ParseUsers(sUsers)
-	tum := ParseUsers(tUsers)
-	deleteIDList := make([]uint64, 0)
-	createIDList := make([]models.User, 0)
-	prevTime := f.updatedAt
-	for id := range sum {
-		su := sum[id]
-		if su.UpdatedAt.After(prevTime) {
-			prevTime = su.UpdatedAt
-		}
-		if tu, exist := tum[id]; !exist { // 源库新建的
-			//log.Println("从目的库中新建 ID:", id)
-			createIDList = append(createIDList, *sum[id])
-		} else { // 源库和目标库都存在
-			if su.Checksum() == tu.Checksum() { // 记录相同
-				continue
-			} else {
-				log.Println("从目的库中更新 ID:", tu.ID)
-				if er := su.Update(ctx, f.tdb); er != nil {
-					log.Println(fmt.Errorf("更新目的库失败，ID: %d err:%w", tu.ID, er))
-				}
-			}
-			delete(tum, tu.ID) // 移除已经记录的条目
-		}
+	c, err := f.reconcile(ctx, sUsers, tUsers)
+	if err != nil {
+		return err
 	}
 	// 更新时间记录
 	f.updatedAt = prevTime
-
-	for id := range tum {
-		if _, exist := sum[id]; !exist { // 源库已经删除
-			//log.Println("从目的库中删除 ID:", id)
-			deleteIDList = append(deleteIDList, id)
-		}
-	}
-
-	if len(createIDList) > 0 {
-		log.Println("1-从目标库中批量创建的数量:", len(createIDList))
-		if er := models.CreateUserBatch(ctx, f.tdb, createIDList); er != nil {
-			log.Println(fmt.Errorf("1-插入目的库失败， err:%w", er))
-		}
-	}
-	if len(deleteIDList) > 0 {
-		log.Println("1-从目标库中批量删除的数量:", len(deleteIDList))
-		if er := models.DeleteUserBatch(ctx, f.tdb, deleteIDList); er != nil {
-			log.Println(fmt.Errorf("删除目的库失败， err:%w", er))
-		}
-	}
+	f.recordFix(c, 0)
 	return nil
 }
 
 // FixIncByCDC 由 binlog 触发增量修复
+// 从数据源获取 binlog，攒批写入目标库成功后保存位点再 Ack，失败则 Rollback，
+// 保证进程崩溃时数据源会重新投递未确认的数据
 func (f *User) FixIncByCDC(ctx context.Context, batchSize int) error {
-	err := f.conn.Subscribe("test.users")
+	pos, err := f.store.Load()
 	if err != nil {
 		return err
 	}
+	f.pos = pos
+	if !pos.IsZero() {
+		log.Println("上次处理的 binlog 位点:", pos)
+	}
+
+	if err = f.source.Connect(f.filter); err != nil {
+		log.Println(fmt.Errorf("连接数据源失败 error:%w", err))
+		if err = f.reconnect(ctx); err != nil {
+			return err
+		}
+	}
 
+	b := &cdcBatch{}
 	for {
 		select {
 		case <-f.quit:
-			return nil
+			return f.commit(ctx, b)
 		case <-ctx.Done():
+			f.rollback(b)
 			return ctx.Err()
 		default:
-			message, er := f.conn.Get(int32(batchSize), nil, nil)
+			batch, er := f.source.Fetch(ctx, batchSize)
+			if batch != nil {
+				b.batches = append(b.batches, batch)
+			}
 			if er != nil {
-				return er
+				if batch != nil { // 数据错误
+					f.rollback(b)
+					return er
+				}
+				log.Println(fmt.Errorf("从数据源获取数据失败 error:%w", er))
+				// 重连时数据源会回滚未确认的批次
+				b.reset()
+				if er = f.reconnect(ctx); er != nil {
+					return er
+				}
+				continue
 			}
-			batchId := message.Id
-			if batchId == -1 || len(message.Entries) <= 0 {
+			if batch == nil {
+				if f.shouldFlush(b) {
+					if er = f.commit(ctx, b); er != nil {
+						return er
+					}
+				}
 				time.Sleep(f.d)
 				continue
 			}
-			if er = f.fixByBinlog(ctx, message.Entries); er != nil {
-				return err
+			if b.start.IsZero() {
+				b.start = time.Now()
+			}
+			events, er := f.parseEvents(batch.Events)
+			if er != nil { // 数据错误
+				f.rollback(b)
+				return er
+			}
+			b.events = append(b.events, events...)
+			if !batch.Position.IsZero() {
+				b.pos = batch.Position
+			}
+			if f.shouldFlush(b) {
+				if er = f.commit(ctx, b); er != nil {
+					return er
+				}
 			}
 		}
 	}
 }
 
-func (f *User) fixByBinlog(ctx context.Context, entries []pbe.Entry) error {
-	for _, entry := range entries {
-		if entry.GetEntryType() == pbe.EntryType_TRANSACTIONBEGIN || entry.GetEntryType() == pbe.EntryType_TRANSACTIONEND {
-			continue
-		}
-		rowChange := new(pbe.RowChange)
-
-		if err := proto.Unmarshal(entry.GetStoreValue(), rowChange); err != nil {
-			return err
+// reconnect 重连数据源并重新订阅，按指数退避重试
+func (f *User) reconnect(ctx context.Context) error {
+	backoff := f.backoff
+	var err error
+	for i := 1; f.retries <= 0 || i <= f.retries; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
 		}
-		if rowChange == nil {
-			continue
+		log.Println(fmt.Sprintf("第 %d 次重连数据源", i))
+		_ = f.source.Close()
+		if err = f.source.Connect(f.filter); err == nil {
+			log.Println("重连数据源成功")
+			return nil
 		}
-		eventType := rowChange.GetEventType()
-		header := entry.GetHeader()
-		//db := header.GetSchemaName()
-		//tb := header.GetTableName()
-		fmt.Println(fmt.Sprintf("================> binlog[%s : %d],name[%s,%s], eventType: %s", header.GetLogfileName(), header.GetLogfileOffset(), header.GetSchemaName(), header.GetTableName(), header.GetEventType()))
-		for _, rowData := range rowChange.GetRowDatas() {
-			if eventType == pbe.EventType_DELETE { // 源表删除的数据
-				id, er := parseID(rowData.GetBeforeColumns())
-				if er != nil {
-					log.Println(fmt.Errorf("获取 ID 失败 error:%w", er))
-					continue
-				}
-				user := &models.User{ID: id}
-				if er = user.Delete(ctx, f.tdb); er != nil {
-					log.Println(fmt.Errorf("从目标库删除失败 ID:%d error:%w", id, er))
-				} else {
-					log.Println(fmt.Sprintf("从目标库删除成功 ID:%d", id))
-				}
-			} else if eventType == pbe.EventType_INSERT { // 源表新插入的数据
-				id, er := parseID(rowData.GetAfterColumns())
-				if er != nil {
-					log.Println(fmt.Errorf("获取 ID 失败 error:%w", er))
-					continue
-				}
-				// 先从源库获取插入数据
-				sUser, er := models.FetchUserByID(ctx, f.sdb, id)
-				if er != nil {
-					log.Println("从源库获取数据失败 ID:", id)
-					continue
-				}
-				// 然后从目标库中获取数据，如果没有或者不一致，则插入或者更新
-				tUser, er := models.FetchUserByID(ctx, f.tdb, id)
-				if er != nil {
-					if errors.Is(er, gorm.ErrRecordNotFound) { // 目标库数据不存在
-						if er = sUser.Create(ctx, f.tdb); er != nil {
-							log.Println(fmt.Errorf("插入目标库失败 ID:%d error:%w", id, er))
-						} else {
-							log.Println(fmt.Sprintf("从目标库创建成功 ID:%d", id))
-						}
-					} else {
-						log.Println(fmt.Errorf("从目标库获取数据失败 ID:%d error:%w", id, er))
-					}
-					continue
-				}
-				if tUser.Checksum() == sUser.Checksum() { // 如果两者数据相同，则不做更新
-					log.Println("数据相同, ID:", id)
-					continue
-				}
-				if er = sUser.Update(ctx, f.tdb); er != nil {
-					log.Println(fmt.Errorf("更新目标库失败 ID:%d error:%w", id, er))
-				} else {
-					log.Println(fmt.Sprintf("从目标库更新成功 ID:%d", id))
-				}
-			} else { // 源表更新的数据
-				id, er := parseID(rowData.GetAfterColumns())
-				if er != nil {
-					log.Println(fmt.Errorf("获取 ID 失败 error:%w", er))
-					continue
-				}
-				// 先从源库获取插入数据
-				sUser, er := models.FetchUserByID(ctx, f.sdb, id)
-				if er != nil {
-					log.Println("从源库获取数据失败 ID:", id)
-					continue
-				}
-				// 然后从目标库中获取数据，如果没有或者不一致，则插入或者更新
-				tUser, er := models.FetchUserByID(ctx, f.tdb, id)
-				if er != nil {
-					if errors.Is(er, gorm.ErrRecordNotFound) { // 目标库数据不存在
-						if er = sUser.Create(ctx, f.tdb); er != nil {
-							log.Println(fmt.Errorf("插入目标库失败 ID:%d error:%w", id, er))
-						} else {
-							log.Println(fmt.Sprintf("从目标库创建成功 ID:%d", id))
-						}
-					} else {
-						log.Println(fmt.Errorf("从目标库获取数据失败 ID:%d error:%w", id, er))
-					}
-					continue
-				}
-				if tUser.Checksum() == sUser.Checksum() { // 如果两者数据相同，则不做更新
-					continue
-				}
-				if er = sUser.Update(ctx, f.tdb); er != nil {
-					log.Println(fmt.Errorf("更新目标库失败 ID:%d error:%w", id, er))
-				} else {
-					log.Println(fmt.Sprintf("从目标库更新成功 ID:%d", id))
-				}
+		log.Println(fmt.Errorf("重连数据源失败 error:%w", err))
+		if backoff < maxBackoff {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
 			}
 		}
 	}
-	return nil
+	return fmt.Errorf("重连数据源失败，已重试 %d 次 error:%w", f.retries, err)
 }
 
-func parseID(columns []*pbe.Column) (uint64, error) {
-	_, idStr := getID(columns)
-	return strconv.ParseUint(idStr, 10, 64)
-}
-
-func getID(columns []*pbe.Column) (idName string, value string) {
-	for _, col := range columns {
-		if col.IsKey {
-			return col.GetName(), col.GetValue()
+// fixByID 从源库和目标库获取数据，如果目标库没有或者不一致，则插入或者更新
+func (f *User) fixByID(ctx context.Context, tdb *gorm.DB, id uint64) error {
+	// 先从源库获取插入数据
+	sUser, err := models.Users.ByID(ctx, f.sdb, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) { // 源库已经删除，由后续的删除事件处理
+			log.Println("源库数据不存在 ID:", id)
+			return nil
+		}
+		return fmt.Errorf("从源库获取数据失败 ID:%d error:%w", id, err)
+	}
+	if f.skipDeleted && sUser.DeletedAt.Valid { // 源库已经软删除，忽略软删除的行时从目标库删除
+		if err = models.Users.Delete(ctx, tdb, id); err != nil {
+			return fmt.Errorf("从目标库删除失败 ID:%d error:%w", id, err)
 		}
+		log.Println(fmt.Sprintf("源库已经软删除，从目标库删除成功 ID:%d", id))
+		return nil
 	}
+	// 然后从目标库中获取数据，如果没有或者不一致，则插入或者更新
+	tUser, err := models.Users.ByID(ctx, tdb, id)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("从目标库获取数据失败 ID:%d error:%w", id, err)
+		}
+		// 目标库数据不存在，双写可能同时插入，使用 Upsert 避免主键冲突
+		if err = models.Users.Upsert(ctx, tdb, &sUser); err != nil {
+			return fmt.Errorf("插入目标库失败 ID:%d error:%w", id, err)
+		}
+		log.Println(fmt.Sprintf("从目标库创建成功 ID:%d", id))
+		return nil
+	}
+	if tUser.Checksum() == sUser.Checksum() { // 如果两者数据相同，则不做更新
+		log.Println("数据相同, ID:", id)
+		return nil
+	}
+	updated, err := models.Users.Update(ctx, tdb, &sUser)
+	if err != nil {
+		return fmt.Errorf("更新目标库失败 ID:%d error:%w", id, err)
+	}
+	if !updated {
+		log.Println("目标库的数据更新，跳过 ID:", id)
+		return nil
+	}
+	log.Println(fmt.Sprintf("从目标库更新成功 ID:%d", id))
+	return nil
+}
 
-	return
+// parseID 获取行数据的 ID，users 表只有一个主键字段
+func parseID(row cdc.Row) (uint64, error) {
+	key := row.Key()
+	if len(key) != 1 {
+		return 0, fmt.Errorf("错误的主键 %v", key)
+	}
+	return userID(key[0].Value)
 }
 
-// ParseUsers 将 []models.User 转为 map[uint64]*models.User 类型
-func ParseUsers(users []models.User) map[uint64]*models.User {
-	um := make(map[uint64]*models.User, len(users))
-	for i := range users {
-		user := &users[i]
-		um[user.ID] = user
+// userID 将字段的值转为 ID
+func userID(v any) (uint64, error) {
+	switch id := v.(type) {
+	case uint64:
+		return id, nil
+	case int64:
+		return uint64(id), nil
+	default:
+		return 0, fmt.Errorf("错误的 ID 类型 %T", v)
 	}
-	return um
 }
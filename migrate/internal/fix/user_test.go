@@ -0,0 +1,652 @@
+package fix
+
+import (
+	"context"
+	"errors"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/internal/throttle"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+
+// testUsers 生成 ID 为 ids 的用户，UpdatedAt 按 ID 递增
+func testUsers(ids ...uint64) []models.User {
+	users := make([]models.User, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, models.User{
+			ID:        id,
+			Name:      "user",
+			Email:     "user@example.com",
+			Birthday:  testTime,
+			CreatedAt: testTime,
+			UpdatedAt: testTime.Add(time.Duration(id) * time.Second),
+		})
+	}
+	return users
+}
+
+func idRange(from, to uint64) []uint64 {
+	ids := make([]uint64, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// without 从 users 中去掉 ID 为 ids 的用户
+func without(users []models.User, ids ...uint64) []models.User {
+	skip := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		skip[id] = true
+	}
+	res := make([]models.User, 0, len(users))
+	for _, u := range users {
+		if !skip[u.ID] {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+func TestFixFull(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(idRange(1, 25)...)...)
+	target := without(testUsers(idRange(1, 27)...), 3, 12)
+	target[3].Name = "changed"  // ID 5
+	target[16].Name = "changed" // ID 20
+	dbtest.SeedUsers(t, tdb, target...)
+
+	f := NewFixUser(sdb, tdb, WithSleep(0))
+	if err := f.FixFull(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	stats := f.FixStats()
+	if stats.Created != 2 || stats.Updated != 2 || stats.Deleted != 2 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFixFullSparse(t *testing.T) {
+	testCases := []struct {
+		name           string
+		source, target []uint64
+	}{
+		{
+			// 中间有超过一批的空洞
+			name:   "gap",
+			source: append(idRange(1, 3), idRange(50, 55)...),
+			target: append(idRange(1, 3), idRange(50, 55)...),
+		},
+		{
+			// 一边的空洞对应另一边的数据
+			name:   "asymmetric gap",
+			source: append(idRange(1, 5), idRange(100, 104)...),
+			target: append(idRange(1, 5), idRange(20, 30)...),
+		},
+		{
+			// 目标库在源库的第一批之前就读完了
+			name:   "target ends first",
+			source: []uint64{2, 40, 41, 80, 300, 301, 302, 1000},
+			target: []uint64{2, 40},
+		},
+		{
+			name:   "source ends first",
+			source: []uint64{7},
+			target: []uint64{1, 7, 8, 9, 500, 501, 502, 503},
+		},
+		{
+			name:   "disjoint",
+			source: []uint64{1, 3, 5, 7, 9, 11},
+			target: []uint64{2, 4, 6, 8, 10, 12, 14},
+		},
+		{name: "empty target", source: []uint64{5, 500, 5000, 50000}},
+		{name: "empty source", target: []uint64{5, 500, 5000, 50000}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+			dbtest.SeedUsers(t, sdb, testUsers(tc.source...)...)
+			dbtest.SeedUsers(t, tdb, testUsers(tc.target...)...)
+			created := len(without(testUsers(tc.source...), tc.target...))
+			deleted := len(without(testUsers(tc.target...), tc.source...))
+
+			f := NewFixUser(sdb, tdb, WithSleep(0))
+			report, err := f.Verify(context.Background(), 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Missing != int64(created) || report.Extra != int64(deleted) || report.Different != 0 {
+				t.Fatalf("expect missing %d extra %d, got %+v", created, deleted, report)
+			}
+			if err = f.FixFull(context.Background(), 3); err != nil {
+				t.Fatal(err)
+			}
+			dbtest.AssertSameUsers(t, sdb, tdb)
+			stats := f.FixStats()
+			if stats.Created != int64(created) || stats.Deleted != int64(deleted) || stats.Updated != 0 {
+				t.Fatalf("expect created %d deleted %d, got %+v", created, deleted, stats)
+			}
+		})
+	}
+}
+
+func TestVerifyProgress(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(idRange(1, 7)...)...)
+	f := NewFixUser(sdb, tdb, WithSleep(0))
+	if _, err := f.Verify(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	// 只读校验不影响全量修复的进度
+	if stats := f.FixStats(); stats != (FixStats{}) {
+		t.Fatalf("expect no fix progress, got %+v", stats)
+	}
+	if stats := f.VerifyStats(); stats.NextID != 7 || stats.Batches != 3 {
+		t.Fatalf("unexpected verify progress %+v", stats)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	f := NewFixUser(dbtest.NewSQLite(t), dbtest.NewSQLite(t), WithSleep(0))
+	ctx := context.Background()
+	for _, size := range []int{0, -1} {
+		if err := f.FixFull(ctx, size); err == nil {
+			t.Fatalf("FixFull %d: expect error", size)
+		}
+		if _, err := f.Verify(ctx, size); err == nil {
+			t.Fatalf("Verify %d: expect error", size)
+		}
+		if _, err := f.scan(ctx, 0, size); err == nil {
+			t.Fatalf("scan %d: expect error", size)
+		}
+	}
+}
+
+// deleted 将 users 中 ID 为 ids 的用户标记为软删除
+func deleted(users []models.User, ids ...uint64) []models.User {
+	res := append([]models.User(nil), users...)
+	for i := range res {
+		for _, id := range ids {
+			if res[i].ID == id {
+				res[i].DeletedAt = gorm.DeletedAt{Time: testTime.Add(time.Hour), Valid: true}
+			}
+		}
+	}
+	return res
+}
+
+func TestFixFullSoftDelete(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	// 源库软删除了 2、3，目标库软删除了 5，源库又恢复了 5
+	dbtest.SeedUsers(t, sdb, deleted(testUsers(idRange(1, 6)...), 2, 3)...)
+	dbtest.SeedUsers(t, tdb, deleted(testUsers(idRange(1, 5)...), 5)...)
+
+	f := NewFixUser(sdb, tdb, WithSleep(0))
+	if err := f.FixFull(context.Background(), 4); err != nil {
+		t.Fatal(err)
+	}
+	// 软删除作为更新同步，不会物理删除
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	stats := f.FixStats()
+	if stats.Created != 1 || stats.Updated != 3 || stats.Deleted != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if report, err := f.Verify(context.Background(), 4); err != nil || !report.Consistent() {
+		t.Fatalf("expect consistent, got %+v %v", report, err)
+	}
+}
+
+func TestFixFullSkipDeleted(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	// 源库软删除了 2、6，目标库已经有 2，还没有 6
+	dbtest.SeedUsers(t, sdb, deleted(testUsers(idRange(1, 6)...), 2, 6)...)
+	dbtest.SeedUsers(t, tdb, testUsers(idRange(1, 5)...)...)
+
+	f := NewFixUser(sdb, tdb, WithSleep(0), WithSkipDeleted(true))
+	report, err := f.Verify(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Missing != 0 || report.Extra != 1 || report.Different != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if err = f.FixFull(context.Background(), 4); err != nil {
+		t.Fatal(err)
+	}
+	stats := f.FixStats()
+	if stats.Created != 0 || stats.Updated != 0 || stats.Deleted != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if got := len(dbtest.Users(t, tdb)); got != 4 {
+		t.Fatalf("expect 4 users in target, got %d", got)
+	}
+}
+
+func TestFixFullThrottle(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(idRange(1, 25)...)...)
+
+	// 源库的负载一直超过阈值，每批之间逐步增加休眠时长
+	threads := func(context.Context) (int64, error) {
+		return 15, nil
+	}
+	th := throttle.New(throttle.WithThreadsRunning(threads, 10), throttle.WithBackoff(time.Millisecond, 2*time.Millisecond))
+	f := NewFixUser(sdb, tdb, WithSleep(0), WithThrottle(th))
+	if err := f.FixFull(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	if th.Throttled() < 3*time.Millisecond {
+		t.Fatalf("expect throttled at least 3ms, got %s", th.Throttled())
+	}
+}
+
+// replicaFixture 主库和落后的从库：
+// ID 3 在目标库不一致，ID 7 目标库缺少，都需要修复；
+// ID 5 和 9 只是源库的从库落后，主库上一致；ID 10 还没有同步到任何从库
+func replicaFixture(t *testing.T) (sdb, tdb, srdb, trdb *gorm.DB) {
+	sdb, tdb = dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	srdb, trdb = dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(idRange(1, 10)...)...)
+	sReplica := testUsers(idRange(1, 8)...)
+	sReplica[4].Name = "old" // ID 5
+	dbtest.SeedUsers(t, srdb, sReplica...)
+	target := without(testUsers(idRange(1, 9)...), 7)
+	target[2].Name = "changed" // ID 3
+	dbtest.SeedUsers(t, tdb, target...)
+	dbtest.SeedUsers(t, trdb, target...)
+	return sdb, tdb, srdb, trdb
+}
+
+func TestFixFullReplica(t *testing.T) {
+	sdb, tdb, srdb, trdb := replicaFixture(t)
+	f := NewFixUser(sdb, tdb, WithSleep(0), WithReplicas(srdb, trdb))
+	if err := f.FixFull(context.Background(), 4); err != nil {
+		t.Fatal(err)
+	}
+	stats := f.FixStats()
+	if stats.Created != 1 || stats.Updated != 1 || stats.Deleted != 0 || stats.Stale != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// ID 10 等从库同步后再修复
+	want := without(testUsers(idRange(1, 10)...), 10)
+	got := dbtest.Users(t, tdb)
+	if len(got) != len(want) {
+		t.Fatalf("expect %d users, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Checksum() != want[i].Checksum() {
+			t.Fatalf("expect user %+v, got %+v", want[i], got[i])
+		}
+	}
+}
+
+func TestVerifyReplica(t *testing.T) {
+	sdb, tdb, srdb, trdb := replicaFixture(t)
+	report, err := NewFixUser(sdb, tdb, WithSleep(0), WithReplicas(srdb, trdb)).Verify(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Missing != 1 || report.Different != 1 || report.Extra != 0 || report.Stale != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestFixByUpdatedAt(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(1, 2, 3, 4)...)
+	target := testUsers(1, 3, 4)
+	target[1].Email = "changed@example.com" // ID 3
+	dbtest.SeedUsers(t, tdb, target...)
+
+	// 只校验 ID 1 之后更新的数据
+	f := NewFixUser(sdb, tdb, WithUpdatedAt(testTime.Add(time.Second)))
+	if err := f.fixByUpdatedAt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	stats := f.FixStats()
+	if stats.Created != 1 || stats.Updated != 1 || !stats.UpdatedAt.Equal(testTime.Add(4*time.Second)) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(idRange(1, 30)...)...)
+	target := without(testUsers(idRange(1, 32)...), 7)
+	target[20].Name = "changed" // ID 22
+	dbtest.SeedUsers(t, tdb, target...)
+
+	report, err := NewFixUser(sdb, tdb).Verify(context.Background(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Source != 30 || report.Target != 31 || report.Missing != 1 || report.Extra != 2 || report.Different != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+// fakeSource 按顺序投递固定的批次
+type fakeSource struct {
+	batches    []*Batch
+	next       int
+	acked      []int64
+	rolledBack []int64
+	drained    chan struct{} // 所有批次投递完后关闭
+	once       sync.Once
+	lock       sync.Mutex
+}
+
+func (s *fakeSource) Connect(string) error {
+	return nil
+}
+
+func (s *fakeSource) Fetch(context.Context, int) (*Batch, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.next >= len(s.batches) {
+		s.once.Do(func() { close(s.drained) })
+		return nil, nil
+	}
+	b := s.batches[s.next]
+	s.next++
+	return b, nil
+}
+
+func (s *fakeSource) Ack(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.acked = append(s.acked, b.ID)
+	return nil
+}
+
+func (s *fakeSource) Rollback(b *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rolledBack = append(s.rolledBack, b.ID)
+	return nil
+}
+
+func (s *fakeSource) Close() error {
+	return nil
+}
+
+func changeEvent(typ pbe.EventType, id int64, offset int64) cdc.ChangeEvent {
+	row := cdc.Row{{Name: "id", Value: id, IsKey: true}}
+	e := cdc.ChangeEvent{Schema: "test", Table: "users", Type: typ,
+		Position: cdc.Position{File: "mysql-bin.000001", Offset: offset}}
+	if typ == pbe.EventType_DELETE {
+		e.Before = row
+	} else {
+		e.After = row
+	}
+	return e
+}
+
+func TestFixIncByCDC(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	dbtest.SeedUsers(t, sdb, testUsers(1, 2)...)
+	target := testUsers(2, 3)
+	target[0].Name = "stale"
+	dbtest.SeedUsers(t, tdb, target...)
+
+	last := Position{File: "mysql-bin.000001", Offset: 300}
+	source := &fakeSource{
+		drained: make(chan struct{}),
+		batches: []*Batch{
+			{ID: 1, Events: []cdc.ChangeEvent{changeEvent(pbe.EventType_INSERT, 1, 100)},
+				Position: Position{File: "mysql-bin.000001", Offset: 100}},
+			{ID: 2, Events: []cdc.ChangeEvent{
+				changeEvent(pbe.EventType_UPDATE, 2, 200),
+				changeEvent(pbe.EventType_DELETE, 3, 300),
+			}, Position: last},
+		},
+	}
+	store := NewMemoryPositionStore(Position{})
+	f := NewFixUser(sdb, tdb, WithSleep(time.Millisecond), WithSource(source), WithPositionStore(store), WithWorkers(2))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f.FixIncByCDC(context.Background(), 10)
+	}()
+	select {
+	case <-source.drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batches not fetched")
+	}
+	f.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	dbtest.AssertSameUsers(t, sdb, tdb)
+	if pos, _ := store.Load(); pos.File != last.File || pos.Offset != last.Offset {
+		t.Fatalf("expect position %s, got %s", last, pos)
+	}
+	if len(source.acked) != 2 {
+		t.Fatalf("expect 2 acked batches, got %v", source.acked)
+	}
+}
+
+// failStore 保存位点时返回 err
+type failStore struct {
+	PositionStore
+	err error
+}
+
+func (s failStore) Save(Position) error {
+	return s.err
+}
+
+func TestCommitAck(t *testing.T) {
+	errFail := errors.New("fail")
+	pos := Position{File: "mysql-bin.000001", Offset: 200}
+	testCases := []struct {
+		name      string
+		failApply bool
+		failSave  bool
+		wantErr   error
+	}{
+		{name: "applied"},
+		{name: "apply failed", failApply: true, wantErr: errFail},
+		{name: "save failed", failSave: true, wantErr: errFail},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+			dbtest.SeedUsers(t, sdb, testUsers(1, 2)...)
+			if tc.failApply {
+				failOn(t, tdb, 2, errFail)
+			}
+			var store PositionStore = NewMemoryPositionStore(Position{})
+			if tc.failSave {
+				store = failStore{PositionStore: store, err: errFail}
+			}
+			source := &fakeSource{}
+			f := NewFixUser(sdb, tdb, WithSource(source), WithPositionStore(store))
+			batch := &Batch{ID: 1, Position: pos, Events: []cdc.ChangeEvent{
+				changeEvent(pbe.EventType_INSERT, 1, 100),
+				changeEvent(pbe.EventType_INSERT, 2, 200),
+			}}
+			events, err := f.parseEvents(batch.Events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &cdcBatch{batches: []*Batch{batch}, events: events, pos: pos, start: time.Now()}
+
+			err = f.commit(context.Background(), b)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expect %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				// 失败时回滚，不能 Ack，也不能推进位点
+				if len(source.acked) != 0 || len(source.rolledBack) != 1 || !f.pos.IsZero() {
+					t.Fatalf("expect rolled back, acked %v rolled back %v position %s", source.acked, source.rolledBack, f.pos)
+				}
+				return
+			}
+			if len(source.acked) != 1 || len(source.rolledBack) != 0 {
+				t.Fatalf("expect acked, acked %v rolled back %v", source.acked, source.rolledBack)
+			}
+			if saved, _ := store.Load(); saved != pos || f.pos != pos {
+				t.Fatalf("expect position %s, saved %s current %s", pos, saved, f.pos)
+			}
+			dbtest.AssertSameUsers(t, sdb, tdb)
+		})
+	}
+}
+
+func TestParseEventsSkip(t *testing.T) {
+	f := NewFixUser(nil, nil)
+	f.pos = Position{File: "mysql-bin.000002", Offset: 200}
+	at := func(e cdc.ChangeEvent, file string) cdc.ChangeEvent {
+		e.Position.File = file
+		return e
+	}
+	kafka := changeEvent(pbe.EventType_UPDATE, 6, 0)
+	kafka.Position = cdc.Position{}
+	kafka.Timestamp = time.UnixMilli(1690000000000)
+	changes := []cdc.ChangeEvent{
+		changeEvent(pbe.EventType_INSERT, 1, 300), // 之前的 binlog 文件
+		at(changeEvent(pbe.EventType_INSERT, 2, 100), "mysql-bin.000002"),
+		at(changeEvent(pbe.EventType_INSERT, 3, 200), "mysql-bin.000002"),
+		at(changeEvent(pbe.EventType_INSERT, 4, 300), "mysql-bin.000002"),
+		at(changeEvent(pbe.EventType_INSERT, 5, 50), "mysql-bin.000003"),
+		kafka, // 没有 binlog 文件位点时不跳过
+	}
+	events, err := f.parseEvents(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]uint64, 0, len(events))
+	for _, e := range events {
+		got = append(got, e.id)
+	}
+	if want := []uint64{4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect %v, got %v", want, got)
+	}
+}
+
+func TestApplyEventSoftDelete(t *testing.T) {
+	testCases := []struct {
+		name        string
+		skipDeleted bool
+		want        int // 目标库剩余的行数
+	}{
+		{name: "sync", want: 2},
+		{name: "skip", skipDeleted: true, want: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+			users := deleted(testUsers(1, 2), 2)
+			dbtest.SeedUsers(t, sdb, users...)
+			dbtest.SeedUsers(t, tdb, testUsers(1, 2)...)
+
+			f := NewFixUser(sdb, tdb, WithSkipDeleted(tc.skipDeleted))
+			// 分别使用 binlog 的行数据和从源库获取的数据
+			for _, e := range []rowEvent{
+				{typ: pbe.EventType_UPDATE, id: 2, user: &users[1]},
+				{typ: pbe.EventType_UPDATE, id: 2},
+			} {
+				if err := f.applyEvent(context.Background(), tdb, e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := dbtest.Users(t, tdb)
+			if len(got) != tc.want {
+				t.Fatalf("expect %d users, got %d", tc.want, len(got))
+			}
+			if !tc.skipDeleted && got[1].Checksum() != users[1].Checksum() {
+				t.Fatalf("expect soft deleted user %+v, got %+v", users[1], got[1])
+			}
+		})
+	}
+}
+
+func TestReconcileNotNewer(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	source := testUsers(1, 2, 3)
+	source[0].Name = "fixed"
+	dbtest.SeedUsers(t, sdb, source...)
+	// 比对时目标库只有旧的 1，之后双写更新了 1、插入了 2
+	scanned := testUsers(1)
+	newer := testUsers(1, 2)
+	for i := range newer {
+		newer[i].Name = "double write"
+		newer[i].UpdatedAt = newer[i].UpdatedAt.Add(time.Minute)
+	}
+	dbtest.SeedUsers(t, tdb, newer...)
+
+	f := NewFixUser(sdb, tdb)
+	c, err := f.reconcile(context.Background(), source, scanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 双写插入的 2 没有被覆盖，不计入创建
+	if c.created != 1 || c.updated != 0 || c.skipped != 2 || c.failed != 0 {
+		t.Fatalf("unexpected count %+v", c)
+	}
+	got := dbtest.Users(t, tdb)
+	if len(got) != 3 {
+		t.Fatalf("expect 3 users, got %d", len(got))
+	}
+	// 双写写入的更新的数据没有被覆盖
+	for i := range newer {
+		if got[i].Checksum() != newer[i].Checksum() {
+			t.Fatalf("expect %+v, got %+v", newer[i], got[i])
+		}
+	}
+	if got[2].Checksum() != source[2].Checksum() {
+		t.Fatalf("expect %+v, got %+v", source[2], got[2])
+	}
+
+	// binlog 的行数据比目标库旧时同样不覆盖，比目标库新时覆盖
+	latest := source[2]
+	latest.Name = "binlog"
+	latest.UpdatedAt = latest.UpdatedAt.Add(time.Hour)
+	for _, e := range []rowEvent{
+		{typ: pbe.EventType_UPDATE, id: 1, user: &source[0]},
+		{typ: pbe.EventType_UPDATE, id: 3, user: &latest},
+	} {
+		if err = f.applyEvent(context.Background(), tdb, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got = dbtest.Users(t, tdb)
+	if got[0].Checksum() != newer[0].Checksum() || got[2].Checksum() != latest.Checksum() {
+		t.Fatalf("unexpected users %+v", got)
+	}
+}
+
+func TestReconcileDeleteRecheck(t *testing.T) {
+	sdb, tdb := dbtest.NewSQLite(t), dbtest.NewSQLite(t)
+	// 读取源库时只有 1，之后双写插入了 2；3 只在目标库中
+	source := testUsers(1)
+	dbtest.SeedUsers(t, sdb, testUsers(1, 2)...)
+	target := testUsers(1, 2, 3)
+	dbtest.SeedUsers(t, tdb, target...)
+
+	f := NewFixUser(sdb, tdb)
+	c, err := f.reconcile(context.Background(), source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.deleted != 1 || c.skipped != 1 || c.failed != 0 {
+		t.Fatalf("unexpected count %+v", c)
+	}
+	got := dbtest.Users(t, tdb)
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+		t.Fatalf("expect users 1 and 2, got %+v", got)
+	}
+}
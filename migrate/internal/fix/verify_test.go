@@ -0,0 +1,53 @@
+package fix
+
+import (
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyReport(t *testing.T) {
+	now := time.Now()
+	users := func(ids ...uint64) []models.User {
+		res := make([]models.User, 0, len(ids))
+		for _, id := range ids {
+			res = append(res, models.User{ID: id, Name: "user", CreatedAt: now, UpdatedAt: now})
+		}
+		return res
+	}
+	sUsers := users(1, 2, 3, 5)
+	tUsers := users(2, 3, 4, 5)
+	tUsers[1].Name = "changed"
+
+	r := &VerifyReport{}
+	r.add(sUsers, tUsers)
+	if r.Source != 4 || r.Target != 4 || r.Missing != 1 || r.Extra != 1 || r.Different != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	want := VerifySamples{Missing: []uint64{1}, Extra: []uint64{4}, Different: []uint64{3}}
+	if !reflect.DeepEqual(r.Samples, want) {
+		t.Fatalf("expect samples %+v, got %+v", want, r.Samples)
+	}
+	if r.Consistent() {
+		t.Fatal("expect inconsistent")
+	}
+}
+
+func TestUsersUpTo(t *testing.T) {
+	users := []models.User{{ID: 2}, {ID: 5}, {ID: 9}}
+	testCases := []struct {
+		upper uint64
+		want  int
+	}{
+		{upper: 1, want: 0},
+		{upper: 5, want: 2},
+		{upper: 8, want: 2},
+		{upper: 9, want: 3},
+	}
+	for _, tc := range testCases {
+		if got := len(usersUpTo(users, tc.upper)); got != tc.want {
+			t.Fatalf("upper %d: expect %d users, got %d", tc.upper, tc.want, got)
+		}
+	}
+}
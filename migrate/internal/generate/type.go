@@ -1,6 +1,7 @@
 package generate
 
 import (
+	"context"
 	"fmt"
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/xuqil/experiments/migrate/internal/models"
@@ -38,9 +39,9 @@ func (g *Generate) InsertBatch(batch int) error {
 		user := FakeUser()
 		users = append(users, user)
 	}
-	result := g.db.Create(users)
-	log.Println("InsertBatch ID:", result.RowsAffected)
-	return result.Error
+	err := models.Users.Create(context.Background(), g.db, users...)
+	log.Println("InsertBatch ID:", len(users))
+	return err
 }
 
 // Insert 新建数据
@@ -49,7 +50,7 @@ func (g *Generate) Insert() error {
 	g.lock.Lock()
 	defer g.lock.Unlock()
 
-	err := g.db.Create(&user).Error
+	err := models.Users.Create(context.Background(), g.db, user)
 	if err != nil {
 		return err
 	}
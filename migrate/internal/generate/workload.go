@@ -0,0 +1,461 @@
+package generate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"gorm.io/gorm"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op 负载中的一种操作
+type Op int
+
+const (
+	OpRead Op = iota
+	OpInsert
+	OpUpdate
+	OpDelete
+	numOps
+)
+
+var opNames = [numOps]string{"read", "insert", "update", "delete"}
+
+func (o Op) String() string {
+	if o < 0 || o >= numOps {
+		return fmt.Sprintf("Op(%d)", int(o))
+	}
+	return opNames[o]
+}
+
+// Mix 各操作的权重，例如 read=90,insert=5,update=5 表示读写比 9:1
+type Mix [numOps]int
+
+// ParseMix 解析 read=90,insert=5,update=4,delete=1 格式的权重，没有写出的操作权重为 0
+func ParseMix(s string) (Mix, error) {
+	var m Mix
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return m, fmt.Errorf("错误的权重 %s，格式为 read=90,insert=10", item)
+		}
+		op := numOps
+		for i, n := range opNames {
+			if n == strings.TrimSpace(name) {
+				op = Op(i)
+			}
+		}
+		if op == numOps {
+			return m, fmt.Errorf("未知的操作 %s，可选 %s", name, strings.Join(opNames[:], "、"))
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || w < 0 {
+			return m, fmt.Errorf("错误的权重 %s", item)
+		}
+		m[op] = w
+	}
+	return m, nil
+}
+
+func (m Mix) String() string {
+	items := make([]string, 0, numOps)
+	for i, w := range m {
+		if w > 0 {
+			items = append(items, fmt.Sprintf("%s=%d", Op(i), w))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (m Mix) total() int {
+	total := 0
+	for _, w := range m {
+		total += w
+	}
+	return total
+}
+
+// pick 按权重选择操作，n 的范围为 [0, total)
+func (m Mix) pick(n int) Op {
+	for i, w := range m {
+		if n < w {
+			return Op(i)
+		}
+		n -= w
+	}
+	return numOps - 1
+}
+
+// Profile 负载的配置
+type Profile struct {
+	Name        string
+	Mix         Mix
+	BatchSize   int           // 每次插入的行数，1 为单行插入
+	Zipf        float64       // 读、改、删选择 ID 的 Zipf 分布参数 s，需要大于 1，越大热点越集中，0 为均匀分布
+	Concurrency int           // 并发数
+	QPS         int           // 目标 QPS，一次批量插入算一次操作，0 为不限速
+	Duration    time.Duration // 运行时长，0 为一直运行直到取消
+}
+
+// Profiles 内置的负载
+var Profiles = map[string]Profile{
+	"read-heavy": {
+		Name: "read-heavy", Mix: Mix{OpRead: 90, OpInsert: 4, OpUpdate: 5, OpDelete: 1},
+		BatchSize: 1, Zipf: 1.1, Concurrency: 16, QPS: 2000, Duration: time.Minute,
+	},
+	"write-heavy": {
+		Name: "write-heavy", Mix: Mix{OpRead: 20, OpInsert: 40, OpUpdate: 35, OpDelete: 5},
+		BatchSize: 1, Zipf: 1.1, Concurrency: 16, QPS: 1000, Duration: time.Minute,
+	},
+	"hotspot": {
+		Name: "hotspot", Mix: Mix{OpRead: 50, OpUpdate: 50},
+		BatchSize: 1, Zipf: 2, Concurrency: 32, QPS: 1000, Duration: time.Minute,
+	},
+	"bulk-insert": {
+		Name: "bulk-insert", Mix: Mix{OpInsert: 1},
+		BatchSize: 1000, Concurrency: 4, Duration: time.Minute,
+	},
+}
+
+// LookupProfile 获取内置的负载
+func LookupProfile(name string) (Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(Profiles))
+		for n := range Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return p, fmt.Errorf("未知的负载 %s，可选 %s", name, strings.Join(names, "、"))
+	}
+	return p, nil
+}
+
+// Validate 校验负载的配置
+func (p Profile) Validate() error {
+	var errs []error
+	if p.Mix.total() <= 0 {
+		errs = append(errs, errors.New("操作的权重之和需要大于 0"))
+	}
+	if p.BatchSize <= 0 {
+		errs = append(errs, errors.New("batch_size 需要大于 0"))
+	}
+	if p.Zipf != 0 && p.Zipf <= 1 {
+		errs = append(errs, errors.New("zipf 需要大于 1，0 为均匀分布"))
+	}
+	if p.Concurrency <= 0 {
+		errs = append(errs, errors.New("concurrency 需要大于 0"))
+	}
+	if p.QPS < 0 {
+		errs = append(errs, errors.New("qps 不能小于 0"))
+	}
+	if p.Duration < 0 {
+		errs = append(errs, errors.New("duration 不能小于 0"))
+	}
+	return errors.Join(errs...)
+}
+
+// Workload 按照 Profile 向数据库施加负载，用于压测双写和修复
+type Workload struct {
+	db      *gorm.DB
+	profile Profile
+	minID   atomic.Uint64
+	maxID   atomic.Uint64
+}
+
+func NewWorkload(db *gorm.DB, profile Profile) *Workload {
+	return &Workload{
+		db:      db,
+		profile: profile,
+	}
+}
+
+// Run 运行负载，直到超过 Duration 或者 ctx 取消，返回吞吐量和延迟的报告
+func (w *Workload) Run(ctx context.Context) (*Report, error) {
+	p := w.profile
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	minID, maxID, err := models.Users.IDRange(ctx, w.db)
+	if err != nil {
+		return nil, fmt.Errorf("查询 ID 范围失败 error:%w", err)
+	}
+	w.minID.Store(minID)
+	w.maxID.Store(maxID)
+
+	if p.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Duration)
+		defer cancel()
+	}
+	var pace *pacer
+	if p.QPS > 0 {
+		pace = &pacer{start: time.Now(), interval: time.Second / time.Duration(p.QPS)}
+	}
+
+	start := time.Now()
+	recorders := make([]*recorder, p.Concurrency)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		rec := &recorder{}
+		recorders[i] = rec
+		r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.worker(ctx, r, pace, rec)
+		}()
+	}
+	wg.Wait()
+	return newReport(p.Name, time.Since(start), recorders), nil
+}
+
+func (w *Workload) worker(ctx context.Context, r *rand.Rand, pace *pacer, rec *recorder) {
+	total := w.profile.Mix.total()
+	for pace.wait(ctx) == nil {
+		op := w.profile.Mix.pick(r.Intn(total))
+		begin := time.Now()
+		op, rows, err := w.do(ctx, r, op)
+		if ctx.Err() != nil {
+			// 运行结束时被中断的操作不计入报告
+			return
+		}
+		rec.add(op, time.Since(begin), rows, err)
+	}
+}
+
+// do 执行一次操作，返回实际执行的操作和影响的行数
+func (w *Workload) do(ctx context.Context, r *rand.Rand, op Op) (Op, int64, error) {
+	db := w.db.WithContext(ctx)
+	var id uint64
+	if op != OpInsert {
+		var ok bool
+		if id, ok = w.key(r); !ok {
+			// 表为空时先插入数据
+			op = OpInsert
+		}
+	}
+
+	switch op {
+	case OpRead:
+		var user models.User
+		err := db.Where("id=?", id).Take(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return op, 0, nil
+		}
+		return op, 1, err
+	case OpInsert:
+		users := make([]*models.User, 0, w.profile.BatchSize)
+		for i := 0; i < w.profile.BatchSize; i++ {
+			users = append(users, FakeUser())
+		}
+		if err := models.Users.Create(ctx, w.db, users...); err != nil {
+			return op, 0, err
+		}
+		for _, u := range users {
+			w.observe(u.ID)
+		}
+		return op, int64(len(users)), nil
+	case OpUpdate:
+		res := db.Model(&models.User{}).Where("id=?", id).Updates(map[string]any{
+			"name":       fmt.Sprintf("update-%d", id),
+			"email":      FakeUser().Email,
+			"updated_at": time.Now(),
+		})
+		return op, res.RowsAffected, res.Error
+	default:
+		res := db.Where("id=?", id).Delete(&models.User{})
+		return op, res.RowsAffected, res.Error
+	}
+}
+
+// key 选择读、改、删的 ID，Zipf 分布时越新的数据越热
+func (w *Workload) key(r *rand.Rand) (uint64, bool) {
+	min, max := w.minID.Load(), w.maxID.Load()
+	if max == 0 || max < min {
+		return 0, false
+	}
+	span := max - min
+	if w.profile.Zipf == 0 {
+		if span == 0 {
+			return min, true
+		}
+		return min + uint64(r.Int63n(int64(span)+1)), true
+	}
+	return max - rand.NewZipf(r, w.profile.Zipf, 1, span).Uint64(), true
+}
+
+// observe 记录插入的 ID，扩大读、改、删的范围
+func (w *Workload) observe(id uint64) {
+	w.minID.CompareAndSwap(0, id)
+	for {
+		max := w.maxID.Load()
+		if id <= max || w.maxID.CompareAndSwap(max, id) {
+			return
+		}
+	}
+}
+
+// pacer 控制所有 worker 的总 QPS，第 n 个操作在 start + n*interval 之后执行
+type pacer struct {
+	start    time.Time
+	interval time.Duration
+	n        atomic.Int64
+}
+
+// wait 等待下一个操作的时间，pacer 为 nil 时不限速
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	n := p.n.Add(1) - 1
+	d := time.Until(p.start.Add(time.Duration(n) * p.interval))
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// recorder 一个 worker 的延迟和结果，每个 worker 独占，结束后再合并
+type recorder struct {
+	latencies [numOps][]time.Duration
+	rows      [numOps]int64
+	errors    [numOps]int64
+	lastError [numOps]error
+}
+
+func (r *recorder) add(op Op, d time.Duration, rows int64, err error) {
+	r.latencies[op] = append(r.latencies[op], d)
+	r.rows[op] += rows
+	if err != nil {
+		r.errors[op]++
+		r.lastError[op] = err
+	}
+}
+
+// Report 负载的吞吐量和延迟
+type Report struct {
+	Profile string        `json:"profile"`
+	Elapsed time.Duration `json:"elapsed"`
+	Ops     []OpReport    `json:"ops"`
+	Total   OpReport      `json:"total"`
+}
+
+// OpReport 一种操作的统计，延迟包含失败的操作
+type OpReport struct {
+	Op        string        `json:"op"`
+	Count     int64         `json:"count"`
+	Errors    int64         `json:"errors"`
+	Rows      int64         `json:"rows"`
+	QPS       float64       `json:"qps"`
+	Mean      time.Duration `json:"mean"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+func newReport(profile string, elapsed time.Duration, recorders []*recorder) *Report {
+	report := &Report{Profile: profile, Elapsed: elapsed}
+	var all []time.Duration
+	for op := Op(0); op < numOps; op++ {
+		var latencies []time.Duration
+		o := OpReport{Op: op.String()}
+		for _, r := range recorders {
+			latencies = append(latencies, r.latencies[op]...)
+			o.Rows += r.rows[op]
+			o.Errors += r.errors[op]
+			if r.lastError[op] != nil {
+				o.LastError = r.lastError[op].Error()
+			}
+		}
+		if len(latencies) == 0 {
+			continue
+		}
+		o.summarize(latencies, elapsed)
+		report.Ops = append(report.Ops, o)
+		all = append(all, latencies...)
+		report.Total.Rows += o.Rows
+		report.Total.Errors += o.Errors
+	}
+	report.Total.Op = "total"
+	report.Total.summarize(all, elapsed)
+	return report
+}
+
+// summarize 计算次数、QPS 和延迟分位数，会对 latencies 排序
+func (o *OpReport) summarize(latencies []time.Duration, elapsed time.Duration) {
+	o.Count = int64(len(latencies))
+	if o.Count == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, d := range latencies {
+		sum += d
+	}
+	o.Mean = sum / time.Duration(o.Count)
+	o.P50 = percentile(latencies, 50)
+	o.P90 = percentile(latencies, 90)
+	o.P99 = percentile(latencies, 99)
+	o.Max = latencies[len(latencies)-1]
+	if elapsed > 0 {
+		o.QPS = float64(o.Count) / elapsed.Seconds()
+	}
+}
+
+// percentile 最近秩法计算分位数，sorted 需要升序
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "负载 %s 运行 %s\n", r.Profile, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&sb, "%-8s %10s %8s %10s %10s %10s %10s %10s %10s %10s\n",
+		"op", "count", "errors", "rows", "qps", "mean", "p50", "p90", "p99", "max")
+	for _, o := range append(r.Ops, r.Total) {
+		fmt.Fprintf(&sb, "%-8s %10d %8d %10d %10.1f %10s %10s %10s %10s %10s\n",
+			o.Op, o.Count, o.Errors, o.Rows, o.QPS, round(o.Mean), round(o.P50), round(o.P90), round(o.P99), round(o.Max))
+	}
+	for _, o := range r.Ops {
+		if o.LastError != "" {
+			fmt.Fprintf(&sb, "%s 最近一次错误: %s\n", o.Op, o.LastError)
+		}
+	}
+	return sb.String()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
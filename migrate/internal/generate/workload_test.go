@@ -0,0 +1,141 @@
+package generate
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	testCases := []struct {
+		s       string
+		want    Mix
+		wantErr bool
+	}{
+		{s: "read=90,insert=5,update=5", want: Mix{OpRead: 90, OpInsert: 5, OpUpdate: 5}},
+		{s: " delete = 1 , ", want: Mix{OpDelete: 1}},
+		{s: "read", wantErr: true},
+		{s: "scan=1", wantErr: true},
+		{s: "read=-1", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseMix(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected error %v", tc.s, err)
+		}
+		if !tc.wantErr && got != tc.want {
+			t.Fatalf("%s: expect %v, got %v", tc.s, tc.want, got)
+		}
+	}
+}
+
+func TestMixPick(t *testing.T) {
+	m := Mix{OpRead: 2, OpUpdate: 1, OpDelete: 1}
+	want := []Op{OpRead, OpRead, OpUpdate, OpDelete}
+	for n, op := range want {
+		if got := m.pick(n); got != op {
+			t.Fatalf("pick(%d): expect %s, got %s", n, op, got)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	testCases := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 50, want: 50 * time.Millisecond},
+		{p: 90, want: 90 * time.Millisecond},
+		{p: 99, want: 99 * time.Millisecond},
+		{p: 100, want: 100 * time.Millisecond},
+		{p: 0, want: time.Millisecond},
+	}
+	for _, tc := range testCases {
+		if got := percentile(sorted, tc.p); got != tc.want {
+			t.Fatalf("p%v: expect %s, got %s", tc.p, tc.want, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Fatalf("empty: expect 0, got %s", got)
+	}
+}
+
+func TestWorkloadKey(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	w := NewWorkload(nil, Profile{Zipf: 2})
+	if _, ok := w.key(r); ok {
+		t.Fatal("expect no key for an empty table")
+	}
+	w.observe(100)
+	w.observe(199)
+	w.observe(150)
+	hot := 0
+	for i := 0; i < 1000; i++ {
+		id, ok := w.key(r)
+		if !ok || id < 100 || id > 199 {
+			t.Fatalf("key %d out of range [100, 199]", id)
+		}
+		if id == 199 {
+			hot++
+		}
+	}
+	// s=2 时最新的 ID 大约占 60%
+	if hot < 400 {
+		t.Fatalf("expect the newest id to be hot, got %d/1000", hot)
+	}
+
+	w = NewWorkload(nil, Profile{})
+	w.observe(7)
+	if id, ok := w.key(r); !ok || id != 7 {
+		t.Fatalf("expect 7, got %d", id)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := &pacer{start: time.Now(), interval: 10 * time.Millisecond}
+	ctx := context.Background()
+	begin := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := p.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(begin); d < 50*time.Millisecond {
+		t.Fatalf("expect at least 50ms for 6 operations, got %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := p.wait(ctx); err == nil {
+		t.Fatal("expect an error after cancel")
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	r1, r2 := &recorder{}, &recorder{}
+	for i := 1; i <= 10; i++ {
+		r1.add(OpRead, time.Duration(i)*time.Millisecond, 1, nil)
+	}
+	r2.add(OpInsert, 20*time.Millisecond, 100, nil)
+	r2.add(OpInsert, 30*time.Millisecond, 0, context.DeadlineExceeded)
+
+	report := newReport("test", 2*time.Second, []*recorder{r1, r2})
+	if len(report.Ops) != 2 {
+		t.Fatalf("expect 2 ops, got %d", len(report.Ops))
+	}
+	read, insert := report.Ops[0], report.Ops[1]
+	if read.Count != 10 || read.QPS != 5 || read.P50 != 5*time.Millisecond || read.Max != 10*time.Millisecond {
+		t.Fatalf("unexpected read report %+v", read)
+	}
+	if insert.Count != 2 || insert.Errors != 1 || insert.Rows != 100 || insert.LastError == "" {
+		t.Fatalf("unexpected insert report %+v", insert)
+	}
+	if report.Total.Count != 12 || report.Total.Errors != 1 || report.Total.Rows != 110 || report.Total.Max != 30*time.Millisecond {
+		t.Fatalf("unexpected total report %+v", report.Total)
+	}
+}
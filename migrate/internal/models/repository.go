@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Row 需要迁移的表的模型，主键为一个自增的整数。
+// Checksum 用于比对两边的数据，需要包括主键以外的所有字段
+type Row[T any] interface {
+	*T
+	Key() uint64
+	Checksum() string
+}
+
+type RepositoryOption func(o *repositoryOptions)
+
+type repositoryOptions struct {
+	version string
+}
+
+// WithVersion 设置版本字段，默认为 updated_at。
+// 写入时只覆盖版本不比写入的行新的数据，按更新时间增量修复时按该字段查询；为空表示不比较版本
+func WithVersion(column string) RepositoryOption {
+	return func(o *repositoryOptions) {
+		o.version = column
+	}
+}
+
+// Repository 迁移时读写一张表，T 为表的模型。
+// 读取都包括已经软删除的行，删除都是物理删除，软删除作为普通的更新同步
+type Repository[T any, P Row[T]] struct {
+	version string
+
+	once    sync.Once
+	schema  *schema.Schema
+	columns []string // 主键冲突时更新的字段，版本字段放在最后
+	err     error
+}
+
+// NewRepository 创建表 T 的 Repository，例如 NewRepository[User]()
+func NewRepository[T any, P Row[T]](opts ...RepositoryOption) *Repository[T, P] {
+	o := repositoryOptions{version: "updated_at"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Repository[T, P]{version: o.version}
+}
+
+// parse 第一次使用时解析 T 的表名和字段
+func (r *Repository[T, P]) parse(db *gorm.DB) (*schema.Schema, error) {
+	r.once.Do(func() {
+		stmt := &gorm.Statement{DB: db}
+		if r.err = stmt.Parse(new(T)); r.err != nil {
+			return
+		}
+		r.schema = stmt.Schema
+		if r.schema.PrioritizedPrimaryField == nil {
+			r.err = fmt.Errorf("表 %s 没有主键", r.schema.Table)
+			return
+		}
+		if r.version != "" && r.schema.LookUpField(r.version) == nil {
+			r.err = fmt.Errorf("表 %s 没有版本字段 %s", r.schema.Table, r.version)
+			return
+		}
+		for _, name := range r.schema.DBNames {
+			if name != r.schema.PrioritizedPrimaryField.DBName && name != r.version {
+				r.columns = append(r.columns, name)
+			}
+		}
+		// MySQL 的 ON DUPLICATE KEY UPDATE 按顺序赋值，之后的字段读到的是已经赋值的版本，所以版本放在最后
+		if r.version != "" {
+			r.columns = append(r.columns, r.version)
+		}
+	})
+	return r.schema, r.err
+}
+
+// session 解析表结构，返回包括软删除的行的会话
+func (r *Repository[T, P]) session(ctx context.Context, db *gorm.DB) (*gorm.DB, *schema.Schema, error) {
+	s, err := r.parse(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.WithContext(ctx).Unscoped(), s, nil
+}
+
+// Batch 按主键分页，获取主键大于 prevID 的 limit 行
+func (r *Repository[T, P]) Batch(ctx context.Context, db *gorm.DB, prevID uint64, limit int) (rows []T, err error) {
+	tx, s, err := r.session(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	pk := s.PrioritizedPrimaryField.DBName
+	err = tx.Where(clause.Gt{Column: pk, Value: prevID}).Order(pk).Limit(limit).Find(&rows).Error
+	return
+}
+
+// Interval 获取主键在 [startID, startID+size) 之间的行
+func (r *Repository[T, P]) Interval(ctx context.Context, db *gorm.DB, startID uint64, size int) (rows []T, err error) {
+	tx, s, err := r.session(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	pk := s.PrioritizedPrimaryField.DBName
+	err = tx.Where(clause.Gte{Column: pk, Value: startID}).Where(clause.Lt{Column: pk, Value: startID + uint64(size)}).
+		Order(pk).Find(&rows).Error
+	return
+}
+
+// UpdatedAfter 获取版本晚于 t 的行，没有版本字段时返回错误
+func (r *Repository[T, P]) UpdatedAfter(ctx context.Context, db *gorm.DB, t time.Time) (rows []T, err error) {
+	tx, s, err := r.session(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if r.version == "" {
+		return nil, fmt.Errorf("表 %s 没有版本字段", s.Table)
+	}
+	err = tx.Where(clause.Gt{Column: r.version, Value: t}).Order(s.PrioritizedPrimaryField.DBName).Find(&rows).Error
+	return
+}
+
+// ByIDs 按主键获取多行
+func (r *Repository[T, P]) ByIDs(ctx context.Context, db *gorm.DB, ids []uint64) (rows []T, err error) {
+	tx, _, err := r.session(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Find(&rows, ids).Error
+	return
+}
+
+// ByID 按主键获取一行，不存在时返回 gorm.ErrRecordNotFound
+func (r *Repository[T, P]) ByID(ctx context.Context, db *gorm.DB, id uint64) (row T, err error) {
+	tx, s, err := r.session(ctx, db)
+	if err != nil {
+		return row, err
+	}
+	err = tx.Where(clause.Eq{Column: s.PrioritizedPrimaryField.DBName, Value: id}).First(&row).Error
+	return
+}
+
+// IDRange 查询最小和最大的主键，表为空时都为 0
+func (r *Repository[T, P]) IDRange(ctx context.Context, db *gorm.DB) (minID, maxID uint64, err error) {
+	tx, s, err := r.session(ctx, db)
+	if err != nil {
+		return 0, 0, err
+	}
+	var row struct {
+		MinID *uint64
+		MaxID *uint64
+	}
+	pk := s.PrioritizedPrimaryField.DBName
+	err = tx.Model(new(T)).Select(fmt.Sprintf("MIN(%s) AS min_id, MAX(%s) AS max_id", pk, pk)).Scan(&row).Error
+	if row.MinID != nil && row.MaxID != nil {
+		minID, maxID = *row.MinID, *row.MaxID
+	}
+	return minID, maxID, err
+}
+
+// Create 插入多行，自增的主键回填到 rows 中
+func (r *Repository[T, P]) Create(ctx context.Context, db *gorm.DB, rows ...P) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.WithContext(ctx).Create(rows).Error
+}
+
+// Update 按主键更新一行的全部字段，包括零值，注意不触发 UpdatedAt 自动更新。
+// 数据库中的行版本比 row 新时不更新，updated 返回 false
+func (r *Repository[T, P]) Update(ctx context.Context, db *gorm.DB, row P) (updated bool, err error) {
+	tx, _, err := r.session(ctx, db)
+	if err != nil {
+		return false, err
+	}
+	if r.version != "" {
+		v, _ := r.schema.LookUpField(r.version).ValueOf(ctx, reflect.ValueOf(row).Elem())
+		tx = tx.Where(clause.Lte{Column: r.version, Value: v})
+	}
+	res := tx.Select("*").UpdateColumns(row)
+	return res.RowsAffected > 0, res.Error
+}
+
+// Upsert 插入一行，主键冲突时更新全部字段，数据库中的行版本比 row 新时不更新
+func (r *Repository[T, P]) Upsert(ctx context.Context, db *gorm.DB, row P) error {
+	tx, _, err := r.session(ctx, db)
+	if err != nil {
+		return err
+	}
+	return tx.Clauses(r.onConflict(db)).Create(row).Error
+}
+
+// UpsertBatch 分批插入多行，主键冲突时同 Upsert，重复执行的结果相同
+func (r *Repository[T, P]) UpsertBatch(ctx context.Context, db *gorm.DB, rows []T, batchSize int) error {
+	tx, _, err := r.session(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Clauses(r.onConflict(db)).CreateInBatches(&rows, batchSize).Error
+}
+
+// Delete 按主键物理删除一行
+func (r *Repository[T, P]) Delete(ctx context.Context, db *gorm.DB, id uint64) error {
+	return r.DeleteBatch(ctx, db, []uint64{id})
+}
+
+// DeleteBatch 按主键物理删除多行
+func (r *Repository[T, P]) DeleteBatch(ctx context.Context, db *gorm.DB, ids []uint64) error {
+	tx, _, err := r.session(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Delete(new(T), ids).Error
+}
+
+// Checksum 一行的校验和
+func (r *Repository[T, P]) Checksum(row P) string {
+	return row.Checksum()
+}
+
+// Index 按主键索引多行，rows 不能修改
+func (r *Repository[T, P]) Index(rows []T) map[uint64]P {
+	m := make(map[uint64]P, len(rows))
+	for i := range rows {
+		row := P(&rows[i])
+		m[row.Key()] = row
+	}
+	return m
+}
+
+// onConflict 主键冲突时，只有数据库中的行版本不比写入的行新才更新全部字段，
+// 避免覆盖双写等并发写入的更新的数据
+func (r *Repository[T, P]) onConflict(db *gorm.DB) clause.OnConflict {
+	pk := []clause.Column{{Name: r.schema.PrioritizedPrimaryField.DBName}}
+	if r.version == "" {
+		return clause.OnConflict{Columns: pk, DoUpdates: clause.AssignmentColumns(r.columns)}
+	}
+	set := make(clause.Set, 0, len(r.columns))
+	for _, column := range r.columns {
+		expr := fmt.Sprintf("CASE WHEN excluded.%s >= %s.%s THEN excluded.%s ELSE %s.%s END",
+			r.version, r.schema.Table, r.version, column, r.schema.Table, column)
+		if db.Dialector.Name() == "mysql" {
+			expr = fmt.Sprintf("IF(VALUES(%s) >= %s, VALUES(%s), %s)", r.version, r.version, column, column)
+		}
+		set = append(set, clause.Assignment{Column: clause.Column{Name: column}, Value: clause.Expr{SQL: expr}})
+	}
+	return clause.OnConflict{Columns: pk, DoUpdates: set}
+}
@@ -0,0 +1,245 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"github.com/xuqil/experiments/migrate/internal/models"
+	"github.com/xuqil/experiments/migrate/pkg/util"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+
+// order 主键不叫 id 的另一张表，只需要定义模型
+type order struct {
+	OrderNo   uint64 `gorm:"primaryKey"`
+	Amount    int64
+	UpdatedAt time.Time
+}
+
+func (o *order) Key() uint64 {
+	return o.OrderNo
+}
+
+func (o *order) Checksum() string {
+	return util.Checksum(util.XXHash, o.Amount, o.UpdatedAt)
+}
+
+func newOrders(t *testing.T, nos ...uint64) (*gorm.DB, []order) {
+	db := dbtest.NewSQLite(t)
+	if err := db.AutoMigrate(&order{}); err != nil {
+		t.Fatal(err)
+	}
+	orders := make([]order, 0, len(nos))
+	for _, no := range nos {
+		orders = append(orders, order{OrderNo: no, Amount: int64(no) * 100, UpdatedAt: testTime})
+	}
+	if len(orders) > 0 {
+		if err := db.Create(&orders).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, orders
+}
+
+func keys(rows []order) []uint64 {
+	res := make([]uint64, 0, len(rows))
+	for i := range rows {
+		res = append(res, rows[i].Key())
+	}
+	return res
+}
+
+func TestRepositoryRead(t *testing.T) {
+	ctx := context.Background()
+	repo := models.NewRepository[order]()
+	db, _ := newOrders(t, 2, 3, 10, 11, 30)
+
+	testCases := []struct {
+		name string
+		read func() ([]order, error)
+		want []uint64
+	}{
+		{name: "batch", read: func() ([]order, error) { return repo.Batch(ctx, db, 0, 3) }, want: []uint64{2, 3, 10}},
+		{name: "batch next", read: func() ([]order, error) { return repo.Batch(ctx, db, 10, 3) }, want: []uint64{11, 30}},
+		{name: "batch end", read: func() ([]order, error) { return repo.Batch(ctx, db, 30, 3) }, want: []uint64{}},
+		{name: "interval", read: func() ([]order, error) { return repo.Interval(ctx, db, 3, 8) }, want: []uint64{3, 10}},
+		{name: "interval gap", read: func() ([]order, error) { return repo.Interval(ctx, db, 12, 10) }, want: []uint64{}},
+		{name: "ids", read: func() ([]order, error) { return repo.ByIDs(ctx, db, []uint64{30, 2, 4}) }, want: []uint64{2, 30}},
+		{name: "updated after", read: func() ([]order, error) {
+			return repo.UpdatedAfter(ctx, db, testTime.Add(-time.Second))
+		}, want: []uint64{2, 3, 10, 11, 30}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := tc.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(rows); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expect %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	minID, maxID, err := repo.IDRange(ctx, db)
+	if err != nil || minID != 2 || maxID != 30 {
+		t.Fatalf("expect [2, 30], got [%d, %d] %v", minID, maxID, err)
+	}
+	if _, err = repo.ByID(ctx, db, 4); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expect %v, got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestRepositoryWrite(t *testing.T) {
+	ctx := context.Background()
+	repo := models.NewRepository[order]()
+	db, orders := newOrders(t, 1, 2, 3)
+
+	// 版本更旧的行不覆盖，版本相同或者更新的行覆盖
+	stale := order{OrderNo: 1, Amount: 1, UpdatedAt: testTime.Add(-time.Second)}
+	same := order{OrderNo: 2, Amount: 2, UpdatedAt: testTime}
+	created := order{OrderNo: 4, Amount: 4, UpdatedAt: testTime}
+	if err := repo.UpsertBatch(ctx, db, []order{stale, same, created}, 2); err != nil {
+		t.Fatal(err)
+	}
+	newer := order{OrderNo: 3, Amount: 3, UpdatedAt: testTime.Add(time.Second)}
+	if updated, err := repo.Update(ctx, db, &newer); err != nil || !updated {
+		t.Fatalf("expect updated, got %v %v", updated, err)
+	}
+	older := order{OrderNo: 3, Amount: 33, UpdatedAt: testTime}
+	if updated, err := repo.Update(ctx, db, &older); err != nil || updated {
+		t.Fatalf("expect not updated, got %v %v", updated, err)
+	}
+	rows, err := repo.Batch(ctx, db, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := repo.Index(rows)
+	for _, want := range []order{orders[0], same, newer, created} {
+		if g, ok := got[want.OrderNo]; !ok || repo.Checksum(g) != repo.Checksum(&want) {
+			t.Fatalf("expect %+v, got %+v", want, g)
+		}
+	}
+
+	if err = repo.DeleteBatch(ctx, db, []uint64{1, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Delete(ctx, db, 2); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ = repo.Batch(ctx, db, 0, 10); !reflect.DeepEqual(keys(rows), []uint64{3}) {
+		t.Fatalf("expect [3], got %v", keys(rows))
+	}
+}
+
+func TestRepositorySoftDelete(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.NewSQLite(t)
+	user := models.User{Name: "tom", CreatedAt: testTime, UpdatedAt: testTime}
+	if err := models.Users.Create(ctx, db, &user); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 读取包括软删除的行
+	got, err := models.Users.ByID(ctx, db, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.DeletedAt.Valid {
+		t.Fatal("expect soft deleted user")
+	}
+	// 删除是物理删除
+	if err = models.Users.Delete(ctx, db, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.Users.ByID(ctx, db, user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expect %v, got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestRepositoryUpsertMySQL(t *testing.T) {
+	// DryRun 只生成 SQL，不连接 MySQL
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "root:pass@tcp(127.0.0.1:3306)/test", SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sqls []string
+	err = db.Callback().Create().After("gorm:create").Register("test:sql", func(tx *gorm.DB) {
+		sqls = append(sqls, tx.Statement.SQL.String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		userColumns = "INSERT INTO `users` (`name`,`email`,`birthday`,`created_at`,`updated_at`,`deleted_at`,`id`) VALUES "
+		userUpdates = " ON DUPLICATE KEY UPDATE " +
+			"`name`=IF(VALUES(updated_at) >= updated_at, VALUES(name), name)," +
+			"`email`=IF(VALUES(updated_at) >= updated_at, VALUES(email), email)," +
+			"`birthday`=IF(VALUES(updated_at) >= updated_at, VALUES(birthday), birthday)," +
+			"`created_at`=IF(VALUES(updated_at) >= updated_at, VALUES(created_at), created_at)," +
+			"`deleted_at`=IF(VALUES(updated_at) >= updated_at, VALUES(deleted_at), deleted_at)," +
+			"`updated_at`=IF(VALUES(updated_at) >= updated_at, VALUES(updated_at), updated_at)"
+	)
+	ctx := context.Background()
+	testCases := []struct {
+		name    string
+		upsert  func() error
+		want    string
+		version string // 版本字段，需要在最后赋值
+	}{
+		{
+			name: "upsert",
+			upsert: func() error {
+				return models.NewRepository[models.User]().Upsert(ctx, db, &models.User{ID: 1, Name: "tom"})
+			},
+			want:    userColumns + "(?,?,?,?,?,?,?)" + userUpdates,
+			version: "updated_at",
+		},
+		{
+			name: "upsert batch",
+			upsert: func() error {
+				return models.NewRepository[models.User]().UpsertBatch(ctx, db, []models.User{{ID: 1}, {ID: 2}}, 10)
+			},
+			want:    userColumns + "(?,?,?,?,?,?,?),(?,?,?,?,?,?,?)" + userUpdates,
+			version: "updated_at",
+		},
+		{
+			name: "no version",
+			upsert: func() error {
+				return models.NewRepository[order](models.WithVersion("")).Upsert(ctx, db, &order{OrderNo: 1})
+			},
+			want: "INSERT INTO `orders` (`amount`,`updated_at`,`order_no`) VALUES (?,?,?) " +
+				"ON DUPLICATE KEY UPDATE `amount`=VALUES(`amount`),`updated_at`=VALUES(`updated_at`)",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sqls = nil
+			if err := tc.upsert(); err != nil {
+				t.Fatal(err)
+			}
+			if len(sqls) != 1 || sqls[0] != tc.want {
+				t.Fatalf("expect %s, got %v", tc.want, sqls)
+			}
+			if tc.version == "" {
+				return
+			}
+			// ON DUPLICATE KEY UPDATE 按顺序赋值，版本字段在最后才能让其它字段比较到旧的版本
+			updates := sqls[0][strings.Index(sqls[0], "ON DUPLICATE KEY UPDATE"):]
+			if last := strings.LastIndex(updates, "`="); !strings.HasSuffix(updates[:last], "`"+tc.version) {
+				t.Fatalf("expect %s assigned last, got %s", tc.version, updates)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package throttle
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pauseRatio 负载超过阈值的该倍数，或者获取指标失败时暂停，直到回到阈值以下
+const pauseRatio = 2
+
+// latencyWeight 读取延迟的指数移动平均中最新一次的权重
+const latencyWeight = 0.2
+
+// LagFunc 获取复制延迟
+type LagFunc func(ctx context.Context) (time.Duration, error)
+
+// ReplicaLag 通过 SHOW REPLICA STATUS 获取从库的复制延迟，多个从库时取最大值。
+// MySQL 8.0.22 之前的版本使用 SHOW SLAVE STATUS；复制线程停止时延迟为 NULL，返回错误
+func ReplicaLag(dbs ...*sql.DB) LagFunc {
+	return func(ctx context.Context) (time.Duration, error) {
+		var lag time.Duration
+		for i, db := range dbs {
+			l, err := replicaLag(ctx, db)
+			if err != nil {
+				return 0, fmt.Errorf("获取第 %d 个从库的复制延迟失败 error:%w", i+1, err)
+			}
+			if l > lag {
+				lag = l
+			}
+		}
+		return lag, nil
+	}
+}
+
+func replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		if rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS"); err != nil {
+			return 0, err
+		}
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("不是从库")
+	}
+	values := make([]any, len(columns))
+	raw := make([]sql.RawBytes, len(columns))
+	for i := range values {
+		values[i] = &raw[i]
+	}
+	if err = rows.Scan(values...); err != nil {
+		return 0, err
+	}
+	for i, name := range columns {
+		if name != "Seconds_Behind_Source" && name != "Seconds_Behind_Master" {
+			continue
+		}
+		if raw[i] == nil {
+			return 0, errors.New("复制线程没有运行")
+		}
+		seconds, er := strconv.ParseInt(string(raw[i]), 10, 64)
+		if er != nil {
+			return 0, er
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("缺少 Seconds_Behind_Source 字段")
+}
+
+// ThreadsRunning 通过 SHOW GLOBAL STATUS 获取正在执行的线程数，反映数据库当前的负载
+func ThreadsRunning(db *sql.DB) func(ctx context.Context) (int64, error) {
+	return func(ctx context.Context) (int64, error) {
+		var name, value string
+		err := db.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_running'").Scan(&name, &value)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(value, 10, 64)
+	}
+}
+
+// metric 负载指标，ratio 返回当前值与阈值的比值，大于 1 表示超过阈值
+type metric struct {
+	name  string
+	ratio func(ctx context.Context) (float64, string, error)
+}
+
+type Option func(t *Throttle)
+
+// WithReplicaLag 复制延迟超过 max 时限速
+func WithReplicaLag(lag LagFunc, max time.Duration) Option {
+	return func(t *Throttle) {
+		if lag == nil || max <= 0 {
+			return
+		}
+		t.metrics = append(t.metrics, metric{name: "复制延迟", ratio: func(ctx context.Context) (float64, string, error) {
+			l, err := lag(ctx)
+			return float64(l) / float64(max), l.String(), err
+		}})
+	}
+}
+
+// WithThreadsRunning Threads_running 超过 max 时限速，threads 一般为 ThreadsRunning
+func WithThreadsRunning(threads func(ctx context.Context) (int64, error), max int64) Option {
+	return func(t *Throttle) {
+		if threads == nil || max <= 0 {
+			return
+		}
+		t.metrics = append(t.metrics, metric{name: "Threads_running", ratio: func(ctx context.Context) (float64, string, error) {
+			n, err := threads(ctx)
+			return float64(n) / float64(max), strconv.FormatInt(n, 10), err
+		}})
+	}
+}
+
+// WithReadLatency 读取延迟的移动平均超过 max 时限速，读取延迟由调用方通过 Observe 上报。
+// 暂停时没有新的读取，两次检查之间没有上报时移动平均按 latencyWeight 衰减，否则会一直暂停
+func WithReadLatency(max time.Duration) Option {
+	return func(t *Throttle) {
+		if max <= 0 {
+			return
+		}
+		t.metrics = append(t.metrics, metric{name: "读取延迟", ratio: func(context.Context) (float64, string, error) {
+			if !t.observed.Swap(false) {
+				t.decay()
+			}
+			l := time.Duration(t.latency.Load())
+			return float64(l) / float64(max), l.String(), nil
+		}})
+	}
+}
+
+// WithBackoff 设置超过阈值时每批之间的休眠时长，从 min 开始每次翻倍，最长为 max，回到阈值以下后逐步减半。
+// min 小于等于 0 时从 0 翻倍一直为 0，超过阈值也不会休眠，此时使用默认值
+func WithBackoff(min, max time.Duration) Option {
+	return func(t *Throttle) {
+		if min > 0 {
+			t.minBackoff = min
+		}
+		t.maxBackoff = max
+	}
+}
+
+// WithInterval 设置检查指标的间隔，间隔内复用上次的结果
+func WithInterval(d time.Duration) Option {
+	return func(t *Throttle) {
+		t.interval = d
+	}
+}
+
+// Throttle 按源库的负载自适应地限速，可以由多个 goroutine 共用：
+// 所有指标都在阈值以下时不休眠；任意指标超过阈值时，每批之间的休眠时长逐步翻倍；
+// 超过阈值的 2 倍或者获取指标失败时暂停，直到回到阈值以下
+type Throttle struct {
+	metrics    []metric
+	interval   time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	checked   time.Time     // 上次检查的时间
+	ratio     float64       // 上次检查时负载最高的指标与阈值的比值
+	lastErr   error         // 上次检查的错误
+	backoff   time.Duration // 当前的休眠时长
+	latency   atomic.Int64  // 读取延迟的移动平均
+	observed  atomic.Bool   // 上次检查之后是否上报过读取延迟
+	throttled atomic.Int64  // 累计限速的时长
+	lock      sync.Mutex
+}
+
+// New 创建 Throttle，没有设置任何指标时返回 nil，不限速
+func New(opts ...Option) *Throttle {
+	t := &Throttle{
+		interval:   time.Second,
+		minBackoff: time.Millisecond * 100,
+		maxBackoff: time.Second * 10,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if len(t.metrics) == 0 {
+		return nil
+	}
+	return t
+}
+
+// Observe 上报一次读取的延迟，t 为 nil 时忽略
+func (t *Throttle) Observe(d time.Duration) {
+	if t == nil {
+		return
+	}
+	for {
+		old := t.latency.Load()
+		next := int64(d)
+		if old > 0 {
+			next = int64(float64(old)*(1-latencyWeight) + float64(d)*latencyWeight)
+		}
+		if t.latency.CompareAndSwap(old, next) {
+			t.observed.Store(true)
+			return
+		}
+	}
+}
+
+// decay 没有新的读取时按一次延迟为 0 的上报衰减移动平均
+func (t *Throttle) decay() {
+	for {
+		old := t.latency.Load()
+		if t.latency.CompareAndSwap(old, int64(float64(old)*(1-latencyWeight))) {
+			return
+		}
+	}
+}
+
+// Wait 按负载休眠或者暂停，t 为 nil 时直接返回
+func (t *Throttle) Wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		t.throttled.Add(int64(time.Since(start)))
+	}()
+	for {
+		ratio, err := t.check(ctx)
+		if err == nil && ratio < pauseRatio {
+			return sleep(ctx, t.next(ratio))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = sleep(ctx, t.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Throttled 累计限速的时长，包括休眠和暂停
+func (t *Throttle) Throttled() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.throttled.Load())
+}
+
+// next 按负载调整休眠时长
+func (t *Throttle) next(ratio float64) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case ratio > 1:
+		t.backoff *= 2
+		if t.backoff < t.minBackoff {
+			t.backoff = t.minBackoff
+		}
+		if t.backoff > t.maxBackoff {
+			t.backoff = t.maxBackoff
+		}
+	case t.backoff > t.minBackoff:
+		t.backoff /= 2
+	default:
+		t.backoff = 0
+	}
+	return t.backoff
+}
+
+// check 获取负载最高的指标与阈值的比值，距离上次检查不到 interval 时返回上次的结果。
+// 查询指标时不持有锁，其它 goroutine 在检查期间使用上次的结果
+func (t *Throttle) check(ctx context.Context) (float64, error) {
+	t.lock.Lock()
+	if !t.checked.IsZero() && time.Since(t.checked) < t.interval {
+		defer t.lock.Unlock()
+		return t.ratio, t.lastErr
+	}
+	t.checked = time.Now()
+	t.lock.Unlock()
+
+	var (
+		max     float64
+		lastErr error
+		over    []string
+	)
+	for _, m := range t.metrics {
+		ratio, value, err := m.ratio(ctx)
+		if err != nil {
+			lastErr = fmt.Errorf("获取%s失败 error:%w", m.name, err)
+			break
+		}
+		if ratio > 1 {
+			over = append(over, fmt.Sprintf("%s %s 为阈值的 %.1f 倍", m.name, value, ratio))
+		}
+		if ratio > max {
+			max = ratio
+		}
+	}
+	switch {
+	case lastErr != nil:
+		log.Println(fmt.Errorf("暂停执行 error:%w", lastErr))
+	case max >= pauseRatio:
+		log.Println("暂停执行:", strings.Join(over, "，"))
+	case max > 1:
+		log.Println("降低速度:", strings.Join(over, "，"))
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ratio, t.lastErr = max, lastErr
+	return max, lastErr
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,182 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottlePause(t *testing.T) {
+	// 前两次检查延迟超过阈值的 2 倍或者获取失败，之后恢复
+	var calls atomic.Int64
+	lag := func(context.Context) (time.Duration, error) {
+		switch calls.Add(1) {
+		case 1:
+			return time.Minute, nil
+		case 2:
+			return 0, errors.New("replica stopped")
+		default:
+			return time.Second, nil
+		}
+	}
+	th := New(WithReplicaLag(lag, 5*time.Second), WithInterval(time.Millisecond))
+	if err := th.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expect 3 checks, got %d", calls.Load())
+	}
+	if th.Throttled() <= 0 {
+		t.Fatal("expect throttled duration")
+	}
+
+	// 检查结果在 interval 内复用
+	th = New(WithReplicaLag(lag, 5*time.Second), WithInterval(time.Hour))
+	for i := 0; i < 3; i++ {
+		if err := th.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 4 {
+		t.Fatalf("expect 4 checks, got %d", calls.Load())
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	var threads atomic.Int64
+	running := func(context.Context) (int64, error) {
+		return threads.Load(), nil
+	}
+	th := New(WithThreadsRunning(running, 10), WithBackoff(time.Millisecond, 4*time.Millisecond),
+		WithInterval(0))
+	testCases := []struct {
+		threads int64
+		want    time.Duration
+	}{
+		{threads: 5},
+		{threads: 15, want: time.Millisecond},
+		{threads: 15, want: 2 * time.Millisecond},
+		{threads: 15, want: 4 * time.Millisecond},
+		{threads: 19, want: 4 * time.Millisecond},
+		{threads: 10, want: 2 * time.Millisecond},
+		{threads: 10, want: time.Millisecond},
+		{threads: 10},
+	}
+	for i, tc := range testCases {
+		threads.Store(tc.threads)
+		ratio, err := th.check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := th.next(ratio); got != tc.want {
+			t.Fatalf("%d: threads %d expect backoff %s, got %s", i, tc.threads, tc.want, got)
+		}
+	}
+}
+
+func TestThrottleZeroMinBackoff(t *testing.T) {
+	running := func(context.Context) (int64, error) {
+		return 15, nil
+	}
+	th := New(WithThreadsRunning(running, 10), WithBackoff(0, time.Second), WithInterval(0))
+	// 超过阈值时从默认的 min 开始翻倍，不会一直为 0
+	for _, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		ratio, err := th.check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := th.next(ratio); got != want {
+			t.Fatalf("expect backoff %s, got %s", want, got)
+		}
+	}
+}
+
+func TestThrottleReadLatency(t *testing.T) {
+	th := New(WithReadLatency(100 * time.Millisecond))
+	th.Observe(50 * time.Millisecond)
+	if ratio, _ := th.check(context.Background()); ratio != 0.5 {
+		t.Fatalf("expect ratio 0.5, got %v", ratio)
+	}
+	// 移动平均：50ms*0.8 + 300ms*0.2 = 100ms
+	th.Observe(300 * time.Millisecond)
+	th.checked = time.Time{}
+	if ratio, _ := th.check(context.Background()); ratio != 1 {
+		t.Fatalf("expect ratio 1, got %v", ratio)
+	}
+}
+
+func TestThrottleCanceled(t *testing.T) {
+	lag := func(context.Context) (time.Duration, error) {
+		return time.Minute, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	th := New(WithReplicaLag(lag, time.Second), WithInterval(time.Millisecond))
+	if err := th.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// 没有设置指标时不限速
+	th = New(WithReplicaLag(lag, 0), WithThreadsRunning(nil, 10))
+	if th != nil {
+		t.Fatal("expect nil throttle")
+	}
+	if err := th.Wait(ctx); err != nil || th.Throttled() != 0 {
+		t.Fatalf("expect no throttle, got %v", err)
+	}
+	th.Observe(time.Second)
+}
+
+func TestThrottleReadLatencyDecay(t *testing.T) {
+	// 读取延迟为阈值的 10 倍时暂停，暂停期间没有新的读取，移动平均逐步衰减后继续执行
+	th := New(WithReadLatency(10*time.Millisecond), WithInterval(time.Millisecond))
+	th.Observe(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := th.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l := time.Duration(th.latency.Load()); l >= 20*time.Millisecond {
+		t.Fatalf("expect latency below pause threshold, got %s", l)
+	}
+	if th.Throttled() <= 0 {
+		t.Fatal("expect throttled duration")
+	}
+}
+
+func TestThrottleCheckUnlocked(t *testing.T) {
+	// 查询指标时不持有锁，其它 goroutine 使用上次的结果，不等待查询完成
+	block := make(chan struct{})
+	var calls atomic.Int64
+	lag := func(context.Context) (time.Duration, error) {
+		if calls.Add(1) == 2 {
+			<-block
+		}
+		return time.Second, nil
+	}
+	th := New(WithReplicaLag(lag, 10*time.Second), WithInterval(0))
+	if _, err := th.check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = th.check(context.Background())
+	}()
+	for calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	th.lock.Lock()
+	th.interval = time.Hour
+	th.lock.Unlock()
+	if ratio, err := th.check(context.Background()); err != nil || ratio != 0.1 {
+		t.Fatalf("expect cached ratio 0.1, got %v %v", ratio, err)
+	}
+	close(block)
+	<-done
+	if calls.Load() != 2 {
+		t.Fatalf("expect 2 checks, got %d", calls.Load())
+	}
+}
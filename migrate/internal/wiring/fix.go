@@ -0,0 +1,85 @@
+// Package wiring 按配置创建修复使用的数据源、限速和选项，conf 只负责加载和校验配置
+package wiring
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/xuqil/experiments/migrate/internal/conf"
+	"github.com/xuqil/experiments/migrate/internal/fix"
+	"github.com/xuqil/experiments/migrate/internal/throttle"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"gorm.io/gorm"
+)
+
+// FixOptions 按配置设置修复的批次、限速和重试
+func FixOptions(cfg *conf.Config) []fix.Optional {
+	return []fix.Optional{
+		fix.WithSleep(cfg.Fix.Sleep), fix.WithFilter(cfg.Fix.Filter),
+		fix.WithRetry(cfg.Fix.Retries, cfg.Fix.RetryBackoff), fix.WithRowImage(cfg.Fix.RowImage),
+		fix.WithWorkers(cfg.Fix.Workers), fix.WithFlush(cfg.Fix.FlushSize, cfg.Fix.FlushInterval),
+		fix.WithDDLAllow(cfg.Fix.DDLAllow...), fix.WithSkipDeleted(cfg.Fix.SkipDeleted),
+	}
+}
+
+// NewFixSource 按 fix.source 创建 binlog 数据源，binlog 中的时间按源库 DSN 的 loc 解析
+func NewFixSource(cfg *conf.Config, sdb *gorm.DB, store fix.PositionStore) (fix.Source, error) {
+	loc, err := cfg.Source.Location()
+	if err != nil {
+		return nil, err
+	}
+	cdc.SetLocation(loc)
+	switch cfg.Fix.Source {
+	case "kafka":
+		// 从 Kafka 消费 canal 投递的消息，canal.serverMode = kafka
+		format := fix.FlatMessage
+		if cfg.Kafka.Format == "protobuf" {
+			format = fix.ProtoMessage
+		}
+		return fix.NewKafkaSource(cfg.Kafka.Brokers, cfg.Kafka.Group, cfg.Kafka.Topics, format), nil
+	case "binlog":
+		// 不部署 canal，伪装成从库直接读取源库的 binlog
+		host, port, user, password, err := cfg.Source.Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		return fix.NewBinlogSource(fix.BinlogConfig{Host: host, Port: port, User: user, Password: password,
+			ServerID: cfg.Binlog.ServerID, GTID: cfg.Binlog.GTID}, sdb, store), nil
+	case "canal":
+		return fix.NewCanalSource(conf.NewCanalConnector(cfg.Canal)), nil
+	}
+	return nil, fmt.Errorf("未知的 binlog 数据源 %s", cfg.Fix.Source)
+}
+
+// NewThrottle 按 throttle 的配置创建自适应限速，没有设置任何阈值时返回 nil。
+// Threads_running 从源库 sdb 获取，返回的 closer 用于关闭从库的连接
+func NewThrottle(cfg *conf.Config, sdb *gorm.DB) (*throttle.Throttle, func(), error) {
+	c := cfg.Throttle
+	replicas := make([]*sql.DB, 0, len(c.Replicas))
+	closer := func() {
+		for _, db := range replicas {
+			_ = db.Close()
+		}
+	}
+	opts := []throttle.Option{throttle.WithBackoff(c.MinBackoff, c.MaxBackoff), throttle.WithInterval(c.Interval),
+		throttle.WithReadLatency(c.MaxReadLatency)}
+	if len(c.Replicas) > 0 {
+		for _, dsn := range c.Replicas {
+			db, err := conf.OpenDB(conf.DB{DSN: dsn, MaxIdleConns: 1, MaxOpenConns: 1})
+			if err != nil {
+				closer()
+				return nil, nil, fmt.Errorf("连接从库失败 error:%w", err)
+			}
+			replicas = append(replicas, db)
+		}
+		opts = append(opts, throttle.WithReplicaLag(throttle.ReplicaLag(replicas...), c.MaxLag))
+	}
+	if c.MaxThreadsRunning > 0 {
+		db, err := sdb.DB()
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		opts = append(opts, throttle.WithThreadsRunning(throttle.ThreadsRunning(db), c.MaxThreadsRunning))
+	}
+	return throttle.New(opts...), closer, nil
+}
@@ -0,0 +1,190 @@
+package cdc
+
+import (
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// java.sql.Types，canal 通过 Column.SqlType 返回
+const (
+	SQLTypeBit           = -7
+	SQLTypeTinyInt       = -6
+	SQLTypeSmallInt      = 5
+	SQLTypeInteger       = 4
+	SQLTypeBigInt        = -5
+	SQLTypeFloat         = 6
+	SQLTypeReal          = 7
+	SQLTypeDouble        = 8
+	SQLTypeNumeric       = 2
+	SQLTypeDecimal       = 3
+	SQLTypeChar          = 1
+	SQLTypeVarchar       = 12
+	SQLTypeDate          = 91
+	SQLTypeTime          = 92
+	SQLTypeTimestamp     = 93
+	SQLTypeBinary        = -2
+	SQLTypeVarBinary     = -3
+	SQLTypeLongVarBinary = -4
+	SQLTypeBlob          = 2004
+	SQLTypeClob          = 2005
+)
+
+// canal 返回的时间格式，小数部分位数不固定
+const (
+	dateLayout     = "2006-01-02"
+	datetimeLayout = "2006-01-02 15:04:05.999999999"
+)
+
+// location 解析 DATE、DATETIME 和 TIMESTAMP 的时区
+var location atomic.Pointer[time.Location]
+
+// SetLocation 设置解析 DATE、DATETIME 和 TIMESTAMP 的时区，默认为 time.Local。
+// binlog 中的时间没有时区，需要与读取源库时使用的时区一致（DSN 的 loc），否则与源库读出的时间不相等
+func SetLocation(loc *time.Location) {
+	location.Store(loc)
+}
+
+// Location 解析 DATE、DATETIME 和 TIMESTAMP 的时区
+func Location() *time.Location {
+	if loc := location.Load(); loc != nil {
+		return loc
+	}
+	return time.Local
+}
+
+// DecodeEntries 解析 canal 的 Entry，跳过事务开始和结束，每行数据一个 ChangeEvent
+func DecodeEntries(entries []pbe.Entry) ([]ChangeEvent, error) {
+	events := make([]ChangeEvent, 0, len(entries))
+	for i := range entries {
+		es, err := DecodeEntry(&entries[i])
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, es...)
+	}
+	return events, nil
+}
+
+// DecodeEntry 解析一个 canal 的 Entry，不是行数据时返回 nil
+func DecodeEntry(entry *pbe.Entry) ([]ChangeEvent, error) {
+	if entry.GetEntryType() != pbe.EntryType_ROWDATA {
+		return nil, nil
+	}
+	rowChange := new(pbe.RowChange)
+	if err := proto.Unmarshal(entry.GetStoreValue(), rowChange); err != nil {
+		return nil, err
+	}
+	header := entry.GetHeader()
+	base := ChangeEvent{
+		Schema: header.GetSchemaName(),
+		Table:  header.GetTableName(),
+		Type:   rowChange.GetEventType(),
+		Position: Position{
+			File:      header.GetLogfileName(),
+			Offset:    header.GetLogfileOffset(),
+			GTID:      header.GetGtid(),
+			Timestamp: header.GetExecuteTime(),
+		},
+		IsDDL: rowChange.GetIsDdl(),
+		SQL:   rowChange.GetSql(),
+	}
+	if ts := header.GetExecuteTime(); ts > 0 {
+		base.Timestamp = time.UnixMilli(ts)
+	}
+	if base.IsDDL {
+		return []ChangeEvent{base}, nil
+	}
+	return DecodeRows(base, rowChange.GetRowDatas())
+}
+
+// DecodeRows 以 base 的库表、类型和位点为基础，将 canal 的每行数据转为一个 ChangeEvent
+func DecodeRows(base ChangeEvent, rows []*pbe.RowData) ([]ChangeEvent, error) {
+	events := make([]ChangeEvent, 0, len(rows))
+	for _, rowData := range rows {
+		e := base
+		var err error
+		if e.Before, err = DecodeColumns(rowData.GetBeforeColumns()); err != nil {
+			return nil, fmt.Errorf("解析 %s.%s 的数据失败 error:%w", e.Schema, e.Table, err)
+		}
+		if e.After, err = DecodeColumns(rowData.GetAfterColumns()); err != nil {
+			return nil, fmt.Errorf("解析 %s.%s 的数据失败 error:%w", e.Schema, e.Table, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// DecodeColumns 将 canal 的字段转为 Row
+func DecodeColumns(columns []*pbe.Column) (Row, error) {
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	row := make(Row, 0, len(columns))
+	for _, col := range columns {
+		v, err := ColumnValue(col)
+		if err != nil {
+			return nil, fmt.Errorf("解析字段 %s 失败 value:%s error:%w", col.GetName(), col.GetValue(), err)
+		}
+		row = append(row, Column{
+			Name:      col.GetName(),
+			Value:     v,
+			Raw:       col.GetValue(),
+			IsNull:    col.GetIsNull(),
+			IsKey:     col.GetIsKey(),
+			Updated:   col.GetUpdated(),
+			SQLType:   col.GetSqlType(),
+			MysqlType: col.GetMysqlType(),
+		})
+	}
+	return row, nil
+}
+
+// ColumnValue 根据 SqlType 和 MysqlType 将 canal 的字符串值转为对应的 Go 类型：
+// 整数为 int64，无符号整数和 BIT 为 uint64，浮点数为 float64，DECIMAL 保留字符串，
+// DATE、DATETIME、TIMESTAMP 为本地时区的 time.Time，二进制为 []byte，其它为 string，NULL 为 nil
+func ColumnValue(col *pbe.Column) (any, error) {
+	if col.GetIsNull() {
+		return nil, nil
+	}
+	val := col.GetValue()
+	switch col.GetSqlType() {
+	case SQLTypeTinyInt, SQLTypeSmallInt, SQLTypeInteger, SQLTypeBigInt:
+		if strings.Contains(strings.ToLower(col.GetMysqlType()), "unsigned") {
+			return strconv.ParseUint(val, 10, 64)
+		}
+		return strconv.ParseInt(val, 10, 64)
+	case SQLTypeBit:
+		return strconv.ParseUint(val, 10, 64)
+	case SQLTypeFloat, SQLTypeReal, SQLTypeDouble:
+		return strconv.ParseFloat(val, 64)
+	case SQLTypeNumeric, SQLTypeDecimal:
+		// 保留原始字符串，避免精度丢失
+		return val, nil
+	case SQLTypeDate:
+		if strings.HasPrefix(val, "0000-00-00") { // MySQL 零值日期
+			return time.Time{}, nil
+		}
+		return time.ParseInLocation(dateLayout, val, Location())
+	case SQLTypeTime:
+		return val, nil
+	case SQLTypeTimestamp:
+		if strings.HasPrefix(val, "0000-00-00") { // MySQL 零值时间
+			return time.Time{}, nil
+		}
+		return time.ParseInLocation(datetimeLayout, val, Location())
+	case SQLTypeBinary, SQLTypeVarBinary, SQLTypeLongVarBinary, SQLTypeBlob:
+		// canal 以 ISO-8859-1 编码二进制数据
+		b := make([]byte, 0, len(val))
+		for _, r := range val {
+			b = append(b, byte(r))
+		}
+		return b, nil
+	default:
+		return val, nil
+	}
+}
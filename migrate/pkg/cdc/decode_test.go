@@ -0,0 +1,216 @@
+package cdc
+
+import (
+	"bytes"
+	"github.com/gogo/protobuf/proto"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"testing"
+	"time"
+)
+
+func column(name string, sqlType int32, mysqlType string, value string) *pbe.Column {
+	return &pbe.Column{
+		Name:      name,
+		SqlType:   sqlType,
+		MysqlType: mysqlType,
+		Value:     value,
+	}
+}
+
+func keyColumn(name string, value string) *pbe.Column {
+	col := column(name, SQLTypeBigInt, "bigint", value)
+	col.IsKey = true
+	return col
+}
+
+func entry(t *testing.T, typ pbe.EntryType, rowChange *pbe.RowChange) pbe.Entry {
+	value, err := proto.Marshal(rowChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pbe.Entry{
+		Header: &pbe.Header{
+			LogfileName:   "mysql-bin.000001",
+			LogfileOffset: 120,
+			ExecuteTime:   1690000000000,
+			SchemaName:    "test",
+			TableName:     "orders",
+			Gtid:          "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		},
+		EntryTypePresent: &pbe.Entry_EntryType{EntryType: typ},
+		StoreValue:       value,
+	}
+}
+
+func TestDecodeEntries(t *testing.T) {
+	before := []*pbe.Column{keyColumn("user_id", "1"), keyColumn("order_id", "2"), column("amount", SQLTypeDecimal, "decimal(10,2)", "1.10")}
+	after := []*pbe.Column{keyColumn("user_id", "1"), keyColumn("order_id", "2"), column("amount", SQLTypeDecimal, "decimal(10,2)", "2.20")}
+	after[2].Updated = true
+	entries := []pbe.Entry{
+		entry(t, pbe.EntryType_TRANSACTIONBEGIN, &pbe.RowChange{}),
+		entry(t, pbe.EntryType_ROWDATA, &pbe.RowChange{
+			EventTypePresent: &pbe.RowChange_EventType{EventType: pbe.EventType_UPDATE},
+			RowDatas: []*pbe.RowData{
+				{BeforeColumns: before, AfterColumns: after},
+				{BeforeColumns: before, AfterColumns: after},
+			},
+		}),
+		entry(t, pbe.EntryType_ROWDATA, &pbe.RowChange{
+			EventTypePresent: &pbe.RowChange_EventType{EventType: pbe.EventType_ALTER},
+			IsDdlPresent:     &pbe.RowChange_IsDdl{IsDdl: true},
+			Sql:              "ALTER TABLE orders ADD COLUMN note varchar(32)",
+		}),
+		entry(t, pbe.EntryType_TRANSACTIONEND, &pbe.RowChange{}),
+	}
+	events, err := DecodeEntries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(events))
+	}
+
+	e := events[0]
+	if e.Schema != "test" || e.Table != "orders" || e.Type != pbe.EventType_UPDATE || e.IsDDL {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	wantPos := Position{File: "mysql-bin.000001", Offset: 120, GTID: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		Timestamp: 1690000000000}
+	if e.Position != wantPos {
+		t.Fatalf("expect position %+v, got %+v", wantPos, e.Position)
+	}
+	if !e.Timestamp.Equal(time.UnixMilli(1690000000000)) {
+		t.Fatalf("unexpected timestamp %s", e.Timestamp)
+	}
+	if key := e.Key(); len(key) != 2 || key.String() != "1,2" || key[0].Value != int64(1) {
+		t.Fatalf("unexpected key %v", key)
+	}
+	if v := e.Before.Value("AMOUNT"); v != "1.10" {
+		t.Fatalf("expect amount 1.10, got %v", v)
+	}
+	if updated := e.Updated(); len(updated) != 1 || updated[0].Name != "amount" {
+		t.Fatalf("unexpected updated columns %v", updated)
+	}
+
+	ddl := events[2]
+	if !ddl.IsDDL || ddl.SQL != "ALTER TABLE orders ADD COLUMN note varchar(32)" || ddl.Before != nil || ddl.After != nil {
+		t.Fatalf("unexpected ddl event: %+v", ddl)
+	}
+}
+
+func TestDeleteKey(t *testing.T) {
+	events, err := DecodeRows(ChangeEvent{Type: pbe.EventType_DELETE}, []*pbe.RowData{
+		{BeforeColumns: []*pbe.Column{keyColumn("id", "7"), column("name", SQLTypeVarchar, "varchar(32)", "tom")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := events[0].Key(); len(key) != 1 || key[0].Value != int64(7) {
+		t.Fatalf("unexpected key %v", key)
+	}
+	if m := events[0].Row().Map(); m["name"] != "tom" {
+		t.Fatalf("unexpected row %v", m)
+	}
+}
+
+func TestDecodeColumnsError(t *testing.T) {
+	_, err := DecodeColumns([]*pbe.Column{column("id", SQLTypeBigInt, "bigint", "abc")})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestColumnValue(t *testing.T) {
+	testCases := []struct {
+		name string
+		col  *pbe.Column
+		want any
+	}{
+		{name: "int", col: column("a", SQLTypeInteger, "int", "-1"), want: int64(-1)},
+		{name: "unsigned", col: column("a", SQLTypeInteger, "int unsigned", "1"), want: uint64(1)},
+		{name: "bit", col: column("a", SQLTypeBit, "bit(1)", "1"), want: uint64(1)},
+		{name: "double", col: column("a", SQLTypeDouble, "double", "1.5"), want: 1.5},
+		{name: "decimal", col: column("a", SQLTypeDecimal, "decimal(10,2)", "1.10"), want: "1.10"},
+		{name: "varchar", col: column("a", SQLTypeVarchar, "varchar(10)", "tom"), want: "tom"},
+		{name: "date", col: column("a", SQLTypeDate, "date", "2023-08-01"), want: time.Date(2023, 8, 1, 0, 0, 0, 0, time.Local)},
+		{name: "datetime", col: column("a", SQLTypeTimestamp, "datetime(3)", "2023-08-01 10:00:01.5"),
+			want: time.Date(2023, 8, 1, 10, 0, 1, 500000000, time.Local)},
+		{name: "zero time", col: column("a", SQLTypeTimestamp, "datetime", "0000-00-00 00:00:00"), want: time.Time{}},
+		{name: "zero date", col: column("a", SQLTypeDate, "date", "0000-00-00"), want: time.Time{}},
+		{name: "null", col: &pbe.Column{Name: "a", SqlType: SQLTypeInteger, IsNullPresent: &pbe.Column_IsNull{IsNull: true}}, want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ColumnValue(tc.col)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, ok := tc.want.(time.Time); ok {
+				if !got.(time.Time).Equal(want) {
+					t.Fatalf("expect %s, got %v", want, got)
+				}
+				return
+			}
+			if got != tc.want {
+				t.Fatalf("expect %v(%T), got %v(%T)", tc.want, tc.want, got, got)
+			}
+		})
+	}
+}
+
+func TestColumnValueLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	SetLocation(loc)
+	defer SetLocation(nil)
+	testCases := []struct {
+		name string
+		col  *pbe.Column
+		want time.Time
+	}{
+		{name: "date", col: column("a", SQLTypeDate, "date", "2023-08-01"), want: time.Date(2023, 8, 1, 0, 0, 0, 0, loc)},
+		{name: "datetime", col: column("a", SQLTypeTimestamp, "datetime", "2023-08-01 10:00:01"),
+			want: time.Date(2023, 8, 1, 10, 0, 1, 0, loc)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ColumnValue(tc.col)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.(time.Time).Equal(tc.want) || got.(time.Time).Location() != loc {
+				t.Fatalf("expect %s, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestColumnValueBinary(t *testing.T) {
+	got, err := ColumnValue(column("a", SQLTypeBlob, "blob", "ÿ\u0001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.([]byte), []byte{0xff, 0x01}) {
+		t.Fatalf("unexpected value %v", got)
+	}
+}
+
+func TestPositionBefore(t *testing.T) {
+	testCases := []struct {
+		p    Position
+		o    Position
+		want bool
+	}{
+		{p: Position{File: "mysql-bin.000001", Offset: 100}, o: Position{File: "mysql-bin.000001", Offset: 200}, want: true},
+		{p: Position{File: "mysql-bin.000001", Offset: 200}, o: Position{File: "mysql-bin.000001", Offset: 200}, want: false},
+		{p: Position{File: "mysql-bin.000001", Offset: 900}, o: Position{File: "mysql-bin.000002", Offset: 4}, want: true},
+		{p: Position{File: "mysql-bin.000002", Offset: 4}, o: Position{File: "mysql-bin.000001", Offset: 900}, want: false},
+		// 序号超过 6 位
+		{p: Position{File: "mysql-bin.999999", Offset: 900}, o: Position{File: "mysql-bin.1000000", Offset: 4}, want: true},
+		{p: Position{File: "mysql-bin.1000000", Offset: 4}, o: Position{File: "mysql-bin.999999", Offset: 900}, want: false},
+	}
+	for _, tc := range testCases {
+		if got := tc.p.Before(tc.o); got != tc.want {
+			t.Fatalf("%s before %s: expect %t, got %t", tc.p, tc.o, tc.want, got)
+		}
+	}
+}
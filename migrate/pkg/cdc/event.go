@@ -0,0 +1,160 @@
+package cdc
+
+import (
+	"fmt"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Position binlog 位点，GTID 为空时以 File 和 Offset 为准
+type Position struct {
+	File      string `json:"file"`
+	Offset    int64  `json:"offset"`
+	GTID      string `json:"gtid,omitempty"`
+	Timestamp int64  `json:"timestamp"` // binlog 的执行时间，单位毫秒
+}
+
+// IsZero 是否为空位点
+func (p Position) IsZero() bool {
+	return p.File == "" && p.Offset == 0 && p.GTID == ""
+}
+
+// Before 是否在位点 o 之前，不同的 binlog 文件按文件名的序号比较，
+// 序号超过 6 位时（例如 mysql-bin.1000000）不能按字符串比较
+func (p Position) Before(o Position) bool {
+	if p.File != o.File {
+		pb, pn, pok := splitFile(p.File)
+		ob, on, ook := splitFile(o.File)
+		if pok && ook && pb == ob {
+			return pn < on
+		}
+		return p.File < o.File
+	}
+	return p.Offset < o.Offset
+}
+
+func (p Position) String() string {
+	if p.GTID != "" {
+		return fmt.Sprintf("%s:%d gtid[%s]", p.File, p.Offset, p.GTID)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Offset)
+}
+
+// splitFile 将 binlog 文件名切分为前缀和序号，例如 mysql-bin.000003 切分为 mysql-bin 和 3
+func splitFile(file string) (string, uint64, bool) {
+	i := strings.LastIndexByte(file, '.')
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(file[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return file[:i], n, true
+}
+
+// ChangeEvent 一行数据的变更，DDL 没有行数据
+type ChangeEvent struct {
+	Schema    string
+	Table     string
+	Type      pbe.EventType
+	Before    Row // 变更前的数据，INSERT 时为空
+	After     Row // 变更后的数据，DELETE 时为空
+	Position  Position
+	Timestamp time.Time // binlog 的执行时间
+	IsDDL     bool
+	SQL       string // DDL 语句
+}
+
+// Row 返回变更后的数据，DELETE 时返回变更前的数据
+func (e *ChangeEvent) Row() Row {
+	if e.Type == pbe.EventType_DELETE {
+		return e.Before
+	}
+	return e.After
+}
+
+// Key 返回行数据的主键，联合主键按字段顺序返回多个字段
+func (e *ChangeEvent) Key() Row {
+	return e.Row().Key()
+}
+
+// Updated 返回 UPDATE 修改过的字段
+func (e *ChangeEvent) Updated() Row {
+	var cols Row
+	for _, col := range e.After {
+		if col.Updated {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// Column 一个字段的值
+type Column struct {
+	Name      string
+	Value     any    // 按字段类型转换后的值，见 ColumnValue
+	Raw       string // canal 返回的原始字符串
+	IsNull    bool
+	IsKey     bool
+	Updated   bool
+	SQLType   int32 // java.sql.Types
+	MysqlType string
+}
+
+func (c Column) String() string {
+	if c.IsNull {
+		return "NULL"
+	}
+	return c.Raw
+}
+
+// Row 一行数据，按表的字段顺序排列
+type Row []Column
+
+// Get 按字段名获取字段，不区分大小写
+func (r Row) Get(name string) (Column, bool) {
+	for _, col := range r {
+		if strings.EqualFold(col.Name, name) {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+// Value 按字段名获取字段的值，字段不存在或者为 NULL 时返回 nil
+func (r Row) Value(name string) any {
+	col, _ := r.Get(name)
+	return col.Value
+}
+
+// Key 返回主键字段
+func (r Row) Key() Row {
+	var key Row
+	for _, col := range r {
+		if col.IsKey {
+			key = append(key, col)
+		}
+	}
+	return key
+}
+
+// Map 将行数据转为字段名到值的 map
+func (r Row) Map() map[string]any {
+	m := make(map[string]any, len(r))
+	for _, col := range r {
+		m[col.Name] = col.Value
+	}
+	return m
+}
+
+// String 以逗号分隔字段的原始值，可以作为联合主键的字符串形式
+func (r Row) String() string {
+	values := make([]string, 0, len(r))
+	for _, col := range r {
+		values = append(values, col.String())
+	}
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,79 @@
+package dwrite
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxHistory 最多保留的双写模式切换记录
+const maxHistory = 100
+
+// ModeChange 一次双写模式的切换
+type ModeChange struct {
+	From Mode      `json:"from"`
+	To   Mode      `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// MarshalText 以名称输出双写模式，例如 double-write
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Mode) UnmarshalText(text []byte) error {
+	mode, err := ParseMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// SecondaryStats 双写时异步写第二个库的统计，DoubleWrite 时第二个库为目标库，Transition 时为源库
+type SecondaryStats struct {
+	Pending     int64     `json:"pending"`   // 正在写入的语句数
+	Succeeded   int64     `json:"succeeded"` // 写入成功的语句数
+	Failed      int64     `json:"failed"`    // 写入失败的语句数
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+type secondaryStats struct {
+	pending   atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+
+	lock        sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (s *secondaryStats) begin() {
+	s.pending.Add(1)
+}
+
+func (s *secondaryStats) end(err error) {
+	s.pending.Add(-1)
+	if err == nil {
+		s.succeeded.Add(1)
+		return
+	}
+	s.failed.Add(1)
+	s.lock.Lock()
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *secondaryStats) snapshot() SecondaryStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SecondaryStats{
+		Pending:     s.pending.Load(),
+		Succeeded:   s.succeeded.Load(),
+		Failed:      s.failed.Load(),
+		LastError:   s.lastError,
+		LastErrorAt: s.lastErrorAt,
+	}
+}
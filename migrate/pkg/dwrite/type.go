@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"gorm.io/gorm"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Mode int
@@ -18,11 +21,33 @@ const (
 	TargetWrite             //切换至目标库
 )
 
+var modeNames = []string{"source-write", "double-write", "transition", "target-write"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// ParseMode 解析双写模式，支持名称（例如 double-write）和数值（例如 1）
+func ParseMode(s string) (Mode, error) {
+	for i, name := range modeNames {
+		if s == name || s == strconv.Itoa(i) {
+			return Mode(i), nil
+		}
+	}
+	return SourceWrite, fmt.Errorf("错误的双写模式 %s，可选 %s", s, strings.Join(modeNames, "、"))
+}
+
 // DoubleWritePool 实现数据库双写
 type DoubleWritePool struct {
-	mode   Mode          // 数据库双写模式，可以记录在内存、 Redis 和注册中心等地方
-	source gorm.ConnPool // 源库
-	target gorm.ConnPool // 目标库
+	mode    Mode          // 数据库双写模式，可以记录在内存、 Redis 和注册中心等地方
+	source  gorm.ConnPool // 源库
+	target  gorm.ConnPool // 目标库
+	history []ModeChange  // 双写模式的切换记录
+	lock    sync.RWMutex
+	stats   secondaryStats // 异步写第二个库的统计
 }
 
 func NewDoubleWritePool(source gorm.ConnPool, target gorm.ConnPool) *DoubleWritePool {
@@ -33,20 +58,48 @@ func NewDoubleWritePool(source gorm.ConnPool, target gorm.ConnPool) *DoubleWrite
 	}
 }
 
-// SetMode 设置双写模式
+// SetMode 设置双写模式，并记录切换历史
 func (d *DoubleWritePool) SetMode(mode Mode) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.mode == mode {
+		return
+	}
+	d.history = append(d.history, ModeChange{From: d.mode, To: mode, At: time.Now()})
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
 	d.mode = mode
 }
 
+// Mode 获取当前的双写模式
+func (d *DoubleWritePool) Mode() Mode {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.mode
+}
+
+// History 获取双写模式的切换历史，按时间顺序排列
+func (d *DoubleWritePool) History() []ModeChange {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return append([]ModeChange(nil), d.history...)
+}
+
+// Stats 获取异步写第二个库的统计
+func (d *DoubleWritePool) Stats() SecondaryStats {
+	return d.stats.snapshot()
+}
+
 func (d *DoubleWritePool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
-	if d.mode == TargetWrite || d.mode == Transition {
+	if mode := d.Mode(); mode == TargetWrite || mode == Transition {
 		return d.target.PrepareContext(ctx, query)
 	}
 	return d.source.PrepareContext(ctx, query)
 }
 
 func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	switch d.mode {
+	switch d.Mode() {
 	case SourceWrite: // 写源库
 		log.Println("source-write")
 		return d.source.ExecContext(ctx, query, args...)
@@ -56,14 +109,19 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 		if err != nil {
 			return nil, err
 		}
+		d.stats.begin()
 		go func() {
+			var err error
+			defer func() { d.stats.end(err) }()
 			if strings.HasPrefix(query, "INSERT") { // 插入数据
 				rows, er := result.RowsAffected()
 				if er != nil {
+					err = er
 					return
 				}
 				lastInsertId, er := result.LastInsertId()
 				if er != nil {
+					err = er
 					return
 				}
 				log.Println("插入操作 lastID:", lastInsertId, "rows:", rows)
@@ -84,7 +142,7 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 					qBuffer.WriteByte(' ')
 					qBuffer.WriteString(s[2]) // `user`
 					qBuffer.WriteByte(' ')
-					if !strings.Contains(fields, "`ID`") { // 创建时没有指定 ID
+					if !hasID(fields) { // 创建时没有指定 ID
 						// 插入 ID 字段
 						qBuffer.WriteByte(fields[0])
 						qBuffer.WriteString("`id`,")
@@ -118,39 +176,47 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 						_, er = d.target.ExecContext(ctx, newQuery, newArgs...)
 						if er != nil {
 							log.Println("插入目标库失败:", er)
+							err = er
+						}
+					} else { // 创建时指定了 ID，直接执行
+						_, er = d.target.ExecContext(ctx, query, args...)
+						if er != nil {
+							log.Println("插入目标库失败:", er)
+							err = er
 						}
 					}
 				} else {
 					//	插入单条记录
 					//  INSERT INTO `users` (`name`,`email`,`birthday`,`created_at`,`updated_at`) VALUES (?,?,?,?,?)
 					s := strings.Split(query, " ")
-					fields := s[3]                         // 插入的字段
-					placeholder := s[5]                    // 占位符
-					if !strings.Contains(fields, "`ID`") { // 创建时没有指定 ID
+					fields := s[3]      // 插入的字段
+					placeholder := s[5] // 占位符
+					newArgs := args
+					if !hasID(fields) { // 创建时没有指定 ID
 						// 插入 ID 字段
 						fields = fmt.Sprintf("%c%s%s", fields[0], "`id`,", fields[1:])
 						// 新增占位符
 						placeholder = fmt.Sprintf("%c%s%s", placeholder[0], "?,", placeholder[1:])
+						newArgs = make([]any, len(args)+1)
+						newArgs[0] = lastInsertId
+						for i := range args {
+							newArgs[i+1] = args[i]
+						}
 					}
 					s[3] = fields
 					s[5] = placeholder
 					newQuery := strings.Join(s, " ")
-					newArgs := make([]any, len(args)+1)
-					newArgs[0] = lastInsertId
-					for i := range args {
-						newArgs[i+1] = args[i]
-					}
-					log.Println("newQuery:", newQuery)
-					log.Println("newArgs:", newArgs)
 					_, er = d.target.ExecContext(ctx, newQuery, newArgs...)
 					if er != nil {
 						log.Println("插入目标库失败:", er)
+						err = er
 					}
 				}
 			} else {
 				_, er := d.target.ExecContext(ctx, query, args...)
 				if er != nil {
 					log.Println("更新或删除目标库失败:", er)
+					err = er
 				}
 			}
 		}()
@@ -161,14 +227,19 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 		if err != nil {
 			return nil, err
 		}
+		d.stats.begin()
 		go func() {
+			var err error
+			defer func() { d.stats.end(err) }()
 			if strings.HasPrefix(query, "INSERT") { // 插入数据
 				rows, er := result.RowsAffected()
 				if er != nil {
+					err = er
 					return
 				}
 				lastInsertId, er := result.LastInsertId()
 				if er != nil {
+					err = er
 					return
 				}
 				log.Println("插入操作 lastID:", lastInsertId, "rows:", rows)
@@ -189,7 +260,7 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 					qBuffer.WriteByte(' ')
 					qBuffer.WriteString(s[2]) // `user`
 					qBuffer.WriteByte(' ')
-					if !strings.Contains(fields, "`ID`") { // 创建时没有指定 ID
+					if !hasID(fields) { // 创建时没有指定 ID
 						// 插入 ID 字段
 						qBuffer.WriteByte(fields[0])
 						qBuffer.WriteString("`id`,")
@@ -221,39 +292,47 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 						_, er = d.source.ExecContext(ctx, newQuery, newArgs...)
 						if er != nil {
 							log.Println("插入源库失败:", er)
+							err = er
+						}
+					} else { // 创建时指定了 ID，直接执行
+						_, er = d.source.ExecContext(ctx, query, args...)
+						if er != nil {
+							log.Println("插入源库失败:", er)
+							err = er
 						}
 					}
 				} else {
 					//	插入单条记录
 					//  INSERT INTO `users` (`name`,`email`,`birthday`,`created_at`,`updated_at`) VALUES (?,?,?,?,?)
 					s := strings.Split(query, " ")
-					fields := s[3]                         // 插入的字段
-					placeholder := s[5]                    // 占位符
-					if !strings.Contains(fields, "`ID`") { // 创建时没有指定 ID
+					fields := s[3]      // 插入的字段
+					placeholder := s[5] // 占位符
+					newArgs := args
+					if !hasID(fields) { // 创建时没有指定 ID
 						// 插入 ID 字段
 						fields = fmt.Sprintf("%c%s%s", fields[0], "`id`,", fields[1:])
 						// 新增占位符
 						placeholder = fmt.Sprintf("%c%s%s", placeholder[0], "?,", placeholder[1:])
+						newArgs = make([]any, len(args)+1)
+						newArgs[0] = lastInsertId
+						for i := range args {
+							newArgs[i+1] = args[i]
+						}
 					}
 					s[3] = fields
 					s[5] = placeholder
 					newQuery := strings.Join(s, " ")
-					newArgs := make([]any, len(args)+1)
-					newArgs[0] = lastInsertId
-					for i := range args {
-						newArgs[i+1] = args[i]
-					}
-					log.Println("newQuery:", newQuery)
-					log.Println("newArgs:", newArgs)
 					_, er = d.source.ExecContext(ctx, newQuery, newArgs...)
 					if er != nil {
 						log.Println("插入目标库失败:", er)
+						err = er
 					}
 				}
 			} else {
 				_, er := d.source.ExecContext(ctx, query, args...)
 				if er != nil {
 					log.Println("更新或删除目标库失败:", er)
+					err = er
 				}
 			}
 		}()
@@ -268,7 +347,7 @@ func (d *DoubleWritePool) ExecContext(ctx context.Context, query string, args ..
 }
 
 func (d *DoubleWritePool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	switch d.mode {
+	switch d.Mode() {
 	case Transition, TargetWrite: // 切换为目标库后读目标库
 		return d.target.QueryContext(ctx, query, args...)
 	default: // 默认读源库
@@ -277,7 +356,7 @@ func (d *DoubleWritePool) QueryContext(ctx context.Context, query string, args .
 }
 
 func (d *DoubleWritePool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
-	switch d.mode {
+	switch d.Mode() {
 	case Transition, TargetWrite: // 切换为目标库后读目标库
 		return d.target.QueryRowContext(ctx, query, args...)
 	default: // 默认读源库
@@ -285,6 +364,11 @@ func (d *DoubleWritePool) QueryRowContext(ctx context.Context, query string, arg
 	}
 }
 
+// hasID 插入的字段中是否已经有 id，gorm 生成的字段名为小写
+func hasID(fields string) bool {
+	return strings.Contains(strings.ToLower(fields), "`id`")
+}
+
 func createBatch(ctx context.Context, db *sql.DB, rows int64, lastInsertId int64, query string, args ...string) error {
 	idList := make([]int64, 0, rows)
 	for i := lastInsertId; i < lastInsertId+rows; i++ {
@@ -296,7 +380,7 @@ func createBatch(ctx context.Context, db *sql.DB, rows int64, lastInsertId int64
 	placeholder := s[5] // 占位符
 	newQuery := query
 	newArgs := args
-	if !strings.Contains(fields, "`ID`") { // 创建时没有指定 ID
+	if !hasID(fields) { // 创建时没有指定 ID
 		qBuffer := strings.Builder{}
 		// INSERT INTO `table`
 		qBuffer.WriteString(strings.Join(s[:3], " "))
@@ -0,0 +1,201 @@
+package dwrite
+
+import (
+	"context"
+	"errors"
+	"github.com/xuqil/experiments/migrate/internal/dbtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	insertUser  = "INSERT INTO `users` (`name`,`email`) VALUES (?,?)"
+	insertUsers = "INSERT INTO `users` (`name`,`email`) VALUES (?,?),(?,?),(?,?)"
+	updateUser  = "UPDATE `users` SET `name`=? WHERE `id` = ?"
+)
+
+func newTestPool(t *testing.T, mode Mode) (*DoubleWritePool, *dbtest.FakeDB, *dbtest.FakeDB) {
+	source, target := dbtest.NewFakeDB(), dbtest.NewFakeDB()
+	t.Cleanup(func() {
+		_ = source.Close()
+		_ = target.Close()
+	})
+	pool := NewDoubleWritePool(source.DB, target.DB)
+	pool.SetMode(mode)
+	return pool, source, target
+}
+
+// waitSecondary 等待异步写第二个库完成
+func waitSecondary(t *testing.T, pool *DoubleWritePool, n int64) SecondaryStats {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := pool.Stats()
+		if stats.Pending == 0 && stats.Succeeded+stats.Failed >= n {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("secondary writes not finished %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoubleWritePoolInsert(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mode      Mode
+		query     string
+		args      []any
+		wantQuery string
+		wantArgs  []any
+	}{
+		{
+			name:      "single",
+			mode:      DoubleWrite,
+			query:     insertUser,
+			args:      []any{"a", "a@x.com"},
+			wantQuery: "INSERT INTO `users` (`id`,`name`,`email`) VALUES (?,?,?)",
+			wantArgs:  []any{int64(10), "a", "a@x.com"},
+		},
+		{
+			name:      "batch",
+			mode:      DoubleWrite,
+			query:     insertUsers,
+			args:      []any{"a", "a@x.com", "b", "b@x.com", "c", "c@x.com"},
+			wantQuery: "INSERT INTO `users` (`id`,`name`,`email`) VALUES (?,?,?),(?,?,?),(?,?,?)",
+			wantArgs:  []any{int64(10), "a", "a@x.com", int64(11), "b", "b@x.com", int64(12), "c", "c@x.com"},
+		},
+		{
+			name:      "single with id",
+			mode:      DoubleWrite,
+			query:     "INSERT INTO `users` (`name`,`id`) VALUES (?,?)",
+			args:      []any{"a", int64(3)},
+			wantQuery: "INSERT INTO `users` (`name`,`id`) VALUES (?,?)",
+			wantArgs:  []any{"a", int64(3)},
+		},
+		{
+			name:      "batch with id",
+			mode:      DoubleWrite,
+			query:     "INSERT INTO `users` (`name`,`id`) VALUES (?,?),(?,?)",
+			args:      []any{"a", int64(3), "b", int64(4)},
+			wantQuery: "INSERT INTO `users` (`name`,`id`) VALUES (?,?),(?,?)",
+			wantArgs:  []any{"a", int64(3), "b", int64(4)},
+		},
+		{
+			name:      "transition",
+			mode:      Transition,
+			query:     insertUsers,
+			args:      []any{"a", "a@x.com", "b", "b@x.com", "c", "c@x.com"},
+			wantQuery: "INSERT INTO `users` (`id`,`name`,`email`) VALUES (?,?,?),(?,?,?),(?,?,?)",
+			wantArgs:  []any{int64(10), "a", "a@x.com", int64(11), "b", "b@x.com", int64(12), "c", "c@x.com"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, source, target := newTestPool(t, tc.mode)
+			primary, secondary := source, target
+			if tc.mode == Transition {
+				primary, secondary = target, source
+			}
+			primary.SetNextID(10)
+
+			if _, err := pool.ExecContext(context.Background(), tc.query, tc.args...); err != nil {
+				t.Fatal(err)
+			}
+			if stats := waitSecondary(t, pool, 1); stats.Failed != 0 {
+				t.Fatalf("unexpected secondary error %s", stats.LastError)
+			}
+			if got := primary.Statements(); len(got) != 1 || got[0].Query != tc.query {
+				t.Fatalf("unexpected primary statements %v", got)
+			}
+			got := secondary.Statements()
+			if len(got) != 1 {
+				t.Fatalf("expect 1 secondary statement, got %v", got)
+			}
+			if got[0].Query != tc.wantQuery || !reflect.DeepEqual(got[0].Args, tc.wantArgs) {
+				t.Fatalf("expect %s %v, got %s %v", tc.wantQuery, tc.wantArgs, got[0].Query, got[0].Args)
+			}
+		})
+	}
+}
+
+func TestDoubleWritePoolModes(t *testing.T) {
+	testCases := []struct {
+		mode       Mode
+		wantSource int
+		wantTarget int
+	}{
+		{mode: SourceWrite, wantSource: 1},
+		{mode: DoubleWrite, wantSource: 1, wantTarget: 1},
+		{mode: Transition, wantSource: 1, wantTarget: 1},
+		{mode: TargetWrite, wantTarget: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			pool, source, target := newTestPool(t, tc.mode)
+			if _, err := pool.ExecContext(context.Background(), updateUser, "a", int64(1)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantSource+tc.wantTarget > 1 {
+				waitSecondary(t, pool, 1)
+			}
+			for _, db := range []struct {
+				name string
+				db   *dbtest.FakeDB
+				want int
+			}{{"source", source, tc.wantSource}, {"target", target, tc.wantTarget}} {
+				got := db.db.Statements()
+				if len(got) != db.want {
+					t.Fatalf("%s: expect %d statements, got %v", db.name, db.want, got)
+				}
+				if db.want > 0 && got[0].Query != updateUser {
+					t.Fatalf("%s: expect %s, got %s", db.name, updateUser, got[0].Query)
+				}
+			}
+		})
+	}
+}
+
+func TestDoubleWritePoolErrors(t *testing.T) {
+	errDown := errors.New("down")
+
+	// 写第二个库失败只记录在统计中，不影响业务
+	pool, _, target := newTestPool(t, DoubleWrite)
+	target.FailOn("UPDATE", errDown)
+	if _, err := pool.ExecContext(context.Background(), updateUser, "a", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	stats := waitSecondary(t, pool, 1)
+	if stats.Failed != 1 || stats.Succeeded != 0 || stats.LastError != errDown.Error() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// 写第一个库失败时返回错误，不再写第二个库
+	pool, source, target := newTestPool(t, DoubleWrite)
+	source.FailOn("", errDown)
+	if _, err := pool.ExecContext(context.Background(), insertUser, "a", "a@x.com"); !errors.Is(err, errDown) {
+		t.Fatalf("expect %v, got %v", errDown, err)
+	}
+	if got := target.WaitStatements(1, 20*time.Millisecond); len(got) != 0 {
+		t.Fatalf("expect no target statements, got %v", got)
+	}
+}
+
+func TestDoubleWritePoolHistory(t *testing.T) {
+	pool, _, _ := newTestPool(t, SourceWrite)
+	pool.SetMode(DoubleWrite)
+	pool.SetMode(DoubleWrite)
+	pool.SetMode(Transition)
+	history := pool.History()
+	if len(history) != 2 {
+		t.Fatalf("expect 2 changes, got %v", history)
+	}
+	if history[0].From != SourceWrite || history[0].To != DoubleWrite || history[1].To != Transition {
+		t.Fatalf("unexpected history %v", history)
+	}
+	if pool.Mode() != Transition {
+		t.Fatalf("expect %s, got %s", Transition, pool.Mode())
+	}
+}
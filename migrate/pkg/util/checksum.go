@@ -0,0 +1,272 @@
+package util
+
+import (
+	"crypto/md5"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLayout 时间字段的规范格式，与 MySQL 的 DATE_FORMAT(col, '%Y-%m-%d %H:%i:%s.%f') 相同。
+// 只使用时间在自身时区的年月日时分秒，不包括时区和单调时钟
+const TimeLayout = "2006-01-02 15:04:05.000000"
+
+// Algorithm 行校验和的哈希算法
+type Algorithm int
+
+const (
+	XXHash Algorithm = iota // 64 位 xxhash，最快，MySQL 不支持
+	CRC32                   // 与 MySQL 的 CRC32() 相同
+	MD5                     // 与 MySQL 的 MD5() 相同
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case XXHash:
+		return "xxhash"
+	case CRC32:
+		return "crc32"
+	case MD5:
+		return "md5"
+	default:
+		return "Algorithm(" + strconv.Itoa(int(a)) + ")"
+	}
+}
+
+// ParseAlgorithm 按名字获取哈希算法：xxhash、crc32、md5
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for _, a := range []Algorithm{XXHash, CRC32, MD5} {
+		if strings.EqualFold(name, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("不支持的校验和算法 %q", name)
+}
+
+func (a Algorithm) hash() hash.Hash {
+	switch a {
+	case CRC32:
+		return crc32.NewIEEE()
+	case MD5:
+		return md5.New()
+	default:
+		return xxhash.New()
+	}
+}
+
+// RowHasher 按字段计算一行的校验和。每个字段按规范的文本编码，并加上字节长度的前缀：
+// 非 NULL 为 "<长度>:<文本>"，NULL 为 "N"，例如 ("ab", "c") 编码为 "2:ab1:c"，与 ("a", "bc") 不同。
+// 文本与 MySQL 把字段转为字符串的结果相同，时间字段使用 TimeLayout，
+// 因此可以用 MySQLChecksum 生成的表达式在数据库中计算相同的校验和
+type RowHasher struct {
+	h   hash.Hash
+	buf []byte
+}
+
+// NewRowHasher 创建 RowHasher，不是并发安全的
+func NewRowHasher(alg Algorithm) *RowHasher {
+	return &RowHasher{h: alg.hash(), buf: make([]byte, 0, 64)}
+}
+
+// Reset 清空已经写入的字段，用于计算下一行
+func (r *RowHasher) Reset() {
+	r.h.Reset()
+}
+
+// Sum 返回十六进制的校验和，不影响已经写入的字段
+func (r *RowHasher) Sum() string {
+	r.buf = r.h.Sum(r.buf[:0])
+	return hex.EncodeToString(r.buf)
+}
+
+// write 写入字段的文本，加上长度前缀
+func (r *RowHasher) write(text []byte) {
+	r.buf = strconv.AppendInt(r.buf[:0], int64(len(text)), 10)
+	r.buf = append(r.buf, ':')
+	_, _ = r.h.Write(r.buf)
+	_, _ = r.h.Write(text)
+}
+
+// Null 写入 NULL
+func (r *RowHasher) Null() *RowHasher {
+	_, _ = r.h.Write([]byte{'N'})
+	return r
+}
+
+// String 写入字符串字段
+func (r *RowHasher) String(v string) *RowHasher {
+	r.buf = strconv.AppendInt(r.buf[:0], int64(len(v)), 10)
+	r.buf = append(r.buf, ':')
+	r.buf = append(r.buf, v...)
+	_, _ = r.h.Write(r.buf)
+	return r
+}
+
+// Bytes 写入二进制字段，nil 为 NULL
+func (r *RowHasher) Bytes(v []byte) *RowHasher {
+	if v == nil {
+		return r.Null()
+	}
+	r.write(v)
+	return r
+}
+
+// Int 写入整数字段
+func (r *RowHasher) Int(v int64) *RowHasher {
+	var b [20]byte
+	r.write(strconv.AppendInt(b[:0], v, 10))
+	return r
+}
+
+// Uint 写入无符号整数字段
+func (r *RowHasher) Uint(v uint64) *RowHasher {
+	var b [20]byte
+	r.write(strconv.AppendUint(b[:0], v, 10))
+	return r
+}
+
+// Bool 写入布尔字段，与 MySQL 的 TINYINT(1) 相同，编码为 1 或 0
+func (r *RowHasher) Bool(v bool) *RowHasher {
+	if v {
+		return r.Int(1)
+	}
+	return r.Int(0)
+}
+
+// Float 写入浮点数字段，使用最短的十进制表示。
+// MySQL 的 FLOAT、DOUBLE 转为字符串的结果可能不同，需要在数据库中比较时应使用 DECIMAL
+func (r *RowHasher) Float(v float64) *RowHasher {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return r.Null()
+	}
+	var b [32]byte
+	r.write(strconv.AppendFloat(b[:0], v, 'g', -1, 64))
+	return r
+}
+
+// Time 写入时间字段，按 TimeLayout 编码，精确到微秒
+func (r *RowHasher) Time(v time.Time) *RowHasher {
+	var b [32]byte
+	r.write(v.AppendFormat(b[:0], TimeLayout))
+	return r
+}
+
+// Add 按类型写入一个字段，支持字符串、整数、布尔、浮点数、时间、[]byte、nil 和它们的指针，
+// 以及 driver.Valuer（例如 sql.NullTime、gorm.DeletedAt），其他类型返回错误
+func (r *RowHasher) Add(v any) error {
+	switch v := v.(type) {
+	case nil:
+		r.Null()
+	case string:
+		r.String(v)
+	case []byte:
+		r.Bytes(v)
+	case int:
+		r.Int(int64(v))
+	case int8:
+		r.Int(int64(v))
+	case int16:
+		r.Int(int64(v))
+	case int32:
+		r.Int(int64(v))
+	case int64:
+		r.Int(v)
+	case uint:
+		r.Uint(uint64(v))
+	case uint8:
+		r.Uint(uint64(v))
+	case uint16:
+		r.Uint(uint64(v))
+	case uint32:
+		r.Uint(uint64(v))
+	case uint64:
+		r.Uint(v)
+	case bool:
+		r.Bool(v)
+	case float32:
+		r.Float(float64(v))
+	case float64:
+		r.Float(v)
+	case time.Time:
+		r.Time(v)
+	case *string:
+		if v == nil {
+			r.Null()
+		} else {
+			r.String(*v)
+		}
+	case *int64:
+		if v == nil {
+			r.Null()
+		} else {
+			r.Int(*v)
+		}
+	case *uint64:
+		if v == nil {
+			r.Null()
+		} else {
+			r.Uint(*v)
+		}
+	case *time.Time:
+		if v == nil {
+			r.Null()
+		} else {
+			r.Time(*v)
+		}
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return err
+		}
+		return r.Add(value)
+	default:
+		return fmt.Errorf("不支持的字段类型 %T", v)
+	}
+	return nil
+}
+
+// Checksum 按顺序计算一行字段的校验和，返回十六进制字符串，字段类型同 RowHasher.Add。
+// 字段类型不支持时 panic，字段类型由调用方的模型决定，属于编程错误
+func Checksum(alg Algorithm, values ...any) string {
+	r := NewRowHasher(alg)
+	for i, v := range values {
+		if err := r.Add(v); err != nil {
+			panic(fmt.Errorf("第 %d 个字段 error:%w", i+1, err))
+		}
+	}
+	return r.Sum()
+}
+
+// MySQLChecksum 生成在 MySQL 中计算与 RowHasher 相同校验和的表达式，结果同样是小写的十六进制。
+// columns 为按顺序的字段表达式，时间字段需要使用 MySQLTime 转换，MySQL 没有 xxhash，只支持 CRC32 和 MD5
+func MySQLChecksum(alg Algorithm, columns ...string) (string, error) {
+	if len(columns) == 0 {
+		return "", errors.New("没有字段")
+	}
+	fields := make([]string, 0, len(columns))
+	for _, c := range columns {
+		fields = append(fields, fmt.Sprintf("IFNULL(CONCAT(LENGTH(%s), ':', %s), 'N')", c, c))
+	}
+	row := "CONCAT(" + strings.Join(fields, ", ") + ")"
+	switch alg {
+	case MD5:
+		return "MD5(" + row + ")", nil
+	case CRC32:
+		return "LPAD(LOWER(HEX(CRC32(" + row + "))), 8, '0')", nil
+	default:
+		return "", fmt.Errorf("MySQL 不支持 %s", alg)
+	}
+}
+
+// MySQLTime 将时间字段转为 TimeLayout 格式的表达式
+func MySQLTime(column string) string {
+	return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m-%%d %%H:%%i:%%s.%%f')", column)
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"github.com/cespare/xxhash/v2"
+	"hash/crc32"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChecksumEncoding(t *testing.T) {
+	ts := time.Date(2023, 8, 1, 10, 0, 0, 123456789, time.UTC)
+	s := "tom"
+	testCases := []struct {
+		name    string
+		values  []any
+		encoded string
+	}{
+		{name: "strings", values: []any{"ab", "c"}, encoded: "2:ab1:c"},
+		{name: "empty and null", values: []any{"", nil, (*string)(nil), &s}, encoded: "0:NN3:tom"},
+		{name: "multibyte", values: []any{"中文"}, encoded: "6:中文"},
+		{name: "integers", values: []any{-5, uint64(18446744073709551615), int8(7)}, encoded: "2:-520:184467440737095516151:7"},
+		{name: "bool", values: []any{true, false}, encoded: "1:11:0"},
+		{name: "float", values: []any{1.5, float32(0.25)}, encoded: "3:1.54:0.25"},
+		{name: "bytes", values: []any{[]byte("ab"), []byte(nil)}, encoded: "2:abN"},
+		{name: "time", values: []any{ts}, encoded: "26:2023-08-01 10:00:00.123456"},
+		{name: "valuer", values: []any{sql.NullTime{}, sql.NullTime{Time: ts, Valid: true}, sql.NullInt64{Int64: 3, Valid: true}},
+			encoded: "N26:2023-08-01 10:00:00.1234561:3"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			md5Sum := md5.Sum([]byte(tc.encoded))
+			want := map[Algorithm]string{
+				XXHash: strconv.FormatUint(xxhash.Sum64String(tc.encoded), 16),
+				CRC32:  strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(tc.encoded))), 16),
+				MD5:    hex.EncodeToString(md5Sum[:]),
+			}
+			for alg, w := range want {
+				// 十六进制固定长度，高位补 0
+				w = "0000000000000000"[:2*alg.hash().Size()-len(w)] + w
+				if got := Checksum(alg, tc.values...); got != w {
+					t.Fatalf("%s: expect %s, got %s", alg, w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksumCollision(t *testing.T) {
+	testCases := []struct {
+		name string
+		a, b []any
+	}{
+		{name: "boundary", a: []any{"ab", "c"}, b: []any{"a", "bc"}},
+		{name: "null and empty", a: []any{nil}, b: []any{""}},
+		{name: "null and N", a: []any{nil}, b: []any{"N"}},
+		{name: "field count", a: []any{"a", ""}, b: []any{"a"}},
+		{name: "prefix in value", a: []any{"1:a"}, b: []any{"a", "a"}},
+	}
+	for _, tc := range testCases {
+		for _, alg := range []Algorithm{XXHash, CRC32, MD5} {
+			if Checksum(alg, tc.a...) == Checksum(alg, tc.b...) {
+				t.Fatalf("%s %s: expect different checksums for %v and %v", tc.name, alg, tc.a, tc.b)
+			}
+		}
+	}
+}
+
+func TestChecksumTime(t *testing.T) {
+	now := time.Now()
+	// 单调时钟和时区名称不影响校验和，只比较年月日时分秒
+	if Checksum(XXHash, now) != Checksum(XXHash, now.Round(0)) {
+		t.Fatal("expect monotonic clock ignored")
+	}
+	ts := time.Date(2023, 8, 1, 10, 0, 0, 0, time.UTC)
+	if Checksum(XXHash, ts) != Checksum(XXHash, ts.In(time.FixedZone("GMT", 0))) {
+		t.Fatal("expect zone name ignored")
+	}
+	// 小于微秒的部分 MySQL 不保存
+	if Checksum(XXHash, ts) != Checksum(XXHash, ts.Add(999)) {
+		t.Fatal("expect nanoseconds ignored")
+	}
+}
+
+func TestRowHasherReset(t *testing.T) {
+	r := NewRowHasher(MD5)
+	r.String("a").Int(1)
+	first := r.Sum()
+	if r.Sum() != first {
+		t.Fatal("expect Sum not to change state")
+	}
+	r.Reset()
+	if got := r.String("a").Int(1).Sum(); got != first {
+		t.Fatalf("expect %s after reset, got %s", first, got)
+	}
+	if err := r.Add(struct{}{}); err == nil {
+		t.Fatal("expect unsupported type error")
+	}
+}
+
+func TestMySQLChecksum(t *testing.T) {
+	testCases := []struct {
+		alg     Algorithm
+		columns []string
+		want    string
+		wantErr bool
+	}{
+		{
+			alg:     MD5,
+			columns: []string{"name", MySQLTime("updated_at")},
+			want: "MD5(CONCAT(IFNULL(CONCAT(LENGTH(name), ':', name), 'N'), " +
+				"IFNULL(CONCAT(LENGTH(DATE_FORMAT(updated_at, '%Y-%m-%d %H:%i:%s.%f')), ':', " +
+				"DATE_FORMAT(updated_at, '%Y-%m-%d %H:%i:%s.%f')), 'N')))",
+		},
+		{
+			alg:     CRC32,
+			columns: []string{"id"},
+			want:    "LPAD(LOWER(HEX(CRC32(CONCAT(IFNULL(CONCAT(LENGTH(id), ':', id), 'N'))))), 8, '0')",
+		},
+		{alg: XXHash, columns: []string{"id"}, wantErr: true},
+		{alg: MD5, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := MySQLChecksum(tc.alg, tc.columns...)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s %v: unexpected error %v", tc.alg, tc.columns, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: expect %s, got %s", tc.alg, tc.want, got)
+		}
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, alg := range []Algorithm{XXHash, CRC32, MD5} {
+		if got, err := ParseAlgorithm(alg.String()); err != nil || got != alg {
+			t.Fatalf("expect %s, got %s %v", alg, got, err)
+		}
+	}
+	if _, err := ParseAlgorithm("sha1"); err == nil {
+		t.Fatal("expect error")
+	}
+}
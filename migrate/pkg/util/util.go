@@ -2,12 +2,14 @@ package util
 
 import (
 	"crypto/md5"
+	"encoding/hex"
 	"io"
 )
 
-// MD5Checksum MD5 实现的校验和
+// MD5Checksum MD5 实现的校验和，返回十六进制字符串。
+// 计算一行数据的校验和使用 Checksum，避免拼接字段时不同的行得到相同的字符串
 func MD5Checksum(val string) string {
 	h := md5.New()
 	_, _ = io.WriteString(h, val)
-	return string(h.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
 }
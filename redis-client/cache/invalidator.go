@@ -0,0 +1,324 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"github.com/xuqil/experiments/redis-client/ha"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rule 一张表的缓存规则
+type Rule struct {
+	Table   string        // 库表，例如 test.users
+	Keys    []string      // 缓存 key 的模板，例如 user:{id}、user:email:{email}
+	Refresh bool          // 写入最新的行数据（JSON），而不是删除缓存
+	TTL     time.Duration // Refresh 时缓存的过期时间，0 表示不过期
+}
+
+// rule 解析后的缓存规则
+type rule struct {
+	Rule
+	templates []*Template
+}
+
+// Stats 缓存失效的统计
+type Stats struct {
+	Events         int64         `json:"events"`          // 处理的行变更
+	Deleted        int64         `json:"deleted"`         // 删除的 key
+	Refreshed      int64         `json:"refreshed"`       // 刷新的 key
+	DelayedDeleted int64         `json:"delayed_deleted"` // 延迟双删删除的 key
+	Retries        int64         `json:"retries"`         // 重试次数
+	Failures       int64         `json:"failures"`        // 重试后仍然失败的次数
+	Lag            time.Duration `json:"lag"`             // 最近一条 binlog 的执行时间到处理完成的延迟
+}
+
+// metrics 使用原子操作更新的统计
+type metrics struct {
+	events         atomic.Int64
+	deleted        atomic.Int64
+	refreshed      atomic.Int64
+	delayedDeleted atomic.Int64
+	retries        atomic.Int64
+	failures       atomic.Int64
+	lag            atomic.Int64
+}
+
+type Option func(inv *Invalidator)
+
+// WithDelay 设置延迟双删的延迟，应该大于一次读库并回写缓存的时间，0 表示不做延迟双删
+func WithDelay(d time.Duration) Option {
+	return func(inv *Invalidator) {
+		inv.delay = d
+	}
+}
+
+// WithRetry 设置操作 Redis 失败时的重试次数和初始退避时长，退避时长按指数增长
+func WithRetry(retries int, backoff time.Duration) Option {
+	return func(inv *Invalidator) {
+		inv.retries = retries
+		if backoff > 0 {
+			inv.backoff = backoff
+		}
+	}
+}
+
+// WithBatchSize 设置每次从 canal 获取的 binlog 条数
+func WithBatchSize(size int32) Option {
+	return func(inv *Invalidator) {
+		if size > 0 {
+			inv.batchSize = size
+		}
+	}
+}
+
+// Invalidator 订阅 canal 的 binlog，按表的 key 模板删除或者刷新 Redis 缓存，
+// 业务代码只需要读缓存和写 MySQL，不需要再删除缓存
+type Invalidator struct {
+	client    redis.UniversalClient
+	rules     map[string]*rule // key 为小写的 schema.table
+	filter    string
+	delay     time.Duration
+	retries   int
+	backoff   time.Duration
+	batchSize int32
+	metrics   metrics
+	wg        sync.WaitGroup // 等待中的延迟双删
+}
+
+func NewInvalidator(rdb redis.UniversalClient, rules []Rule, opts ...Option) (*Invalidator, error) {
+	inv := &Invalidator{
+		client:    rdb,
+		rules:     make(map[string]*rule, len(rules)),
+		delay:     time.Millisecond * 500,
+		retries:   3,
+		backoff:   time.Millisecond * 100,
+		batchSize: 100,
+	}
+	tables := make([]string, 0, len(rules))
+	for _, r := range rules {
+		if len(r.Keys) == 0 {
+			return nil, fmt.Errorf("表 %s 没有配置缓存 key", r.Table)
+		}
+		compiled := &rule{Rule: r}
+		for _, key := range r.Keys {
+			t, err := ParseTemplate(key)
+			if err != nil {
+				return nil, err
+			}
+			compiled.templates = append(compiled.templates, t)
+		}
+		inv.rules[strings.ToLower(r.Table)] = compiled
+		tables = append(tables, regexp.QuoteMeta(r.Table))
+	}
+	inv.filter = strings.Join(tables, ",")
+	for _, opt := range opts {
+		opt(inv)
+	}
+	return inv, nil
+}
+
+// Stats 获取缓存失效的统计
+func (inv *Invalidator) Stats() Stats {
+	return Stats{
+		Events:         inv.metrics.events.Load(),
+		Deleted:        inv.metrics.deleted.Load(),
+		Refreshed:      inv.metrics.refreshed.Load(),
+		DelayedDeleted: inv.metrics.delayedDeleted.Load(),
+		Retries:        inv.metrics.retries.Load(),
+		Failures:       inv.metrics.failures.Load(),
+		Lag:            time.Duration(inv.metrics.lag.Load()),
+	}
+}
+
+// Run 使用 ha.Consumer 订阅规则中的表：连接失败、canal server 切换或者 ZooKeeper 会话断开时按指数退避重连，
+// 处理失败的批次回滚后由 canal 重新投递，ctx 取消后等待延迟双删完成再返回
+func (inv *Invalidator) Run(ctx context.Context, cfg ha.Config) error {
+	cfg.Filter = inv.filter
+	cfg.BatchSize = inv.batchSize
+	defer inv.wg.Wait()
+	return ha.NewConsumer(cfg, inv.Handle).Run(ctx)
+}
+
+// Handle 处理一批变更事件，按 binlog 顺序处理每一行变更，可以作为 ha.Handler 使用
+func (inv *Invalidator) Handle(ctx context.Context, events []cdc.ChangeEvent) error {
+	for i := range events {
+		e := &events[i]
+		if e.IsDDL {
+			continue
+		}
+		r, ok := inv.rules[strings.ToLower(e.Schema+"."+e.Table)]
+		if !ok {
+			continue
+		}
+		if err := inv.apply(ctx, r, e); err != nil {
+			return err
+		}
+		inv.metrics.events.Add(1)
+		if !e.Timestamp.IsZero() {
+			inv.metrics.lag.Store(int64(time.Since(e.Timestamp)))
+		}
+	}
+	return nil
+}
+
+// apply 处理一行变更：删除变更前后的 key，Refresh 时写入变更后的数据
+func (inv *Invalidator) apply(ctx context.Context, r *rule, e *cdc.ChangeEvent) error {
+	before := inv.keys(r, e.Before)
+	after := inv.keys(r, e.After)
+	if !r.Refresh || e.Type == pbe.EventType_DELETE {
+		keys := union(before, after)
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := inv.retry(ctx, func() error { return inv.del(ctx, keys) }); err != nil {
+			inv.metrics.failures.Add(1)
+			return fmt.Errorf("删除缓存失败 keys:%v error:%w", keys, err)
+		}
+		inv.metrics.deleted.Add(int64(len(keys)))
+		log.Println("删除缓存:", keys)
+		inv.delayDelete(keys)
+		return nil
+	}
+
+	// 修改了 key 中的字段时，旧的 key 需要删除
+	stale := difference(before, after)
+	if len(stale) > 0 {
+		if err := inv.retry(ctx, func() error { return inv.del(ctx, stale) }); err != nil {
+			inv.metrics.failures.Add(1)
+			return fmt.Errorf("删除缓存失败 keys:%v error:%w", stale, err)
+		}
+		inv.metrics.deleted.Add(int64(len(stale)))
+	}
+	if len(after) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(e.After.Map())
+	if err != nil {
+		return err
+	}
+	if err = inv.retry(ctx, func() error { return inv.set(ctx, after, value, r.TTL) }); err != nil {
+		inv.metrics.failures.Add(1)
+		return fmt.Errorf("刷新缓存失败 keys:%v error:%w", after, err)
+	}
+	inv.metrics.refreshed.Add(int64(len(after)))
+	log.Println("刷新缓存:", after)
+	return nil
+}
+
+// keys 使用行数据生成规则中的全部 key，无法生成的 key 记录日志后跳过
+func (inv *Invalidator) keys(r *rule, row cdc.Row) []string {
+	if len(row) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(r.templates))
+	for _, t := range r.templates {
+		key, err := t.Render(row)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// delayDelete 延迟后再删除一次，删除其它请求在 binlog 之前读到旧数据并回写的缓存
+func (inv *Invalidator) delayDelete(keys []string) {
+	if inv.delay <= 0 {
+		return
+	}
+	inv.wg.Add(1)
+	time.AfterFunc(inv.delay, func() {
+		defer inv.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := inv.retry(ctx, func() error { return inv.del(ctx, keys) }); err != nil {
+			inv.metrics.failures.Add(1)
+			log.Println(fmt.Errorf("延迟双删失败 keys:%v error:%w", keys, err))
+			return
+		}
+		inv.metrics.delayedDeleted.Add(int64(len(keys)))
+	})
+}
+
+// del 使用 pipeline 逐个删除，避免 Redis Cluster 的 CROSSSLOT 错误
+func (inv *Invalidator) del(ctx context.Context, keys []string) error {
+	_, err := inv.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Del(ctx, key)
+		}
+		return nil
+	})
+	return err
+}
+
+func (inv *Invalidator) set(ctx context.Context, keys []string, value []byte, ttl time.Duration) error {
+	_, err := inv.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Set(ctx, key, value, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// retry 失败时按指数退避重试
+func (inv *Invalidator) retry(ctx context.Context, fn func() error) error {
+	backoff := inv.backoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= inv.retries {
+			return err
+		}
+		inv.metrics.retries.Add(1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// union 合并两组 key 并去重
+func union(a, b []string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, group := range [][]string{a, b} {
+		for _, key := range group {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// difference 在 a 中但不在 b 中的 key
+func difference(a, b []string) []string {
+	var keys []string
+	for _, key := range a {
+		found := false
+		for _, k := range b {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
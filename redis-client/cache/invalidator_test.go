@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHook 记录 pipeline 中的命令，不发送到 Redis
+type recordHook struct {
+	lock sync.Mutex
+	cmds []string
+	err  error // 不为空时 pipeline 返回该错误
+}
+
+func (h *recordHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *recordHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h *recordHook) ProcessPipelineHook(_ redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.err != nil {
+			return h.err
+		}
+		for _, cmd := range cmds {
+			args := make([]string, 0, len(cmd.Args()))
+			for _, arg := range cmd.Args() {
+				switch v := arg.(type) {
+				case string:
+					args = append(args, v)
+				case []byte:
+					args = append(args, string(v))
+				}
+			}
+			h.cmds = append(h.cmds, strings.Join(args, " "))
+		}
+		return nil
+	}
+}
+
+func (h *recordHook) commands() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.cmds...)
+}
+
+func newTestInvalidator(t *testing.T, rules []Rule, opts ...Option) (*Invalidator, *recordHook) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	t.Cleanup(func() { _ = rdb.Close() })
+	hook := &recordHook{}
+	rdb.AddHook(hook)
+	inv, err := NewInvalidator(rdb, rules, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv, hook
+}
+
+func userRow(id, email string) cdc.Row {
+	return cdc.Row{
+		{Name: "id", Value: id, Raw: id, IsKey: true},
+		{Name: "email", Value: email, Raw: email},
+	}
+}
+
+func TestHandle(t *testing.T) {
+	testCases := []struct {
+		name    string
+		refresh bool
+		event   cdc.ChangeEvent
+		want    []string
+	}{
+		{
+			name:  "insert",
+			event: cdc.ChangeEvent{Type: pbe.EventType_INSERT, After: userRow("1", "tom@example.com")},
+			want:  []string{"del user:1", "del user:email:tom@example.com"},
+		},
+		{
+			name: "update",
+			event: cdc.ChangeEvent{Type: pbe.EventType_UPDATE,
+				Before: userRow("1", "old@example.com"), After: userRow("1", "new@example.com")},
+			want: []string{"del user:1", "del user:email:old@example.com", "del user:email:new@example.com"},
+		},
+		{
+			name:  "delete",
+			event: cdc.ChangeEvent{Type: pbe.EventType_DELETE, Before: userRow("1", "tom@example.com")},
+			want:  []string{"del user:1", "del user:email:tom@example.com"},
+		},
+		{
+			name:    "refresh update",
+			refresh: true,
+			event: cdc.ChangeEvent{Type: pbe.EventType_UPDATE,
+				Before: userRow("1", "old@example.com"), After: userRow("1", "new@example.com")},
+			want: []string{
+				"del user:email:old@example.com",
+				`set user:1 {"email":"new@example.com","id":"1"}`,
+				`set user:email:new@example.com {"email":"new@example.com","id":"1"}`,
+			},
+		},
+		{
+			name:    "refresh delete",
+			refresh: true,
+			event:   cdc.ChangeEvent{Type: pbe.EventType_DELETE, Before: userRow("1", "tom@example.com")},
+			want:    []string{"del user:1", "del user:email:tom@example.com"},
+		},
+		{
+			name: "null column",
+			event: cdc.ChangeEvent{Type: pbe.EventType_DELETE,
+				Before: cdc.Row{{Name: "id", Value: "1", Raw: "1"}, {Name: "email", IsNull: true}}},
+			want: []string{"del user:1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inv, hook := newTestInvalidator(t, []Rule{{Table: "test.users",
+				Keys: []string{"user:{id}", "user:email:{email}"}, Refresh: tc.refresh}}, WithDelay(0))
+			tc.event.Schema, tc.event.Table = "test", "users"
+			// 其它表和 DDL 不处理
+			events := []cdc.ChangeEvent{
+				{Schema: "test", Table: "orders", Type: pbe.EventType_DELETE, Before: userRow("2", "")},
+				{Schema: "test", Table: "users", IsDDL: true, SQL: "ALTER TABLE users ADD age INT"},
+				tc.event,
+			}
+			if err := inv.Handle(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			if got := hook.commands(); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expect %q, got %q", tc.want, got)
+			}
+			if got := inv.Stats().Events; got != 1 {
+				t.Fatalf("expect 1 event, got %d", got)
+			}
+		})
+	}
+}
+
+func TestHandleDelayDelete(t *testing.T) {
+	inv, hook := newTestInvalidator(t, []Rule{{Table: "test.users", Keys: []string{"user:{id}"}}},
+		WithDelay(time.Millisecond*10))
+	events := []cdc.ChangeEvent{{Schema: "test", Table: "users", Type: pbe.EventType_DELETE, Before: userRow("1", "")}}
+	if err := inv.Handle(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	inv.wg.Wait()
+	want := []string{"del user:1", "del user:1"}
+	if got := hook.commands(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect %q, got %q", want, got)
+	}
+	if got := inv.Stats().DelayedDeleted; got != 1 {
+		t.Fatalf("expect 1 delayed delete, got %d", got)
+	}
+}
+
+func TestHandleRetry(t *testing.T) {
+	errFail := errors.New("fail")
+	inv, hook := newTestInvalidator(t, []Rule{{Table: "test.users", Keys: []string{"user:{id}"}}},
+		WithDelay(0), WithRetry(2, time.Millisecond))
+	hook.err = errFail
+	events := []cdc.ChangeEvent{{Schema: "test", Table: "users", Type: pbe.EventType_DELETE, Before: userRow("1", "")}}
+	if err := inv.Handle(context.Background(), events); !errors.Is(err, errFail) {
+		t.Fatalf("expect %v, got %v", errFail, err)
+	}
+	stats := inv.Stats()
+	if stats.Retries != 2 || stats.Failures != 1 || stats.Events != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
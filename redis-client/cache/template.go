@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"strings"
+)
+
+// Template 缓存 key 的模板，{column} 替换为行数据中对应字段的值，例如 user:{id}、order:{user_id}:{order_id}
+type Template struct {
+	text    string
+	parts   []string // 固定的文本，比 columns 多一个
+	columns []string // 模板中引用的字段
+}
+
+// ParseTemplate 解析缓存 key 的模板
+func ParseTemplate(text string) (*Template, error) {
+	t := &Template{text: text}
+	rest := text
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("错误的 key 模板 %s：缺少 }", text)
+		}
+		column := strings.TrimSpace(rest[start+1 : start+end])
+		if column == "" {
+			return nil, fmt.Errorf("错误的 key 模板 %s：字段名为空", text)
+		}
+		t.parts = append(t.parts, rest[:start])
+		t.columns = append(t.columns, column)
+		rest = rest[start+end+1:]
+	}
+	if strings.IndexByte(rest, '}') >= 0 {
+		return nil, fmt.Errorf("错误的 key 模板 %s：缺少 {", text)
+	}
+	t.parts = append(t.parts, rest)
+	return t, nil
+}
+
+// Render 使用行数据生成缓存 key，字段不存在或者为 NULL 时返回错误
+func (t *Template) Render(row cdc.Row) (string, error) {
+	var b strings.Builder
+	for i, name := range t.columns {
+		col, ok := row.Get(name)
+		if !ok {
+			return "", fmt.Errorf("key 模板 %s 的字段 %s 不存在", t.text, name)
+		}
+		if col.IsNull {
+			return "", fmt.Errorf("key 模板 %s 的字段 %s 为 NULL", t.text, name)
+		}
+		b.WriteString(t.parts[i])
+		b.WriteString(col.Raw)
+	}
+	b.WriteString(t.parts[len(t.parts)-1])
+	return b.String(), nil
+}
+
+func (t *Template) String() string {
+	return t.text
+}
+
+// Pattern 返回匹配模板生成的全部 key 的 SCAN 模式，字段替换为 *，例如 user:{id} 返回 user:*
+func (t *Template) Pattern() string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i > 0 {
+			b.WriteByte('*')
+		}
+		for _, c := range part {
+			if strings.ContainsRune(`*?[]\`, c) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"reflect"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	row := cdc.Row{
+		{Name: "user_id", Raw: "1", IsKey: true},
+		{Name: "order_id", Raw: "2", IsKey: true},
+		{Name: "email", Raw: "tom@example.com"},
+		{Name: "note", IsNull: true},
+	}
+	testCases := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "single", text: "user:{user_id}", want: "user:1"},
+		{name: "composite", text: "order:{user_id}:{ORDER_ID}", want: "order:1:2"},
+		{name: "suffix", text: "user:{email}:profile", want: "user:tom@example.com:profile"},
+		{name: "constant", text: "orders:count", want: "orders:count"},
+		{name: "missing column", text: "user:{name}", wantErr: true},
+		{name: "null column", text: "note:{note}", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tpl, err := ParseTemplate(tc.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tpl.Render(row)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expect error %t, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("expect %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTemplateError(t *testing.T) {
+	for _, text := range []string{"user:{id", "user:id}", "user:{}"} {
+		if _, err := ParseTemplate(text); err == nil {
+			t.Fatalf("%s: expect error", text)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	testCases := []struct {
+		text string
+		want string
+	}{
+		{text: "user:{id}", want: "user:*"},
+		{text: "users:{status}:by_id", want: "users:*:by_id"},
+		{text: "users:by_created_at", want: "users:by_created_at"},
+		{text: "user[1]:{id}", want: `user\[1\]:*`},
+	}
+	for _, tc := range testCases {
+		tpl, err := ParseTemplate(tc.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tpl.Pattern(); got != tc.want {
+			t.Fatalf("%s: expect %s, got %s", tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	inv, err := NewInvalidator(nil, []Rule{{Table: "test.users", Keys: []string{"user:{id}", "user:email:{email}"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.filter != `test\.users` {
+		t.Fatalf("unexpected filter %s", inv.filter)
+	}
+	r := inv.rules["test.users"]
+	before := inv.keys(r, cdc.Row{{Name: "id", Raw: "1"}, {Name: "email", Raw: "old@example.com"}})
+	after := inv.keys(r, cdc.Row{{Name: "id", Raw: "1"}, {Name: "email", Raw: "new@example.com"}})
+	if got := union(before, after); !reflect.DeepEqual(got, []string{"user:1", "user:email:old@example.com", "user:email:new@example.com"}) {
+		t.Fatalf("unexpected union %v", got)
+	}
+	if got := difference(before, after); !reflect.DeepEqual(got, []string{"user:email:old@example.com"}) {
+		t.Fatalf("unexpected difference %v", got)
+	}
+}
@@ -1,117 +1,59 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gogo/protobuf/proto"
-	"github.com/withlin/canal-go/client"
 	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"github.com/xuqil/experiments/redis-client/ha"
 	"log"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
-var conn *client.ClusterCanalConnector
-
 func main() {
-	conn = createConnection()
-	subscribe(conn, ".*\\..*")
-
+	consumer := ha.NewConsumer(ha.Config{
+		ZkServers:   []string{"192.168.0.201:2181", "192.168.0.202:2181", "192.168.0.203:2181"},
+		Destination: "example",
+		Username:    "canal",
+		Password:    "canal",
+		Filter:      ".*\\..*",
+	}, printEvents)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 	fmt.Println("canal start listening...")
-	listen()
-	err := conn.DisConnection()
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
-func listen() {
-	for {
-		message, err := conn.Get(100, nil, nil)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		batchId := message.Id
-		if batchId == -1 || len(message.Entries) <= 0 {
-			time.Sleep(200 * time.Millisecond)
-			continue
-		}
-
-		printEntry(message.Entries)
-	}
-}
-
-func subscribe(conn *client.ClusterCanalConnector, str string) {
-	err := conn.Subscribe(str)
-	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-}
-
-func createConnection() *client.ClusterCanalConnector {
-	cn, err := client.NewCanalClusterNode("example", []string{"192.168.0.201:2181", "192.168.0.202:2181", "192.168.0.203:2181"}, time.Second*10)
-	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-
-	canalConnector, err := client.NewClusterCanalConnector(cn, "canal", "canal", "example", 60000, 60*60*1000)
-	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-
-	err = canalConnector.Connect()
-	if err != nil {
+	// 多个实例只有一个在消费，活跃实例退出或者 canal server 切换时自动接替和重连
+	if err := consumer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		log.Println(err)
-		os.Exit(1)
 	}
-
-	return canalConnector
 }
 
-func printEntry(entrys []pbe.Entry) {
-
-	for _, entry := range entrys {
-		if entry.GetEntryType() == pbe.EntryType_TRANSACTIONBEGIN || entry.GetEntryType() == pbe.EntryType_TRANSACTIONEND {
+func printEvents(_ context.Context, events []cdc.ChangeEvent) error {
+	for _, e := range events {
+		fmt.Println(fmt.Sprintf("================> binlog[%s],name[%s,%s], eventType: %s, key: %s", e.Position, e.Schema, e.Table, e.Type, e.Key()))
+		if e.IsDDL {
+			fmt.Println(e.SQL)
 			continue
 		}
-		rowChange := new(pbe.RowChange)
-
-		err := proto.Unmarshal(entry.GetStoreValue(), rowChange)
-		checkError(err)
-		if rowChange != nil {
-			eventType := rowChange.GetEventType()
-			header := entry.GetHeader()
-			fmt.Println(fmt.Sprintf("================> binlog[%s : %d],name[%s,%s], eventType: %s", header.GetLogfileName(), header.GetLogfileOffset(), header.GetSchemaName(), header.GetTableName(), header.GetEventType()))
-
-			for _, rowData := range rowChange.GetRowDatas() {
-				if eventType == pbe.EventType_DELETE {
-					printColumn(rowData.GetBeforeColumns())
-				} else if eventType == pbe.EventType_INSERT {
-					printColumn(rowData.GetAfterColumns())
-				} else {
-					fmt.Println("-------> before")
-					printColumn(rowData.GetBeforeColumns())
-					fmt.Println("-------> after")
-					printColumn(rowData.GetAfterColumns())
-				}
-			}
+		if e.Type == pbe.EventType_DELETE {
+			printColumn(e.Before)
+		} else if e.Type == pbe.EventType_INSERT {
+			printColumn(e.After)
+		} else {
+			fmt.Println("-------> before")
+			printColumn(e.Before)
+			fmt.Println("-------> after")
+			printColumn(e.After)
 		}
 	}
+	return nil
 }
 
-func printColumn(columns []*pbe.Column) {
-	for _, col := range columns {
-		fmt.Println(fmt.Sprintf("%s : %s  update= %t", col.GetName(), col.GetValue(), col.GetUpdated()))
-	}
-}
-
-func checkError(err error) {
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Fatal error: %s", err.Error())
-		os.Exit(1)
+func printColumn(row cdc.Row) {
+	for _, col := range row {
+		fmt.Println(fmt.Sprintf("%s : %s  update= %t", col.Name, col, col.Updated))
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"github.com/redis/go-redis/v9"
+	"github.com/xuqil/experiments/redis-client/cache"
+	"github.com/xuqil/experiments/redis-client/ha"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{"127.0.0.1:6379"},
+	})
+	defer rdb.Close()
+
+	// 每张表的缓存 key 模板，{字段名} 替换为行数据中的值
+	rules := []cache.Rule{
+		{Table: "test.users", Keys: []string{"user:{id}", "user:email:{email}"}},
+		{Table: "test.orders", Keys: []string{"order:{user_id}:{order_id}"}, Refresh: true, TTL: time.Hour},
+	}
+	inv, err := cache.NewInvalidator(rdb, rules,
+		cache.WithDelay(time.Millisecond*500), cache.WithRetry(3, time.Millisecond*100))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// 统计信息：curl 127.0.0.1:9100/debug/vars
+	expvar.Publish("cache_invalidator", expvar.Func(func() any {
+		return inv.Stats()
+	}))
+	go func() {
+		log.Println(http.ListenAndServe(":9100", nil))
+	}()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	log.Println("缓存失效服务启动")
+	// 多个实例只有一个在消费，canal server 切换或者连接断开时自动重连
+	err = inv.Run(ctx, ha.Config{
+		ZkServers:   []string{"127.0.0.1:2181"},
+		Destination: "example",
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+	}
+	log.Println("缓存失效服务退出:", inv.Stats())
+}
@@ -6,9 +6,9 @@ import (
 	"os"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/withlin/canal-go/client"
 	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
 )
 
 func main() {
@@ -62,39 +62,30 @@ func main() {
 }
 
 func printEntry(entrys []pbe.Entry) {
-
-	for _, entry := range entrys {
-		if entry.GetEntryType() == pbe.EntryType_TRANSACTIONBEGIN || entry.GetEntryType() == pbe.EntryType_TRANSACTIONEND {
+	events, err := cdc.DecodeEntries(entrys)
+	checkError(err)
+	for _, e := range events {
+		fmt.Println(fmt.Sprintf("================> binlog[%s],name[%s,%s], eventType: %s, key: %s", e.Position, e.Schema, e.Table, e.Type, e.Key()))
+		if e.IsDDL {
+			fmt.Println(e.SQL)
 			continue
 		}
-		rowChange := new(pbe.RowChange)
-
-		err := proto.Unmarshal(entry.GetStoreValue(), rowChange)
-		checkError(err)
-		if rowChange != nil {
-			eventType := rowChange.GetEventType()
-			header := entry.GetHeader()
-			fmt.Println(fmt.Sprintf("================> binlog[%s : %d],name[%s,%s], eventType: %s", header.GetLogfileName(), header.GetLogfileOffset(), header.GetSchemaName(), header.GetTableName(), header.GetEventType()))
-
-			for _, rowData := range rowChange.GetRowDatas() {
-				if eventType == pbe.EventType_DELETE {
-					printColumn(rowData.GetBeforeColumns())
-				} else if eventType == pbe.EventType_INSERT {
-					printColumn(rowData.GetAfterColumns())
-				} else {
-					fmt.Println("-------> before")
-					printColumn(rowData.GetBeforeColumns())
-					fmt.Println("-------> after")
-					printColumn(rowData.GetAfterColumns())
-				}
-			}
+		if e.Type == pbe.EventType_DELETE {
+			printColumn(e.Before)
+		} else if e.Type == pbe.EventType_INSERT {
+			printColumn(e.After)
+		} else {
+			fmt.Println("-------> before")
+			printColumn(e.Before)
+			fmt.Println("-------> after")
+			printColumn(e.After)
 		}
 	}
 }
 
-func printColumn(columns []*pbe.Column) {
-	for _, col := range columns {
-		fmt.Println(fmt.Sprintf("%s : %s  update= %t", col.GetName(), col.GetValue(), col.GetUpdated()))
+func printColumn(row cdc.Row) {
+	for _, col := range row {
+		fmt.Println(fmt.Sprintf("%s : %s  update= %t", col.Name, col, col.Updated))
 	}
 }
 
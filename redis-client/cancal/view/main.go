@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/redis/go-redis/v9"
+	"github.com/withlin/canal-go/client"
+	"github.com/xuqil/experiments/redis-client/view"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	// canal 实例需要在全量加载之前启动，保证 canal 的位点不晚于快照位点
+	connector := client.NewSimpleCanalConnector("127.0.0.1", 11111, "", "",
+		"example", 60000, 60*60*1000)
+	db, err := sql.Open("mysql", "root:Mysql_1234@tcp(127.0.0.1:3306)/test?charset=utf8mb4&loc=Local")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{"127.0.0.1:6379"},
+	})
+	defer rdb.Close()
+
+	// 每行一个 hash，有序集合按字段排序，例如 ZREVRANGE users:by_created_at 0 9 获取最新的 10 个用户
+	views := []view.View{
+		{
+			Table:   "test.users",
+			Key:     "user:{id}",
+			Columns: []string{"id", "name", "email", "birthday", "created_at", "updated_at"},
+			Indexes: []view.Index{
+				{Key: "users:by_created_at", Column: "created_at"},
+				{Key: "users:by_birthday", Column: "birthday"},
+			},
+		},
+	}
+	syncer, err := view.NewSyncer(connector, db, rdb, views)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err = syncer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+	}
+	if err = connector.DisConnection(); err != nil {
+		log.Println(err)
+	}
+}
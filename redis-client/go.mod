@@ -3,15 +3,19 @@ module github.com/xuqil/experiments/redis-client
 go 1.19
 
 require (
-	github.com/gogo/protobuf v1.3.1
-	github.com/golang/protobuf v1.5.2
+	github.com/go-sql-driver/mysql v1.7.0
 	github.com/redis/go-redis/v9 v9.0.5
+	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
 	github.com/withlin/canal-go v1.1.1
+	github.com/xuqil/experiments/migrate v0.0.0-00010101000000-000000000000
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec // indirect
-	google.golang.org/protobuf v1.26.0 // indirect
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
+
+replace github.com/xuqil/experiments/migrate => ../migrate
@@ -0,0 +1,367 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/withlin/canal-go/client"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// consumerPath 客户端 HA 的选主路径，与 canal-go 的 ClusterCanalConnector 相同，可以和它混合部署
+	consumerPath = "/canal-consumer/%s"
+	// runningPath canal server 的 HA 路径，保存当前运行的 canal server
+	runningPath = "/otter/canal/destinations/%s/running"
+)
+
+var (
+	errLeadershipLost = errors.New("失去活跃消费者身份")
+	errServerChanged  = errors.New("活跃的 canal server 发生变化")
+)
+
+// Handler 处理一批变更事件，返回错误时回滚批次，canal 会重新投递
+type Handler func(ctx context.Context, events []cdc.ChangeEvent) error
+
+// Config HA 消费者的配置
+type Config struct {
+	ZkServers   []string
+	ZkTimeout   time.Duration // ZooKeeper 的会话超时
+	Destination string
+	Username    string
+	Password    string
+	Filter      string
+	BatchSize   int32
+	SoTimeout   int32
+	IdleTimeout int32
+	Backoff     time.Duration // 重连的初始退避时长，按指数增长
+	MaxBackoff  time.Duration
+}
+
+// Consumer 长期运行的 canal 集群消费者：
+// 通过 ZooKeeper 选出一个活跃消费者，其它实例等待；活跃的 canal server 切换或者连接失败时，
+// 重新从 ZooKeeper 获取 canal server 并重连，canal 从已经 Ack 的位点重新投递
+type Consumer struct {
+	cfg     Config
+	handler Handler
+
+	zk      *zk.Conn
+	session int64  // 选主时的 ZooKeeper 会话，会话变化时临时节点已经失效
+	node    string // 选主的临时顺序节点
+	server  string // 当前连接的 canal server
+	conn    *client.SimpleCanalConnector
+}
+
+func NewConsumer(cfg Config, handler Handler) *Consumer {
+	if cfg.ZkTimeout <= 0 {
+		cfg.ZkTimeout = time.Second * 10
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.SoTimeout <= 0 {
+		cfg.SoTimeout = 60000
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 60 * 60 * 1000
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Second * 30
+	}
+	return &Consumer{cfg: cfg, handler: handler}
+}
+
+// Run 选主并消费，直到 ctx 取消，期间的错误都会重试
+func (c *Consumer) Run(ctx context.Context) error {
+	defer c.close()
+	backoff := c.cfg.Backoff
+	for {
+		err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.closeCanal()
+		if errors.Is(err, errServerChanged) {
+			// 切换 canal server 不需要退避，立即连接新的 canal server
+			logEvent("活跃的 canal server 发生变化", "destination", c.cfg.Destination, "server", c.server)
+			backoff = c.cfg.Backoff
+			continue
+		}
+		logEvent("消费中断，准备重连", "destination", c.cfg.Destination, "server", c.server, "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// runOnce 连接 ZooKeeper、选主、连接活跃的 canal server 并消费，返回中断的原因
+func (c *Consumer) runOnce(ctx context.Context) error {
+	if err := c.connectZk(); err != nil {
+		return err
+	}
+	if err := c.elect(ctx); err != nil {
+		return err
+	}
+	addr, serverEvents, err := c.runningServer()
+	if err != nil {
+		return err
+	}
+	if err = c.connectCanal(addr); err != nil {
+		return err
+	}
+	return c.consume(ctx, serverEvents)
+}
+
+// connectZk 连接 ZooKeeper，会话过期时重新建立连接
+func (c *Consumer) connectZk() error {
+	if c.zk != nil && c.zk.State() != zk.StateExpired {
+		return nil
+	}
+	if c.zk != nil {
+		c.zk.Close()
+		c.zk = nil
+	}
+	conn, _, err := zk.Connect(c.cfg.ZkServers, c.cfg.ZkTimeout, zk.WithLogInfo(false),
+		zk.WithEventCallback(func(ev zk.Event) {
+			if ev.Type == zk.EventSession {
+				logEvent("ZooKeeper 会话状态变化", "destination", c.cfg.Destination, "state", ev.State)
+			}
+		}))
+	if err != nil {
+		return err
+	}
+	c.zk = conn
+	return nil
+}
+
+// elect 创建临时顺序节点，等待成为最小的节点，即唯一的活跃消费者
+func (c *Consumer) elect(ctx context.Context) error {
+	dir := fmt.Sprintf(consumerPath, c.cfg.Destination)
+	if err := c.ensurePath(dir); err != nil {
+		return err
+	}
+	if c.node != "" && c.session == c.zk.SessionID() {
+		if ok, _, err := c.zk.Exists(dir + "/" + c.node); err != nil {
+			return err
+		} else if !ok {
+			c.node = ""
+		}
+	} else {
+		c.node = ""
+	}
+	if c.node == "" {
+		node, err := c.zk.Create(dir+"/", []byte{0}, zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+		if err != nil {
+			return err
+		}
+		c.node = node[strings.LastIndex(node, "/")+1:]
+		c.session = c.zk.SessionID()
+	}
+
+	for {
+		children, _, err := c.zk.Children(dir)
+		if err != nil {
+			return err
+		}
+		prev, ok := predecessor(children, c.node)
+		if !ok {
+			c.node = ""
+			return errLeadershipLost
+		}
+		if prev == "" {
+			logEvent("成为活跃消费者", "destination", c.cfg.Destination, "node", c.node)
+			return nil
+		}
+		exists, _, events, err := c.zk.ExistsW(dir + "/" + prev)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		logEvent("等待成为活跃消费者", "destination", c.cfg.Destination, "node", c.node, "waiting", prev)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-events:
+		}
+	}
+}
+
+// ensurePath 逐级创建持久节点
+func (c *Consumer) ensurePath(path string) error {
+	p := ""
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		p += "/" + part
+		_, err := c.zk.Create(p, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runningServer 获取活跃的 canal server 并监听变化
+func (c *Consumer) runningServer() (string, <-chan zk.Event, error) {
+	data, _, events, err := c.zk.GetW(fmt.Sprintf(runningPath, c.cfg.Destination))
+	if err != nil {
+		return "", nil, fmt.Errorf("获取活跃的 canal server 失败 error:%w", err)
+	}
+	addr, err := parseRunning(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, events, nil
+}
+
+// connectCanal 连接 canal server 并订阅，连接时回滚未确认的批次，从已经 Ack 的位点重新获取
+func (c *Consumer) connectCanal(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	conn := client.NewSimpleCanalConnector(host, port, c.cfg.Username, c.cfg.Password,
+		c.cfg.Destination, c.cfg.SoTimeout, c.cfg.IdleTimeout)
+	if err = conn.Connect(); err != nil {
+		return err
+	}
+	if err = conn.Subscribe(c.cfg.Filter); err != nil {
+		_ = conn.DisConnection()
+		return err
+	}
+	if c.server != "" && c.server != addr {
+		logEvent("canal server 故障转移", "destination", c.cfg.Destination, "from", c.server, "to", addr)
+	} else {
+		logEvent("连接 canal server 成功", "destination", c.cfg.Destination, "server", addr)
+	}
+	c.server = addr
+	c.conn = conn
+	return nil
+}
+
+// consume 获取、处理并确认 binlog，会话变化或者 canal server 切换时返回
+func (c *Consumer) consume(ctx context.Context, serverEvents <-chan zk.Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-serverEvents:
+			return errServerChanged
+		default:
+		}
+		// 会话断开时其它实例可能已经成为活跃消费者，立即停止消费
+		if c.zk.State() != zk.StateHasSession || c.zk.SessionID() != c.session {
+			return errLeadershipLost
+		}
+
+		message, err := c.conn.GetWithOutAck(c.cfg.BatchSize, nil, nil)
+		if err != nil {
+			return err
+		}
+		if message == nil || message.Id == -1 || len(message.Entries) <= 0 {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		events, err := cdc.DecodeEntries(message.Entries)
+		if err == nil {
+			err = c.handler(ctx, events)
+		}
+		if err != nil {
+			logEvent("处理批次失败", "destination", c.cfg.Destination, "batchId", message.Id, "error", err)
+			if err = c.conn.RollBack(message.Id); err != nil {
+				return err
+			}
+			time.Sleep(c.cfg.Backoff)
+			continue
+		}
+		if err = c.conn.Ack(message.Id); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Consumer) closeCanal() {
+	if c.conn != nil {
+		_ = c.conn.DisConnection()
+		c.conn = nil
+	}
+}
+
+// close 断开 canal server 和 ZooKeeper，临时节点随会话删除，其它实例接替消费
+func (c *Consumer) close() {
+	c.closeCanal()
+	if c.zk != nil {
+		c.zk.Close()
+		c.zk = nil
+	}
+	logEvent("消费者退出", "destination", c.cfg.Destination, "node", c.node)
+}
+
+// predecessor 返回排在 node 前面的节点，node 最小时返回空字符串，node 不存在时 ok 为 false
+func predecessor(children []string, node string) (prev string, ok bool) {
+	sorted := append([]string(nil), children...)
+	sort.Strings(sorted)
+	for i, child := range sorted {
+		if child == node {
+			if i == 0 {
+				return "", true
+			}
+			return sorted[i-1], true
+		}
+	}
+	return "", false
+}
+
+// parseRunning 解析 canal server 的运行信息，例如 {"active":true,"address":"127.0.0.1:11111"}
+func parseRunning(data []byte) (string, error) {
+	var running struct {
+		Active  bool   `json:"active"`
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &running); err != nil {
+		return "", fmt.Errorf("错误的 canal server 运行信息 %s error:%w", data, err)
+	}
+	if !running.Active || running.Address == "" {
+		return "", fmt.Errorf("没有活跃的 canal server %s", data)
+	}
+	return running.Address, nil
+}
+
+// logEvent 以 key=value 的格式输出结构化日志，便于检索故障转移
+func logEvent(msg string, kv ...any) {
+	log.Println(formatEvent(msg, kv...))
+}
+
+func formatEvent(msg string, kv ...any) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(fmt.Sprintf(" %v=%s", kv[i], v))
+	}
+	return b.String()
+}
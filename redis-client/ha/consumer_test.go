@@ -0,0 +1,47 @@
+package ha
+
+import "testing"
+
+func TestPredecessor(t *testing.T) {
+	children := []string{"0000000012", "0000000010", "0000000011"}
+	testCases := []struct {
+		node   string
+		prev   string
+		wantOk bool
+	}{
+		{node: "0000000010", prev: "", wantOk: true},
+		{node: "0000000011", prev: "0000000010", wantOk: true},
+		{node: "0000000012", prev: "0000000011", wantOk: true},
+		{node: "0000000013", prev: "", wantOk: false},
+	}
+	for _, tc := range testCases {
+		prev, ok := predecessor(children, tc.node)
+		if prev != tc.prev || ok != tc.wantOk {
+			t.Fatalf("%s: expect (%s, %t), got (%s, %t)", tc.node, tc.prev, tc.wantOk, prev, ok)
+		}
+	}
+}
+
+func TestParseRunning(t *testing.T) {
+	addr, err := parseRunning([]byte(`{"active":true,"address":"192.168.0.201:11111","cid":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "192.168.0.201:11111" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+	if _, err = parseRunning([]byte(`{"active":false,"address":"192.168.0.201:11111"}`)); err == nil {
+		t.Fatal("expect error for inactive server")
+	}
+	if _, err = parseRunning([]byte(`not json`)); err == nil {
+		t.Fatal("expect error for invalid data")
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	got := formatEvent("canal server 故障转移", "destination", "example", "from", "a:1", "to", "b:1", "error", "read: connection reset")
+	want := `canal server 故障转移 destination=example from=a:1 to=b:1 error="read: connection reset"`
+	if got != want {
+		t.Fatalf("expect %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,471 @@
+package view
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/withlin/canal-go/client"
+	pbe "github.com/withlin/canal-go/protocol/entry"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotSlack 快照位点与之后第一个事务的 BEGIN 之间最多只有一个 GTID 事件（不超过 128 字节），
+// 一个完整的事务（GTID、BEGIN、行数据和 XID）大于这个长度，第一条 binlog 在这个范围内时没有遗漏的事务
+const snapshotSlack = 128
+
+type Option func(s *Syncer)
+
+// WithoutSnapshot 不做全量加载，直接从 canal 已经确认的位点开始同步
+func WithoutSnapshot() Option {
+	return func(s *Syncer) {
+		s.snapshot = false
+	}
+}
+
+// WithPositionKey 设置保存快照位点的 Redis key，多个 Syncer 共用一个 Redis 时需要使用不同的 key
+func WithPositionKey(key string) Option {
+	return func(s *Syncer) {
+		if key != "" {
+			s.positionKey = key
+		}
+	}
+}
+
+// WithBatchSize 设置每次从 canal 获取的 binlog 条数和全量加载时每个 pipeline 写入的行数
+func WithBatchSize(binlog int32, snapshot int) Option {
+	return func(s *Syncer) {
+		if binlog > 0 {
+			s.batchSize = binlog
+		}
+		if snapshot > 0 {
+			s.snapshotSize = snapshot
+		}
+	}
+}
+
+// Syncer 将 MySQL 的表同步为 Redis 的物化视图：先从一致性快照全量加载，
+// 再从 canal 同步快照位点之后的 binlog，读多写少的服务可以直接读 Redis
+type Syncer struct {
+	conn  client.CanalConnector
+	db    *sql.DB
+	rdb   redis.UniversalClient
+	views map[string]*view // key 为小写的 schema.table
+
+	filter       string
+	snapshot     bool
+	batchSize    int32
+	snapshotSize int
+	positionKey  string       // 保存快照位点的 Redis key
+	pos          cdc.Position // 快照的 binlog 位点，之前的 binlog 已经包含在快照中
+}
+
+func NewSyncer(conn client.CanalConnector, db *sql.DB, rdb redis.UniversalClient, views []View, opts ...Option) (*Syncer, error) {
+	s := &Syncer{
+		conn:         conn,
+		db:           db,
+		rdb:          rdb,
+		views:        make(map[string]*view, len(views)),
+		snapshot:     true,
+		batchSize:    100,
+		snapshotSize: 500,
+		positionKey:  "view:snapshot:position",
+	}
+	tables := make([]string, 0, len(views))
+	for _, v := range views {
+		compiled, err := newView(v)
+		if err != nil {
+			return nil, err
+		}
+		s.views[strings.ToLower(v.Table)] = compiled
+		tables = append(tables, regexp.QuoteMeta(v.Table))
+	}
+	s.filter = strings.Join(tables, ",")
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Run 先订阅 canal 固定同步的起点，再全量加载，最后同步 binlog，跳过快照位点之前的 binlog。
+// 已经保存了快照位点时不再全量加载；全量加载后 canal 投递的第一条 binlog 晚于快照位点时拒绝启动，
+// 检查通过后才保存快照位点，即 canal 实例需要在全量加载之前启动
+func (s *Syncer) Run(ctx context.Context) error {
+	if err := s.conn.Connect(); err != nil {
+		return err
+	}
+	if err := s.conn.Subscribe(s.filter); err != nil {
+		return err
+	}
+	check := false
+	if s.snapshot {
+		pos, err := s.loadPosition(ctx)
+		if err != nil {
+			return err
+		}
+		if pos.IsZero() {
+			if pos, err = s.Snapshot(ctx); err != nil {
+				return err
+			}
+			check = true
+			log.Println("全量加载完成，从快照位点开始同步 binlog:", pos)
+		} else {
+			log.Println("已经全量加载，从保存的快照位点开始同步 binlog:", pos)
+		}
+		s.pos = pos
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		message, err := s.conn.GetWithOutAck(s.batchSize, nil, nil)
+		if err != nil {
+			return err
+		}
+		if message == nil || message.Id == -1 || len(message.Entries) <= 0 {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		if check {
+			if err = s.checkCursor(entryPosition(&message.Entries[0])); err == nil {
+				err = s.savePosition(ctx, s.pos)
+			}
+			if err != nil {
+				_ = s.conn.RollBack(message.Id)
+				return err
+			}
+			check = false
+		}
+		if err = s.handle(ctx, message.Entries); err != nil {
+			log.Println(fmt.Errorf("同步批次失败 batchId:%d error:%w", message.Id, err))
+			if err = s.conn.RollBack(message.Id); err != nil {
+				return err
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if err = s.conn.Ack(message.Id); err != nil {
+			return err
+		}
+	}
+}
+
+// Snapshot 在一致性快照中全量加载所有表，返回快照的 binlog 位点，
+// 与 mysqldump --single-transaction --master-data 相同，需要 RELOAD 和 REPLICATION CLIENT 权限
+func (s *Syncer) Snapshot(ctx context.Context) (cdc.Position, error) {
+	var pos cdc.Position
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return pos, err
+	}
+	defer conn.Close()
+
+	// 加全局读锁的同时开启快照事务并获取位点，保证快照和位点一致
+	if _, err = conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		return pos, err
+	}
+	locked := true
+	defer func() {
+		if locked {
+			_, _ = conn.ExecContext(context.Background(), "UNLOCK TABLES")
+		}
+	}()
+	if _, err = conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return pos, err
+	}
+	if _, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+		return pos, err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "COMMIT")
+	}()
+	if pos, err = masterStatus(ctx, conn); err != nil {
+		return pos, err
+	}
+	if _, err = conn.ExecContext(ctx, "UNLOCK TABLES"); err != nil {
+		return pos, err
+	}
+	locked = false
+	log.Println("快照位点:", pos)
+
+	for _, v := range s.views {
+		if err = s.load(ctx, conn, v); err != nil {
+			return pos, fmt.Errorf("全量加载 %s 失败 error:%w", v.Table, err)
+		}
+	}
+	return pos, nil
+}
+
+// load 清理视图已有的 hash 和索引后全量加载一张表
+func (s *Syncer) load(ctx context.Context, conn *sql.Conn, v *view) error {
+	if err := s.clear(ctx, v); err != nil {
+		return fmt.Errorf("清理已有的数据失败 error:%w", err)
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT * FROM "+quoteTable(v.Table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]sql.NullString, len(names))
+	dest := make([]any, len(names))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var (
+		pipe  = s.rdb.Pipeline()
+		count int
+	)
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return err
+		}
+		row := make(cdc.Row, len(names))
+		for i, name := range names {
+			row[i] = cdc.Column{Name: name, Raw: values[i].String, IsNull: !values[i].Valid}
+			if values[i].Valid {
+				row[i].Value = values[i].String
+			}
+		}
+		if err = v.write(ctx, pipe, nil, row); err != nil {
+			return err
+		}
+		count++
+		if count%s.snapshotSize == 0 {
+			if _, err = pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("全量加载 %s 完成 rows:%d", v.Table, count))
+	return nil
+}
+
+// clear 删除视图已有的 hash 和索引，避免全量加载前已经删除的行残留在 Redis 中
+func (s *Syncer) clear(ctx context.Context, v *view) error {
+	patterns := []string{v.key.Pattern()}
+	for _, idx := range v.indexes {
+		patterns = append(patterns, idx.key.Pattern())
+	}
+	for _, pattern := range patterns {
+		var err error
+		if c, ok := s.rdb.(*redis.ClusterClient); ok {
+			// Redis Cluster 需要在每个主节点上分别 SCAN
+			err = c.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+				return deleteKeys(ctx, node, pattern, s.snapshotSize)
+			})
+		} else {
+			err = deleteKeys(ctx, s.rdb, pattern, s.snapshotSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteKeys 使用 SCAN 删除匹配 pattern 的 key，使用 pipeline 逐个 UNLINK，避免 Redis Cluster 的 CROSSSLOT 错误
+func deleteKeys(ctx context.Context, rdb redis.Cmdable, pattern string, count int) error {
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, pattern, int64(count)).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			_, err = rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+				for _, key := range keys {
+					p.Unlink(ctx, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// loadPosition 获取保存的快照位点，没有保存时返回空位点
+func (s *Syncer) loadPosition(ctx context.Context) (cdc.Position, error) {
+	var pos cdc.Position
+	data, err := s.rdb.Get(ctx, s.positionKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, err
+	}
+	if err = json.Unmarshal(data, &pos); err != nil {
+		return pos, fmt.Errorf("错误的快照位点 %s error:%w", data, err)
+	}
+	return pos, nil
+}
+
+func (s *Syncer) savePosition(ctx context.Context, pos cdc.Position) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.positionKey, data, 0).Err()
+}
+
+// checkCursor 检查 canal 投递的第一条 binlog 不晚于快照位点，否则快照位点之后、canal 位点之前的 binlog 会丢失。
+// 没有新的写入时 canal 投递的第一条 binlog 是快照之后的第一个事务，它紧跟在快照位点之后
+func (s *Syncer) checkCursor(first cdc.Position) error {
+	if !s.pos.Before(first) {
+		return nil
+	}
+	if first.File == s.pos.File && first.Offset-s.pos.Offset <= snapshotSlack {
+		return nil
+	}
+	return fmt.Errorf("canal 的位点 %s 晚于快照位点 %s，需要在全量加载之前启动 canal 实例", first, s.pos)
+}
+
+// entryPosition 获取 canal Entry 的 binlog 位点，包括事务的开始和结束
+func entryPosition(entry *pbe.Entry) cdc.Position {
+	header := entry.GetHeader()
+	return cdc.Position{File: header.GetLogfileName(), Offset: header.GetLogfileOffset()}
+}
+
+// handle 同步一批 binlog，快照位点之前的 binlog 已经包含在快照中，直接跳过
+func (s *Syncer) handle(ctx context.Context, entries []pbe.Entry) error {
+	events, err := cdc.DecodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range events {
+			e := &events[i]
+			if e.IsDDL {
+				continue
+			}
+			if !s.pos.IsZero() && e.Position.Before(s.pos) {
+				continue
+			}
+			v, ok := s.views[strings.ToLower(e.Schema+"."+e.Table)]
+			if !ok {
+				continue
+			}
+			var after cdc.Row
+			if e.Type != pbe.EventType_DELETE {
+				after = e.After
+			}
+			if er := v.write(ctx, pipe, e.Before, after); er != nil {
+				return er
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// write 将一行变更写入 pipeline：删除旧的 hash 和索引成员，再写入新的 hash 和索引成员，
+// before 为空表示插入，after 为空表示删除
+func (v *view) write(ctx context.Context, pipe redis.Pipeliner, before, after cdc.Row) error {
+	if len(before) > 0 {
+		key, err := v.key.Render(before)
+		if err != nil {
+			return err
+		}
+		members, err := v.members(before, key)
+		if err != nil {
+			return err
+		}
+		pipe.Del(ctx, key)
+		for _, m := range members {
+			pipe.ZRem(ctx, m.key, m.member)
+		}
+	}
+	if len(after) == 0 {
+		return nil
+	}
+	key, fields, err := v.hash(after)
+	if err != nil {
+		return err
+	}
+	members, err := v.members(after, key)
+	if err != nil {
+		return err
+	}
+	if len(before) == 0 {
+		// 全量加载和重复投递时覆盖已有的数据
+		pipe.Del(ctx, key)
+	}
+	if len(fields) > 0 {
+		pipe.HSet(ctx, key, fields)
+	}
+	for _, m := range members {
+		pipe.ZAdd(ctx, m.key, redis.Z{Score: m.score, Member: m.member})
+	}
+	return nil
+}
+
+// masterStatus 获取当前的 binlog 位点
+func masterStatus(ctx context.Context, conn *sql.Conn) (cdc.Position, error) {
+	var pos cdc.Position
+	rows, err := conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		return pos, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	if !rows.Next() {
+		return pos, errors.New("MySQL 没有开启 binlog")
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return pos, err
+	}
+	for i, name := range columns {
+		switch name {
+		case "File":
+			pos.File = values[i].String
+		case "Position":
+			pos.Offset, err = strconv.ParseInt(values[i].String, 10, 64)
+		case "Executed_Gtid_Set":
+			pos.GTID = strings.ReplaceAll(values[i].String, "\n", "")
+		}
+	}
+	return pos, err
+}
+
+// quoteTable 给 schema.table 加上反引号
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(parts, ".")
+}
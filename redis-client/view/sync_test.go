@@ -0,0 +1,174 @@
+package view
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeRedis 在内存中执行 GET、SET、SCAN 和 UNLINK，不连接 Redis
+type fakeRedis struct {
+	lock sync.Mutex
+	data map[string]string
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessHook(_ redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return f.process(cmd)
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(_ redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if err := f.process(cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (f *fakeRedis) process(cmd redis.Cmder) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	args := cmd.Args()
+	switch c := cmd.(type) {
+	case *redis.StringCmd:
+		v, ok := f.data[fmt.Sprint(args[1])]
+		if !ok {
+			c.SetErr(redis.Nil)
+			return redis.Nil
+		}
+		c.SetVal(v)
+	case *redis.StatusCmd:
+		value, _ := args[2].([]byte)
+		f.data[fmt.Sprint(args[1])] = string(value)
+		c.SetVal("OK")
+	case *redis.ScanCmd:
+		// 一次返回全部匹配的 key
+		var keys []string
+		for key := range f.data {
+			if ok, _ := path.Match(fmt.Sprint(args[3]), key); ok {
+				keys = append(keys, key)
+			}
+		}
+		c.SetVal(keys, 0)
+	case *redis.IntCmd:
+		delete(f.data, fmt.Sprint(args[1]))
+		c.SetVal(1)
+	default:
+		return fmt.Errorf("unexpected command %v", args)
+	}
+	return nil
+}
+
+func (f *fakeRedis) keys() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]string, 0, len(f.data))
+	for key := range f.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestSyncer(t *testing.T, data map[string]string) (*Syncer, *fakeRedis) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	t.Cleanup(func() { _ = rdb.Close() })
+	fake := &fakeRedis{data: data}
+	rdb.AddHook(fake)
+	s, err := NewSyncer(nil, nil, rdb, []View{{
+		Table:   "test.users",
+		Key:     "user:{id}",
+		Indexes: []Index{{Key: "users:by_created_at", Column: "created_at"}, {Key: "users:{status}:by_id", Column: "id"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func TestClear(t *testing.T) {
+	s, fake := newTestSyncer(t, map[string]string{
+		"user:1":              "",
+		"user:2":              "",
+		"users:by_created_at": "",
+		"users:1:by_id":       "",
+		"users:count":         "",
+		"order:1":             "",
+	})
+	if err := s.clear(context.Background(), s.views["test.users"]); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"order:1", "users:count"}
+	if got := fake.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect %v, got %v", want, got)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	s, _ := newTestSyncer(t, map[string]string{})
+	ctx := context.Background()
+	pos, err := s.loadPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pos.IsZero() {
+		t.Fatalf("expect zero position, got %s", pos)
+	}
+	want := cdc.Position{File: "mysql-bin.000003", Offset: 1200}
+	if err = s.savePosition(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err = s.loadPosition(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pos != want {
+		t.Fatalf("expect %s, got %s", want, pos)
+	}
+}
+
+func TestCheckCursor(t *testing.T) {
+	s := &Syncer{pos: cdc.Position{File: "mysql-bin.000003", Offset: 1200}}
+	testCases := []struct {
+		name    string
+		first   cdc.Position
+		wantErr bool
+	}{
+		{name: "before", first: cdc.Position{File: "mysql-bin.000003", Offset: 800}},
+		{name: "previous file", first: cdc.Position{File: "mysql-bin.000002", Offset: 5000}},
+		{name: "equal", first: cdc.Position{File: "mysql-bin.000003", Offset: 1200}},
+		{name: "next transaction", first: cdc.Position{File: "mysql-bin.000003", Offset: 1265}},
+		{name: "later", first: cdc.Position{File: "mysql-bin.000003", Offset: 1500}, wantErr: true},
+		{name: "later file", first: cdc.Position{File: "mysql-bin.000004", Offset: 200}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := s.checkCursor(tc.first); (err != nil) != tc.wantErr {
+				t.Fatalf("expect error %t, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewViewPattern(t *testing.T) {
+	if _, err := newView(View{Table: "test.users", Key: "{id}"}); err == nil {
+		t.Fatal("expect error for key without prefix")
+	}
+	_, err := newView(View{Table: "test.users", Key: "user:{id}", Indexes: []Index{{Key: "{status}:by_id", Column: "id"}}})
+	if err == nil {
+		t.Fatal("expect error for index without prefix")
+	}
+}
@@ -0,0 +1,131 @@
+package view
+
+import (
+	"fmt"
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"github.com/xuqil/experiments/redis-client/cache"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Index 有序集合索引，成员为行的 hash key，分数为字段的值
+type Index struct {
+	Key    string // 有序集合的 key 模板，例如 users:by_created_at、users:{status}:by_created_at
+	Column string // 作为分数的字段，支持数值和时间（毫秒时间戳）
+}
+
+// View 一张表的物化视图，每行一个 hash
+type View struct {
+	Table   string   // 库表，例如 test.users
+	Key     string   // hash 的 key 模板，例如 user:{id}
+	Columns []string // 写入 hash 的字段，为空时写入全部字段
+	Indexes []Index
+}
+
+// view 解析后的物化视图
+type view struct {
+	View
+	key     *cache.Template
+	indexes []index
+	columns map[string]struct{}
+}
+
+type index struct {
+	key    *cache.Template
+	column string
+}
+
+// member 有序集合的一个成员
+type member struct {
+	key    string // 有序集合的 key
+	score  float64
+	member string // 行的 hash key
+}
+
+func newView(v View) (*view, error) {
+	key, err := cache.ParseTemplate(v.Key)
+	if err != nil {
+		return nil, err
+	}
+	// 全量加载前按模板的模式清理已有的 key，模板需要以固定的文本开头，避免 SCAN 匹配其它数据
+	if strings.HasPrefix(key.Pattern(), "*") {
+		return nil, fmt.Errorf("hash 的 key 模板 %s 需要以固定的文本开头", v.Key)
+	}
+	compiled := &view{View: v, key: key}
+	if len(v.Columns) > 0 {
+		compiled.columns = make(map[string]struct{}, len(v.Columns))
+		for _, col := range v.Columns {
+			compiled.columns[strings.ToLower(col)] = struct{}{}
+		}
+	}
+	for _, idx := range v.Indexes {
+		t, er := cache.ParseTemplate(idx.Key)
+		if er != nil {
+			return nil, er
+		}
+		if strings.HasPrefix(t.Pattern(), "*") {
+			return nil, fmt.Errorf("索引的 key 模板 %s 需要以固定的文本开头", idx.Key)
+		}
+		compiled.indexes = append(compiled.indexes, index{key: t, column: idx.Column})
+	}
+	return compiled, nil
+}
+
+// hash 生成行的 hash key 和字段，NULL 字段不写入 hash
+func (v *view) hash(row cdc.Row) (string, map[string]any, error) {
+	key, err := v.key.Render(row)
+	if err != nil {
+		return "", nil, err
+	}
+	fields := make(map[string]any, len(row))
+	for _, col := range row {
+		if col.IsNull {
+			continue
+		}
+		if v.columns != nil {
+			if _, ok := v.columns[strings.ToLower(col.Name)]; !ok {
+				continue
+			}
+		}
+		fields[col.Name] = col.Raw
+	}
+	return key, fields, nil
+}
+
+// members 生成行在各个索引中的成员，字段为 NULL 或者无法生成 key 时不加入索引
+func (v *view) members(row cdc.Row, key string) ([]member, error) {
+	members := make([]member, 0, len(v.indexes))
+	for _, idx := range v.indexes {
+		col, ok := row.Get(idx.column)
+		if !ok || col.IsNull {
+			continue
+		}
+		score, err := parseScore(col.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("索引字段 %s 的值 %s 不能作为分数 error:%w", idx.column, col.Raw, err)
+		}
+		zkey, err := idx.key.Render(row)
+		if err != nil {
+			continue
+		}
+		members = append(members, member{key: zkey, score: score, member: key})
+	}
+	return members, nil
+}
+
+// parseScore 将字段的值转为有序集合的分数，时间转为毫秒时间戳
+func parseScore(raw string) (float64, error) {
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f, nil
+	}
+	layout := "2006-01-02 15:04:05.999999999"
+	if len(raw) == len("2006-01-02") {
+		layout = "2006-01-02"
+	}
+	t, err := time.ParseInLocation(layout, raw, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	return float64(t.UnixMilli()), nil
+}
@@ -0,0 +1,85 @@
+package view
+
+import (
+	"github.com/xuqil/experiments/migrate/pkg/cdc"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestView(t *testing.T) {
+	v, err := newView(View{
+		Table:   "test.users",
+		Key:     "user:{id}",
+		Columns: []string{"id", "name", "status", "created_at"},
+		Indexes: []Index{
+			{Key: "users:by_created_at", Column: "created_at"},
+			{Key: "users:{status}:by_id", Column: "id"},
+			{Key: "users:by_score", Column: "score"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := cdc.Row{
+		{Name: "id", Raw: "7"},
+		{Name: "name", Raw: "tom"},
+		{Name: "email", Raw: "tom@example.com"},
+		{Name: "status", Raw: "1"},
+		{Name: "created_at", Raw: "2023-08-01 10:00:00.500"},
+		{Name: "score", IsNull: true},
+	}
+	key, fields, err := v.hash(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "user:7" {
+		t.Fatalf("expect user:7, got %s", key)
+	}
+	wantFields := map[string]any{"id": "7", "name": "tom", "status": "1", "created_at": "2023-08-01 10:00:00.500"}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+
+	members, err := v.members(row, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := float64(time.Date(2023, 8, 1, 10, 0, 0, 500000000, time.Local).UnixMilli())
+	wantMembers := []member{
+		{key: "users:by_created_at", score: createdAt, member: "user:7"},
+		{key: "users:1:by_id", score: 7, member: "user:7"},
+	}
+	if !reflect.DeepEqual(members, wantMembers) {
+		t.Fatalf("unexpected members %v", members)
+	}
+}
+
+func TestParseScore(t *testing.T) {
+	testCases := []struct {
+		raw     string
+		want    float64
+		wantErr bool
+	}{
+		{raw: "12", want: 12},
+		{raw: "-1.5", want: -1.5},
+		{raw: "2023-08-01", want: float64(time.Date(2023, 8, 1, 0, 0, 0, 0, time.Local).UnixMilli())},
+		{raw: "2023-08-01 10:00:00", want: float64(time.Date(2023, 8, 1, 10, 0, 0, 0, time.Local).UnixMilli())},
+		{raw: "tom", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseScore(tc.raw)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: expect error %t, got %v", tc.raw, tc.wantErr, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: expect %v, got %v", tc.raw, tc.want, got)
+		}
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	if got := quoteTable("test.users"); got != "`test`.`users`" {
+		t.Fatalf("unexpected %s", got)
+	}
+}